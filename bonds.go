@@ -0,0 +1,425 @@
+/*
+ * bonds.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/rmera/gochem/v3"
+)
+
+//Bond represents a covalent bond between two atoms of a topology.
+//The atoms are given by their indexes in the topology, so a bond
+//is only meaningful together with the topology that contains it.
+type Bond struct {
+	At1   int
+	At2   int
+	Order float64 //Bond order. 0 means that the order is not known. Aromatic bonds have order 1.5
+}
+
+//Copy returns a copy of the bond.
+func (B *Bond) Copy() *Bond {
+	return &Bond{At1: B.At1, At2: B.At2, Order: B.Order}
+}
+
+//Cross returns the index of the atom bonded to i
+//through B, or -1 if i is not part of the bond.
+func (B *Bond) Cross(i int) int {
+	if B.At1 == i {
+		return B.At2
+	}
+	if B.At2 == i {
+		return B.At1
+	}
+	return -1
+}
+
+//DefaultBondTolerance is the tolerance, in A, used when a negative
+//number is given to the bond perception functions.
+const DefaultBondTolerance = 0.45
+
+//minimum distance, in A, between 2 atoms for them to be considered bonded.
+//Shorter distances are assumed to come from overlapping or duplicated atoms.
+const minBondDist = 0.4
+
+//A map for assigning covalent radii (in A) to elements.
+//Values from Cordero et al., Dalton Trans., 2008, 2832.
+//For C, the sp3 radius is used. For Mn, Fe and Co, the low spin radii.
+var symbolCovalentRadius = map[string]float64{
+	"H":  0.31,
+	"He": 0.28,
+	"Li": 1.28,
+	"Be": 0.96,
+	"B":  0.84,
+	"C":  0.76,
+	"N":  0.71,
+	"O":  0.66,
+	"F":  0.57,
+	"Ne": 0.58,
+	"Na": 1.66,
+	"Mg": 1.41,
+	"Al": 1.21,
+	"Si": 1.11,
+	"P":  1.07,
+	"S":  1.05,
+	"Cl": 1.02,
+	"Ar": 1.06,
+	"K":  2.03,
+	"Ca": 1.76,
+	"Sc": 1.70,
+	"Ti": 1.60,
+	"V":  1.53,
+	"Cr": 1.39,
+	"Mn": 1.39,
+	"Fe": 1.32,
+	"Co": 1.26,
+	"Ni": 1.24,
+	"Cu": 1.32,
+	"Zn": 1.22,
+	"Ga": 1.22,
+	"Ge": 1.20,
+	"As": 1.19,
+	"Se": 1.20,
+	"Br": 1.20,
+	"Kr": 1.16,
+	"Rb": 2.20,
+	"Sr": 1.95,
+	"Mo": 1.54,
+	"Ru": 1.46,
+	"Rh": 1.42,
+	"Pd": 1.39,
+	"Ag": 1.45,
+	"Cd": 1.44,
+	"Sn": 1.39,
+	"I":  1.39,
+	"Xe": 1.40,
+	"W":  1.62,
+	"Pt": 1.36,
+	"Au": 1.36,
+	"Hg": 1.32,
+}
+
+//CovalentRadius returns the covalent radius, in A, for the element
+//with the given symbol, or an error if the symbol is not known.
+func CovalentRadius(symbol string) (float64, error) {
+	r, ok := symbolCovalentRadius[symbol]
+	if !ok {
+		return 0, CError{fmt.Sprintf("goChem: No covalent radius for element %s", symbol), []string{"CovalentRadius"}}
+	}
+	return r, nil
+}
+
+//BondsFromCoords obtains the bonds in mol from the coordinates in coords.
+//Two atoms are considered bonded if the distance between them is smaller
+//than the sum of their covalent radii plus tolerance (in A). If tolerance
+//is negative, DefaultBondTolerance is used. The bond orders are not assigned.
+//It returns an error if the symbol for one of the atoms is unknown, or if
+//coords and mol don't have the same number of atoms.
+//The search uses a NeighborIndex, so it is fast also for large systems.
+func BondsFromCoords(coords *v3.Matrix, mol Atomer, tolerance float64) ([]*Bond, error) {
+	if mol.Len() != coords.NVecs() {
+		return nil, CError{"goChem: Ref and Coords dont have the same number of atoms", []string{"BondsFromCoords"}}
+	}
+	if tolerance < 0 {
+		tolerance = DefaultBondTolerance
+	}
+	radii := make([]float64, mol.Len())
+	for i := range radii {
+		r, err := CovalentRadius(mol.Atom(i).Symbol)
+		if err != nil {
+			return nil, errDecorate(err, "BondsFromCoords")
+		}
+		radii[i] = r
+	}
+	maxr := 0.0
+	for _, r := range radii {
+		maxr = math.Max(maxr, r)
+	}
+	maxcutoff := 2*maxr + tolerance
+	index := NewNeighborIndex(coords, maxcutoff)
+	bonds := make([]*Bond, 0, mol.Len())
+	for i := 0; i < mol.Len(); i++ {
+		for _, j := range index.Within(coords.VecView(i), maxcutoff) {
+			if j <= i {
+				continue
+			}
+			d2 := index.dist2(index.pos[i], index.pos[j])
+			cutoff := radii[i] + radii[j] + tolerance
+			if d2 > cutoff*cutoff || d2 < minBondDist*minBondDist {
+				continue
+			}
+			bonds = append(bonds, &Bond{At1: i, At2: j})
+		}
+	}
+	return bonds, nil
+}
+
+//Bonds returns the bonds in the topology. The slice is not copied,
+//so changes to it will affect the topology.
+func (T *Topology) Bonds() []*Bond {
+	return T.bonds
+}
+
+//SetBonds sets the bonds of the topology to b. It doesn't check that the
+//bonds are consistent with the atoms of the topology.
+func (T *Topology) SetBonds(b []*Bond) {
+	T.bonds = b
+}
+
+//AddBond adds a bond of order order between the atoms i and j of the topology.
+//Panics if any of the indexes is out of range.
+func (T *Topology) AddBond(i, j int, order float64) {
+	if i >= T.Len() || j >= T.Len() || i < 0 || j < 0 {
+		panic(ErrAtomOutOfRange)
+	}
+	T.bonds = append(T.bonds, &Bond{At1: i, At2: j, Order: order})
+}
+
+//AssignBonds replaces the bonds in the topology with those obtained from coords,
+//using BondsFromCoords with the given tolerance.
+func (T *Topology) AssignBonds(coords *v3.Matrix, tolerance float64) error {
+	b, err := BondsFromCoords(coords, T, tolerance)
+	if err != nil {
+		return errDecorate(err, "AssignBonds")
+	}
+	T.bonds = b
+	return nil
+}
+
+//Bonded returns the indexes of the atoms bonded to the atom i.
+func (T *Topology) Bonded(i int) []int {
+	ret := make([]int, 0, 4)
+	for _, b := range T.bonds {
+		if c := b.Cross(i); c >= 0 {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+//Adjacency returns a slice with, for each atom in the topology, the
+//indexes of the atoms bonded to it.
+func (T *Topology) Adjacency() [][]int {
+	ret := make([][]int, T.Len())
+	for _, b := range T.bonds {
+		ret[b.At1] = append(ret[b.At1], b.At2)
+		ret[b.At2] = append(ret[b.At2], b.At1)
+	}
+	return ret
+}
+
+//angler is implemented by topologies that also contain angles and dihedrals.
+type angler interface {
+	Angles() [][]int
+	Dihedrals() [][]int
+	Impropers() [][]int
+}
+
+//Angles returns the angles in the topology, each as the indexes of its 3 atoms,
+//with the central atom in the middle. The slice is not copied.
+func (T *Topology) Angles() [][]int {
+	return T.angles
+}
+
+//SetAngles sets the angles of the topology to a. Each angle must contain 3 atom indexes.
+//It doesn't check that the angles are consistent with the atoms of the topology.
+func (T *Topology) SetAngles(a [][]int) {
+	T.angles = a
+}
+
+//Dihedrals returns the proper dihedrals in the topology, each as the indexes of its 4 atoms.
+//The slice is not copied.
+func (T *Topology) Dihedrals() [][]int {
+	return T.dihedrals
+}
+
+//SetDihedrals sets the proper dihedrals of the topology to d. Each dihedral must contain 4 atom
+//indexes. It doesn't check that the dihedrals are consistent with the atoms of the topology.
+func (T *Topology) SetDihedrals(d [][]int) {
+	T.dihedrals = d
+}
+
+//Impropers returns the improper dihedrals in the topology, each as the indexes of its 4 atoms.
+//The slice is not copied.
+func (T *Topology) Impropers() [][]int {
+	return T.impropers
+}
+
+//SetImpropers sets the improper dihedrals of the topology to d. Each improper must contain 4 atom
+//indexes. It doesn't check that the impropers are consistent with the atoms of the topology.
+func (T *Topology) SetImpropers(d [][]int) {
+	T.impropers = d
+}
+
+//Some internal helpers to keep the bonds consistent when the atoms of a topology change.
+
+//copyBonds returns a slice with copies of the bonds in b.
+func copyBonds(b []*Bond) []*Bond {
+	if b == nil {
+		return nil
+	}
+	ret := make([]*Bond, len(b))
+	for k, v := range b {
+		ret[k] = v.Copy()
+	}
+	return ret
+}
+
+//someBonds returns copies of the bonds in b for which both atoms are in atomlist,
+//with the indexes changed to the position of each atom in atomlist.
+func someBonds(b []*Bond, atomlist []int) []*Bond {
+	if len(b) == 0 {
+		return nil
+	}
+	newindex := make(map[int]int, len(atomlist))
+	for k, v := range atomlist {
+		newindex[v] = k
+	}
+	ret := make([]*Bond, 0, len(atomlist))
+	for _, v := range b {
+		i, ok1 := newindex[v.At1]
+		j, ok2 := newindex[v.At2]
+		if ok1 && ok2 {
+			ret = append(ret, &Bond{At1: i, At2: j, Order: v.Order})
+		}
+	}
+	return ret
+}
+
+//delBondsAtom removes from b all bonds with the atom i, and shifts
+//the indexes larger than i by -1, as expected after deleting i.
+func delBondsAtom(b []*Bond, i int) []*Bond {
+	if len(b) == 0 {
+		return b
+	}
+	ret := b[:0]
+	for _, v := range b {
+		if v.At1 == i || v.At2 == i {
+			continue
+		}
+		if v.At1 > i {
+			v.At1--
+		}
+		if v.At2 > i {
+			v.At2--
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+//The same helpers for angles and dihedrals, which are kept as slices of atom indexes.
+
+//copyTuples returns a deep copy of t.
+func copyTuples(t [][]int) [][]int {
+	if t == nil {
+		return nil
+	}
+	ret := make([][]int, len(t))
+	for k, v := range t {
+		ret[k] = append([]int(nil), v...)
+	}
+	return ret
+}
+
+//offsetTuples returns copies of the tuples in t with off added to every atom index.
+func offsetTuples(t [][]int, off int) [][]int {
+	ret := make([][]int, len(t))
+	for k, v := range t {
+		ret[k] = make([]int, len(v))
+		for l, at := range v {
+			ret[k][l] = at + off
+		}
+	}
+	return ret
+}
+
+//someTuples returns copies of the tuples in t for which all atoms are in atomlist,
+//with the indexes changed to the position of each atom in atomlist.
+func someTuples(t [][]int, atomlist []int) [][]int {
+	if len(t) == 0 {
+		return nil
+	}
+	newindex := make(map[int]int, len(atomlist))
+	for k, v := range atomlist {
+		newindex[v] = k
+	}
+	ret := make([][]int, 0, len(t))
+tuples:
+	for _, v := range t {
+		n := make([]int, len(v))
+		for k, at := range v {
+			i, ok := newindex[at]
+			if !ok {
+				continue tuples
+			}
+			n[k] = i
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+//delTuplesAtom removes from t all tuples with the atom i, and shifts
+//the indexes larger than i by -1, as expected after deleting i.
+func delTuplesAtom(t [][]int, i int) [][]int {
+	if len(t) == 0 {
+		return t
+	}
+	ret := t[:0]
+tuples:
+	for _, v := range t {
+		for _, at := range v {
+			if at == i {
+				continue tuples
+			}
+		}
+		for k, at := range v {
+			if at > i {
+				v[k]--
+			}
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+//swapTuples exchanges the indexes i and j in all the tuples of t.
+func swapTuples(t [][]int, i, j int) {
+	for _, v := range t {
+		for k, at := range v {
+			switch at {
+			case i:
+				v[k] = j
+			case j:
+				v[k] = i
+			}
+		}
+	}
+}
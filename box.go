@@ -0,0 +1,330 @@
+/*
+ * box.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/rmera/gochem/v3"
+)
+
+//Box is a periodic simulation cell. It is defined by its 3 cell vectors (in A),
+//which can form an orthorhombic or a triclinic cell.
+type Box struct {
+	vecs [3][3]float64 //the cell vectors, one per row.
+	inv  [3][3]float64 //the inverse of vecs, to obtain fractional coordinates.
+	hmin float64       //the smallest of the perpendicular widths of the box.
+}
+
+//NewBox returns a box with the cell vectors given as the rows of vecs,
+//which must have exactly 3 vectors. The data in vecs is copied.
+//It returns an error if the vectors don't define a cell with a non-zero volume.
+func NewBox(vecs *v3.Matrix) (*Box, error) {
+	if vecs.NVecs() != 3 {
+		return nil, CError{"goChem: A box needs exactly 3 vectors", []string{"NewBox"}}
+	}
+	B := new(Box)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			B.vecs[i][j] = vecs.At(i, j)
+		}
+	}
+	if err := B.setInverse(); err != nil {
+		return nil, errDecorate(err, "NewBox")
+	}
+	return B, nil
+}
+
+//NewOrthoBox returns an orthorhombic box with sides a, b and c (in A)
+//along the x, y and z axes, respectively. It panics if any of the sides
+//is not positive.
+func NewOrthoBox(a, b, c float64) *Box {
+	if a <= 0 || b <= 0 || c <= 0 {
+		panic(ErrBadBox)
+	}
+	B := new(Box)
+	B.vecs[0][0] = a
+	B.vecs[1][1] = b
+	B.vecs[2][2] = c
+	B.setInverse()
+	return B
+}
+
+//NewBoxFromParams returns a box with the lengths a, b and c (in A) and the angles alpha, beta and gamma
+//(in degrees, alpha between b and c, beta between a and c and gamma between a and b), as used in PDB files.
+//The first cell vector is placed along the x axis and the second in the xy plane.
+func NewBoxFromParams(a, b, c, alpha, beta, gamma float64) (*Box, error) {
+	if a <= 0 || b <= 0 || c <= 0 || alpha <= 0 || beta <= 0 || gamma <= 0 || alpha >= 180 || beta >= 180 || gamma >= 180 {
+		return nil, CError{fmt.Sprintf("goChem: Invalid box parameters %.3f %.3f %.3f %.2f %.2f %.2f", a, b, c, alpha, beta, gamma), []string{"NewBoxFromParams"}}
+	}
+	cosa, _ := cosSinDeg(alpha)
+	cosb, _ := cosSinDeg(beta)
+	cosg, sing := cosSinDeg(gamma)
+	B := new(Box)
+	B.vecs[0] = [3]float64{a, 0, 0}
+	B.vecs[1] = [3]float64{b * cosg, b * sing, 0}
+	cx := cosb
+	cy := (cosa - cosb*cosg) / sing
+	cz2 := 1 - cx*cx - cy*cy
+	if cz2 <= 0 {
+		return nil, CError{fmt.Sprintf("goChem: Box angles %.2f %.2f %.2f don't define a valid cell", alpha, beta, gamma), []string{"NewBoxFromParams"}}
+	}
+	B.vecs[2] = [3]float64{c * cx, c * cy, c * math.Sqrt(cz2)}
+	if err := B.setInverse(); err != nil {
+		return nil, errDecorate(err, "NewBoxFromParams")
+	}
+	return B, nil
+}
+
+//cosSinDeg returns the cosine and sine of the angle ang, in degrees, making sure
+//that the result is exact for right angles.
+func cosSinDeg(ang float64) (float64, float64) {
+	if ang == 90 {
+		return 0, 1
+	}
+	r := ang * math.Pi / 180
+	return math.Cos(r), math.Sin(r)
+}
+
+//setInverse obtains the inverse of the cell matrix.
+func (B *Box) setInverse() error {
+	m := B.vecs
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < appzero {
+		return CError{"goChem: The box vectors are linearly dependent", []string{"Box.setInverse"}}
+	}
+	B.inv[0][0] = (m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det
+	B.inv[0][1] = (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det
+	B.inv[0][2] = (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det
+	B.inv[1][0] = (m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det
+	B.inv[1][1] = (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det
+	B.inv[1][2] = (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det
+	B.inv[2][0] = (m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det
+	B.inv[2][1] = (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det
+	B.inv[2][2] = (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det
+	B.hmin = math.Inf(1)
+	for i := 0; i < 3; i++ {
+		B.hmin = math.Min(B.hmin, math.Abs(det)/norm3(cross3(m[(i+1)%3], m[(i+2)%3])))
+	}
+	return nil
+}
+
+//Copy returns a copy of the box.
+func (B *Box) Copy() *Box {
+	r := *B
+	return &r
+}
+
+//Vectors returns a matrix with the cell vectors of the box (in A) as rows.
+func (B *Box) Vectors() *v3.Matrix {
+	ret := v3.Zeros(3)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			ret.Set(i, j, B.vecs[i][j])
+		}
+	}
+	return ret
+}
+
+//Params returns the lengths of the cell vectors (in A) and the angles between them
+//(in degrees, alpha between b and c, beta between a and c and gamma between a and b).
+func (B *Box) Params() (a, b, c, alpha, beta, gamma float64) {
+	a = norm3(B.vecs[0])
+	b = norm3(B.vecs[1])
+	c = norm3(B.vecs[2])
+	angle := func(u, v [3]float64, nu, nv float64) float64 {
+		cos := dot3(u, v) / (nu * nv)
+		return math.Acos(math.Max(-1, math.Min(1, cos))) * 180 / math.Pi
+	}
+	alpha = angle(B.vecs[1], B.vecs[2], b, c)
+	beta = angle(B.vecs[0], B.vecs[2], a, c)
+	gamma = angle(B.vecs[0], B.vecs[1], a, b)
+	return
+}
+
+//Orthorhombic returns true if the cell vectors of the box lie along the x, y and z axes.
+func (B *Box) Orthorhombic() bool {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if i != j && B.vecs[i][j] != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//Volume returns the volume of the box, in A^3.
+func (B *Box) Volume() float64 {
+	m := B.vecs
+	return math.Abs(m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0]))
+}
+
+//String returns the parameters of the box in a CRYST1-like format.
+func (B *Box) String() string {
+	a, b, c, alpha, beta, gamma := B.Params()
+	return fmt.Sprintf("%9.3f%9.3f%9.3f%7.2f%7.2f%7.2f", a, b, c, alpha, beta, gamma)
+}
+
+//toFrac transforms the cartesian vector r into fractional coordinates.
+func (B *Box) toFrac(r [3]float64) [3]float64 {
+	var f [3]float64
+	for j := 0; j < 3; j++ {
+		f[j] = r[0]*B.inv[0][j] + r[1]*B.inv[1][j] + r[2]*B.inv[2][j]
+	}
+	return f
+}
+
+//toCart transforms the fractional vector f into cartesian coordinates.
+func (B *Box) toCart(f [3]float64) [3]float64 {
+	var r [3]float64
+	for j := 0; j < 3; j++ {
+		r[j] = f[0]*B.vecs[0][j] + f[1]*B.vecs[1][j] + f[2]*B.vecs[2][j]
+	}
+	return r
+}
+
+//Fractional returns a matrix with the coordinates in coords
+//transformed to fractional coordinates in the box.
+func (B *Box) Fractional(coords *v3.Matrix) *v3.Matrix {
+	ret := v3.Zeros(coords.NVecs())
+	for i := 0; i < coords.NVecs(); i++ {
+		f := B.toFrac(getVec3(coords, i))
+		setVec3(ret, i, f)
+	}
+	return ret
+}
+
+//Cartesian returns a matrix with the fractional coordinates in frac
+//transformed to cartesian coordinates.
+func (B *Box) Cartesian(frac *v3.Matrix) *v3.Matrix {
+	ret := v3.Zeros(frac.NVecs())
+	for i := 0; i < frac.NVecs(); i++ {
+		setVec3(ret, i, B.toCart(getVec3(frac, i)))
+	}
+	return ret
+}
+
+//minImage returns the shortest periodic image of the vector d.
+func (B *Box) minImage(d [3]float64) [3]float64 {
+	f := B.toFrac(d)
+	for j := range f {
+		f[j] -= math.Floor(f[j] + 0.5)
+	}
+	r := B.toCart(f)
+	//Any other image is at least hmin/2 long in this case.
+	if dot3(r, r) <= B.hmin*B.hmin/4 || B.Orthorhombic() {
+		return r
+	}
+	//For triclinic cells the rounding above doesn't always give the shortest image,
+	//so we check the neighboring images.
+	best := r
+	bestd := dot3(r, r)
+	for i := -1.0; i <= 1; i++ {
+		for j := -1.0; j <= 1; j++ {
+			for k := -1.0; k <= 1; k++ {
+				t := B.toCart([3]float64{f[0] + i, f[1] + j, f[2] + k})
+				if d2 := dot3(t, t); d2 < bestd {
+					best, bestd = t, d2
+				}
+			}
+		}
+	}
+	return best
+}
+
+//MinImage replaces, in place, each vector in d, which is assumed to be
+//a difference between two positions, by its shortest periodic image in the box.
+func (B *Box) MinImage(d *v3.Matrix) {
+	for i := 0; i < d.NVecs(); i++ {
+		setVec3(d, i, B.minImage(getVec3(d, i)))
+	}
+}
+
+//Distance returns the minimum-image distance between the positions a and b, which are
+//the first vectors of each matrix.
+func (B *Box) Distance(a, b *v3.Matrix) float64 {
+	va := getVec3(a, 0)
+	vb := getVec3(b, 0)
+	d := B.minImage([3]float64{vb[0] - va[0], vb[1] - va[1], vb[2] - va[2]})
+	return math.Sqrt(dot3(d, d))
+}
+
+//Wrap puts, in place, each position in coords inside the box,
+//so the fractional coordinates of all atoms are in [0,1).
+//Notice that this can split molecules across the box boundaries.
+func (B *Box) Wrap(coords *v3.Matrix) {
+	for i := 0; i < coords.NVecs(); i++ {
+		f := B.toFrac(getVec3(coords, i))
+		for j := range f {
+			f[j] -= math.Floor(f[j])
+			//A tiny negative coordinate gives 1 after rounding.
+			if f[j] >= 1 {
+				f[j] = 0
+			}
+		}
+		setVec3(coords, i, B.toCart(f))
+	}
+}
+
+//MinImageDistance returns the minimum-image distance between the positions a and b
+//(the first vector of each) in the box. If box is nil, the plain euclidean distance is returned.
+func MinImageDistance(a, b *v3.Matrix, box *Box) float64 {
+	if box == nil {
+		va := getVec3(a, 0)
+		vb := getVec3(b, 0)
+		d := [3]float64{vb[0] - va[0], vb[1] - va[1], vb[2] - va[2]}
+		return math.Sqrt(dot3(d, d))
+	}
+	return box.Distance(a, b)
+}
+
+//Some small helpers for the box functions.
+
+func getVec3(m *v3.Matrix, i int) [3]float64 {
+	return [3]float64{m.At(i, 0), m.At(i, 1), m.At(i, 2)}
+}
+
+func setVec3(m *v3.Matrix, i int, v [3]float64) {
+	m.Set(i, 0, v[0])
+	m.Set(i, 1, v[1])
+	m.Set(i, 2, v[2])
+}
+
+func dot3(u, v [3]float64) float64 {
+	return u[0]*v[0] + u[1]*v[1] + u[2]*v[2]
+}
+
+func norm3(u [3]float64) float64 {
+	return math.Sqrt(dot3(u, u))
+}
@@ -28,6 +28,9 @@ package chem
 import (
 	"fmt"
 	"github.com/rmera/gochem/v3"
+	"math"
+	"strconv"
+	"strings"
 )
 
 //import "strings"
@@ -54,7 +57,8 @@ type Atom struct {
 	Vdw       float64 //radius
 	Charge    float64 //Partial charge on an atom
 	Symbol    string
-	Het       bool // is the atom an hetatm in the pdb file? (if applicable)
+	Het       bool   // is the atom an hetatm in the pdb file? (if applicable)
+	Type      string //Force field or file-format atom type (i.e. the Tripos type in MOL2 files), if available.
 }
 
 //Atom methods
@@ -78,6 +82,7 @@ func (N *Atom) Copy(A *Atom) {
 	N.Charge = A.Charge
 	N.Symbol = A.Symbol
 	N.Het = A.Het
+	N.Type = A.Type
 }
 
 /*****Topology type***/
@@ -87,6 +92,12 @@ type Topology struct {
 	Atoms  []*Atom
 	charge int
 	multi  int
+	bonds  []*Bond
+
+	//Angles, proper and improper dihedrals, as slices of 3 or 4 atom indexes.
+	angles    [][]int
+	dihedrals [][]int
+	impropers [][]int
 }
 
 //NewTopology returns topology with ats atoms
@@ -156,13 +167,24 @@ func (T *Topology) ResetIDs() {
 }
 
 //Copy atoms into a topology. This is a deep copy, so T must have
-//at least as many atoms as A.
+//at least as many atoms as A. If A contains bonds, angles or dihedrals, they are also copied.
 func (T *Topology) CopyAtoms(A Atomer) {
 	//T := new(Topology)
 	T.Atoms = make([]*Atom, A.Len())
 	for key := 0; key < A.Len(); key++ {
+		T.Atoms[key] = new(Atom)
 		T.Atoms[key].Copy(A.Atom(key))
 	}
+	T.bonds = nil
+	if b, ok := A.(Bonder); ok {
+		T.bonds = copyBonds(b.Bonds())
+	}
+	T.angles, T.dihedrals, T.impropers = nil, nil, nil
+	if a, ok := A.(angler); ok {
+		T.angles = copyTuples(a.Angles())
+		T.dihedrals = copyTuples(a.Dihedrals())
+		T.impropers = copyTuples(a.Impropers())
+	}
 }
 
 //Atom returns the Atom corresponding to the index i
@@ -195,7 +217,8 @@ func (T *Topology) AppendAtom(at *Atom) {
 }
 
 //SelectAtoms puts the atoms of T
-//with indexes in atomlist into the receiver.
+//with indexes in atomlist into the receiver. The bonds, angles and dihedrals
+//of T between atoms in atomlist, if any, are also kept.
 func (R *Topology) SomeAtoms(T Atomer, atomlist []int) {
 	var ret []*Atom
 	lenatoms := T.Len()
@@ -206,7 +229,18 @@ func (R *Topology) SomeAtoms(T Atomer, atomlist []int) {
 		}
 		ret = append(ret, T.Atom(j))
 	}
+	var bonds []*Bond
+	if b, ok := T.(Bonder); ok {
+		bonds = someBonds(b.Bonds(), atomlist)
+	}
 	R.Atoms = ret
+	R.bonds = bonds
+	R.angles, R.dihedrals, R.impropers = nil, nil, nil
+	if a, ok := T.(angler); ok {
+		R.angles = someTuples(a.Angles(), atomlist)
+		R.dihedrals = someTuples(a.Dihedrals(), atomlist)
+		R.impropers = someTuples(a.Impropers(), atomlist)
+	}
 }
 
 //SelectAtoms puts the atoms of T
@@ -218,10 +252,15 @@ func (R *Topology) SomeAtomsSafe(T Atomer, atomlist []int) error {
 
 //DelAtom Deletes atom i by reslicing.
 //This means that the copy still uses as much memory as the original T.
+//Bonds, angles and dihedrals with atom i are also deleted.
 func (T *Topology) DelAtom(i int) {
 	if i >= T.Len() {
 		panic(ErrAtomOutOfRange)
 	}
+	T.bonds = delBondsAtom(T.bonds, i)
+	T.angles = delTuplesAtom(T.angles, i)
+	T.dihedrals = delTuplesAtom(T.dihedrals, i)
+	T.impropers = delTuplesAtom(T.impropers, i)
 	if i == T.Len()-1 {
 		T.Atoms = T.Atoms[:i]
 	} else {
@@ -257,9 +296,12 @@ func (T *Topology) Masses() ([]float64, error) {
 //Coordinates and b-factors are stored separately from other atomic info.
 type Molecule struct {
 	*Topology
-	Coords   []*v3.Matrix
-	Bfactors [][]float64
-	current  int
+	Coords     []*v3.Matrix
+	Bfactors   [][]float64
+	Boxes      []*Box       //Periodic boxes. nil for non-periodic systems, otherwise one box for all frames, or one per frame.
+	Velocities []*v3.Matrix //Velocities (in A/ps) for each frame, nil if not available.
+	Info       []*FrameInfo //Per-frame data read from XYZ files, nil if not available.
+	current    int
 }
 
 //NewMolecule makes a molecule with ats atoms, coords coordinates, bfactors b-factors
@@ -281,6 +323,14 @@ func NewMolecule(coords []*v3.Matrix, ats Atomer, bfactors [][]float64) (*Molecu
 		for i := 0; i < ats.Len(); i++ {
 			mol.Atoms = append(mol.Atoms, ats.Atom(i))
 		}
+		if b, ok := ats.(Bonder); ok {
+			mol.bonds = copyBonds(b.Bonds())
+		}
+		if a, ok := ats.(angler); ok {
+			mol.angles = copyTuples(a.Angles())
+			mol.dihedrals = copyTuples(a.Dihedrals())
+			mol.impropers = copyTuples(a.Impropers())
+		}
 	}
 	switch ats := ats.(type) { //for speed
 	case *Topology:
@@ -299,7 +349,7 @@ func NewMolecule(coords []*v3.Matrix, ats Atomer, bfactors [][]float64) (*Molecu
 
 //The molecule methods:
 
-//Deletes the coodinate i from every frame of the molecule.
+//Deletes the coodinate i (and the velocity and per-atom properties, if present) from every frame of the molecule.
 func (M *Molecule) DelCoord(i int) error {
 	r, _ := M.Coords[0].Dims()
 	var err error
@@ -311,6 +361,16 @@ func (M *Molecule) DelCoord(i int) error {
 			return err
 		}
 	}
+	for j, v := range M.Velocities {
+		tmp := v3.Zeros(r - 1)
+		tmp.DelVec(v, i)
+		M.Velocities[j] = tmp
+	}
+	for _, v := range M.Info {
+		if v != nil {
+			v.delAtom(i)
+		}
+	}
 	return nil
 }
 
@@ -339,6 +399,14 @@ func (M *Molecule) Copy(A *Molecule) {
 		M.Topology.Atoms = append(M.Topology.Atoms, at)
 
 	}
+	M.bonds = copyBonds(A.bonds)
+	M.angles = copyTuples(A.angles)
+	M.dihedrals = copyTuples(A.dihedrals)
+	M.impropers = copyTuples(A.impropers)
+	M.Boxes = nil
+	for _, b := range A.Boxes {
+		M.Boxes = append(M.Boxes, b.Copy())
+	}
 	//	M.CopyAtoms(A)
 	M.Coords = make([]*v3.Matrix, 0, len(A.Coords))
 	M.Bfactors = make([][]float64, 0, len(A.Bfactors))
@@ -349,6 +417,16 @@ func (M *Molecule) Copy(A *Molecule) {
 		tmp2 := copyB(A.Bfactors[key])
 		M.Bfactors = append(M.Bfactors, tmp2)
 	}
+	M.Info = nil
+	for _, val := range A.Info {
+		M.Info = append(M.Info, val.Copy())
+	}
+	M.Velocities = nil
+	for _, val := range A.Velocities {
+		tmp := v3.Zeros(r)
+		tmp.Copy(val)
+		M.Velocities = append(M.Velocities, tmp)
+	}
 	if err := M.Corrupted(); err != nil {
 		panic(PanicMsg(fmt.Sprintf("goChem: Molecule creation error: %s", err.Error())))
 	}
@@ -498,12 +576,44 @@ func (M *Molecule) NFrames() int {
 	return len(M.Coords)
 }
 
+//FrameBox returns the periodic box for the frame i, or nil if the molecule
+//has no box. If the molecule has only one box, it is returned for any frame.
+func (M *Molecule) FrameBox(i int) *Box {
+	if len(M.Boxes) == 0 {
+		return nil
+	}
+	if len(M.Boxes) == 1 {
+		return M.Boxes[0]
+	}
+	if i < 0 || i >= len(M.Boxes) {
+		panic(ErrNilFrame)
+	}
+	return M.Boxes[i]
+}
+
 //Implementaiton of the sort.Interface
 
 //Swap function, as demanded by sort.Interface. It swaps atoms, coordinates
-//(all frames) and bfactors of the molecule.
+//(all frames), bfactors, velocities and per-atom properties of the molecule. The bonds, angles and dihedrals are updated accordingly.
 func (M *Molecule) Swap(i, j int) {
 	M.Atoms[i], M.Atoms[j] = M.Atoms[j], M.Atoms[i]
+	for _, b := range M.bonds {
+		switch b.At1 {
+		case i:
+			b.At1 = j
+		case j:
+			b.At1 = i
+		}
+		switch b.At2 {
+		case i:
+			b.At2 = j
+		case j:
+			b.At2 = i
+		}
+	}
+	swapTuples(M.angles, i, j)
+	swapTuples(M.dihedrals, i, j)
+	swapTuples(M.impropers, i, j)
 	for k := 0; k < len(M.Coords); k++ {
 		M.Coords[k].SwapVecs(i, j)
 		t1 := M.Bfactors[k][i]
@@ -511,6 +621,14 @@ func (M *Molecule) Swap(i, j int) {
 		M.Bfactors[k][i] = t2
 		M.Bfactors[k][j] = t1
 	}
+	for _, v := range M.Velocities {
+		v.SwapVecs(i, j)
+	}
+	for _, v := range M.Info {
+		if v != nil {
+			v.swapAtoms(i, j)
+		}
+	}
 }
 
 //Less: Should the atom i be sorted before atom j?
@@ -552,6 +670,54 @@ func (M *Molecule) Next(V *v3.Matrix) error {
 	return nil
 }
 
+//Box returns the periodic box for the last frame read with Next
+//(or the first frame if no frame has been read), or nil if the molecule has no box.
+func (M *Molecule) Box() *Box {
+	if M.current == 0 {
+		return M.FrameBox(0)
+	}
+	return M.FrameBox(M.current - 1)
+}
+
+//frameKey returns the value of the key in the Info of the last frame read with Next
+//(or the first frame if no frame has been read) as a float64, and whether it was found.
+func (M *Molecule) frameKey(key string) (float64, bool) {
+	frame := M.current - 1
+	if frame < 0 {
+		frame = 0
+	}
+	if frame >= len(M.Info) || M.Info[frame] == nil {
+		return 0, false
+	}
+	for k, v := range M.Info[frame].Keys {
+		if strings.ToLower(k) == key {
+			f, err := strconv.ParseFloat(v, 64)
+			return f, err == nil
+		}
+	}
+	return 0, false
+}
+
+//Time returns the time, in ps, of the last frame read with Next (or the first frame
+//if no frame has been read), taken from the "time" key of its Info (as written, for instance,
+//in extended XYZ files). If there is no such key, NaN is returned.
+func (M *Molecule) Time() float64 {
+	if t, ok := M.frameKey("time"); ok {
+		return t
+	}
+	return math.NaN()
+}
+
+//Step returns the simulation step of the last frame read with Next (or the first frame
+//if no frame has been read), taken from the "step" key of its Info. If there is no such key,
+//-1 is returned.
+func (M *Molecule) Step() int {
+	if s, ok := M.frameKey("step"); ok {
+		return int(s)
+	}
+	return -1
+}
+
 //Initializes molecule to be read as a traj (not tested!)
 func (M *Molecule) InitRead() error {
 	if M == nil || len(M.Coords) == 0 {
@@ -602,6 +768,8 @@ func (M *Molecule) NextConc(frames []bool) ([]chan *v3.Matrix, error) {
 type lastFrameError struct {
 	fileName string
 	frame    int
+	format   string
+	deco     []string
 }
 
 //Error returns an error message string.
@@ -611,7 +779,7 @@ func (E *lastFrameError) Error() string {
 
 //Format returns the format used by the trajectory that returned the error.
 func (E *lastFrameError) Format() string {
-	return "mol"
+	return E.format
 }
 
 //Frame returns the frame at which the error was detected.
@@ -624,18 +792,69 @@ func (E *lastFrameError) FileName() string {
 	return E.fileName
 }
 
+//Critical returns false, as reaching the last frame is not really an error.
+func (E *lastFrameError) Critical() bool {
+	return false
+}
+
+//Decorate will add the dec string to the decoration slice of strings of the error,
+//and return the resulting slice.
+func (E *lastFrameError) Decorate(dec string) []string {
+	if dec != "" {
+		E.deco = append(E.deco, dec)
+	}
+	return E.deco
+}
+
 //NormalLastFrameTermination does nothing, it is there so we can have an interface unifying all
 //"normal termination" errors so they can be filtered out by type switch.
 func (E *lastFrameError) NormalLastFrameTermination() {
 }
 
-func newlastFrameError(filename string, frame int) *lastFrameError {
+func newlastFrameError(filename string, frame int, format ...string) *lastFrameError {
 	e := new(lastFrameError)
 	e.fileName = filename
 	e.frame = frame
+	e.format = "mol"
+	if len(format) > 0 {
+		e.format = format[0]
+	}
 	return e
 }
 
+//trajError is the error returned by the file-based trajectories of the chem package
+//for problems other than reaching the last frame.
+type trajError struct {
+	msg      string
+	fileName string
+	format   string
+	deco     []string
+	critical bool
+}
+
+//Error returns an error message string.
+func (E *trajError) Error() string {
+	return fmt.Sprintf("%s file %s error: %s", E.format, E.fileName, E.msg)
+}
+
+//Decorate will add the dec string to the decoration slice of strings of the error,
+//and return the resulting slice.
+func (E *trajError) Decorate(dec string) []string {
+	if dec != "" {
+		E.deco = append(E.deco, dec)
+	}
+	return E.deco
+}
+
+//FileName returns the name of the file from where the trajectory that gave the error is read.
+func (E *trajError) FileName() string { return E.fileName }
+
+//Format returns the format used by the trajectory that returned the error.
+func (E *trajError) Format() string { return E.format }
+
+//Critical returns true if the error leaves the trajectory unusable.
+func (E *trajError) Critical() bool { return E.critical }
+
 //End Traj Error
 
 //The general concrete error type for the package
@@ -693,5 +912,6 @@ const (
 	ErrAtomOutOfRange   = PanicMsg("goChem: Requested/Attempted setting Atom out of range")
 	ErrNilFrame         = PanicMsg("goChem: Attempted to acces nil frame")
 	ErrNotXx3Matrix     = PanicMsg("goChem: A v3.Matrix should have 3 columns")
+	ErrBadBox           = PanicMsg("goChem: Box sides must be positive")
 	ErrCliffordRotation = PanicMsg("goChem-Clifford: Target and Result matrices must have the same dimensions. They cannot reference the same matrix") //the only panic that the Clifford functions throw.
 )
@@ -0,0 +1,475 @@
+/*
+ * cif.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/gochem/v3"
+)
+
+//CIFFileRead reads the atom_site category of an mmCIF (PDBx) file. Each model becomes a frame of the returned
+//Molecule. Alternative locations are all kept, with the alt loc identifier in the Char16 field of each atom,
+//as done for PDB files. The author numbering, chain and names (the ones used in PDB files) are used unless the optional
+//argument label is given and true, in which case the label ones are used whenever present.
+//Returns error or nil.
+func CIFFileRead(cifname string, label ...bool) (*Molecule, error) {
+	ciffile, err := OpenFile(cifname)
+	if err != nil {
+		return nil, errDecorate(err, "CIFFileRead")
+	}
+	defer ciffile.Close()
+	mol, err := CIFRead(ciffile, label...)
+	if err != nil {
+		return nil, errDecorate(err, "CIFFileRead "+fmt.Sprintf("error in file %s", cifname))
+	}
+	return mol, nil
+}
+
+//CIFRead reads the atom_site category of mmCIF data from cif. See CIFFileRead for details.
+//Returns a Molecule and error or nil.
+func CIFRead(cif io.Reader, label ...bool) (*Molecule, error) {
+	uselabel := len(label) > 0 && label[0]
+	cols, rows, cell, err := cifAtomSite(bufio.NewReader(cif))
+	if err != nil {
+		return nil, errDecorate(err, "CIFRead")
+	}
+	if len(rows) == 0 {
+		return nil, CError{"No atom_site data in mmCIF file", []string{"CIFRead"}}
+	}
+	get := func(row []string, names ...string) string {
+		for _, n := range names {
+			if i, ok := cols[n]; ok && row[i] != "." && row[i] != "?" {
+				return row[i]
+			}
+		}
+		return ""
+	}
+	for _, c := range []string{"Cartn_x", "Cartn_y", "Cartn_z"} {
+		if _, ok := cols[c]; !ok {
+			return nil, CError{"Missing coordinates in mmCIF atom_site", []string{"CIFRead"}}
+		}
+	}
+	//auth fields are the default, label ones the fallback, or the other way around.
+	seq, comp, asym, atom := []string{"auth_seq_id", "label_seq_id"}, []string{"auth_comp_id", "label_comp_id"}, []string{"auth_asym_id", "label_asym_id"}, []string{"auth_atom_id", "label_atom_id"}
+	if uselabel {
+		for _, v := range [][]string{seq, comp, asym, atom} {
+			v[0], v[1] = v[1], v[0]
+		}
+	}
+	atoms := make([]*Atom, 0, len(rows))
+	coords := make([][]float64, 1, 1)
+	bfactors := make([][]float64, 1, 1)
+	model := ""
+	for k, row := range rows {
+		m := get(row, "pdbx_PDB_model_num")
+		if k == 0 {
+			model = m
+		} else if m != model {
+			model = m
+			coords = append(coords, make([]float64, 0, len(atoms)*3))
+			bfactors = append(bfactors, make([]float64, 0, len(atoms)))
+		}
+		frame := len(coords) - 1
+		var c [3]float64
+		for i, n := range []string{"Cartn_x", "Cartn_y", "Cartn_z"} {
+			c[i], err = strconv.ParseFloat(row[cols[n]], 64)
+			if err != nil {
+				return nil, CError{fmt.Sprintf("Wrong coordinate in atom_site row %d: %s", k+1, err.Error()), []string{"strconv.ParseFloat", "CIFRead"}}
+			}
+		}
+		coords[frame] = append(coords[frame], c[:]...)
+		var bfac float64
+		if b := get(row, "B_iso_or_equiv"); b != "" {
+			bfac, err = strconv.ParseFloat(b, 64)
+			if err != nil {
+				return nil, CError{fmt.Sprintf("Wrong B-factor in atom_site row %d: %s", k+1, err.Error()), []string{"strconv.ParseFloat", "CIFRead"}}
+			}
+		}
+		bfactors[frame] = append(bfactors[frame], bfac)
+		if frame > 0 {
+			continue //the topology is taken from the first model
+		}
+		at, err := cifAtom(row, get, seq, comp, asym, atom)
+		if err != nil {
+			return nil, CError{fmt.Sprintf("Wrong atom_site row %d: %s", k+1, err.Error()), []string{"cifAtom", "CIFRead"}}
+		}
+		atoms = append(atoms, at)
+	}
+	mcoords := make([]*v3.Matrix, len(coords), len(coords))
+	for i, c := range coords {
+		if len(c) != len(atoms)*3 {
+			return nil, CError{fmt.Sprintf("Model %d has %d atoms instead of %d", i+1, len(c)/3, len(atoms)), []string{"CIFRead"}}
+		}
+		mcoords[i], err = v3.NewMatrix(c)
+		if err != nil {
+			return nil, errDecorate(err, "CIFRead")
+		}
+	}
+	mol, err := NewMolecule(mcoords, NewTopology(0, 1, atoms), bfactors)
+	if err != nil {
+		return nil, errDecorate(err, "CIFRead")
+	}
+	if cell != nil {
+		mol.Boxes = []*Box{cell}
+	}
+	return mol, nil
+}
+
+//cifAtom builds an atom from an atom_site row. get returns the first non-null value among the given columns of the row.
+//seq, comp, asym and atom are the columns for the residue number, residue name, chain and atom name, in order of preference.
+func cifAtom(row []string, get func([]string, ...string) string, seq, comp, asym, atom []string) (*Atom, error) {
+	var err error
+	at := new(Atom)
+	at.Het = get(row, "group_PDB") == "HETATM"
+	if id := get(row, "id"); id != "" {
+		at.ID, err = strconv.Atoi(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	at.Name = get(row, atom...)
+	at.Molname = get(row, comp...)
+	at.Molname1 = three2OneLetter[at.Molname]
+	at.Chain = get(row, asym...)
+	if s := get(row, seq...); s != "" {
+		at.MolID, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	at.Char16 = ' '
+	if alt := get(row, "label_alt_id"); alt != "" {
+		at.Char16 = alt[0]
+	}
+	at.Occupancy = 1
+	if occ := get(row, "occupancy"); occ != "" {
+		at.Occupancy, err = strconv.ParseFloat(occ, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ch := get(row, "pdbx_formal_charge"); ch != "" {
+		at.Charge, err = strconv.ParseFloat(ch, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sym := get(row, "type_symbol"); sym != "" {
+		at.Symbol = strings.Title(strings.ToLower(sym))
+	} else {
+		at.Symbol, _ = symbolFromName(at.Name)
+	}
+	if at.Symbol != "" {
+		at.Mass = symbolMass[at.Symbol]
+	}
+	return at, nil
+}
+
+//cifAtomSite reads the first data block of an mmCIF file, and returns a map from the atom_site column names
+//(without the "_atom_site." prefix) to their positions in each row, the rows of the atom_site category and
+//the box in the cell category, or nil if there is none.
+func cifAtomSite(cif *bufio.Reader) (map[string]int, [][]string, *Box, error) {
+	tok := newCIFTokenizer(cif)
+	cols := make(map[string]int)
+	var rows [][]string
+	var values []string
+	cell := make(map[string]string)
+	inloop := false   //we are reading the tags of a loop
+	atomloop := false //the loop being read is the atom_site one
+	blocks := 0
+tokens:
+	for {
+		t, quoted, err := tok.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, errDecorate(err, "cifAtomSite")
+		}
+		lower := strings.ToLower(t)
+		switch {
+		case !quoted && strings.HasPrefix(lower, "data_"):
+			blocks++
+			if blocks > 1 {
+				break tokens //we only read the first data block
+			}
+			continue
+		case !quoted && lower == "loop_":
+			inloop, atomloop = true, false
+			continue
+		case !quoted && strings.HasPrefix(t, "_"):
+			if inloop {
+				if strings.HasPrefix(lower, "_atom_site.") {
+					atomloop = true
+					cols[t[len("_atom_site."):]] = len(cols)
+				}
+				continue
+			}
+			//a single key-value pair
+			atomloop = false
+			v, _, err := tok.next()
+			if err != nil {
+				return nil, nil, nil, CError{fmt.Sprintf("Missing value for %s", t), []string{"cifAtomSite"}}
+			}
+			if strings.HasPrefix(lower, "_atom_site.") {
+				cols[t[len("_atom_site."):]] = len(cols)
+				values = append(values, v)
+			} else if strings.HasPrefix(lower, "_cell.") {
+				cell[lower[len("_cell."):]] = v
+			}
+			continue
+		}
+		//a value in a loop
+		inloop = false
+		if atomloop {
+			values = append(values, t)
+		}
+	}
+	if len(cols) > 0 && len(values)%len(cols) != 0 {
+		return nil, nil, nil, CError{"The number of values in atom_site is not a multiple of the number of columns", []string{"cifAtomSite"}}
+	}
+	for i := 0; len(cols) > 0 && i < len(values); i += len(cols) {
+		rows = append(rows, values[i:i+len(cols)])
+	}
+	box, err := cifCell(cell)
+	return cols, rows, box, errDecorate(err, "cifAtomSite")
+}
+
+//cifCell builds a box from the lengths and angles of the cell category, given as a map.
+//It returns nil and no error if there is no cell, or if it is the 1 A unit cube used for
+//non-crystallographic structures.
+func cifCell(cell map[string]string) (*Box, error) {
+	var p [6]float64
+	for i, n := range []string{"length_a", "length_b", "length_c", "angle_alpha", "angle_beta", "angle_gamma"} {
+		v, ok := cell[n]
+		if !ok || v == "." || v == "?" {
+			return nil, nil
+		}
+		var err error
+		p[i], err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, CError{err.Error(), []string{"strconv.ParseFloat", "cifCell"}}
+		}
+	}
+	if p[0] == 1 && p[1] == 1 && p[2] == 1 {
+		return nil, nil
+	}
+	box, err := NewBoxFromParams(p[0], p[1], p[2], p[3], p[4], p[5])
+	return box, errDecorate(err, "cifCell")
+}
+
+//cifTokenizer splits CIF data into tokens, handling comments, quoted strings and
+//semicolon-delimited text fields.
+type cifTokenizer struct {
+	r    *bufio.Reader
+	line string
+	pos  int
+	eof  bool
+}
+
+func newCIFTokenizer(r *bufio.Reader) *cifTokenizer {
+	return &cifTokenizer{r: r}
+}
+
+//readLine puts the next line of the input in the tokenizer, returns io.EOF if there are no more lines.
+func (T *cifTokenizer) readLine() error {
+	if T.eof {
+		return io.EOF
+	}
+	line, err := T.r.ReadString('\n')
+	if err != nil {
+		if err != io.EOF {
+			return CError{err.Error(), []string{"bufio.Reader.ReadString", "cifTokenizer.readLine"}}
+		}
+		T.eof = true
+		if line == "" {
+			return io.EOF
+		}
+	}
+	T.line = strings.TrimRight(line, "\r\n")
+	T.pos = 0
+	return nil
+}
+
+//next returns the next token, whether it was quoted (or a text field) and an error, which is io.EOF at
+//the end of the data.
+func (T *cifTokenizer) next() (string, bool, error) {
+	for {
+		for T.pos < len(T.line) && (T.line[T.pos] == ' ' || T.line[T.pos] == '\t') {
+			T.pos++
+		}
+		if T.pos < len(T.line) && T.line[T.pos] != '#' {
+			break
+		}
+		if err := T.readLine(); err != nil {
+			return "", false, err
+		}
+		//a text field starts with a semicolon at the beginning of a line
+		if strings.HasPrefix(T.line, ";") {
+			text := []string{T.line[1:]}
+			for {
+				if err := T.readLine(); err != nil {
+					return "", false, CError{"Unterminated text field in CIF data", []string{"cifTokenizer.next"}}
+				}
+				if strings.HasPrefix(T.line, ";") {
+					T.pos = 1
+					return strings.Join(text, "\n"), true, nil
+				}
+				text = append(text, T.line)
+			}
+		}
+	}
+	start := T.pos
+	if q := T.line[start]; q == '\'' || q == '"' {
+		//the closing quote must be followed by a blank or the end of the line
+		for i := start + 1; i < len(T.line); i++ {
+			if T.line[i] == q && (i+1 == len(T.line) || T.line[i+1] == ' ' || T.line[i+1] == '\t') {
+				T.pos = i + 1
+				return T.line[start+1 : i], true, nil
+			}
+		}
+		return "", false, CError{"Unterminated quoted string in CIF data", []string{"cifTokenizer.next"}}
+	}
+	for T.pos < len(T.line) && T.line[T.pos] != ' ' && T.line[T.pos] != '\t' {
+		T.pos++
+	}
+	return T.line[start:T.pos], false, nil
+}
+
+//cifQuote returns s as a CIF value, quoting it if needed. Empty strings become the null value ".".
+func cifQuote(s string) string {
+	if s == "" {
+		return "."
+	}
+	if s != "." && s != "?" && !strings.ContainsAny(s, " \t") && !strings.ContainsAny(s[:1], "_#$'\"[];") &&
+		!strings.HasPrefix(strings.ToLower(s), "data_") && !strings.HasPrefix(strings.ToLower(s), "loop_") {
+		return s
+	}
+	if !strings.Contains(s, "\"") {
+		return "\"" + s + "\""
+	}
+	return "'" + s + "'"
+}
+
+//cifAtomSiteColumns are the atom_site columns written by goChem.
+var cifAtomSiteColumns = []string{"group_PDB", "id", "type_symbol", "label_atom_id", "label_alt_id", "label_comp_id",
+	"label_asym_id", "label_seq_id", "Cartn_x", "Cartn_y", "Cartn_z", "occupancy", "B_iso_or_equiv",
+	"pdbx_formal_charge", "auth_seq_id", "auth_comp_id", "auth_asym_id", "auth_atom_id", "pdbx_PDB_model_num"}
+
+//CIFFileWrite writes the atoms of mol with the coordinates coords to an mmCIF file with name cifname, which will
+//be overwritten if it exists. See CIFWrite for details.
+func CIFFileWrite(cifname string, coords *v3.Matrix, mol Atomer, bfact []float64, box ...*Box) error {
+	out, err := CreateFile(cifname)
+	if err != nil {
+		return errDecorate(err, "CIFFileWrite")
+	}
+	err = CIFWrite(out, coords, mol, bfact, box...)
+	if err != nil {
+		out.Close()
+		return errDecorate(err, "CIFFileWrite")
+	}
+	return errDecorate(out.Close(), "CIFFileWrite")
+}
+
+//CIFWrite writes the atoms of mol with the coordinates coords and the b-factors bfact (which can be nil)
+//in mmCIF format to out, as an atom_site loop. The same names and numbering are written as label and
+//author data. If a box is given, it is written in the cell category.
+//The Char16 field of the atoms is written as the alternative location identifier, and the charges
+//are written as formal charges only if they are integers. If the atom IDs are missing or repeated,
+//the atoms are numbered sequentially from 1.
+func CIFWrite(out io.Writer, coords *v3.Matrix, mol Atomer, bfact []float64, box ...*Box) error {
+	if bfact == nil {
+		bfact = make([]float64, mol.Len())
+	}
+	if coords.NVecs() != mol.Len() || len(bfact) != mol.Len() {
+		return CError{"Ref, Coords and/or Bfactors don't have the same number of atoms", []string{"CIFWrite"}}
+	}
+	w := bufio.NewWriter(out)
+	w.WriteString("data_gochem\n#\n")
+	if len(box) > 0 && box[0] != nil {
+		a, b, c, alpha, beta, gamma := box[0].Params()
+		fmt.Fprintf(w, "_cell.length_a %.3f\n_cell.length_b %.3f\n_cell.length_c %.3f\n", a, b, c)
+		fmt.Fprintf(w, "_cell.angle_alpha %.2f\n_cell.angle_beta %.2f\n_cell.angle_gamma %.2f\n#\n", alpha, beta, gamma)
+	}
+	ids := cifIDs(mol)
+	w.WriteString("loop_\n")
+	for _, c := range cifAtomSiteColumns {
+		fmt.Fprintf(w, "_atom_site.%s\n", c)
+	}
+	for i := 0; i < mol.Len(); i++ {
+		at := mol.Atom(i)
+		group := "ATOM"
+		seq := strconv.Itoa(at.MolID)
+		if at.Het {
+			group = "HETATM"
+			seq = "." //non-polymer entities have no label_seq_id
+		}
+		alt := "."
+		if at.Char16 != ' ' && at.Char16 != 0 {
+			alt = cifQuote(string(at.Char16))
+		}
+		charge := "?"
+		if at.Charge == math.Trunc(at.Charge) {
+			charge = strconv.Itoa(int(at.Charge))
+		}
+		name, resname, chain := cifQuote(strings.TrimSpace(at.Name)), cifQuote(strings.TrimSpace(at.Molname)), cifQuote(strings.TrimSpace(at.Chain))
+		fmt.Fprintf(w, "%-6s %d %s %s %s %s %s %s %.3f %.3f %.3f %.2f %.2f %s %d %s %s %s 1\n", group, ids[i], cifQuote(at.Symbol),
+			name, alt, resname, chain, seq, coords.At(i, 0), coords.At(i, 1), coords.At(i, 2), at.Occupancy, bfact[i],
+			charge, at.MolID, resname, chain, name)
+	}
+	w.WriteString("#\n")
+	if err := w.Flush(); err != nil {
+		return CError{"Failed to write in io.Writer" + err.Error(), []string{"io.Writer.Write", "CIFWrite"}}
+	}
+	return nil
+}
+
+//cifIDs returns the atom IDs of mol, or the sequential numbers 1..N if any ID is
+//missing (i.e. 0) or repeated, as _atom_site.id must be unique.
+func cifIDs(mol Atomer) []int {
+	ids := make([]int, mol.Len())
+	seen := make(map[int]bool, mol.Len())
+	for i := range ids {
+		id := mol.Atom(i).ID
+		if id == 0 || seen[id] {
+			for j := range ids {
+				ids[j] = j + 1
+			}
+			return ids
+		}
+		seen[id] = true
+		ids[i] = id
+	}
+	return ids
+}
@@ -0,0 +1,254 @@
+/*
+ * compress.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+//Compression formats supported by OpenFile and CreateFile.
+const (
+	NoCompression = ""
+	Gzip          = "gzip"
+	Bzip2         = "bzip2"
+	Xz            = "xz"
+)
+
+//compressionMagic are the first bytes of files in each compression format.
+var compressionMagic = map[string][]byte{
+	Gzip:  {0x1f, 0x8b},
+	Bzip2: []byte("BZh"),
+	Xz:    {0xfd, '7', 'z', 'X', 'Z', 0x00},
+}
+
+//compressionExt are the file extensions for each compression format.
+var compressionExt = map[string]string{
+	".gz":  Gzip,
+	".bz2": Bzip2,
+	".xz":  Xz,
+}
+
+//CompressionFromName returns the compression format implied by the extension of
+//the file name (.gz, .bz2 or .xz), or NoCompression.
+func CompressionFromName(name string) string {
+	return compressionExt[strings.ToLower(filepath.Ext(name))]
+}
+
+//Compression returns the compression format of the file name, detected from its first bytes, or NoCompression.
+func Compression(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", CError{err.Error(), []string{"os.Open", "Compression"}}
+	}
+	defer f.Close()
+	head := make([]byte, 6)
+	n, _ := io.ReadFull(f, head)
+	return compressionFromMagic(head[:n]), nil
+}
+
+//compressionFromMagic returns the compression format for a file starting with head.
+func compressionFromMagic(head []byte) string {
+	for k, v := range compressionMagic {
+		if bytes.HasPrefix(head, v) {
+			return k
+		}
+	}
+	return NoCompression
+}
+
+//closers closes several things, in order.
+type closers []io.Closer
+
+//Close closes everything in C and returns the first error found, if any.
+func (C closers) Close() error {
+	var err error
+	for _, c := range C {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return CError{err.Error(), []string{"closers.Close"}}
+	}
+	return nil
+}
+
+//fileReader is a, possibly decompressing, reader for a file.
+type fileReader struct {
+	io.Reader
+	closers
+}
+
+//fileWriter is a, possibly compressing, writer for a file.
+type fileWriter struct {
+	io.Writer
+	closers
+}
+
+//cmdCloser waits for a command to finish and then closes a file.
+type cmdCloser struct {
+	cmd  *exec.Cmd
+	file *os.File
+}
+
+//Close waits for the command and closes the file. It returns the first error found.
+func (C *cmdCloser) Close() error {
+	err := C.cmd.Wait()
+	if e := C.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+//cmdReader reads the output of a decompressing command. When the output ends, it waits for
+//the command, so a corrupt file gives an error instead of just appearing truncated.
+type cmdReader struct {
+	out    io.ReadCloser
+	cmd    *exec.Cmd
+	file   *os.File
+	waited bool
+	err    error
+}
+
+//Read reads from the output of the command. At the end of the output, it returns the error
+//from the command, if any, instead of io.EOF.
+func (C *cmdReader) Read(p []byte) (int, error) {
+	if C.waited {
+		if C.err != nil {
+			return 0, C.err
+		}
+		return 0, io.EOF
+	}
+	n, err := C.out.Read(p)
+	if err == io.EOF {
+		C.waited = true
+		if e := C.cmd.Wait(); e != nil {
+			C.err = CError{C.cmd.Path + ": " + e.Error(), []string{"exec.Cmd.Wait", "cmdReader.Read"}}
+			return n, C.err
+		}
+	}
+	return n, err
+}
+
+//Close closes the output and the file. If the output was read to the end, it returns the error from
+//the command, if any. Otherwise, the reader was closed early, which makes the command fail,
+//so its error is ignored.
+func (C *cmdReader) Close() error {
+	if !C.waited {
+		C.out.Close()
+		C.cmd.Wait()
+		C.waited = true
+	}
+	if err := C.file.Close(); err != nil && C.err == nil {
+		return CError{err.Error(), []string{"os.File.Close", "cmdReader.Close"}}
+	}
+	return C.err
+}
+
+//OpenFile opens the file name for reading. If the file is compressed with gzip, bzip2 or xz, which is
+//detected from its first bytes, the returned ReadCloser decompresses it on the fly. gzip and bzip2
+//are handled by the Go standard library, while xz files need the xz program to be in the PATH.
+//Compressed files can only be read sequentially, which is enough for every format except when
+//random access (i.e. seeking in trajectories) is needed. For a regular uncompressed file, the *os.File
+//itself is returned.
+func OpenFile(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, CError{err.Error(), []string{"os.Open", "OpenFile"}}
+	}
+	buf := bufio.NewReader(f)
+	head, _ := buf.Peek(6)
+	switch compressionFromMagic(head) {
+	case Gzip:
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			f.Close()
+			return nil, CError{err.Error(), []string{"gzip.NewReader", "OpenFile"}}
+		}
+		return &fileReader{gz, closers{gz, f}}, nil
+	case Bzip2:
+		return &fileReader{bzip2.NewReader(buf), closers{f}}, nil
+	case Xz:
+		cmd := exec.Command("xz", "-dc")
+		cmd.Stdin = buf
+		out, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			f.Close()
+			return nil, CError{err.Error(), []string{"exec.Cmd.Start", "OpenFile"}}
+		}
+		return &cmdReader{out: out, cmd: cmd, file: f}, nil
+	}
+	//Uncompressed files are returned as they are, so they can be seeked.
+	if _, err := f.Seek(0, io.SeekStart); err == nil {
+		return f, nil
+	}
+	return &fileReader{buf, closers{f}}, nil
+}
+
+//CreateFile creates the file name, truncating it if it exists, and returns a WriteCloser
+//for it. If the name ends in .gz, .bz2 or .xz, the data is compressed in the corresponding format.
+//gzip compression is handled by the Go standard library, while bzip2 and xz need the bzip2 and xz programs
+//to be in the PATH. The returned WriteCloser must be closed for the data to be completely written.
+func CreateFile(name string) (io.WriteCloser, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, CError{err.Error(), []string{"os.Create", "CreateFile"}}
+	}
+	comp := CompressionFromName(name)
+	switch comp {
+	case Gzip:
+		gz := gzip.NewWriter(f)
+		return &fileWriter{gz, closers{gz, f}}, nil
+	case Bzip2, Xz:
+		cmd := exec.Command(comp, "-c")
+		cmd.Stdout = f
+		in, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			f.Close()
+			return nil, CError{err.Error(), []string{"exec.Cmd.Start", "CreateFile"}}
+		}
+		//The program needs to get the end of its input before we wait for it, and it
+		//needs to finish before the file is closed.
+		return &fileWriter{in, closers{in, &cmdCloser{cmd, f}}}, nil
+	}
+	return &fileWriter{f, closers{f}}, nil
+}
@@ -30,12 +30,16 @@
 package dcd
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
 	"github.com/rmera/gochem"
 	"github.com/rmera/gochem/v3"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"runtime"
 )
 
@@ -52,24 +56,54 @@ type DCDObj struct {
 	charmm     bool //Charmm traj?
 	extrablock bool
 	fourdim    bool
-	new        bool     //Still no frame read from it?
-	fixed      int32    //Fixed atoms (not supported)
-	dcd        *os.File //The DCD file
+	new        bool          //Still no frame read from it?
+	fixed      int32         //Number of fixed atoms
+	free       []int         //Indexes of the free atoms, if there are fixed atoms
+	freeBuffer [][]float32   //Buffer for the coordinates of the free atoms
+	ref        [][]float32   //Coordinates of the first frame, for the fixed atoms
+	file       io.ReadCloser //The DCD file
+	dcd        *bufio.Reader //Buffered reader for file
+	nset       int32         //Number of frames, according to the header
+	istart     int32         //Step of the first frame
+	nsavc      int32         //Steps between frames
+	delta      float32       //Time step, in AKMA units
+	last       int           //The last frame read
+	headerSize int64         //Size of the header in bytes
+	current    int           //The next frame to be read
+	stop       int           //Frames from this one on are not read. Negative means no limit.
+	step       int           //Read one in every step frames
 	dcdFields  [][]float32
 	concBuffer [][][]float32
 	endian     binary.ByteOrder
+	box        *chem.Box //The unit cell of the last frame read, if any.
+	indexes    []int     //The atoms read, nil for all atoms.
 }
 
-func New(filename string) (*DCDObj, error) {
+//New opens the DCD file filename for reading and returns a DCDObj for it. The file
+//can be compressed with gzip, bzip2 or xz (see chem.OpenFile). If a slice of indexes
+//is given, only those atoms are returned by Next and NextConc, in that order, and
+//Len returns the number of indexes.
+func New(filename string, indexes ...[]int) (*DCDObj, error) {
 	traj := new(DCDObj)
 	if err := traj.initRead(filename); err != nil {
 		return nil, errDecorate(err, "New")
 	}
+	if len(indexes) > 0 && indexes[0] != nil {
+		for _, v := range indexes[0] {
+			if v < 0 || v >= int(traj.natoms) {
+				traj.file.Close()
+				return nil, Error{fmt.Sprintf("Index %d out of range for a trajectory with %d atoms", v, traj.natoms), filename, []string{"New"}, true}
+			}
+		}
+		traj.indexes = indexes[0]
+	}
 	traj.dcdFields = make([][]float32, 3, 3)
 	traj.dcdFields[0] = make([]float32, int(traj.natoms), int(traj.natoms))
 	traj.dcdFields[1] = make([]float32, int(traj.natoms), int(traj.natoms))
 	traj.dcdFields[2] = make([]float32, int(traj.natoms), int(traj.natoms))
 	traj.concBuffer = append(traj.concBuffer, traj.dcdFields)
+	traj.stop = -1
+	traj.step = 1
 	return traj, nil
 
 }
@@ -85,8 +119,8 @@ func (D *DCDObj) Readable() bool {
 
 //InitRead initializes a XtcObj for reading.
 //It requires only the filename, which must be valid.
-//It support big and little endianness, charmm or (namd>=2.1) and no
-//fixed atoms.
+//It support big and little endianness, charmm or (namd>=2.1), fixed
+//atoms and 4D trajectories (the fourth dimension is skipped).
 func (D *DCDObj) initRead(name string) error {
 	wrapbinerr := func(err error) error {
 		return Error{err.Error(), D.filename, []string{"binary.Read", "initRead"}, true}
@@ -97,10 +131,12 @@ func (D *DCDObj) initRead(name string) error {
 	_ = rec_scale
 	NB := bytes.NewBuffer //shortness sake
 	var err error
-	D.dcd, err = os.Open(name)
+	D.filename = name
+	D.file, err = chem.OpenFile(name)
 	if err != nil {
-		return Error{err.Error(), D.filename, []string{"os.Open", "initRead"}, true}
+		return Error{err.Error(), D.filename, []string{"chem.OpenFile", "initRead"}, true}
 	}
+	D.dcd = bufio.NewReader(D.file)
 	var check int32
 	if err := binary.Read(D.dcd, D.endian, &check); err != nil {
 		return wrapbinerr(err)
@@ -124,6 +160,11 @@ func (D *DCDObj) initRead(name string) error {
 	if err := binary.Read(D.dcd, D.endian, buf); err != nil {
 		return wrapbinerr(err)
 	}
+	for i, v := range []*int32{&D.nset, &D.istart, &D.nsavc} {
+		if err := binary.Read(NB(buf[4*i:]), D.endian, v); err != nil {
+			return wrapbinerr(err)
+		}
+	}
 	//X-plor sets this last int to zero, charmm sets it to its version number.
 	//if we have a charmm file we get some additional flags.
 	if err := binary.Read(NB(buf[76:]), D.endian, &check); err != nil {
@@ -139,7 +180,7 @@ func (D *DCDObj) initRead(name string) error {
 			//			fmt.Println("block", check) ///////////
 			D.extrablock = true
 		}
-		if err := binary.Read(NB(buf[40:]), D.endian, &check); err != nil {
+		if err := binary.Read(NB(buf[44:]), D.endian, &check); err != nil {
 			return wrapbinerr(err)
 		}
 		if check == 1 {
@@ -155,8 +196,8 @@ func (D *DCDObj) initRead(name string) error {
 
 	}
 	//	fmt.Println("fixed", D.fixed)
-	var delta float32 //This should work only on Charmm and namd >=2.1
-	if err := binary.Read(NB(buf[36:]), D.endian, &delta); err != nil {
+	//This should work only on Charmm and namd >=2.1
+	if err := binary.Read(NB(buf[36:]), D.endian, &D.delta); err != nil {
 		return wrapbinerr(err)
 	}
 	//	fmt.Println("delta:", delta)///////////////////////////////////////
@@ -202,16 +243,56 @@ func (D *DCDObj) initRead(name string) error {
 	if check != 4 { //and one more 4
 		return Error{WrongFormat, D.filename, []string{"initRead"}, true}
 	}
-	if D.fixed == 0 {
-		runtime.SetFinalizer(D, func(D *DCDObj) {
-			D.dcd.Close()
-		})
-		D.readable = true
-		return nil //nothing else to do
+	//The first block has 84 bytes, then comes the title block, and the last one has 4 bytes (the number of atoms).
+	//Each block is surrounded by its size.
+	D.headerSize = (4 + 84 + 4) + (4 + int64(input_int) + 4) + (4 + 4 + 4)
+	if D.fixed > 0 {
+		if err := D.readFree(); err != nil {
+			return errDecorate(err, "initRead")
+		}
 	}
-	D.new = true //nothing read yet
-	return Error{"Fixed atoms not supported", D.filename, []string{"initRead"}, true}
+	runtime.SetFinalizer(D, func(D *DCDObj) {
+		D.file.Close()
+	})
+	D.readable = true
+	return nil
+}
 
+//readFree reads the block with the (1-based) indexes of the free atoms, present
+//after the header in files with fixed atoms.
+func (D *DCDObj) readFree() error {
+	nfree := D.natoms - D.fixed
+	if nfree <= 0 {
+		return Error{WrongFormat + ": No free atoms", D.filename, []string{"readFree"}, true}
+	}
+	var blocksize int32
+	if err := binary.Read(D.dcd, D.endian, &blocksize); err != nil {
+		return Error{err.Error(), D.filename, []string{"binary.Read", "readFree"}, true}
+	}
+	if blocksize != 4*nfree {
+		return Error{WrongFormat + ": Wrong size for the free atoms block", D.filename, []string{"readFree"}, true}
+	}
+	block, err := D.readByteBlock(blocksize)
+	if err != nil {
+		return errDecorate(err, "readFree")
+	}
+	free := make([]int32, nfree)
+	if err := binary.Read(bytes.NewReader(block), D.endian, free); err != nil {
+		return Error{err.Error(), D.filename, []string{"binary.Read", "readFree"}, true}
+	}
+	D.free = make([]int, nfree)
+	for i, v := range free {
+		if v < 1 || v > D.natoms {
+			return Error{fmt.Sprintf("%s: Free atom index %d out of range", WrongFormat, v), D.filename, []string{"readFree"}, true}
+		}
+		D.free[i] = int(v - 1)
+	}
+	D.freeBuffer = make([][]float32, 3)
+	for i := range D.freeBuffer {
+		D.freeBuffer[i] = make([]float32, nfree)
+	}
+	D.headerSize += 4 + int64(blocksize) + 4
+	return nil
 }
 
 //Next Reads the next frame in a DcDObj that has been initialized for read
@@ -234,105 +315,356 @@ func (D *DCDObj) Next(keep *v3.Matrix) error {
 	if keep == nil {
 		return nil
 	}
-	if r, _ := keep.Dims(); int32(r) < D.natoms {
+	if r, _ := keep.Dims(); r < D.Len() {
 		panic("Not enough space in matrix")
 	}
-	//outBlock := make([]float64, int(D.natoms)*3, int(D.natoms)*3)
-	for i := 0; i < int(D.natoms); i++ {
-		k := i - i*(i/int(D.natoms))
-		keep.Set(k, 0, float64(D.dcdFields[0][k]))
-		keep.Set(k, 1, float64(D.dcdFields[1][k]))
-		keep.Set(k, 2, float64(D.dcdFields[2][k]))
-	}
-	//	final := NewVecs(outBlock, int(D.natoms), 3)
-	//	fmt.Print(final)/////////7
+	D.toMatrix(D.dcdFields, keep)
 	return nil
 }
 
-//Next Reads the next frame in a XtcObj that has been initialized for read
-//With initread. If keep is true, returns a pointer to matrix.DenseMatrix
-//With the coordinates read, otherwiser, it discards the coordinates and
-//returns nil.
+//toMatrix puts the coordinates of the atoms read from the X, Y and Z blocks in keep,
+//which must have enough space.
+func (D *DCDObj) toMatrix(blocks [][]float32, keep *v3.Matrix) {
+	for i := 0; i < D.Len(); i++ {
+		k := i
+		if D.indexes != nil {
+			k = D.indexes[i]
+		}
+		keep.Set(i, 0, float64(blocks[0][k]))
+		keep.Set(i, 1, float64(blocks[1][k]))
+		keep.Set(i, 2, float64(blocks[2][k]))
+	}
+}
+
+//nextRaw reads the next frame to be read, according to the range set, into blocks, which must have
+//space for all the atoms in the trajectory.
 func (D *DCDObj) nextRaw(blocks [][]float32) error {
 	if len(blocks[0]) != int(D.natoms) || len(blocks[1]) != int(D.natoms) || len(blocks[2]) != int(D.natoms) {
 		return Error{NotEnoughSpace, D.filename, []string{"nextRaw"}, true}
 	}
 	D.new = false
-	if D.readLast {
+	if D.readLast || (D.stop >= 0 && D.current >= D.stop) {
 		D.readable = false
 		return newlastFrameError(D.filename, "nextRaw")
 	}
+	if err := D.readFrame(blocks); err != nil {
+		return errDecorate(err, "nextRaw")
+	}
+	D.last = D.current
+	D.current++
+	if D.step > 1 {
+		if err := D.skip(D.step - 1); err != nil {
+			return errDecorate(err, "nextRaw")
+		}
+	}
+	return nil
+
+}
+
+//frameAtoms returns the number of atoms in the coordinate blocks of the frame. If there are
+//fixed atoms, only the first frame contains all the atoms.
+func (D *DCDObj) frameAtoms(frame int) int32 {
+	if D.fixed > 0 && frame > 0 {
+		return D.natoms - D.fixed
+	}
+	return D.natoms
+}
+
+//readFrame reads the frame D.current from the file into blocks. If there are fixed atoms,
+//the coordinates of the first frame are kept, and used for the fixed atoms in the following ones.
+func (D *DCDObj) readFrame(blocks [][]float32) error {
 	//if there is an extra block we just skip it.
 	//Sadly, even when there is an extra block, it is not present in all
 	//snapshots for some trajectories, so we must use the block size to see if
 	//there is an extra block or if the X block starts inmediately
 	var blocksize int32
-	if D.extrablock {
-		if err := binary.Read(D.dcd, D.endian, &blocksize); err != nil {
-			return Error{err.Error(), D.filename, []string{"binary.Read", "nextRaw"}, true}
+	//An EOF at the beginning of a frame just means that there are no more frames.
+	if err := binary.Read(D.dcd, D.endian, &blocksize); err != nil {
+		if err == io.EOF {
+			D.readLast = true
+			D.readable = false
+			return newlastFrameError(D.filename, "readFrame")
 		}
+		return Error{err.Error(), D.filename, []string{"binary.Read", "readFrame"}, true}
+	}
+	natoms := D.frameAtoms(D.current)
+	if D.extrablock {
 		//If the blocksize is 4*natoms it means that the block is not an
 		//extra block, but the X coordinates, and thus we must skip the following
-		if blocksize != D.natoms*4 {
-			if _, err := D.readByteBlock(blocksize); err != nil {
+		if blocksize != natoms*4 {
+			block, err := D.readByteBlock(blocksize)
+			if err != nil {
 				return err
 			}
+			if blocksize == 48 {
+				if err := D.setBox(block); err != nil {
+					return errDecorate(err, "readFrame")
+				}
+			}
 			blocksize = 0
 		}
 	}
+	//The free atoms are read into their own buffers, and then put in their places in blocks.
+	read := blocks
+	if natoms != D.natoms {
+		if D.ref == nil {
+			return Error{"No reference coordinates for the fixed atoms", D.filename, []string{"readFrame"}, true}
+		}
+		read = D.freeBuffer
+	}
 	//now get the coords, each as a slice of float32
-	//X
-	//we collect the X block size again only if it has not been collected before
-	if blocksize == 0 {
+	//X, Y and Z.
+	for i := 0; i < 3; i++ {
+		//we collect the X block size again only if it has not been collected before
+		if i > 0 || blocksize == 0 {
+			if err := binary.Read(D.dcd, D.endian, &blocksize); err != nil {
+				return Error{err.Error(), D.filename, []string{"binary.Read", "readFrame"}, true}
+			}
+		}
+		if blocksize != 4*natoms {
+			return Error{WrongFormat + ": Wrong size for a coordinate block", D.filename, []string{"readFrame"}, true}
+		}
+		if err := D.readFloat32Block(blocksize, read[i]); err != nil {
+			return errDecorate(err, "readFrame")
+		}
+	}
+	//we skip the 4-D values if they exist.
+	if D.charmm && D.fourdim {
 		if err := binary.Read(D.dcd, D.endian, &blocksize); err != nil {
-			return Error{err.Error(), D.filename, []string{"binary.Read", "nextRaw"}, true}
-
+			return Error{err.Error(), D.filename, []string{"binary.Read", "readFrame"}, true}
+		}
+		if _, err := D.readByteBlock(blocksize); err != nil {
+			return errDecorate(err, "readFrame")
 		}
 	}
-	err := D.readFloat32Block(blocksize, blocks[0])
-	if err != nil {
-		return errDecorate(err, "nextRaw")
+	if D.fixed == 0 {
+		return nil
 	}
-	//	fmt.Println("X", len(xblock)) //, xblock)
-	//	fmt.Println("X", blocks[0])  ///////////////////////////////
-	//Y
-	//Collect the size first, then the rest
-	if err := binary.Read(D.dcd, D.endian, &blocksize); err != nil {
-		return err
+	if natoms == D.natoms {
+		//the first frame, we keep it as reference.
+		D.ref = make([][]float32, 3)
+		for i := range D.ref {
+			D.ref[i] = append([]float32(nil), blocks[i]...)
+		}
+		return nil
 	}
-	err = D.readFloat32Block(blocksize, blocks[1])
-	if err != nil {
-		return errDecorate(err, "nextRaw")
+	for i := range blocks {
+		copy(blocks[i], D.ref[i])
+		for j, v := range D.free {
+			blocks[i][v] = read[i][j]
+		}
 	}
-	//	fmt.Println("Y", blocks[1])
-	//Z
-	if err := binary.Read(D.dcd, D.endian, &blocksize); err != nil {
-		return Error{err.Error(), D.filename, []string{"binary.Read", "nextRaw"}, true}
+	return nil
+}
+
+//readReference reads the first frame, which must be the next one in the file,
+//only to keep its coordinates as reference for the fixed atoms.
+func (D *DCDObj) readReference() error {
+	blocks := make([][]float32, 3)
+	for i := range blocks {
+		blocks[i] = make([]float32, D.natoms)
 	}
-	err = D.readFloat32Block(blocksize, blocks[2])
-	if err != nil {
-		return errDecorate(err, "nextRaw")
+	return D.readFrame(blocks)
+}
+
+//frameSize returns the size of the frame in the file, in bytes. It assumes that
+//all frames have the same size (except for the first one, if there are fixed atoms) which
+//is the case for the files written by CHARMM, NAMD, OpenMM, VMD and goChem.
+func (D *DCDObj) frameSize(frame int) int64 {
+	coords := 4 + 4*int64(D.frameAtoms(frame)) + 4
+	size := 3 * coords
+	if D.extrablock {
+		size += 4 + 48 + 4
 	}
-	//	fmt.Println("Z", blocks[2])
-	//we skip the 4-D values if they exist. Apparently this is not present in the
-	//last snapshot, so we use an EOF here to signal that we have read the last snapshot.
 	if D.charmm && D.fourdim {
-		if err := binary.Read(D.dcd, D.endian, &blocksize); err != nil {
-			if err.Error() == "EOF" {
-				D.readLast = true
-				//	fmt.Println("LAST!")
-			} else {
-				return Error{err.Error(), D.filename, []string{"binary.Read", "nextRaw"}, true}
+		size += coords
+	}
+	return size
+}
+
+//frameOffset returns the position of the frame in the file.
+func (D *DCDObj) frameOffset(frame int) int64 {
+	if frame == 0 {
+		return D.headerSize
+	}
+	return D.headerSize + D.frameSize(0) + int64(frame-1)*D.frameSize(1)
+}
+
+//osFile returns the file of the trajectory as an *os.File, or nil if the trajectory
+//is read from a compressed file, and thus doesn't allow random access.
+func (D *DCDObj) osFile() *os.File {
+	f, _ := D.file.(*os.File)
+	return f
+}
+
+//skip skips the next n frames without decoding them. It doesn't return an error if
+//the end of the file is reached. In that case the next read will signal the last frame.
+func (D *DCDObj) skip(n int) error {
+	if D.osFile() != nil {
+		return errDecorate(D.Seek(D.current+n), "skip")
+	}
+	if n <= 0 {
+		return nil
+	}
+	//The first frame is needed as a reference for the fixed atoms, so it is always read.
+	if D.fixed > 0 && D.ref == nil {
+		if err := D.readReference(); err != nil {
+			if _, ok := err.(*lastFrameError); ok {
+				return nil
 			}
+			return errDecorate(err, "skip")
 		}
-		if !D.readLast {
-			if _, err := D.readByteBlock(blocksize); err != nil {
-				return errDecorate(err, "nextRaw")
-			}
+		D.current++
+		n--
+	}
+	_, err := D.dcd.Discard(int(D.frameOffset(D.current+n) - D.frameOffset(D.current)))
+	if err != nil && err != io.EOF {
+		return Error{err.Error(), D.filename, []string{"bufio.Reader.Discard", "skip"}, true}
+	}
+	D.current += n
+	return nil
+}
+
+//NFrames returns the number of frames in the trajectory. For uncompressed files, it is obtained
+//from the file size, otherwise, from the header, which is not always reliable. The frames excluded
+//by SetRange are counted.
+func (D *DCDObj) NFrames() int {
+	f := D.osFile()
+	if f == nil {
+		return int(D.nset)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return int(D.nset)
+	}
+	if info.Size() <= D.headerSize {
+		return 0
+	}
+	if D.fixed > 0 {
+		return 1 + int((info.Size()-D.frameOffset(1))/D.frameSize(1))
+	}
+	return int((info.Size() - D.headerSize) / D.frameSize(0))
+}
+
+//Seek sets the trajectory so the next frame read is frame (the first frame is 0). The trajectory
+//becomes readable again if the last frame had been read. Seek needs random access, so it is not
+//supported for compressed files.
+func (D *DCDObj) Seek(frame int) error {
+	f := D.osFile()
+	if f == nil {
+		return Error{"Random access not supported for compressed files", D.filename, []string{"Seek"}, true}
+	}
+	if D.headerSize == 0 {
+		return Error{TrajUnIni, D.filename, []string{"Seek"}, true}
+	}
+	if frame < 0 {
+		return Error{fmt.Sprintf("Invalid frame %d", frame), D.filename, []string{"Seek"}, true}
+	}
+	//The first frame is needed as a reference for the fixed atoms.
+	if D.fixed > 0 && D.ref == nil && frame > 0 {
+		if err := D.Seek(0); err != nil {
+			return errDecorate(err, "Seek")
 		}
+		if err := D.readReference(); err != nil {
+			return errDecorate(err, "Seek")
+		}
+	}
+	if _, err := f.Seek(D.frameOffset(frame), io.SeekStart); err != nil {
+		return Error{err.Error(), D.filename, []string{"os.File.Seek", "Seek"}, true}
+	}
+	D.dcd.Reset(f)
+	D.current = frame
+	D.readLast = false
+	D.readable = true
+	return nil
+}
+
+//ReadFrame reads the frame i (the first one is 0) into output. After the call, the next frame read
+//with Next is the one after i, or the next one in the range set with SetRange.
+func (D *DCDObj) ReadFrame(i int, output *v3.Matrix) error {
+	if i >= D.NFrames() {
+		return Error{fmt.Sprintf("Frame %d requested from a trajectory with %d frames", i, D.NFrames()), D.filename, []string{"ReadFrame"}, true}
+	}
+	if err := D.Seek(i); err != nil {
+		return errDecorate(err, "ReadFrame")
+	}
+	return errDecorate(D.Next(output), "ReadFrame")
+}
+
+//SetRange sets the trajectory so Next and NextConc read only the frames
+//start, start+step, start+2*step... up to, but not including, stop. A negative
+//stop means that the frames are read until the end of the trajectory. The frames
+//in between are skipped without decoding them. For compressed files, start can't
+//be smaller than the next frame to be read.
+func (D *DCDObj) SetRange(start, stop, step int) error {
+	if start < 0 || step < 1 {
+		return Error{fmt.Sprintf("Invalid range %d:%d:%d", start, stop, step), D.filename, []string{"SetRange"}, true}
+	}
+	D.stop = stop
+	D.step = step
+	if start == D.current {
+		return nil
+	}
+	if D.osFile() != nil {
+		return errDecorate(D.Seek(start), "SetRange")
 	}
+	if start < D.current {
+		return Error{"Can't go back in a compressed file", D.filename, []string{"SetRange"}, true}
+	}
+	return errDecorate(D.skip(start-D.current), "SetRange")
+}
+
+//setBox obtains the unit cell from the extra block of a frame, which contains
+//6 float64 in the order A, gamma, B, beta, alpha, C. The lengths are in A. Charmm
+//writes the angles in degrees, while NAMD writes their cosines, so if all the
+//angles are in [-1,1], we take them as cosines.
+func (D *DCDObj) setBox(block []byte) error {
+	cell := make([]float64, 6)
+	if err := binary.Read(bytes.NewBuffer(block), D.endian, cell); err != nil {
+		return Error{err.Error(), D.filename, []string{"binary.Read", "setBox"}, true}
+	}
+	a, b, c := cell[0], cell[2], cell[5]
+	alpha, beta, gamma := cell[4], cell[3], cell[1]
+	if a <= 0 || b <= 0 || c <= 0 {
+		D.box = nil //Some programs write a zero cell for non-periodic systems.
+		return nil
+	}
+	if math.Abs(alpha) <= 1 && math.Abs(beta) <= 1 && math.Abs(gamma) <= 1 {
+		alpha = math.Acos(alpha) * 180 / math.Pi
+		beta = math.Acos(beta) * 180 / math.Pi
+		gamma = math.Acos(gamma) * 180 / math.Pi
+	}
+	box, err := chem.NewBoxFromParams(a, b, c, alpha, beta, gamma)
+	if err != nil {
+		return Error{err.Error(), D.filename, []string{"chem.NewBoxFromParams", "setBox"}, true}
+	}
+	D.box = box
 	return nil
+}
+
+//Box returns the unit cell of the last frame read, or nil if the
+//trajectory has no unit cell information. When frames are read with NextConc,
+//it returns the cell of the last frame of the batch.
+func (D *DCDObj) Box() *chem.Box {
+	return D.box
+}
+
+//Step returns the simulation step of the last frame read, or of the first frame,
+//if no frame has been read, obtained from the first step and the steps between frames
+//given in the header.
+func (D *DCDObj) Step() int {
+	return int(D.istart) + D.last*int(D.nsavc)
+}
 
+//Time returns the simulation time, in ps, of the last frame read, or of the first frame,
+//if no frame has been read. It is obtained from the step and the time step in the header.
+func (D *DCDObj) Time() float64 {
+	return float64(D.Step()) * float64(D.delta) * akmaPs
+}
+
+//TimeStep returns the time between frames, in ps.
+func (D *DCDObj) TimeStep() float64 {
+	return float64(D.nsavc) * float64(D.delta) * akmaPs
 }
 
 //Queries the size of a block, and reads its contents into block, which must have the
@@ -374,9 +706,13 @@ func (D *DCDObj) readByteBlock(blocksize int32) ([]byte, error) {
 	return block, nil
 }
 
-//Natoms returns the number of atoms per frame in the XtcObj.
-//XtcObj must be initialized. 0 means an uninitialized object.
+//Len returns the number of atoms per frame in the DCDObj, or the number
+//of atoms selected, if the DCDObj was created with a slice of indexes.
+//DCDObj must be initialized. 0 means an uninitialized object.
 func (D *DCDObj) Len() int {
+	if D.indexes != nil {
+		return len(D.indexes)
+	}
 	return int(D.natoms)
 }
 
@@ -398,9 +734,9 @@ func (D *DCDObj) setConcBuffer(batchsize int) error {
 		return nil
 	}
 	for i := 0; i < batchsize-l; i++ {
-		x := make([]float32, D.Len())
-		y := make([]float32, D.Len())
-		z := make([]float32, D.Len())
+		x := make([]float32, D.natoms)
+		y := make([]float32, D.natoms)
+		z := make([]float32, D.natoms)
 		tmp := [][]float32{x, y, z}
 		D.concBuffer = append(D.concBuffer, tmp)
 	}
@@ -431,28 +767,232 @@ func (D *DCDObj) NextConc(frames []*v3.Matrix) ([]chan *v3.Matrix, error) {
 			framechans[key] = nil //ignored frame
 			continue
 		}
+		if r, _ := frames[key].Dims(); r < D.Len() {
+			panic("Not enough space in matrix")
+		}
 		framechans[key] = make(chan *v3.Matrix)
 		//Now the parallel part
-		go func(natoms int, DFields [][]float32, keep *v3.Matrix, pipe chan *v3.Matrix) {
-			for i := 0; i < int(D.natoms); i++ {
-				k := i - i*(i/int(D.natoms))
-				keep.Set(k, 0, float64(DFields[0][k]))
-				keep.Set(k, 1, float64(DFields[1][k]))
-				keep.Set(k, 2, float64(DFields[2][k]))
-			}
+		go func(DFields [][]float32, keep *v3.Matrix, pipe chan *v3.Matrix) {
+			D.toMatrix(DFields, keep)
 			//			fmt.Println("in gorutine!", temp.GetRowVector(2))
 			pipe <- keep
-		}(int(D.natoms), DFields, frames[key], framechans[key])
+		}(DFields, frames[key], framechans[key])
 	}
 	return framechans, nil
 }
 
+/***Writing***/
+
+//akmaPs is the AKMA time unit, used for the time step in DCD files, in ps.
+const akmaPs = 0.04888821
+
+//DCDWObj is a CHARMM/NAMD DCD trajectory file open for writing.
+type DCDWObj struct {
+	natoms     int32
+	filename   string
+	dcd        *os.File //the file written, a temporary one if the trajectory is to be compressed
+	buf        *bufio.Writer
+	endian     binary.ByteOrder
+	dt         float64 //in ps
+	extrablock bool
+	nset       int32 //frames written
+	writable   bool
+}
+
+//NewWriter creates the file filename and returns a DCDWObj to write frames with
+//natoms atoms to it. The file is written in CHARMM format, little-endian by default,
+//with frames 1 ps apart. The header is written with the first frame, so the settings
+//can be changed with the Set* methods until then.
+//Since the number of frames in the header is only known at the end, the DCD file
+//needs random access. If filename ends in .gz, .bz2 or .xz, the trajectory is written
+//to a temporary file in the same directory, which is compressed into filename by Close.
+func NewWriter(filename string, natoms int) (*DCDWObj, error) {
+	W := new(DCDWObj)
+	W.filename = filename
+	W.natoms = int32(natoms)
+	var err error
+	if chem.CompressionFromName(filename) != chem.NoCompression {
+		dir, base := filepath.Split(filename)
+		W.dcd, err = os.CreateTemp(dir, base+".*.tmp")
+	} else {
+		W.dcd, err = os.Create(filename)
+	}
+	if err != nil {
+		return nil, Error{err.Error(), filename, []string{"os.Create", "NewWriter"}, true}
+	}
+	W.buf = bufio.NewWriter(W.dcd)
+	W.endian = binary.LittleEndian
+	W.dt = 1
+	W.writable = true
+	return W, nil
+}
+
+//SetEndian sets the byte order of the file. It has no effect after the first frame is written.
+func (W *DCDWObj) SetEndian(endian binary.ByteOrder) {
+	W.endian = endian
+}
+
+//SetTimeStep sets the time between frames, in ps. It has no effect after the first frame is written.
+func (W *DCDWObj) SetTimeStep(dt float64) {
+	W.dt = dt
+}
+
+//Len returns the number of atoms per frame in the trajectory.
+func (W *DCDWObj) Len() int {
+	return int(W.natoms)
+}
+
+//writeHeader writes the CHARMM-style header. The number of frames is written as 0, and
+//corrected by Close.
+func (W *DCDWObj) writeHeader() error {
+	var icntrl [20]int32
+	icntrl[1] = 1 //first step
+	icntrl[2] = 1 //steps between frames
+	if W.extrablock {
+		icntrl[10] = 1
+	}
+	icntrl[19] = 24 //we pretend to be CHARMM 24, as VMD does.
+	delta := float32(W.dt / akmaPs)
+	title := make([]byte, 2*mAXTITLE)
+	for i := range title {
+		title[i] = ' '
+	}
+	copy(title, "REMARKS FILENAME="+W.filename)
+	copy(title[mAXTITLE:], "REMARKS CREATED BY GOCHEM")
+	data := []interface{}{int32(84), []byte("CORD"), icntrl[:9], delta, icntrl[10:], int32(84),
+		int32(164), int32(2), title, int32(164), int32(4), W.natoms, int32(4)}
+	for _, v := range data {
+		if err := binary.Write(W.buf, W.endian, v); err != nil {
+			return Error{err.Error(), W.filename, []string{"binary.Write", "writeHeader"}, true}
+		}
+	}
+	return nil
+}
+
+//WNext writes the coordinates in coords (in A) as the next frame of the trajectory.
+//If a box is given with the first frame, the file will have unit cell information
+//for all frames (a zero cell is written for the following frames without a box). Boxes
+//given after the first frame are ignored if the first frame had none.
+func (W *DCDWObj) WNext(coords *v3.Matrix, box ...*chem.Box) error {
+	if !W.writable {
+		return Error{TrajUnIni, W.filename, []string{"WNext"}, true}
+	}
+	if coords.NVecs() != int(W.natoms) {
+		return Error{fmt.Sprintf("Frame with %d atoms for a trajectory with %d", coords.NVecs(), W.natoms), W.filename, []string{"WNext"}, true}
+	}
+	var b *chem.Box
+	if len(box) > 0 {
+		b = box[0]
+	}
+	if W.nset == 0 {
+		W.extrablock = b != nil
+		if err := W.writeHeader(); err != nil {
+			return errDecorate(err, "WNext")
+		}
+	}
+	wrapbinerr := func(err error) error {
+		return Error{err.Error(), W.filename, []string{"binary.Write", "WNext"}, true}
+	}
+	if W.extrablock {
+		cell := make([]float64, 6)
+		if b != nil {
+			//The order is A, gamma, B, beta, alpha, C. We write the cosines of the angles, like NAMD.
+			a, bl, c, alpha, beta, gamma := b.Params()
+			cell = []float64{a, math.Cos(gamma * math.Pi / 180), bl, math.Cos(beta * math.Pi / 180), math.Cos(alpha * math.Pi / 180), c}
+			for _, i := range []int{1, 3, 4} {
+				if math.Abs(cell[i]) < 1e-12 {
+					cell[i] = 0
+				}
+			}
+		}
+		for _, v := range []interface{}{int32(48), cell, int32(48)} {
+			if err := binary.Write(W.buf, W.endian, v); err != nil {
+				return wrapbinerr(err)
+			}
+		}
+	}
+	block := make([]float32, W.natoms)
+	blocksize := 4 * W.natoms
+	for j := 0; j < 3; j++ {
+		for i := range block {
+			block[i] = float32(coords.At(i, j))
+		}
+		for _, v := range []interface{}{blocksize, block, blocksize} {
+			if err := binary.Write(W.buf, W.endian, v); err != nil {
+				return wrapbinerr(err)
+			}
+		}
+	}
+	W.nset++
+	return nil
+}
+
+//Close writes the number of frames to the header and closes the file, compressing
+//it if needed. The DCDWObj can't be used after that.
+func (W *DCDWObj) Close() error {
+	if !W.writable {
+		return nil
+	}
+	W.writable = false
+	if W.nset == 0 {
+		if err := W.writeHeader(); err != nil {
+			W.dcd.Close()
+			return errDecorate(err, "Close")
+		}
+	}
+	if err := W.buf.Flush(); err != nil {
+		W.dcd.Close()
+		return Error{err.Error(), W.filename, []string{"bufio.Writer.Flush", "Close"}, true}
+	}
+	//The number of frames is at byte 8, and the number of steps at byte 20.
+	for _, v := range [][2]int32{{8, W.nset}, {20, W.nset}} {
+		b := make([]byte, 4)
+		W.endian.PutUint32(b, uint32(v[1]))
+		if _, err := W.dcd.WriteAt(b, int64(v[0])); err != nil {
+			W.dcd.Close()
+			return Error{err.Error(), W.filename, []string{"os.File.WriteAt", "Close"}, true}
+		}
+	}
+	if W.dcd.Name() != W.filename {
+		return W.compress()
+	}
+	if err := W.dcd.Close(); err != nil {
+		return Error{err.Error(), W.filename, []string{"os.File.Close", "Close"}, true}
+	}
+	return nil
+}
+
+//compress copies the temporary file written into the compressed file W.filename, and removes
+//the temporary file.
+func (W *DCDWObj) compress() error {
+	defer os.Remove(W.dcd.Name())
+	defer W.dcd.Close()
+	if _, err := W.dcd.Seek(0, 0); err != nil {
+		return Error{err.Error(), W.filename, []string{"os.File.Seek", "compress", "Close"}, true}
+	}
+	out, err := chem.CreateFile(W.filename)
+	if err != nil {
+		return Error{err.Error(), W.filename, []string{"chem.CreateFile", "compress", "Close"}, true}
+	}
+	if _, err := io.Copy(out, W.dcd); err != nil {
+		out.Close()
+		return Error{err.Error(), W.filename, []string{"io.Copy", "compress", "Close"}, true}
+	}
+	if err := out.Close(); err != nil {
+		return Error{err.Error(), W.filename, []string{"io.WriteCloser.Close", "compress", "Close"}, true}
+	}
+	return nil
+}
+
 //Errors
 
 //errDecorate is a helper function that asserts that the error is
 //implements chem.Error and decorates the error with the caller's name before returning it.
-//if used with a non-chem.Error error, it will cause a panic.
+//if used with a non-chem.Error error, it will cause a panic. A nil error is returned as it is.
 func errDecorate(err error, caller string) error {
+	if err == nil {
+		return nil
+	}
 	err2 := err.(chem.Error) //I know that is the type returned byt initRead
 	err2.Decorate(caller)
 	return err2
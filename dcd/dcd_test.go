@@ -28,7 +28,10 @@
 
 package dcd
 
+import "encoding/binary"
 import "fmt"
+import "io/ioutil"
+import "math"
 import "testing"
 import "github.com/rmera/gochem"
 import "github.com/rmera/gochem/v3"
@@ -59,6 +62,348 @@ func TestDCD(Te *testing.T) {
 	fmt.Println("Over! frames read:", i)
 }
 
+//TestDCDBox checks that the unit cell is read from the extra block of the frames.
+func TestDCDBox(Te *testing.T) {
+	traj, err := New("../test/test.dcd")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if err := traj.Next(nil); err != nil {
+		Te.Fatal(err)
+	}
+	box := traj.Box()
+	if box == nil {
+		Te.Fatal("No box read")
+	}
+	a, b, c, alpha, beta, gamma := box.Params()
+	fmt.Println("Box:", box)
+	if math.Abs(a-47.19) > 0.001 || math.Abs(b-47.19) > 0.001 || math.Abs(c-47.19) > 0.001 {
+		Te.Errorf("Wrong box lengths %f %f %f", a, b, c)
+	}
+	if alpha != 90 || beta != 90 || gamma != 90 {
+		Te.Errorf("Wrong box angles %f %f %f", alpha, beta, gamma)
+	}
+}
+
+//TestDCDWrite writes the frames of the test file to new files with both endianness, and
+//checks that they are read back correctly.
+func TestDCDWrite(Te *testing.T) {
+	traj, err := New("../test/test.dcd")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	var frames []*v3.Matrix
+	var boxes []*chem.Box
+	for {
+		coords := v3.Zeros(traj.Len())
+		if err := traj.Next(coords); err != nil {
+			if _, ok := err.(chem.LastFrameError); ok {
+				break
+			}
+			Te.Fatal(err)
+		}
+		frames = append(frames, coords)
+		boxes = append(boxes, traj.Box())
+	}
+	//The big-endian file is also gzip-compressed.
+	names := map[binary.ByteOrder]string{binary.LittleEndian: "../test/testW.dcd", binary.BigEndian: "../test/testW.dcd.gz"}
+	for _, endian := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		w, err := NewWriter(names[endian], traj.Len())
+		if err != nil {
+			Te.Fatal(err)
+		}
+		w.SetEndian(endian)
+		for i, frame := range frames {
+			if err := w.WNext(frame, boxes[i]); err != nil {
+				Te.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			Te.Fatal(err)
+		}
+		traj2, err := New(names[endian])
+		if err != nil {
+			Te.Fatal(err)
+		}
+		coords := v3.Zeros(traj2.Len())
+		for i, frame := range frames {
+			if err := traj2.Next(coords); err != nil {
+				Te.Fatal(err)
+			}
+			for j := 0; j < coords.NVecs(); j++ {
+				for k := 0; k < 3; k++ {
+					if coords.At(j, k) != frame.At(j, k) {
+						Te.Fatalf("%v: Frame %d atom %d differs: %v %v", endian, i, j, coords.VecView(j), frame.VecView(j))
+					}
+				}
+			}
+			if traj2.Box() == nil || traj2.Box().String() != boxes[i].String() {
+				Te.Errorf("%v: Frame %d box differs: %v %v", endian, i, traj2.Box(), boxes[i])
+			}
+		}
+		if err := traj2.Next(nil); err == nil {
+			Te.Errorf("%v: The written trajectory has extra frames", endian)
+		}
+	}
+}
+
+//TestDCDMeta checks that the time and step of each frame are obtained from the header.
+func TestDCDMeta(Te *testing.T) {
+	var traj chem.TrajMeta
+	traj, err := New("../test/test.dcd")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if traj.NFrames() != 1000 {
+		Te.Errorf("NFrames is %d, not 1000", traj.NFrames())
+	}
+	coords := v3.Zeros(traj.Len())
+	w, err := NewWriter("../test/testMeta.dcd", traj.Len())
+	if err != nil {
+		Te.Fatal(err)
+	}
+	w.SetTimeStep(2)
+	for i := 0; i < 5; i++ {
+		if err := traj.Next(coords); err != nil {
+			Te.Fatal(err)
+		}
+		if traj.Step() != i+1 {
+			Te.Errorf("Step %d for frame %d", traj.Step(), i)
+		}
+		if err := w.WNext(coords); err != nil {
+			Te.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		Te.Fatal(err)
+	}
+	traj2, err := New("../test/testMeta.dcd")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if math.Abs(traj2.TimeStep()-2) > 1e-5 {
+		Te.Errorf("Time step is %f, not 2", traj2.TimeStep())
+	}
+	for i := 0; traj2.Next(nil) == nil; i++ {
+		if math.Abs(traj2.Time()-float64(2*(i+1))) > 1e-4 || traj2.Step() != i+1 {
+			Te.Errorf("Frame %d has time %f and step %d", i, traj2.Time(), traj2.Step())
+		}
+	}
+}
+
+//TestDCDFixed reads crafted files with fixed atoms and with 4 dimensions. The atom i has the coordinates
+//(i+0.5f, 2i+0.25f, -i-f) in the frame f, except for the fixed atoms, which keep the coordinates of the first frame.
+func TestDCDFixed(Te *testing.T) {
+	data, err := ioutil.ReadFile("../test/fixed.dcd")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	gz, err := chem.CreateFile("../test/testFixed.dcd.gz")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		Te.Fatal(err)
+	}
+	check := func(name string, coords *v3.Matrix, f int, fixed []int) {
+		for i := 0; i < coords.NVecs(); i++ {
+			g := f
+			for _, v := range fixed {
+				if v == i {
+					g = 0
+				}
+			}
+			expected := []float64{float64(i) + 0.5*float64(g), float64(2*i) + 0.25*float64(g), float64(-i - g)}
+			for k, v := range expected {
+				if coords.At(i, k) != v {
+					Te.Errorf("%s: Frame %d atom %d: %v, expected %v", name, f, i, coords.VecView(i), expected)
+					break
+				}
+			}
+		}
+	}
+	for _, t := range []struct {
+		name   string
+		fixed  []int
+		frames int
+	}{{"../test/fixed.dcd", []int{1, 3}, 4}, {"../test/fourdim.dcd", nil, 3}} {
+		traj, err := New(t.name)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if traj.NFrames() != t.frames {
+			Te.Errorf("%s: NFrames is %d, not %d", t.name, traj.NFrames(), t.frames)
+		}
+		coords := v3.Zeros(traj.Len())
+		f := 0
+		for ; traj.Next(coords) == nil; f++ {
+			check(t.name, coords, f, t.fixed)
+		}
+		if f != t.frames {
+			Te.Errorf("%s: %d frames read, not %d", t.name, f, t.frames)
+		}
+		traj, err = New(t.name)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if err := traj.ReadFrame(2, coords); err != nil {
+			Te.Fatal(err)
+		}
+		check(t.name, coords, 2, t.fixed)
+	}
+	//The first frame has to be read to skip frames in a compressed file with fixed atoms.
+	traj, err := New("../test/testFixed.dcd.gz")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if err := traj.SetRange(1, -1, 2); err != nil {
+		Te.Fatal(err)
+	}
+	coords := v3.Zeros(traj.Len())
+	f := 1
+	for ; traj.Next(coords) == nil; f += 2 {
+		check("compressed", coords, f, []int{1, 3})
+	}
+	if f != 5 {
+		Te.Errorf("Frames up to %d read from the compressed file, instead of 3", f-2)
+	}
+}
+
+//TestDCDSeek checks that random access and ranged reading give the same frames as
+//reading the trajectory sequentially, for a plain and a compressed file.
+func TestDCDSeek(Te *testing.T) {
+	var traj chem.SeekTraj
+	traj, err := New("../test/test.dcd")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	var frames []*v3.Matrix
+	for {
+		coords := v3.Zeros(traj.Len())
+		if err := traj.Next(coords); err != nil {
+			if _, ok := err.(chem.LastFrameError); ok {
+				break
+			}
+			Te.Fatal(err)
+		}
+		frames = append(frames, coords)
+	}
+	if traj.NFrames() != len(frames) || len(frames) != 1000 {
+		Te.Fatalf("NFrames gives %d frames, %d read", traj.NFrames(), len(frames))
+	}
+	same := func(name string, i int, coords *v3.Matrix) {
+		for j := 0; j < coords.NVecs(); j++ {
+			for k := 0; k < 3; k++ {
+				if coords.At(j, k) != frames[i].At(j, k) {
+					Te.Fatalf("%s: Frame %d atom %d differs: %v %v", name, i, j, coords.VecView(j), frames[i].VecView(j))
+				}
+			}
+		}
+	}
+	coords := v3.Zeros(traj.Len())
+	for _, i := range []int{500, 3, 999, 0} {
+		if err := traj.ReadFrame(i, coords); err != nil {
+			Te.Fatal(err)
+		}
+		same("ReadFrame", i, coords)
+	}
+	if err := traj.ReadFrame(1000, coords); err == nil {
+		Te.Error("Frame out of range read")
+	}
+	w, err := NewWriter("../test/testSeek.dcd.gz", traj.Len())
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for _, frame := range frames {
+		if err := w.WNext(frame); err != nil {
+			Te.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		Te.Fatal(err)
+	}
+	traj2, err := New("../test/testSeek.dcd.gz")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if err := traj2.Seek(3); err == nil {
+		Te.Error("Seek worked on a compressed file")
+	}
+	for _, t := range []chem.SeekTraj{traj, traj2} {
+		if err := t.SetRange(10, 100, 7); err != nil {
+			Te.Fatal(err)
+		}
+		read := 0
+		for i := 10; ; i += 7 {
+			if err := t.Next(coords); err != nil {
+				if _, ok := err.(chem.LastFrameError); ok {
+					break
+				}
+				Te.Fatal(err)
+			}
+			same("SetRange", i, coords)
+			read++
+		}
+		if read != 13 {
+			Te.Errorf("%d frames read from range 10:100:7, instead of 13", read)
+		}
+	}
+}
+
+//TestDCDIndexes checks that reading a subset of the atoms gives the same coordinates
+//as reading all of them, with Next and NextConc.
+func TestDCDIndexes(Te *testing.T) {
+	indexes := []int{5, 2, 69, 0}
+	traj, err := New("../test/test.dcd")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	sub, err := New("../test/test.dcd", indexes)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if sub.Len() != len(indexes) {
+		Te.Fatalf("Len is %d for %d indexes", sub.Len(), len(indexes))
+	}
+	full := v3.Zeros(traj.Len())
+	frames := []*v3.Matrix{v3.Zeros(sub.Len()), nil, v3.Zeros(sub.Len())}
+	for i := 0; i < 2; i++ {
+		if err := sub.Next(frames[0]); err != nil {
+			Te.Fatal(err)
+		}
+		if err := traj.Next(full); err != nil {
+			Te.Fatal(err)
+		}
+		for j, v := range indexes {
+			if frames[0].VecView(j).String() != full.VecView(v).String() {
+				Te.Errorf("Frame %d atom %d differs: %v %v", i, v, frames[0].VecView(j), full.VecView(v))
+			}
+		}
+	}
+	chans, err := sub.NextConc(frames)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for i, c := range chans {
+		if err := traj.Next(full); err != nil {
+			Te.Fatal(err)
+		}
+		if c == nil {
+			continue
+		}
+		coords := <-c
+		for j, v := range indexes {
+			if coords.VecView(j).String() != full.VecView(v).String() {
+				Te.Errorf("NextConc frame %d atom %d differs: %v %v", i, v, coords.VecView(j), full.VecView(v))
+			}
+		}
+	}
+	if _, err := New("../test/test.dcd", []int{-1}); err == nil {
+		Te.Error("Negative index accepted")
+	}
+}
+
 func TestFrameDCDConc(Te *testing.T) {
 	traj, err := New("../test/test.dcd")
 	if err != nil {
@@ -32,9 +32,16 @@ indicators.
 	**goChem Capabilities**
 
 
-    Reads/writes PDB and XYZ files.
+    Reads/writes PDB, mmCIF, XYZ (including extended XYZ), GRO, MOL2, SDF/MOL and DFTB+ GEN
+	files, which can be compressed with gzip, bzip2 or xz.
 
-    Reads XTC and DCD trajectory files, both sequentially and concurrently.
+    Reads CHARMM/NAMD PSF (standard, EXT and XPLOR), AMBER prmtop and GROMACS top/itp
+	topologies, with charges, masses, bonds, angles and dihedrals.
+
+    Reads XTC, DCD, TRR (including velocities and forces), AMBER NetCDF, multi-XYZ and
+	multi-model PDB trajectory files, both sequentially and concurrently, and DCD and NetCDF
+	files with random access.
+	Writes XTC and DCD files.
 
     Superimposes molecules (especially adequate for non-proteins since doesn't
 	use sequence information). The user specify what atoms to use for the
@@ -69,7 +76,7 @@ indicators.
 	aminoacidic chain or a subset of it.
 
     Generates input for, run and recover results from QM calculations with Turbomole,
-	Orca and MOPAC (which must be obtained independently from their respective
+	Orca, Gaussian, Psi4, DFTB+ and MOPAC (which must be obtained independently from their respective
 	distributors). Interfacing gochem to other QM codes is fairly simple.
 
     goChem data can be JSON encoded and transfered in such a way that PyMOL
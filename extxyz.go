@@ -0,0 +1,440 @@
+/*
+ * extxyz.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/gochem/v3"
+)
+
+//FrameInfo contains the data in the comment line of an XYZ frame and the per-atom
+//properties in the extra columns of the frame, following the extended XYZ convention
+//(used, for instance, by ASE), in which the comment line contains key=value pairs.
+type FrameInfo struct {
+	Comment    string            //The whole comment line.
+	Energy     float64           //The energy of the frame, if HasEnergy is true.
+	HasEnergy  bool              //Whether the energy of the frame is known.
+	Box        *Box              //The box given by the Lattice key, nil if there is none.
+	Keys       map[string]string //Other key=value pairs in the comment line. Keys with no value have the value "T".
+	Properties []*AtomProperty   //Per-atom properties other than the symbols and coordinates.
+}
+
+//AtomProperty is a per-atom property in an extended XYZ frame, with Cols columns for each atom.
+//Properties of type 'R' (real), 'I' (integer) and 'L' (logical, 1 for true and 0 for false) are stored in Values,
+//those of type 'S' (string) in Strings. The data for each atom is stored contiguously.
+type AtomProperty struct {
+	Name    string
+	Type    byte
+	Cols    int
+	Values  []float64
+	Strings []string
+}
+
+//Property returns the per-atom property with the given name, or nil if the frame doesn't have it.
+func (F *FrameInfo) Property(name string) *AtomProperty {
+	for _, p := range F.Properties {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+//Forces returns the "forces" property of the frame as a matrix, or nil if the frame doesn't have
+//real forces with 3 columns.
+func (F *FrameInfo) Forces() *v3.Matrix {
+	p := F.Property("forces")
+	if p == nil || p.Type != 'R' || p.Cols != 3 {
+		return nil
+	}
+	f, err := v3.NewMatrix(append([]float64(nil), p.Values...))
+	if err != nil {
+		return nil
+	}
+	return f
+}
+
+//delAtom deletes the data for atom i from all the per-atom properties of the frame.
+func (F *FrameInfo) delAtom(i int) {
+	for _, p := range F.Properties {
+		if p.Values != nil {
+			p.Values = append(p.Values[:i*p.Cols], p.Values[(i+1)*p.Cols:]...)
+		}
+		if p.Strings != nil {
+			p.Strings = append(p.Strings[:i*p.Cols], p.Strings[(i+1)*p.Cols:]...)
+		}
+	}
+}
+
+//swapAtoms swaps the data for atoms i and j in all the per-atom properties of the frame.
+func (F *FrameInfo) swapAtoms(i, j int) {
+	for _, p := range F.Properties {
+		for c := 0; c < p.Cols; c++ {
+			if p.Values != nil {
+				p.Values[i*p.Cols+c], p.Values[j*p.Cols+c] = p.Values[j*p.Cols+c], p.Values[i*p.Cols+c]
+			}
+			if p.Strings != nil {
+				p.Strings[i*p.Cols+c], p.Strings[j*p.Cols+c] = p.Strings[j*p.Cols+c], p.Strings[i*p.Cols+c]
+			}
+		}
+	}
+}
+
+//Copy returns a copy of the frame information.
+func (F *FrameInfo) Copy() *FrameInfo {
+	r := *F
+	if F.Box != nil {
+		r.Box = F.Box.Copy()
+	}
+	r.Keys = make(map[string]string, len(F.Keys))
+	for k, v := range F.Keys {
+		r.Keys[k] = v
+	}
+	r.Properties = make([]*AtomProperty, 0, len(F.Properties))
+	for _, p := range F.Properties {
+		n := *p
+		n.Values = append([]float64(nil), p.Values...)
+		n.Strings = append([]string(nil), p.Strings...)
+		r.Properties = append(r.Properties, &n)
+	}
+	return &r
+}
+
+//xyzColumn is a group of columns in the atom lines of an extended XYZ frame.
+type xyzColumn struct {
+	name string
+	kind byte
+	cols int
+}
+
+//xyzDefaultColumns is the layout of the atom lines of a plain XYZ frame.
+var xyzDefaultColumns = []xyzColumn{{"species", 'S', 1}, {"pos", 'R', 3}}
+
+//splitXYZComment splits an extended XYZ comment line into key=value pairs. Values can
+//be quoted with double quotes, in which case \" and \\ stand for a double quote and a backslash.
+//It returns nil if the line is not in the key=value format.
+func splitXYZComment(line string) [][2]string {
+	var pairs [][2]string
+	hasequal := false
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		end := strings.IndexAny(line, " \t=")
+		if end < 0 {
+			end = len(line)
+		}
+		key := line[:end]
+		line = line[end:]
+		trimmed := strings.TrimLeft(line, " \t")
+		if !strings.HasPrefix(trimmed, "=") {
+			pairs = append(pairs, [2]string{key, "T"})
+			continue
+		}
+		hasequal = true
+		line = strings.TrimLeft(trimmed[1:], " \t")
+		var value string
+		if strings.HasPrefix(line, "\"") {
+			var q int
+			value, q = xyzUnquote(line)
+			if q < 0 {
+				return nil
+			}
+			line = line[q+1:]
+		} else {
+			e := strings.IndexAny(line, " \t")
+			if e < 0 {
+				e = len(line)
+			}
+			value = line[:e]
+			line = line[e:]
+		}
+		if key == "" {
+			return nil
+		}
+		pairs = append(pairs, [2]string{key, value})
+	}
+	if !hasequal {
+		return nil
+	}
+	return pairs
+}
+
+//xyzUnquote returns the value quoted at the beginning of line, which starts with a double quote,
+//and the position of the closing quote, or -1 if there is none.
+func xyzUnquote(line string) (string, int) {
+	value := make([]byte, 0, len(line))
+	for i := 1; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			return string(value), i
+		case '\\':
+			if i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\') {
+				i++
+			}
+		}
+		value = append(value, line[i])
+	}
+	return "", -1
+}
+
+//xyzQuote quotes value with double quotes if it is empty or contains spaces, equal signs or quotes,
+//escaping the quotes and backslashes in it.
+func xyzQuote(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t=\"") {
+		return value
+	}
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	return "\"" + strings.Replace(value, "\"", "\\\"", -1) + "\""
+}
+
+//parseXYZComment parses the comment line of an XYZ frame and returns the frame information
+//and the layout of the atom lines. If the comment line is not in the extended XYZ format, or
+//some of its keys can't be parsed, the line is taken as a plain comment, and the energy is
+//searched for as written by ORCA ("... E -154.12") and xtb ("energy: -5.07 ...").
+func parseXYZComment(line string) (*FrameInfo, []xyzColumn) {
+	comment := strings.TrimRight(line, "\r\n")
+	if pairs := splitXYZComment(comment); pairs != nil {
+		if info, layout, err := parseXYZPairs(comment, pairs); err == nil {
+			return info, layout
+		}
+	}
+	info := &FrameInfo{Comment: comment, Keys: make(map[string]string)}
+	fields := strings.Fields(comment)
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == "E" || strings.ToLower(fields[i]) == "energy:" {
+			if e, err := strconv.ParseFloat(fields[i+1], 64); err == nil {
+				info.Energy, info.HasEnergy = e, true
+				break
+			}
+		}
+	}
+	return info, xyzDefaultColumns
+}
+
+//parseXYZPairs returns the frame information and the layout of the atom lines given by the
+//key=value pairs of an extended XYZ comment line.
+func parseXYZPairs(comment string, pairs [][2]string) (*FrameInfo, []xyzColumn, error) {
+	info := &FrameInfo{Comment: comment, Keys: make(map[string]string)}
+	layout := xyzDefaultColumns
+	for _, p := range pairs {
+		var err error
+		switch strings.ToLower(p[0]) {
+		case "energy":
+			//Plain XYZ comments often have things like "Energy =", so a wrong value is not an error.
+			var e error
+			info.Energy, e = strconv.ParseFloat(p[1], 64)
+			info.HasEnergy = e == nil
+			if !info.HasEnergy {
+				info.Keys[p[0]] = p[1]
+			}
+		case "lattice":
+			info.Box, err = xyzLattice(p[1])
+		case "properties":
+			layout, err = xyzProperties(p[1])
+		default:
+			info.Keys[p[0]] = p[1]
+		}
+		if err != nil {
+			return nil, nil, CError{fmt.Sprintf("Wrong %s in extended XYZ comment: %s", p[0], err.Error()), []string{"parseXYZPairs"}}
+		}
+	}
+	return info, layout, nil
+}
+
+//xyzLattice returns the box given by the value of a Lattice key.
+func xyzLattice(value string) (*Box, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 9 {
+		return nil, fmt.Errorf("9 values needed")
+	}
+	vals := make([]float64, 9)
+	for i, f := range fields {
+		var err error
+		vals[i], err = strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	vecs, err := v3.NewMatrix(vals)
+	if err != nil {
+		return nil, err
+	}
+	return NewBox(vecs)
+}
+
+//xyzProperties returns the layout of the atom lines given by the value of a Properties key, for
+//instance species:S:1:pos:R:3:forces:R:3. The layout must include the species and pos columns.
+func xyzProperties(value string) ([]xyzColumn, error) {
+	fields := strings.Split(value, ":")
+	if len(fields)%3 != 0 {
+		return nil, fmt.Errorf("the number of fields is not a multiple of 3")
+	}
+	layout := make([]xyzColumn, 0, len(fields)/3)
+	var species, pos bool
+	for i := 0; i < len(fields); i += 3 {
+		t := strings.ToUpper(fields[i+1])
+		n, err := strconv.Atoi(fields[i+2])
+		if err != nil || n < 1 || len(t) != 1 || !strings.Contains("RISL", t) {
+			return nil, fmt.Errorf("wrong property %s", strings.Join(fields[i:i+3], ":"))
+		}
+		switch fields[i] {
+		case "species":
+			species = t == "S" && n == 1
+		case "pos":
+			pos = t == "R" && n == 3
+		}
+		layout = append(layout, xyzColumn{fields[i], t[0], n})
+	}
+	if !species || !pos {
+		return nil, fmt.Errorf("species:S:1 and pos:R:3 are needed")
+	}
+	return layout, nil
+}
+
+//xyzNCols returns the number of columns in the atom lines with the given layout.
+func xyzNCols(layout []xyzColumn) int {
+	n := 0
+	for _, c := range layout {
+		n += c.cols
+	}
+	return n
+}
+
+//xyzParseAtomLine parses the fields of an atom line with the given layout, and puts the symbol in symbol,
+//the coordinates in coords, and the rest of the properties (in the same order as in layout) in props.
+func xyzParseAtomLine(fields []string, layout []xyzColumn, symbol *string, coords []float64, props []*AtomProperty) error {
+	col := 0
+	p := 0
+	for _, c := range layout {
+		vals := fields[col : col+c.cols]
+		col += c.cols
+		switch c.name {
+		case "species":
+			*symbol = vals[0]
+			continue
+		case "pos":
+			for i, v := range vals {
+				var err error
+				coords[i], err = strconv.ParseFloat(v, 64)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		prop := props[p]
+		p++
+		for _, v := range vals {
+			switch c.kind {
+			case 'S':
+				prop.Strings = append(prop.Strings, v)
+			case 'L':
+				b := 0.0
+				if strings.HasPrefix(strings.ToUpper(v), "T") {
+					b = 1
+				}
+				prop.Values = append(prop.Values, b)
+			default:
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return err
+				}
+				prop.Values = append(prop.Values, f)
+			}
+		}
+	}
+	return nil
+}
+
+//xyzCommentLine returns the extended XYZ comment line for info. If info has no box, energy, keys or
+//properties, the Comment is returned instead.
+func xyzCommentLine(info *FrameInfo) string {
+	if info.Box == nil && !info.HasEnergy && len(info.Keys) == 0 && len(info.Properties) == 0 {
+		return strings.Replace(info.Comment, "\n", " ", -1)
+	}
+	items := make([]string, 0, len(info.Keys)+3)
+	if info.Box != nil {
+		v := info.Box.vecs
+		items = append(items, fmt.Sprintf("Lattice=\"%.8f %.8f %.8f %.8f %.8f %.8f %.8f %.8f %.8f\"", v[0][0], v[0][1], v[0][2],
+			v[1][0], v[1][1], v[1][2], v[2][0], v[2][1], v[2][2]))
+	}
+	props := "Properties=species:S:1:pos:R:3"
+	for _, p := range info.Properties {
+		props = fmt.Sprintf("%s:%s:%c:%d", props, p.Name, p.Type, p.Cols)
+	}
+	items = append(items, props)
+	if info.HasEnergy {
+		items = append(items, "energy="+strconv.FormatFloat(info.Energy, 'f', -1, 64))
+	}
+	keys := make([]string, 0, len(info.Keys))
+	for k := range info.Keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		items = append(items, k+"="+xyzQuote(info.Keys[k]))
+	}
+	return strings.Join(items, " ")
+}
+
+//xyzPropertyColumns returns the extra columns of the atom i for the properties in info.
+func xyzPropertyColumns(info *FrameInfo, i int) (string, error) {
+	var cols []string
+	for _, p := range info.Properties {
+		for j := i * p.Cols; j < (i+1)*p.Cols; j++ {
+			if p.Type == 'S' {
+				if j >= len(p.Strings) {
+					return "", CError{"Not enough values for property " + p.Name, []string{"xyzPropertyColumns"}}
+				}
+				cols = append(cols, p.Strings[j])
+				continue
+			}
+			if j >= len(p.Values) {
+				return "", CError{"Not enough values for property " + p.Name, []string{"xyzPropertyColumns"}}
+			}
+			switch p.Type {
+			case 'L':
+				l := "F"
+				if p.Values[j] != 0 {
+					l = "T"
+				}
+				cols = append(cols, l)
+			case 'I':
+				cols = append(cols, fmt.Sprintf("%d", int(p.Values[j])))
+			default:
+				cols = append(cols, fmt.Sprintf("%12.6f", p.Values[j]))
+			}
+		}
+	}
+	if len(cols) == 0 {
+		return "", nil
+	}
+	return " " + strings.Join(cols, " "), nil
+}
@@ -30,9 +30,10 @@ package chem
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
-	"os"
+	"math"
 	"strconv"
 	"strings"
 
@@ -66,6 +67,17 @@ var symbolMass = map[string]float64{
 	"F":  18.998,
 }
 
+//The element symbols, in order of atomic number, up to Rn.
+var numberSymbol = []string{
+	"H", "He", "Li", "Be", "B", "C", "N", "O", "F", "Ne", "Na", "Mg", "Al", "Si",
+	"P", "S", "Cl", "Ar", "K", "Ca", "Sc", "Ti", "V", "Cr", "Mn", "Fe", "Co",
+	"Ni", "Cu", "Zn", "Ga", "Ge", "As", "Se", "Br", "Kr", "Rb", "Sr", "Y", "Zr",
+	"Nb", "Mo", "Tc", "Ru", "Rh", "Pd", "Ag", "Cd", "In", "Sn", "Sb", "Te", "I",
+	"Xe", "Cs", "Ba", "La", "Ce", "Pr", "Nd", "Pm", "Sm", "Eu", "Gd", "Tb", "Dy",
+	"Ho", "Er", "Tm", "Yb", "Lu", "Hf", "Ta", "W", "Re", "Os", "Ir", "Pt", "Au",
+	"Hg", "Tl", "Pb", "Bi", "Po", "At", "Rn",
+}
+
 //A map between 3-letters name for aminoacidic residues to the corresponding 1-letter names.
 var three2OneLetter = map[string]byte{
 	"SER": 'S',
@@ -139,6 +151,60 @@ func symbolFromName(name string) (string, error) {
 	return symbol, nil
 }
 
+//symbolFromMass guesses a chemical element symbol from an atomic mass, by looking for the
+//element in symbolMass with the closest mass. It returns an error if no mass is within 0.5 of the
+//given one, as with dummy atoms, or with hydrogens whose mass has been repartitioned.
+func symbolFromMass(mass float64) (string, error) {
+	symbol := ""
+	best := 0.5
+	for k, v := range symbolMass {
+		if d := math.Abs(v - mass); d < best {
+			symbol = k
+			best = d
+		}
+	}
+	if symbol == "" {
+		return symbol, CError{fmt.Sprintf("Couldn't guess symbol from mass %5.3f", mass), []string{"symbolFromMass"}}
+	}
+	return symbol, nil
+}
+
+//symbolFromNameMass guesses a chemical element symbol from an atom name and mass. The name is tried first,
+//and the mass is used to confirm it. If they disagree, the name is trusted for hydrogens, and for heavy atoms
+//lighter than expected by the mass of 1 to 3 hydrogens (2.016 each), as happens with hydrogen mass
+//repartitioning. Otherwise, as with ions named, for instance, SOD or CLA, the symbol is taken from the mass.
+func symbolFromNameMass(name string, mass float64) (string, error) {
+	var byname string
+	err := CError{"Couldn't guess symbol from name", []string{"symbolFromNameMass"}}
+	if name != "" {
+		byname, _ = symbolFromName(name)
+	}
+	bymass, _ := symbolFromMass(mass)
+	switch {
+	case byname == "" && bymass == "":
+		return "", err
+	case byname == "" || byname == bymass:
+		return bymass, nil
+	case bymass == "" || byname == "H":
+		return byname, nil
+	}
+	diff := symbolMass[byname] - mass
+	for k := 1.0; k <= 3; k++ {
+		if math.Abs(diff-k*2.016) < 0.1 {
+			return byname, nil
+		}
+	}
+	return bymass, nil
+}
+
+//symbolFromNumber returns the chemical element symbol for the atomic number z.
+func symbolFromNumber(z int) (string, error) {
+	if z < 1 || z > len(numberSymbol) {
+		return "", CError{fmt.Sprintf("Couldn't get a symbol for atomic number %d", z), []string{"symbolFromNumber"}}
+	}
+	return numberSymbol[z-1], nil
+}
+
 //Parses a valid ATOM or HETATM line of a PDB file, returns an Atom
 // object with the info except for the coordinates and b-factors, which  are returned
 // separately as an array of 3 float64 and a float64, respectively
@@ -231,10 +297,10 @@ func PDBRead(pdb io.Reader, read_additional bool) (*Molecule, error) {
 // the coordinates array will be of lenght 1. It also returns an error which is not
 // really well set up right now.
 func PDBFileRead(pdbname string, read_additional bool) (*Molecule, error) {
-	pdbfile, err := os.Open(pdbname)
+	pdbfile, err := OpenFile(pdbname)
 	if err != nil {
 		//fmt.Println("Unable to open file!!")
-		return nil, err
+		return nil, errDecorate(err, "PDBFileRead")
 	}
 	defer pdbfile.Close()
 	pdb := bufio.NewReader(pdbfile)
@@ -254,6 +320,7 @@ func pdbBufIORead(pdb *bufio.Reader, read_additional bool) (*Molecule, error) {
 	bfactors := make([][]float64, 1, 1)
 	bfactors[0] = make([]float64, 0)
 	first_model := true //are we reading the first model? if not we only save coordinates
+	var boxes []*Box    //the CRYST1 boxes read, if any.
 	contlines := 1      //count the lines read to better report errors
 	for {
 		line, err := pdb.ReadString('\n')
@@ -291,6 +358,14 @@ func pdbBufIORead(pdb *bufio.Reader, read_additional bool) (*Molecule, error) {
 			//we add the coords to the latest frame of coordinaates
 			coords[len(coords)-1] = append(coords[len(coords)-1], c[0], c[1], c[2])
 			bfactors[len(bfactors)-1] = append(bfactors[len(bfactors)-1], bfactemp)
+		} else if strings.HasPrefix(line, "CRYST1") {
+			box, err := readCryst1(line)
+			if err != nil {
+				return nil, errDecorate(err, "pdbBufIORead")
+			}
+			if box != nil {
+				boxes = append(boxes, box)
+			}
 		} else if strings.HasPrefix(line, "MODEL") {
 			modelnumber++        //,_=strconv.Atoi(strings.TrimSpace(line[6:]))
 			if modelnumber > 1 { //will be one for the first model, 2 for the second.
@@ -317,7 +392,54 @@ func pdbBufIORead(pdb *bufio.Reader, read_additional bool) (*Molecule, error) {
 		return nil, errDecorate(err, "pdbBufIORead")
 	}
 	returned, err := NewMolecule(mcoords, top, bfactors)
-	return returned, errDecorate(err, "pdbBufIORead")
+	if err != nil {
+		return nil, errDecorate(err, "pdbBufIORead")
+	}
+	//We either have one box per model, or we just keep the first one for all models.
+	if len(boxes) == frames || len(boxes) == 1 {
+		returned.Boxes = boxes
+	} else if len(boxes) > 1 {
+		returned.Boxes = boxes[:1]
+	}
+	return returned, nil
+}
+
+//readCryst1 reads a periodic box from a PDB CRYST1 line. It returns nil and no error
+//for the 1 A unit cube that the PDB format uses for non-crystallographic structures.
+func readCryst1(line string) (*Box, error) {
+	var fields []string
+	if len(line) >= 54 {
+		for _, v := range [][2]int{{6, 15}, {15, 24}, {24, 33}, {33, 40}, {40, 47}, {47, 54}} {
+			fields = append(fields, strings.TrimSpace(line[v[0]:v[1]]))
+		}
+	} else {
+		fields = strings.Fields(line)[1:]
+	}
+	if len(fields) < 6 {
+		return nil, CError{"goChem: Malformed CRYST1 line", []string{"readCryst1"}}
+	}
+	var p [6]float64
+	var err error
+	for i := range p {
+		p[i], err = strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, CError{err.Error(), []string{"strconv.ParseFloat", "readCryst1"}}
+		}
+	}
+	if p[0] == 1 && p[1] == 1 && p[2] == 1 {
+		return nil, nil
+	}
+	box, err := NewBoxFromParams(p[0], p[1], p[2], p[3], p[4], p[5])
+	if err != nil {
+		return nil, errDecorate(err, "readCryst1")
+	}
+	return box, nil
+}
+
+//cryst1Line returns a PDB CRYST1 line for box. The space group is always P 1.
+func cryst1Line(box *Box) string {
+	a, b, c, alpha, beta, gamma := box.Params()
+	return fmt.Sprintf("CRYST1%9.3f%9.3f%9.3f%7.2f%7.2f%7.2f P 1           1\n", a, b, c, alpha, beta, gamma)
 }
 
 //End PDB_read family
@@ -366,24 +488,29 @@ func writePDBLine(atom *Atom, coord *v3.Matrix, bfact float64, chainprev string)
 }
 
 //PDBFileWrite writes a PDB for the molecule mol and the coordinates Coords.
-func PDBFileWrite(pdbname string, coords *v3.Matrix, mol Atomer, Bfactors []float64) error {
-	out, err := os.Create(pdbname)
+//If a box is given, it is written as a CRYST1 record.
+func PDBFileWrite(pdbname string, coords *v3.Matrix, mol Atomer, Bfactors []float64, box ...*Box) error {
+	out, err := CreateFile(pdbname)
 	if err != nil {
-		return CError{err.Error(), []string{"os.Create", "PDBFileWrite"}}
+		return errDecorate(err, "PDBFileWrite")
 	}
-	defer out.Close()
 	fmt.Fprintf(out, "REMARK WRITTEN WITH GOCHEM :-) \n")
-	err = PDBWrite(out, coords, mol, Bfactors)
+	err = PDBWrite(out, coords, mol, Bfactors, box...)
 	if err != nil {
+		out.Close()
 		return errDecorate(err, "PDBFileWrite")
 	}
-	return nil
+	return errDecorate(out.Close(), "PDBFileWrite")
 }
 
 //PDBWrite writes a PDB formatted sequence of bytes to an io.Writer for a given reference, coordinate set and bfactor set, which must match each other
-//returns error or nil.
-func PDBWrite(out io.Writer, coords *v3.Matrix, mol Atomer, bfact []float64) error {
-	err := pdbWrite(out, coords, mol, bfact)
+//If a box is given, it is written as a CRYST1 record. Returns error or nil.
+func PDBWrite(out io.Writer, coords *v3.Matrix, mol Atomer, bfact []float64, box ...*Box) error {
+	var b *Box
+	if len(box) > 0 {
+		b = box[0]
+	}
+	err := pdbWrite(out, coords, mol, bfact, b)
 	if err != nil {
 		errDecorate(err, "PDBWrite")
 	}
@@ -395,7 +522,7 @@ func PDBWrite(out io.Writer, coords *v3.Matrix, mol Atomer, bfact []float64) err
 	return nil
 }
 
-func pdbWrite(out io.Writer, coords *v3.Matrix, mol Atomer, bfact []float64) error {
+func pdbWrite(out io.Writer, coords *v3.Matrix, mol Atomer, bfact []float64, box *Box) error {
 	if bfact == nil {
 		bfact = make([]float64, mol.Len())
 	}
@@ -410,6 +537,11 @@ func pdbWrite(out io.Writer, coords *v3.Matrix, mol Atomer, bfact []float64) err
 	iowriteError := func(err error) error {
 		return CError{"Failed to write in io.Writer" + err.Error(), []string{"io.Write.Write", "pdbWrite"}}
 	}
+	if box != nil {
+		if _, err := out.Write([]byte(cryst1Line(box))); err != nil {
+			return iowriteError(err)
+		}
+	}
 	for i := 0; i < mol.Len(); i++ {
 		//	r,c:=coords.Dims()
 		//	fmt.Println("IIIIIIIIIIIi", i,coords,r,c, "lllllll")
@@ -432,8 +564,8 @@ func pdbWrite(out io.Writer, coords *v3.Matrix, mol Atomer, bfact []float64) err
 }
 
 //PDBStringWrite writes a string in PDB format for a given reference, coordinate set and bfactor set, which must match each other
-//returns the written string and error or nil.
-func PDBStringWrite(coords *v3.Matrix, mol Atomer, bfact []float64) (string, error) {
+//If a box is given, it is written as a CRYST1 record. Returns the written string and error or nil.
+func PDBStringWrite(coords *v3.Matrix, mol Atomer, bfact []float64, box ...*Box) (string, error) {
 	if bfact == nil {
 		bfact = make([]float64, mol.Len())
 	}
@@ -446,6 +578,9 @@ func PDBStringWrite(coords *v3.Matrix, mol Atomer, bfact []float64) (string, err
 	var outline string
 	var outstring string
 	var err error
+	if len(box) > 0 && box[0] != nil {
+		outstring = cryst1Line(box[0])
+	}
 	for i := 0; i < mol.Len(); i++ {
 		//	r,c:=coords.Dims()
 		//	fmt.Println("IIIIIIIIIIIi", i,coords,r,c, "lllllll")
@@ -463,8 +598,10 @@ func PDBStringWrite(coords *v3.Matrix, mol Atomer, bfact []float64) (string, err
 //MultiPDBWrite writes a multiPDB  for the molecule mol and the various coordinate sets in CandB, to the io.Writer given.
 //CandB is a list of lists of *matrix.DenseMatrix. If it has 2 elements or more, the second will be used as
 //Bfactors. If it has one element, all b-factors will be zero.
+//If one box is given, it is written as a CRYST1 record before all models. If
+//one box per frame is given, each is written at the beginning of the corresponding model.
 //Returns an error if fails, or nil if succeeds.
-func MultiPDBWrite(out io.Writer, Coords []*v3.Matrix, mol Atomer, Bfactors [][]float64) error {
+func MultiPDBWrite(out io.Writer, Coords []*v3.Matrix, mol Atomer, Bfactors [][]float64, boxes ...*Box) error {
 	if !correctBfactors(Coords, Bfactors) {
 		Bfactors = make([][]float64, len(Coords), len(Coords))
 	}
@@ -476,13 +613,22 @@ func MultiPDBWrite(out io.Writer, Coords []*v3.Matrix, mol Atomer, Bfactors [][]
 	if err != nil {
 		return iowriterError(err)
 	}
+	if len(boxes) == 1 && boxes[0] != nil {
+		if _, err := out.Write([]byte("\n" + cryst1Line(boxes[0]))); err != nil {
+			return iowriterError(err)
+		}
+	}
 	//OK now the real business.
 	for j := range Coords {
 		_, err := out.Write([]byte(fmt.Sprintf("MODEL %d\n", j+1))) //The model number starts with one
 		if err != nil {
 			return iowriterError(err)
 		}
-		err = PDBWrite(out, Coords[j], mol, Bfactors[j])
+		var box []*Box
+		if len(boxes) > 1 && len(boxes) == len(Coords) {
+			box = boxes[j : j+1]
+		}
+		err = PDBWrite(out, Coords[j], mol, Bfactors[j], box...)
 		if err != nil {
 			return errDecorate(err, "MultiPDBWrite")
 		}
@@ -505,10 +651,10 @@ func MultiPDBWrite(out io.Writer, Coords []*v3.Matrix, mol Atomer, Bfactors [][]
 
 //XYZFileRead Reads an xyz or multixyz file (as produced by Turbomole). Returns a Molecule and error or nil.
 func XYZFileRead(xyzname string) (*Molecule, error) {
-	xyzfile, err := os.Open(xyzname)
+	xyzfile, err := OpenFile(xyzname)
 	if err != nil {
 		//fmt.Println("Unable to open file!!")
-		return nil, CError{err.Error(), []string{"os.Open", "XYZFileRead"}}
+		return nil, errDecorate(err, "XYZFileRead")
 	}
 	defer xyzfile.Close()
 	mol, err := XYZRead(xyzfile)
@@ -520,6 +666,9 @@ func XYZFileRead(xyzname string) (*Molecule, error) {
 }
 
 //Reads an xyz or multixyz formatted bufio.Reader (as produced by Turbomole). Returns a Molecule and error or nil.
+//The data in the comment line and extra columns of each frame, including the extended XYZ metadata, is put in the Info
+//field of the Molecule. If all frames have a Lattice, it is also used for the boxes of the molecule.
+//Charges given as the "charges" or "initial_charges" property of the first frame are put in the Charge field of the atoms.
 func XYZRead(xyzp io.Reader) (*Molecule, error) {
 	snaps := 1
 	xyz := bufio.NewReader(xyzp)
@@ -527,12 +676,13 @@ func XYZRead(xyzp io.Reader) (*Molecule, error) {
 	var top *Topology
 	var molecule []*Atom
 	Coords := make([]*v3.Matrix, 1, 1)
+	Info := make([]*FrameInfo, 1, 1)
 
 	for {
 		//When we read the first snapshot we collect also the topology data, later
 		//only coords are collected.
 		if snaps == 1 {
-			Coords[0], molecule, err = xyzReadSnap(xyz, true)
+			Coords[0], molecule, Info[0], err = xyzReadSnap(xyz, true)
 			if err != nil {
 				return nil, errDecorate(err, "XYZRead")
 			}
@@ -543,7 +693,7 @@ func XYZRead(xyzp io.Reader) (*Molecule, error) {
 			snaps++
 			continue
 		}
-		tmpcoords, _, err := xyzReadSnap(xyz, false)
+		tmpcoords, _, tmpinfo, err := xyzReadSnap(xyz, false)
 		if err != nil {
 			//An error here simply means that there are no more snapshots
 			errm := err.Error()
@@ -554,117 +704,144 @@ func XYZRead(xyzp io.Reader) (*Molecule, error) {
 			return nil, errDecorate(err, "XYZRead")
 		}
 		Coords = append(Coords, tmpcoords)
+		Info = append(Info, tmpinfo)
 	}
 	bfactors := make([][]float64, len(Coords), len(Coords))
 	for key, _ := range bfactors {
 		bfactors[key] = make([]float64, top.Len())
 	}
 	returned, err := NewMolecule(Coords, top, bfactors)
-	return returned, errDecorate(err, "XYZRead")
+	if err != nil {
+		return nil, errDecorate(err, "XYZRead")
+	}
+	returned.Info = Info
+	boxes := make([]*Box, 0, len(Info))
+	for _, v := range Info {
+		if v.Box == nil {
+			boxes = nil
+			break
+		}
+		boxes = append(boxes, v.Box)
+	}
+	returned.Boxes = boxes
+	return returned, nil
 }
 
 //xyzReadSnap reads an xyz file snapshot from a bufio.Reader, returns a slice of Atom objects, which will be nil if ReadTopol is false,
-// a slice of matrix.DenseMatrix and an error or nil.
-func xyzReadSnap(xyz *bufio.Reader, ReadTopol bool) (*v3.Matrix, []*Atom, error) {
+// a slice of matrix.DenseMatrix, the information in the comment line and extra columns, and an error or nil.
+func xyzReadSnap(xyz *bufio.Reader, ReadTopol bool) (*v3.Matrix, []*Atom, *FrameInfo, error) {
 	line, err := xyz.ReadString('\n')
 	if err != nil {
-		return nil, nil, CError{fmt.Sprintf("Empty XYZ File: %s", err.Error()), []string{"bufio.Reader.ReadString", "xyzReadSnap"}}
+		return nil, nil, nil, CError{fmt.Sprintf("Empty XYZ File: %s", err.Error()), []string{"bufio.Reader.ReadString", "xyzReadSnap"}}
 	}
 	natoms, err := strconv.Atoi(strings.TrimSpace(line))
 	if err != nil {
-		return nil, nil, CError{fmt.Sprintf("Wrong header for an XYZ file %s", err.Error()), []string{"strconv.Atoi", "xyzReadSnap"}}
+		return nil, nil, nil, CError{fmt.Sprintf("Wrong header for an XYZ file %s", err.Error()), []string{"strconv.Atoi", "xyzReadSnap"}}
 	}
 	var molecule []*Atom
 	if ReadTopol {
 		molecule = make([]*Atom, natoms, natoms)
 	}
 	coords := make([]float64, natoms*3, natoms*3)
-	_, err = xyz.ReadString('\n') //We dont care about this line
+	line, err = xyz.ReadString('\n')
 	if err != nil {
-		return nil, nil, CError{fmt.Sprintf("Ill formatted XYZ file: %s", err.Error()), []string{"bufio.Reader.ReadString", "xyzReadSnap"}}
+		return nil, nil, nil, CError{fmt.Sprintf("Ill formatted XYZ file: %s", err.Error()), []string{"bufio.Reader.ReadString", "xyzReadSnap"}}
 
 	}
-	errs := make([]error, 3, 3)
+	info, layout := parseXYZComment(line)
+	for _, c := range layout {
+		if c.name != "species" && c.name != "pos" {
+			info.Properties = append(info.Properties, &AtomProperty{Name: c.name, Type: c.kind, Cols: c.cols})
+		}
+	}
+	ncols := xyzNCols(layout)
+	var symbol string
 	for i := 0; i < natoms; i++ {
-		line, errs[0] = xyz.ReadString('\n')
-		if errs[0] != nil { //inefficient, (errs[1] can be checked once before), but clearer.
-			if strings.Contains(errs[0].Error(), "EOF") && i == natoms-1 { //This allows that an XYZ ends without a newline
-				errs[0] = nil
+		line, err = xyz.ReadString('\n')
+		if err != nil {
+			if strings.Contains(err.Error(), "EOF") && i == natoms-1 { //This allows that an XYZ ends without a newline
+				err = nil
 			} else {
 				break
 			}
 		}
 		fields := strings.Fields(line)
-		if len(fields) < 4 {
-			errs[0] = fmt.Errorf("Line number %d ill formed", i)
+		if len(fields) < ncols {
+			err = fmt.Errorf("Line number %d ill formed", i)
+			break
+		}
+		err = xyzParseAtomLine(fields, layout, &symbol, coords[i*3:i*3+3], info.Properties)
+		if err != nil {
 			break
 		}
 		if ReadTopol {
 			molecule[i] = new(Atom)
-			molecule[i].Symbol = strings.Title(fields[0])
+			molecule[i].Symbol = strings.Title(symbol)
 			molecule[i].Mass = symbolMass[molecule[i].Symbol]
 			molecule[i].Molname = "UNK"
 			molecule[i].Name = molecule[i].Symbol
 		}
-		coords[i*3], errs[0] = strconv.ParseFloat(fields[1], 64)
-		coords[i*3+1], errs[1] = strconv.ParseFloat(fields[2], 64)
-		coords[i*3+2], errs[2] = strconv.ParseFloat(fields[3], 64)
 	}
-	//This could be done faster if done in the same loop where the coords are read
-	//Instead of having another loop just for them.
-	for _, i := range errs {
-		if i != nil {
-		//	fmt.Println("line", line, k)
-			return nil, nil, CError{i.Error(), []string{"strconv.ParseFloat", "xyzReadSnap"}}
+	if err != nil {
+		return nil, nil, nil, CError{err.Error(), []string{"strconv.ParseFloat", "xyzReadSnap"}}
+	}
+	if ReadTopol {
+		for _, name := range []string{"initial_charges", "charges"} {
+			if p := info.Property(name); p != nil && p.Type == 'R' && p.Cols == 1 {
+				for i, at := range molecule {
+					at.Charge = p.Values[i]
+				}
+			}
 		}
 	}
 	mcoords, err := v3.NewMatrix(coords)
-	return mcoords, molecule, errDecorate(err, "xyzReadSnap")
+	return mcoords, molecule, info, errDecorate(err, "xyzReadSnap")
 }
 
 //XYZWrite writes the mol Ref and the Coord coordinates in an XYZ file with name xyzname which will
-//be created fot that. If the file exist it will be overwritten.
-func XYZFileWrite(xyzname string, Coords *v3.Matrix, mol Atomer) error {
-	out, err := os.Create(xyzname)
+//be created fot that. If the file exist it will be overwritten. If info is given, it is written
+//as in XYZWrite.
+func XYZFileWrite(xyzname string, Coords *v3.Matrix, mol Atomer, info ...*FrameInfo) error {
+	out, err := CreateFile(xyzname)
 	if err != nil {
-		return CError{err.Error(), []string{"os.Create", "XYZFileWrite"}}
+		return errDecorate(err, "XYZFileWrite")
 	}
-	defer out.Close()
-	err = XYZWrite(out, Coords, mol)
+	err = XYZWrite(out, Coords, mol, info...)
 	if err != nil {
+		out.Close()
 		return errDecorate(err, "XYZFileWrite")
 	}
-	return nil
+	return errDecorate(out.Close(), "XYZFileWrite")
 }
 
 //XYZStringWrite writes the mol Ref and the Coord coordinates in an XYZ-formatted string.
-func XYZStringWrite(Coords *v3.Matrix, mol Atomer) (string, error) {
-	var out string
-	if mol.Len() != Coords.NVecs() {
-		return "", CError{"Ref and Coords dont have the same number of atoms", []string{"XYZStringWrite"}}
+//If info is given, it is written as in XYZWrite.
+func XYZStringWrite(Coords *v3.Matrix, mol Atomer, info ...*FrameInfo) (string, error) {
+	var out bytes.Buffer
+	if err := XYZWrite(&out, Coords, mol, info...); err != nil {
+		return "", errDecorate(err, "XYZStringWrite")
 	}
-	c := make([]float64, 3, 3)
-	out = fmt.Sprintf("%-4d\n\n", mol.Len())
-	//towrite := Coords.Arrays() //An array of array with the data in the matrix
-	for i := 0; i < mol.Len(); i++ {
-		//c := towrite[i] //coordinates for the corresponding atoms
-		c = Coords.Row(c, i)
-		temp := fmt.Sprintf("%-2s  %12.6f%12.6f%12.6f \n", mol.Atom(i).Symbol, c[0], c[1], c[2])
-		out = strings.Join([]string{out, temp}, "")
-	}
-	return out, nil
+	return out.String(), nil
 }
 
 //XYZStringWrite writes the mol Ref and the Coord coordinates in an XYZ-formatted string.
-func XYZWrite(out io.Writer, Coords *v3.Matrix, mol Atomer) error {
+//If info is given, its data is written in the comment line, in the extended XYZ format
+//if it has a box, energy, keys or per-atom properties, which are written as extra columns.
+func XYZWrite(out io.Writer, Coords *v3.Matrix, mol Atomer, info ...*FrameInfo) error {
 	iowriterError := func(err error) error {
 		return CError{"Failed to write in io.Writer" + err.Error(), []string{"io.Writer.Write", "XYZWrite"}}
 	}
 	if mol.Len() != Coords.NVecs() {
 		return CError{"Ref and Coords dont have the same number of atoms", []string{"XYZWrite"}}
 	}
+	var inf *FrameInfo
+	comment := ""
+	if len(info) > 0 && info[0] != nil {
+		inf = info[0]
+		comment = xyzCommentLine(inf)
+	}
 	c := make([]float64, 3, 3)
-	_, err := out.Write([]byte(fmt.Sprintf("%-4d\n\n", mol.Len())))
+	_, err := out.Write([]byte(fmt.Sprintf("%-4d\n%s\n", mol.Len(), comment)))
 	if err != nil {
 		return iowriterError(err)
 	}
@@ -672,7 +849,14 @@ func XYZWrite(out io.Writer, Coords *v3.Matrix, mol Atomer) error {
 	for i := 0; i < mol.Len(); i++ {
 		//c := towrite[i] //coordinates for the corresponding atoms
 		c = Coords.Row(c, i)
-		temp := fmt.Sprintf("%-2s  %12.6f%12.6f%12.6f \n", mol.Atom(i).Symbol, c[0], c[1], c[2])
+		extra := ""
+		if inf != nil {
+			extra, err = xyzPropertyColumns(inf, i)
+			if err != nil {
+				return errDecorate(err, "XYZWrite")
+			}
+		}
+		temp := fmt.Sprintf("%-2s  %12.6f%12.6f%12.6f%s \n", mol.Atom(i).Symbol, c[0], c[1], c[2], extra)
 		_, err := out.Write([]byte(temp))
 		if err != nil {
 			return iowriterError(err)
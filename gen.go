@@ -0,0 +1,223 @@
+/*
+ * gen.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/gochem/v3"
+)
+
+//GENFileRead reads a file in the GEN format used by DFTB+. Returns a Molecule, with a box if the
+//geometry is periodic, and error or nil.
+func GENFileRead(genname string) (*Molecule, error) {
+	genfile, err := OpenFile(genname)
+	if err != nil {
+		return nil, errDecorate(err, "GENFileRead")
+	}
+	defer genfile.Close()
+	mol, err := GENRead(genfile)
+	if err != nil {
+		return nil, errDecorate(err, "GENFileRead "+fmt.Sprintf("error in file %s", genname))
+	}
+	return mol, nil
+}
+
+//GENRead reads a geometry in the GEN format used by DFTB+ from an io.Reader. The geometry can be
+//a cluster (C), or periodic with cartesian (S) or fractional (F) coordinates. For periodic geometries
+//the box is put in the Boxes field of the Molecule, and the coordinates are always returned as
+//cartesian, in A. Returns a Molecule and error or nil.
+func GENRead(genp io.Reader) (*Molecule, error) {
+	gen := bufio.NewReader(genp)
+	fields, err := genNextLine(gen)
+	if err != nil || len(fields) < 2 {
+		return nil, CError{"Wrong header for a GEN file", []string{"GENRead"}}
+	}
+	natoms, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, CError{fmt.Sprintf("Wrong header for a GEN file %s", err.Error()), []string{"strconv.Atoi", "GENRead"}}
+	}
+	if natoms < 1 {
+		return nil, CError{fmt.Sprintf("Wrong number of atoms in GEN file: %d", natoms), []string{"GENRead"}}
+	}
+	kind := strings.ToUpper(fields[1])
+	if kind != "C" && kind != "S" && kind != "F" {
+		return nil, CError{fmt.Sprintf("Unknown GEN geometry type %s", fields[1]), []string{"GENRead"}}
+	}
+	species, err := genNextLine(gen)
+	if err != nil || len(species) == 0 {
+		return nil, CError{"GEN file with no element list", []string{"GENRead"}}
+	}
+	atoms := make([]*Atom, natoms)
+	coords := make([]float64, natoms*3)
+	for i := range atoms {
+		fields, err := genNextLine(gen)
+		if err != nil || len(fields) < 5 {
+			return nil, CError{fmt.Sprintf("GEN file ended or ill formatted at atom %d of %d", i+1, natoms), []string{"GENRead"}}
+		}
+		sp, err := strconv.Atoi(fields[1])
+		if err != nil || sp < 1 || sp > len(species) {
+			return nil, CError{fmt.Sprintf("Wrong element index for atom %d", i+1), []string{"GENRead"}}
+		}
+		for j := 0; j < 3; j++ {
+			coords[i*3+j], err = strconv.ParseFloat(fields[j+2], 64)
+			if err != nil {
+				return nil, CError{err.Error(), []string{"strconv.ParseFloat", "GENRead"}}
+			}
+		}
+		atoms[i] = new(Atom)
+		atoms[i].Symbol = strings.Title(strings.ToLower(species[sp-1]))
+		atoms[i].Name = atoms[i].Symbol
+		atoms[i].Mass = symbolMass[atoms[i].Symbol]
+		atoms[i].Molname = "UNK"
+		atoms[i].ID = i + 1
+	}
+	mcoords, err := v3.NewMatrix(coords)
+	if err != nil {
+		return nil, errDecorate(err, "GENRead")
+	}
+	var box *Box
+	if kind != "C" {
+		//The origin of the cell, which doesn't change the coordinates, then the 3 cell vectors.
+		vecs := make([]float64, 0, 9)
+		for i := 0; i < 4; i++ {
+			fields, err := genNextLine(gen)
+			if err != nil || len(fields) < 3 {
+				return nil, CError{"GEN file ended or ill formatted in the cell vectors", []string{"GENRead"}}
+			}
+			if i == 0 {
+				continue
+			}
+			for _, v := range fields[:3] {
+				c, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return nil, CError{err.Error(), []string{"strconv.ParseFloat", "GENRead"}}
+				}
+				vecs = append(vecs, c)
+			}
+		}
+		mvecs, err := v3.NewMatrix(vecs)
+		if err != nil {
+			return nil, errDecorate(err, "GENRead")
+		}
+		box, err = NewBox(mvecs)
+		if err != nil {
+			return nil, errDecorate(err, "GENRead")
+		}
+		if kind == "F" {
+			mcoords = box.Cartesian(mcoords)
+		}
+	}
+	bfactors := [][]float64{make([]float64, natoms)}
+	mol, err := NewMolecule([]*v3.Matrix{mcoords}, NewTopology(0, 1, atoms), bfactors)
+	if err != nil {
+		return nil, errDecorate(err, "GENRead")
+	}
+	if box != nil {
+		mol.Boxes = []*Box{box}
+	}
+	return mol, nil
+}
+
+//genNextLine returns the fields of the next line in a GEN file that is not empty
+//or a comment. Anything after a # is a comment.
+func genNextLine(gen *bufio.Reader) ([]string, error) {
+	for {
+		line, err := gen.ReadString('\n')
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+//GENFileWrite writes the coordinates coords for the atoms in mol to a file genname in the GEN format
+//used by DFTB+. If a box is given, the geometry is written as periodic. If the file exist it will be overwritten.
+func GENFileWrite(genname string, coords *v3.Matrix, mol Atomer, box ...*Box) error {
+	out, err := CreateFile(genname)
+	if err != nil {
+		return errDecorate(err, "GENFileWrite")
+	}
+	err = GENWrite(out, coords, mol, box...)
+	if err != nil {
+		out.Close()
+		return errDecorate(err, "GENFileWrite")
+	}
+	return errDecorate(out.Close(), "GENFileWrite")
+}
+
+//GENWrite writes the coordinates coords for the atoms in mol to out, in the GEN format used by DFTB+.
+//If a box is given, the geometry is written as periodic, with cartesian coordinates. Otherwise, it is
+//written as a cluster.
+func GENWrite(out io.Writer, coords *v3.Matrix, mol Atomer, box ...*Box) error {
+	if mol.Len() != coords.NVecs() {
+		return CError{"Ref and Coords dont have the same number of atoms", []string{"GENWrite"}}
+	}
+	kind := "C"
+	if len(box) > 0 && box[0] != nil {
+		kind = "S"
+	}
+	//The elements, in order of appearance.
+	species := make([]string, 0, 5)
+	index := make(map[string]int)
+	for i := 0; i < mol.Len(); i++ {
+		s := mol.Atom(i).Symbol
+		if _, ok := index[s]; !ok {
+			species = append(species, s)
+			index[s] = len(species)
+		}
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "%d %s\n", mol.Len(), kind)
+	fmt.Fprintf(w, "%s\n", strings.Join(species, " "))
+	c := make([]float64, 3)
+	for i := 0; i < mol.Len(); i++ {
+		c = coords.Row(c, i)
+		fmt.Fprintf(w, "%5d %3d %16.8f %16.8f %16.8f\n", i+1, index[mol.Atom(i).Symbol], c[0], c[1], c[2])
+	}
+	if kind == "S" {
+		fmt.Fprintf(w, "%16.8f %16.8f %16.8f\n", 0.0, 0.0, 0.0)
+		vecs := box[0].Vectors()
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "%16.8f %16.8f %16.8f\n", vecs.At(i, 0), vecs.At(i, 1), vecs.At(i, 2))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return CError{"Failed to write in io.Writer" + err.Error(), []string{"bufio.Writer.Flush", "GENWrite"}}
+	}
+	return nil
+}
@@ -0,0 +1,449 @@
+/*
+ * gmxtop.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//maximum depth of nested #include directives in a GROMACS topology,
+//to catch files that include themselves.
+const gmxMaxIncludeDepth = 32
+
+//GMXTopFileRead reads the GROMACS topology topname (a .top or .itp file) and returns the topology
+//of the whole system. The files in #include directives are searched for in the directory of
+//the file that includes them, then in the directories in includedirs, in order, and then in the
+//directories in the GMXLIB environment variable. See GMXTopRead for details.
+func GMXTopFileRead(topname string, includedirs ...string) (*Topology, error) {
+	topfile, err := OpenFile(topname)
+	if err != nil {
+		return nil, errDecorate(err, "GMXTopFileRead")
+	}
+	defer topfile.Close()
+	g := newGMXPreprocessor(includedirs)
+	err = g.read(topfile, filepath.Dir(topname), 0)
+	if err != nil {
+		return nil, errDecorate(err, "GMXTopFileRead "+fmt.Sprintf("error in file %s", topname))
+	}
+	top, err := gmxTopology(g.lines)
+	if err != nil {
+		return nil, errDecorate(err, "GMXTopFileRead "+fmt.Sprintf("error in file %s", topname))
+	}
+	return top, nil
+}
+
+//GMXTopRead reads a GROMACS topology from topp. The files in #include directives are searched for
+//in the directories in includedirs, in order, and then in those in the GMXLIB environment variable.
+//The #ifdef, #ifndef, #else, #endif, #define and #undef directives are followed.
+//The molecule types in the [ molecules ] section are repeated as many times as given there,
+//in order, to build the system. The atom names, types, partial charges and masses (from the [ atoms ]
+//section or, if not given there, from the [ atomtypes ]) are put in the Name, Type, Charge and Mass
+//fields of each atom, and the residue names in Molname. As GROMACS topologies repeat the residue
+//numbers for each molecule, the residues are numbered sequentially across the system in the MolID field, as in
+//GRO files. The element symbols are taken from the atomic numbers in the [ atomtypes ], or guessed from
+//the masses. The bonds (with order 0), including those from [ settles ] and type 1 [ constraints ],
+//angles, proper and improper dihedrals are also read. The charge of the topology is the sum of the atomic charges,
+//rounded, and the multiplicity is set to 1.
+func GMXTopRead(topp io.Reader, includedirs ...string) (*Topology, error) {
+	g := newGMXPreprocessor(includedirs)
+	if err := g.read(topp, "", 0); err != nil {
+		return nil, errDecorate(err, "GMXTopRead")
+	}
+	top, err := gmxTopology(g.lines)
+	if err != nil {
+		return nil, errDecorate(err, "GMXTopRead")
+	}
+	return top, nil
+}
+
+//gmxPreprocessor follows the C-preprocessor-like directives in GROMACS topologies, and
+//collects the lines of the topology, without comments, with all the included files expanded.
+type gmxPreprocessor struct {
+	dirs    []string
+	defines map[string]bool
+	lines   []string
+}
+
+func newGMXPreprocessor(includedirs []string) *gmxPreprocessor {
+	g := new(gmxPreprocessor)
+	g.dirs = append(g.dirs, includedirs...)
+	g.dirs = append(g.dirs, filepath.SplitList(os.Getenv("GMXLIB"))...)
+	g.defines = make(map[string]bool)
+	return g
+}
+
+//read preprocesses the topology in r. dir is the directory where the file being read is,
+//or an empty string if not known. depth is the number of files including this one.
+func (g *gmxPreprocessor) read(r io.Reader, dir string, depth int) error {
+	if depth > gmxMaxIncludeDepth {
+		return CError{"Too many nested #include directives", []string{"gmxPreprocessor.read"}}
+	}
+	in := bufio.NewReader(r)
+	active := []bool{true} //one element per #ifdef/#ifndef block we are in, plus the file itself.
+	for {
+		line, err := gmxReadLine(in)
+		if err != nil && err != io.EOF {
+			return CError{"Error reading GROMACS topology: " + err.Error(), []string{"gmxPreprocessor.read"}}
+		}
+		fields := strings.Fields(line)
+		on := active[len(active)-1]
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "#ifdef" || fields[0] == "#ifndef":
+			if len(fields) < 2 {
+				return CError{"Malformed directive: " + line, []string{"gmxPreprocessor.read"}}
+			}
+			def := g.defines[fields[1]]
+			active = append(active, on && def == (fields[0] == "#ifdef"))
+		case fields[0] == "#else":
+			if len(active) < 2 {
+				return CError{"#else without #ifdef", []string{"gmxPreprocessor.read"}}
+			}
+			active[len(active)-1] = active[len(active)-2] && !on
+		case fields[0] == "#endif":
+			if len(active) < 2 {
+				return CError{"#endif without #ifdef", []string{"gmxPreprocessor.read"}}
+			}
+			active = active[:len(active)-1]
+		case !on:
+		case fields[0] == "#define" && len(fields) > 1:
+			g.defines[fields[1]] = true
+		case fields[0] == "#undef" && len(fields) > 1:
+			delete(g.defines, fields[1])
+		case fields[0] == "#include":
+			if len(fields) < 2 {
+				return CError{"Malformed directive: " + line, []string{"gmxPreprocessor.read"}}
+			}
+			if err := g.include(strings.Trim(fields[1], "\"<>"), dir, depth); err != nil {
+				return errDecorate(err, "gmxPreprocessor.read")
+			}
+		case strings.HasPrefix(fields[0], "#"): //other directives are ignored.
+		default:
+			g.lines = append(g.lines, line)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if len(active) != 1 {
+		return CError{"#ifdef without #endif", []string{"gmxPreprocessor.read"}}
+	}
+	return nil
+}
+
+//include finds the file name and preprocesses it.
+func (g *gmxPreprocessor) include(name, dir string, depth int) error {
+	dirs := g.dirs
+	if dir != "" {
+		dirs = append([]string{dir}, dirs...)
+	}
+	if filepath.IsAbs(name) {
+		dirs = []string{""}
+	}
+	for _, d := range dirs {
+		path := filepath.Join(d, name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		f, err := OpenFile(path)
+		if err != nil {
+			return errDecorate(err, "gmxPreprocessor.include")
+		}
+		defer f.Close()
+		return errDecorate(g.read(f, filepath.Dir(path), depth+1), "gmxPreprocessor.include "+path)
+	}
+	return CError{"Couldn't find included file " + name, []string{"gmxPreprocessor.include"}}
+}
+
+//gmxReadLine reads a line from in, joining lines ending in a backslash, and
+//removes the comments, which start with a semicolon.
+func gmxReadLine(in *bufio.Reader) (string, error) {
+	line := ""
+	for {
+		l, err := in.ReadString('\n')
+		if i := strings.Index(l, ";"); i >= 0 {
+			l = l[:i]
+		}
+		l = strings.TrimSpace(l)
+		if strings.HasSuffix(l, "\\") && err == nil {
+			line += strings.TrimSuffix(l, "\\") + " "
+			continue
+		}
+		return line + l, err
+	}
+}
+
+//gmxMolType is a GROMACS molecule type.
+type gmxMolType struct {
+	atoms     []*Atom
+	bonds     [][]int
+	angles    [][]int
+	dihedrals [][]int
+	impropers [][]int
+}
+
+//gmxAtomType contains the data we use from an atom type in a GROMACS topology.
+type gmxAtomType struct {
+	mass   float64
+	number int
+}
+
+//gmxTopology builds the system topology from the preprocessed lines of a GROMACS topology.
+func gmxTopology(lines []string) (*Topology, error) {
+	atomtypes := make(map[string]gmxAtomType)
+	moltypes := make(map[string]*gmxMolType)
+	var mol *gmxMolType
+	var section string
+	top := NewTopology(0, 1)
+	charge := 0.0
+	res := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "[") {
+			section = strings.TrimSpace(strings.Trim(line, "[]"))
+			continue
+		}
+		fields := strings.Fields(line)
+		var err error
+		switch section {
+		case "atomtypes":
+			err = gmxReadAtomType(fields, atomtypes)
+		case "moleculetype":
+			mol = new(gmxMolType)
+			moltypes[fields[0]] = mol
+		case "atoms", "bonds", "constraints", "settles", "angles", "dihedrals":
+			if mol == nil {
+				return nil, CError{"Section " + section + " outside a molecule type in GROMACS topology", []string{"gmxTopology"}}
+			}
+			err = mol.readLine(section, fields, atomtypes)
+		case "molecules":
+			if len(fields) < 2 {
+				return nil, CError{"Malformed line in molecules section of GROMACS topology: " + line, []string{"gmxTopology"}}
+			}
+			m, ok := moltypes[fields[0]]
+			if !ok {
+				return nil, CError{"Unknown molecule type " + fields[0] + " in GROMACS topology", []string{"gmxTopology"}}
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, CError{"Malformed line in molecules section of GROMACS topology: " + line, []string{"strconv.Atoi", "gmxTopology"}}
+			}
+			for i := 0; i < n; i++ {
+				res = m.appendTo(top, res)
+			}
+		}
+		if err != nil {
+			return nil, errDecorate(err, "gmxTopology")
+		}
+	}
+	if top.Len() == 0 {
+		return nil, CError{"No molecules in GROMACS topology", []string{"gmxTopology"}}
+	}
+	for _, at := range top.Atoms {
+		charge += at.Charge
+	}
+	top.SetCharge(int(math.Floor(charge + 0.5)))
+	return top, nil
+}
+
+//gmxReadAtomType reads a line of the atomtypes section. The number of fields varies, but the particle
+//type (A, S, V or D) always follows the mass and charge, and, if present, the atomic number precedes them.
+func gmxReadAtomType(fields []string, atomtypes map[string]gmxAtomType) error {
+	p := -1
+	for i := 3; i < len(fields); i++ {
+		if f := fields[i]; f == "A" || f == "S" || f == "V" || f == "D" {
+			p = i
+			break
+		}
+	}
+	if p < 0 {
+		return CError{"Malformed atom type in GROMACS topology: " + strings.Join(fields, " "), []string{"gmxReadAtomType"}}
+	}
+	var t gmxAtomType
+	var err error
+	t.mass, err = strconv.ParseFloat(fields[p-2], 64)
+	if err != nil {
+		return CError{"Malformed atom type in GROMACS topology: " + strings.Join(fields, " "), []string{"strconv.ParseFloat", "gmxReadAtomType"}}
+	}
+	if p >= 4 {
+		//if not an integer, this is the bonded type, so we just don't get the atomic number.
+		t.number, _ = strconv.Atoi(fields[p-3])
+	}
+	atomtypes[fields[0]] = t
+	return nil
+}
+
+//readLine reads a line of the section of the molecule type M.
+func (M *gmxMolType) readLine(section string, fields []string, atomtypes map[string]gmxAtomType) error {
+	if section == "atoms" {
+		at, err := gmxReadAtom(fields, atomtypes)
+		if err != nil {
+			return errDecorate(err, "readLine")
+		}
+		if at.ID != len(M.atoms)+1 {
+			return CError{fmt.Sprintf("Atom %d out of order in GROMACS topology", at.ID), []string{"readLine"}}
+		}
+		M.atoms = append(M.atoms, at)
+		return nil
+	}
+	size := map[string]int{"bonds": 2, "constraints": 2, "settles": 1, "angles": 3, "dihedrals": 4}[section]
+	if len(fields) < size+1 {
+		return CError{"Malformed line in the " + section + " section of GROMACS topology: " + strings.Join(fields, " "), []string{"readLine"}}
+	}
+	t := make([]int, size)
+	for i := range t {
+		n, err := strconv.Atoi(fields[i])
+		if err != nil || n < 1 || n > len(M.atoms) {
+			return CError{"Wrong atom index in the " + section + " section of GROMACS topology: " + strings.Join(fields, " "), []string{"readLine"}}
+		}
+		t[i] = n - 1
+	}
+	funct := fields[size]
+	switch section {
+	case "bonds":
+		M.bonds = append(M.bonds, t)
+	case "constraints":
+		if funct == "1" { //type 2 constraints don't create bonds.
+			M.bonds = append(M.bonds, t)
+		}
+	case "settles":
+		//settles are for 3-site waters: the oxygen and the two hydrogens after it.
+		if t[0]+2 >= len(M.atoms) {
+			return CError{"Wrong atom index in the settles section of GROMACS topology", []string{"readLine"}}
+		}
+		M.bonds = append(M.bonds, []int{t[0], t[0] + 1}, []int{t[0], t[0] + 2})
+	case "angles":
+		M.angles = append(M.angles, t)
+	case "dihedrals":
+		d := &M.dihedrals
+		if funct == "2" || funct == "4" {
+			d = &M.impropers
+		}
+		for _, v := range *d {
+			if v[0] == t[0] && v[1] == t[1] && v[2] == t[2] && v[3] == t[3] {
+				return nil //dihedrals with several terms appear once per term.
+			}
+		}
+		*d = append(*d, t)
+	}
+	return nil
+}
+
+//gmxReadAtom reads a line of the atoms section of a molecule type.
+func gmxReadAtom(fields []string, atomtypes map[string]gmxAtomType) (*Atom, error) {
+	if len(fields) < 7 {
+		return nil, CError{"Malformed atom in GROMACS topology: " + strings.Join(fields, " "), []string{"gmxReadAtom"}}
+	}
+	var err error
+	at := new(Atom)
+	at.ID, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, CError{"Malformed atom in GROMACS topology: " + strings.Join(fields, " "), []string{"strconv.Atoi", "gmxReadAtom"}}
+	}
+	at.Type = fields[1]
+	at.MolID, err = strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, CError{"Malformed atom in GROMACS topology: " + strings.Join(fields, " "), []string{"strconv.Atoi", "gmxReadAtom"}}
+	}
+	at.Molname = fields[3]
+	at.Molname1 = three2OneLetter[at.Molname]
+	at.Name = fields[4]
+	at.Chain = " "
+	at.Charge, err = strconv.ParseFloat(fields[6], 64)
+	if err != nil {
+		return nil, CError{"Malformed atom in GROMACS topology: " + strings.Join(fields, " "), []string{"strconv.ParseFloat", "gmxReadAtom"}}
+	}
+	t, ok := atomtypes[at.Type]
+	massknown := true
+	if len(fields) > 7 {
+		at.Mass, err = strconv.ParseFloat(fields[7], 64)
+		if err != nil {
+			return nil, CError{"Malformed atom in GROMACS topology: " + strings.Join(fields, " "), []string{"strconv.ParseFloat", "gmxReadAtom"}}
+		}
+	} else if ok {
+		at.Mass = t.mass
+	} else {
+		massknown = false
+	}
+	if t.number > 0 {
+		at.Symbol, _ = symbolFromNumber(t.number)
+	}
+	if at.Symbol == "" && massknown {
+		at.Symbol, _ = symbolFromMass(at.Mass)
+	}
+	if at.Symbol == "" {
+		at.Symbol, _ = symbolFromName(at.Name)
+	}
+	if !massknown {
+		at.Mass = symbolMass[at.Symbol]
+	}
+	return at, nil
+}
+
+//appendTo appends a copy of the molecule type M to top. res is the number of residues
+//already in top. It returns the number of residues after appending M.
+func (M *gmxMolType) appendTo(top *Topology, res int) int {
+	offset := top.Len()
+	prevres := -1
+	for _, v := range M.atoms {
+		at := new(Atom)
+		at.Copy(v)
+		if v.MolID != prevres {
+			res++
+			prevres = v.MolID
+		}
+		at.MolID = res
+		at.ID = top.Len() + 1
+		top.AppendAtom(at)
+	}
+	for _, v := range M.bonds {
+		top.SetBonds(append(top.Bonds(), &Bond{At1: v[0] + offset, At2: v[1] + offset}))
+	}
+	top.SetAngles(append(top.Angles(), gmxShift(M.angles, offset)...))
+	top.SetDihedrals(append(top.Dihedrals(), gmxShift(M.dihedrals, offset)...))
+	top.SetImpropers(append(top.Impropers(), gmxShift(M.impropers, offset)...))
+	return res
+}
+
+//gmxShift returns a copy of the tuples in t with offset added to all indexes.
+func gmxShift(t [][]int, offset int) [][]int {
+	ret := make([][]int, len(t))
+	for i, v := range t {
+		ret[i] = make([]int, len(v))
+		for j, at := range v {
+			ret[i][j] = at + offset
+		}
+	}
+	return ret
+}
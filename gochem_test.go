@@ -27,8 +27,13 @@ import (
 	"fmt"
 	"github.com/rmera/gochem/v3"
 	"gonum.org/v1/gonum/mat"
+	"io/ioutil"
+	"math"
 	"os"
+	"os/exec"
 	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -226,6 +231,823 @@ func TestDelete(Te *testing.T) {
 
 }
 
+//TestBonds checks the bond perception and that bonds are kept consistent
+//when atoms are selected or deleted.
+func TestBonds(Te *testing.T) {
+	mol, err := XYZFileRead("test/ethanol.xyz")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if err := mol.AssignBonds(mol.Coords[0], -1); err != nil {
+		Te.Fatal(err)
+	}
+	if len(mol.Bonds()) != 8 {
+		Te.Errorf("Ethanol should have 8 bonds, got %d", len(mol.Bonds()))
+	}
+	if b := mol.Bonded(7); len(b) != 2 {
+		Te.Errorf("The ethanol O should have 2 bonds, got %v", b)
+	}
+	sel := NewTopology(0, 1)
+	sel.SomeAtoms(mol, []int{1, 4, 7})
+	if len(sel.Bonds()) != 2 {
+		Te.Errorf("C-C-O selection should have 2 bonds, got %d", len(sel.Bonds()))
+	}
+	for _, b := range sel.Bonds() {
+		if b.Cross(1) < 0 {
+			Te.Errorf("Bond %d-%d wrongly remapped", b.At1, b.At2)
+		}
+	}
+	mol.Del(8)
+	if len(mol.Bonds()) != 7 {
+		Te.Errorf("Ethanol without its OH hydrogen should have 7 bonds, got %d", len(mol.Bonds()))
+	}
+	cp := NewTopology(0, 1)
+	cp.CopyAtoms(mol)
+	if len(cp.Bonds()) != 7 {
+		Te.Errorf("Copied topology should have 7 bonds, got %d", len(cp.Bonds()))
+	}
+}
+
+//TestSelection checks the selection language against hand-made selections.
+func TestSelection(Te *testing.T) {
+	mol, err := PDBFileRead("test/2c9v.pdb", true)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	sel, err := Select(mol, "chain A and resid 10-12 and name CA")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if len(sel) != 3 {
+		Te.Errorf("Expected 3 atoms, got %d: %v", len(sel), sel)
+	}
+	ref := Molecules2Atoms(mol, []int{10, 11, 12}, []string{"A"})
+	sel, err = Select(mol, "resid 10 to 12 and (chain A)")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if len(sel) != len(ref) {
+		Te.Errorf("Selection and Molecules2Atoms differ: %v %v", sel, ref)
+	}
+	sel, err = Select(mol, "not hydrogen and not het")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	heavy := 0
+	for i := 0; i < mol.Len(); i++ {
+		if at := mol.Atom(i); at.Symbol != "H" && !at.Het {
+			heavy++
+		}
+	}
+	if len(sel) != heavy {
+		Te.Errorf("Expected %d atoms, got %d", heavy, len(sel))
+	}
+	if _, err = Select(mol, "within 5 of resname ZN"); err == nil {
+		Te.Error("Geometric selection without coordinates should fail")
+	}
+	sel, err = Select(mol, "within 3 of resname ZN and not resname ZN", mol.Coords[0])
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if len(sel) == 0 {
+		Te.Error("No atoms selected around the Zn ions")
+	}
+	for _, expr := range []string{"name", "chain A and", "(all", "resid A-B", "foo 3"} {
+		if _, err := NewSelection(expr); err == nil {
+			Te.Errorf("Malformed expression %q was accepted", expr)
+		}
+	}
+}
+
+//TestBox checks the periodic box reading/writing from PDB files, and the minimum image
+//and wrapping functions.
+func TestBox(Te *testing.T) {
+	mol, err := PDBFileRead("test/1uxm.pdb", false)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	box := mol.FrameBox(0)
+	if box == nil {
+		Te.Fatal("No box read from the CRYST1 record")
+	}
+	a, b, c, alpha, beta, gamma := box.Params()
+	if math.Abs(a-112.374) > 0.001 || math.Abs(b-145.582) > 0.001 || math.Abs(c-112.497) > 0.001 {
+		Te.Errorf("Wrong box lengths %f %f %f", a, b, c)
+	}
+	if math.Abs(alpha-90) > 0.001 || math.Abs(beta-120.05) > 0.001 || math.Abs(gamma-90) > 0.001 {
+		Te.Errorf("Wrong box angles %f %f %f", alpha, beta, gamma)
+	}
+	if err := PDBFileWrite("test/1uxmBox.pdb", mol.Coords[0], mol, mol.Bfactors[0], box); err != nil {
+		Te.Fatal(err)
+	}
+	mol2, err := PDBFileRead("test/1uxmBox.pdb", false)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if b2 := mol2.FrameBox(0); b2 == nil || math.Abs(b2.Volume()-box.Volume()) > 1 {
+		Te.Errorf("Box not written correctly: %v %v", box, b2)
+	}
+	//A point on each side of the boundary of a triclinic box.
+	tric, err := NewBoxFromParams(10, 10, 10, 90, 120, 90)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	p, _ := v3.NewMatrix([]float64{0.5, 0.5, 0.5, 9.5, 9.5, 0.5})
+	if d := tric.Distance(p.VecView(0), p.VecView(1)); math.Abs(d-1.4142) > 0.001 {
+		Te.Errorf("Wrong minimum image distance %f", d)
+	}
+	ortho := NewOrthoBox(10, 10, 10)
+	ortho.Wrap(p)
+	q, _ := v3.NewMatrix([]float64{-9.5, 10.5, 25})
+	ortho.Wrap(q)
+	if math.Abs(q.At(0, 0)-0.5) > 0.0001 || math.Abs(q.At(0, 1)-0.5) > 0.0001 || math.Abs(q.At(0, 2)-5) > 0.0001 {
+		Te.Errorf("Wrong wrapping: %v", q)
+	}
+	//Tiny negative coordinates are wrapped to 0, not to the box length.
+	r, _ := v3.NewMatrix([]float64{-1e-16, 5, -1e-17})
+	ortho.Wrap(r)
+	if r.At(0, 0) < 0 || r.At(0, 0) >= 10 || r.At(0, 2) < 0 || r.At(0, 2) >= 10 {
+		Te.Errorf("Wrong wrapping of tiny negative coordinates: %v", r)
+	}
+}
+
+//TestGRO reads a 2-frame GRO file with velocities and a triclinic box, writes it back
+//and checks that the written file is read again with the same data.
+func TestGRO(Te *testing.T) {
+	mol, err := GROFileRead("test/sample.gro")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if mol.Len() != 8 || mol.NFrames() != 2 || len(mol.Velocities) != 2 || len(mol.Boxes) != 2 {
+		Te.Fatalf("Wrong GRO data: %d atoms %d frames %d velocities %d boxes", mol.Len(), mol.NFrames(), len(mol.Velocities), len(mol.Boxes))
+	}
+	at := mol.Atom(5)
+	if at.Name != "HW1" || at.Molname != "SOL" || at.MolID != 2 || at.ID != 6 || at.Symbol != "H" {
+		Te.Errorf("Wrong atom read: %v", at)
+	}
+	if math.Abs(mol.Coords[1].At(7, 1)-21.1) > 0.0001 || math.Abs(mol.Velocities[1].At(0, 1)-1.5) > 0.0001 {
+		Te.Errorf("Wrong coordinates or velocities read: %v %v", mol.Coords[1].VecView(7), mol.Velocities[1].VecView(0))
+	}
+	a, b, _, _, _, gamma := mol.FrameBox(0).Params()
+	if math.Abs(a-30) > 0.001 || math.Abs(b-30) > 0.001 || math.Abs(gamma-70.53) > 0.01 || math.Abs(mol.FrameBox(0).Volume()-30*28.2843*24.4949) > 0.1 {
+		Te.Errorf("Wrong box read: %v", mol.FrameBox(0))
+	}
+	sel, err := Select(mol, "resname SOL and name HW*")
+	if err != nil || len(sel) != 2 {
+		Te.Errorf("Couldn't select the water hydrogens: %v %v", sel, err)
+	}
+	if err := GROFileWrite("test/sampleIO.gro", mol, "goChem test"); err != nil {
+		Te.Fatal(err)
+	}
+	mol2, err := GROFileRead("test/sampleIO.gro")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if mol2.NFrames() != 2 || len(mol2.Velocities) != 2 || len(mol2.Boxes) != 2 {
+		Te.Fatalf("GRO file not written correctly")
+	}
+	for i := 0; i < 2; i++ {
+		for j := 0; j < mol.Len(); j++ {
+			for k := 0; k < 3; k++ {
+				if math.Abs(mol.Coords[i].At(j, k)-mol2.Coords[i].At(j, k)) > 0.001 || math.Abs(mol.Velocities[i].At(j, k)-mol2.Velocities[i].At(j, k)) > 0.0001 {
+					Te.Fatalf("Written and read GRO data differ in frame %d atom %d", i, j)
+				}
+			}
+		}
+		if math.Abs(mol.FrameBox(i).Volume()-mol2.FrameBox(i).Volume()) > 0.01 {
+			Te.Errorf("Written and read boxes differ in frame %d", i)
+		}
+	}
+	//Reading it as a trajectory
+	frame := v3.Zeros(mol2.Len())
+	read := 0
+	for mol2.Next(frame) == nil {
+		read++
+	}
+	if read != 2 {
+		Te.Errorf("Read %d frames instead of 2", read)
+	}
+}
+
+//TestCIF reads a 2-model mmCIF file with alternative locations, multi-character chains and large
+//atom numbers, checks author and label numbering, and writes a PDB structure as mmCIF and reads it back.
+func TestCIF(Te *testing.T) {
+	mol, err := CIFFileRead("test/sample.cif")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if mol.Len() != 7 || mol.NFrames() != 2 {
+		Te.Fatalf("Wrong mmCIF data: %d atoms %d models", mol.Len(), mol.NFrames())
+	}
+	if at := mol.Atom(3); at.Char16 != 'B' || at.Chain != "AAA" || at.MolID != 101 || math.Abs(at.Occupancy-0.4) > 0.001 {
+		Te.Errorf("Wrong alternative location atom: %v", at)
+	}
+	if at := mol.Atom(5); at.Name != "O5'" || at.Symbol != "O" {
+		Te.Errorf("Wrong quoted atom name: %v", at)
+	}
+	if at := mol.Atom(6); at.ID != 100000 || !at.Het || at.Charge != 2 || at.Mass == 0 {
+		Te.Errorf("Wrong hetero atom: %v", at)
+	}
+	if math.Abs(mol.Coords[1].At(0, 0)-10.1) > 0.0001 || math.Abs(mol.Bfactors[1][6]-15) > 0.0001 {
+		Te.Errorf("Wrong coordinates or b-factors in the second model")
+	}
+	if b := mol.FrameBox(0); b == nil || math.Abs(b.Volume()-40*50*60*math.Sin(100*math.Pi/180)) > 0.01 {
+		Te.Errorf("Wrong box read: %v", b)
+	}
+	lab, err := CIFFileRead("test/sample.cif", true)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if at := lab.Atom(0); at.Chain != "A" || at.MolID != 1 {
+		Te.Errorf("Label numbering not used: %v", at)
+	}
+	if at := lab.Atom(6); at.Chain != "C" || at.MolID != 201 {
+		Te.Errorf("Wrong fallback to author numbering: %v", at)
+	}
+	pdb, err := PDBFileRead("test/2c9v.pdb", true)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if err := CIFFileWrite("test/2c9vIO.cif", pdb.Coords[0], pdb, pdb.Bfactors[0], NewOrthoBox(50, 60, 70)); err != nil {
+		Te.Fatal(err)
+	}
+	mol2, err := CIFFileRead("test/2c9vIO.cif")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if mol2.Len() != pdb.Len() || mol2.FrameBox(0) == nil {
+		Te.Fatalf("mmCIF file not written correctly: %d atoms instead of %d", mol2.Len(), pdb.Len())
+	}
+	for i := 0; i < pdb.Len(); i++ {
+		a, b := pdb.Atom(i), mol2.Atom(i)
+		if a.Name != b.Name || strings.TrimSpace(a.Molname) != b.Molname || a.MolID != b.MolID || a.Chain != b.Chain ||
+			math.Abs(pdb.Coords[0].At(i, 2)-mol2.Coords[0].At(i, 2)) > 0.001 || math.Abs(pdb.Bfactors[0][i]-mol2.Bfactors[0][i]) > 0.01 {
+			Te.Fatalf("Written and read atoms %d differ: %v %v", i, a, b)
+		}
+	}
+	//Molecules without atom IDs are numbered sequentially.
+	xyz, err := XYZFileRead("test/sample.xyz")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if err := CIFFileWrite("test/sampleIO.cif", xyz.Coords[0], xyz, nil); err != nil {
+		Te.Fatal(err)
+	}
+	mol3, err := CIFFileRead("test/sampleIO.cif")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for i := 0; i < mol3.Len(); i++ {
+		if mol3.Atom(i).ID != i+1 {
+			Te.Fatalf("Wrong ID for atom %d without ID: %d", i, mol3.Atom(i).ID)
+		}
+	}
+}
+
+//TestMOL2 reads a MOL2 file with two poses, writes it and reads it back.
+func TestMOL2(Te *testing.T) {
+	mol, err := MOL2FileRead("test/sample.mol2")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if mol.Len() != 6 || mol.NFrames() != 2 || len(mol.Bonds()) != 4 {
+		Te.Fatalf("Wrong MOL2 data: %d atoms %d frames %d bonds", mol.Len(), mol.NFrames(), len(mol.Bonds()))
+	}
+	if at := mol.Atom(2); at.Type != "O.co2" || at.Symbol != "O" || at.Molname != "ACT" || at.Chain != "A" || math.Abs(at.Charge+0.8) > 0.0001 {
+		Te.Errorf("Wrong atom read: %v", at)
+	}
+	if at := mol.Atom(4); at.MolID != 2 || at.Chain != "B" || at.Name != "N1" {
+		Te.Errorf("Wrong atom read: %v", at)
+	}
+	if b := mol.Bonds()[1]; b.At1 != 1 || b.At2 != 2 || b.Order != 1.5 {
+		Te.Errorf("Wrong aromatic bond read: %v", b)
+	}
+	if math.Abs(mol.Coords[1].At(0, 0)-1) > 0.0001 {
+		Te.Errorf("Wrong coordinates in the second pose")
+	}
+	if err := MOL2FileWrite("test/sampleIO.mol2", mol.Coords[0], mol, "test"); err != nil {
+		Te.Fatal(err)
+	}
+	mol2, err := MOL2FileRead("test/sampleIO.mol2")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if mol2.Len() != mol.Len() || len(mol2.Bonds()) != 4 || mol2.Bonds()[2].Order != 1.5 {
+		Te.Fatalf("MOL2 file not written correctly")
+	}
+	for i := 0; i < mol.Len(); i++ {
+		a, b := mol.Atom(i), mol2.Atom(i)
+		if a.Name != b.Name || a.Type != b.Type || a.Charge != b.Charge || a.MolID != b.MolID || a.Chain != b.Chain || a.Molname != b.Molname {
+			Te.Errorf("Written and read atoms %d differ: %v %v", i, a, b)
+		}
+	}
+	//Unknown bond orders are written as such, orders without a Tripos bond type give an error.
+	var buf strings.Builder
+	mol.Bonds()[0].Order = 0
+	if err := MOL2Write(&buf, mol.Coords[0], mol, "test"); err != nil || !strings.Contains(buf.String(), "     1     1     2 un\n") {
+		Te.Errorf("Unknown bond order not written: %v\n%s", err, buf.String())
+	}
+	mol.Bonds()[0].Order = 2.5
+	if err := MOL2Write(&buf, mol.Coords[0], mol, "test"); err == nil {
+		Te.Errorf("No error writing a bond of order 2.5")
+	}
+}
+
+//TestPSF reads a PSF file in the standard format, with some empty segment names, and the same
+//system in the EXT XPLOR format, and checks that the connectivity survives selecting and deleting atoms.
+func TestPSF(Te *testing.T) {
+	top, err := PSFFileRead("test/sample.psf")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	ext, err := PSFFileRead("test/sample_ext.psf")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for _, t := range []*Topology{top, ext} {
+		if t.Len() != 10 || len(t.Bonds()) != 7 || len(t.Angles()) != 8 || len(t.Dihedrals()) != 3 || len(t.Impropers()) != 1 || t.Charge() != 1 {
+			Te.Fatalf("Wrong PSF data: %d atoms %d bonds %d angles %d dihedrals %d impropers, charge %d", t.Len(), len(t.Bonds()), len(t.Angles()), len(t.Dihedrals()), len(t.Impropers()), t.Charge())
+		}
+		if at := t.Atom(1); at.Name != "OG" || at.Type != "OH1" || at.Symbol != "O" || at.Chain != "MEOH" || at.Molname != "MEO" || math.Abs(at.Charge+0.66) > 0.0001 || math.Abs(at.Mass-15.999) > 0.0001 {
+			Te.Errorf("Wrong atom read: %v", at)
+		}
+		if at := t.Atom(9); at.Symbol != "Na" || at.MolID != 2 || at.ID != 10 {
+			Te.Errorf("Wrong atom read: %v", at)
+		}
+		if a := t.Angles()[6]; a[0] != 0 || a[1] != 1 || a[2] != 2 {
+			Te.Errorf("Wrong angle read: %v", a)
+		}
+	}
+	if top.Atom(7).Chain != "" || ext.Atom(7).Chain != "SOLV" || top.Atom(7).Molname != "TIP3" {
+		Te.Errorf("Wrong segments read: %q %q", top.Atom(7).Chain, ext.Atom(7).Chain)
+	}
+	water := new(Topology)
+	water.SomeAtoms(top, []int{6, 7, 8})
+	if len(water.Bonds()) != 2 || len(water.Angles()) != 1 || len(water.Dihedrals()) != 0 || water.Angles()[0][1] != 0 {
+		Te.Errorf("Wrong connectivity after selecting the water: %v %v", water.Bonds(), water.Angles())
+	}
+	top.DelAtom(2)
+	if len(top.Bonds()) != 6 || len(top.Angles()) != 7 || len(top.Dihedrals()) != 0 || len(top.Impropers()) != 1 || top.Angles()[6][1] != 5 {
+		Te.Errorf("Wrong connectivity after deleting an atom: %v %v", top.Angles(), top.Dihedrals())
+	}
+	//The symbols are guessed from the names, confirmed by the masses, even with hydrogen mass repartitioning.
+	for _, v := range []struct {
+		name   string
+		mass   float64
+		symbol string
+	}{{"N", 11.991, "N"}, {"CB", 7.979, "C"}, {"HN", 3.024, "H"}, {"CT1", 12.011, "C"}, {"SOD", 22.99, "Na"}, {"CLA", 35.45, "Cl"}, {"OH2", 15.999, "O"}} {
+		if s, _ := symbolFromNameMass(v.name, v.mass); s != v.symbol {
+			Te.Errorf("Wrong symbol for %s with mass %f: %s instead of %s", v.name, v.mass, s, v.symbol)
+		}
+	}
+	merged := MergeAtomers(ext, ext)
+	if merged.Len() != 20 || len(merged.Bonds()) != 14 || len(merged.Angles()) != 16 || len(merged.Dihedrals()) != 6 || len(merged.Impropers()) != 2 {
+		Te.Fatalf("Wrong connectivity after merging: %d bonds %d angles %d dihedrals %d impropers", len(merged.Bonds()), len(merged.Angles()), len(merged.Dihedrals()), len(merged.Impropers()))
+	}
+	if a, b := merged.Angles()[6], merged.Angles()[14]; b[0] != a[0]+10 || b[1] != a[1]+10 || b[2] != a[2]+10 {
+		Te.Errorf("Wrong merged angles: %v %v", a, b)
+	}
+	if _, err := PSFRead(strings.NewReader("PSF\n\n       1 !NTITLE\n title\n\n      -3 !NATOM\n")); err == nil {
+		Te.Errorf("No error for a negative number of atoms")
+	}
+}
+
+//TestPrmtop reads an AMBER prmtop file with a dihedral with two terms and an improper.
+func TestPrmtop(Te *testing.T) {
+	top, err := PrmtopFileRead("test/sample.prmtop")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if top.Len() != 10 || len(top.Bonds()) != 8 || len(top.Angles()) != 7 || len(top.Dihedrals()) != 3 || len(top.Impropers()) != 1 || top.Charge() != 1 {
+		Te.Fatalf("Wrong prmtop data: %d atoms %d bonds %d angles %d dihedrals %d impropers, charge %d", top.Len(), len(top.Bonds()), len(top.Angles()), len(top.Dihedrals()), len(top.Impropers()), top.Charge())
+	}
+	if at := top.Atom(1); at.Name != "O1" || at.Type != "OH" || at.Symbol != "O" || at.Molname != "MOH" || at.MolID != 1 || math.Abs(at.Charge+0.66) > 0.0001 || math.Abs(at.Mass-16) > 0.0001 {
+		Te.Errorf("Wrong atom read: %v", at)
+	}
+	if at := top.Atom(9); at.Name != "Na+" || at.Symbol != "Na" || at.MolID != 3 || at.ID != 10 {
+		Te.Errorf("Wrong atom read: %v", at)
+	}
+	if b := top.Bonds()[0]; b.At1 != 1 || b.At2 != 2 {
+		Te.Errorf("Wrong bond read: %v", b)
+	}
+	if d := top.Impropers()[0]; d[0] != 0 || d[1] != 3 || d[2] != 1 || d[3] != 4 {
+		Te.Errorf("Wrong improper read: %v", d)
+	}
+}
+
+//TestGMXTop reads a GROMACS topology with included files, some in an include directory, and
+//conditional sections, and checks that the molecules are repeated as given in the molecules section.
+func TestGMXTop(Te *testing.T) {
+	if _, err := GMXTopFileRead("test/gmx/topol.top"); err == nil && os.Getenv("GMXLIB") == "" {
+		Te.Errorf("Included file not in the include directories was found")
+	}
+	top, err := GMXTopFileRead("test/gmx/topol.top", "test/gmxlib")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if top.Len() != 19 || len(top.Bonds()) != 14 || len(top.Angles()) != 14 || len(top.Dihedrals()) != 6 || len(top.Impropers()) != 2 || top.Charge() != 1 {
+		Te.Fatalf("Wrong GROMACS topology data: %d atoms %d bonds %d angles %d dihedrals %d impropers, charge %d", top.Len(), len(top.Bonds()), len(top.Angles()), len(top.Dihedrals()), len(top.Impropers()), top.Charge())
+	}
+	if at := top.Atom(7); at.Name != "O1" || at.Type != "OH" || at.Symbol != "O" || at.MolID != 2 || at.ID != 8 || math.Abs(at.Mass-16) > 0.0001 || math.Abs(at.Charge+0.66) > 0.0001 {
+		Te.Errorf("Wrong atom read: %v", at)
+	}
+	if at := top.Atom(10); at.Name != "H2" || math.Abs(at.Mass-1.008) > 0.0001 {
+		Te.Errorf("Wrong atom read from a continued line: %v", at)
+	}
+	if at := top.Atom(18); at.Name != "NA" || at.Symbol != "Na" || at.MolID != 5 || math.Abs(at.Mass-22.99) > 0.0001 {
+		Te.Errorf("Wrong atom read: %v", at)
+	}
+	if b := top.Bonds()[13]; b.At1 != 15 || b.At2 != 17 {
+		Te.Errorf("Wrong bond from the settles read: %v", b)
+	}
+	if a := top.Angles()[13]; a[0] != 6 || a[1] != 7 || a[2] != 8 {
+		Te.Errorf("Wrong angle read: %v", a)
+	}
+}
+
+//TestSDF reads an SD file with a V2000 and a V3000 record, and writes both, in the V2000 and V3000
+//formats, and reads them back.
+func TestSDF(Te *testing.T) {
+	mols, data, err := SDFFileRead("test/sample.sdf")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if len(mols) != 2 || len(data) != 2 {
+		Te.Fatalf("Read %d records instead of 2", len(mols))
+	}
+	ac, bz := mols[0], mols[1]
+	if ac.Len() != 7 || len(ac.Bonds()) != 6 || ac.Bonds()[1].Order != 2 || ac.Atom(3).Charge != -1 || ac.Charge() != -1 {
+		Te.Errorf("Wrong V2000 record read: %d atoms %d bonds", ac.Len(), len(ac.Bonds()))
+	}
+	if data[0]["_Name"] != "acetate" || data[0]["PUBCHEM_COMPOUND_CID"] != "175" || data[0]["COMMENT"] != "first line\nsecond line" {
+		Te.Errorf("Wrong data items: %v", data[0])
+	}
+	if bz.Len() != 12 || len(bz.Bonds()) != 12 || bz.Bonds()[0].Order != 1.5 || bz.Atom(6).Symbol != "H" || math.Abs(bz.Coords[0].At(0, 0)-1.39) > 0.0001 {
+		Te.Errorf("Wrong V3000 record read: %d atoms %d bonds", bz.Len(), len(bz.Bonds()))
+	}
+	if data[1]["SMILES"] != "c1ccccc1" {
+		Te.Errorf("Wrong data items: %v", data[1])
+	}
+	//A large molecule, to be written in the V3000 format.
+	big, err := PDBFileRead("test/2c9v.pdb", false)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if err := big.AssignBonds(big.Coords[0], DefaultBondTolerance); err != nil {
+		Te.Fatal(err)
+	}
+	out, err := os.Create("test/sampleIO.sdf")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for i, m := range []*Molecule{ac, bz, big} {
+		if i == 2 {
+			data = append(data, map[string]string{"_Name": "2c9v"})
+		}
+		if err := SDFWrite(out, m.Coords[0], m, data[i]); err != nil {
+			Te.Fatal(err)
+		}
+	}
+	out.Close()
+	mols2, data2, err := SDFFileRead("test/sampleIO.sdf")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if len(mols2) != 3 {
+		Te.Fatalf("Read %d records instead of 3", len(mols2))
+	}
+	for i, m := range []*Molecule{ac, bz, big} {
+		m2 := mols2[i]
+		if m2.Len() != m.Len() || len(m2.Bonds()) != len(m.Bonds()) || data2[i]["_Name"] != data[i]["_Name"] {
+			Te.Fatalf("Record %d not written correctly", i)
+		}
+		if m2.Charge() != m.Charge() || math.Abs(m2.Coords[0].At(m.Len()-1, 1)-m.Coords[0].At(m.Len()-1, 1)) > 0.0001 {
+			Te.Errorf("Record %d: Written and read data differ", i)
+		}
+	}
+	if data2[0]["COMMENT"] != data[0]["COMMENT"] {
+		Te.Errorf("Data items not written correctly: %v", data2[0])
+	}
+	if _, _, err := SDFRead(strings.NewReader("bad\n\n\n -2  0  0  0  0  0  0  0  0  0999 V2000\nM  END\n$$$$\n")); err == nil {
+		Te.Errorf("No error for a negative number of atoms")
+	}
+}
+
+//TestTrajFiles reads multi-XYZ and multi-model PDB files as streaming trajectories, with Next and NextConc,
+//and compares the frames with those read by XYZFileRead and PDBFileRead.
+func TestTrajFiles(Te *testing.T) {
+	mol, err := XYZFileRead("test/sample.xyz")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	first, xyz, err := XYZFileAsTraj("test/sample.xyz")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if first.Len() != mol.Len() || first.Atom(0).Symbol != mol.Atom(0).Symbol || xyz.Len() != mol.Len() {
+		Te.Fatalf("Wrong topology read")
+	}
+	var traj Traj = xyz
+	frame := v3.Zeros(xyz.Len())
+	for i := 0; ; i++ {
+		err := traj.Next(frame)
+		if err != nil {
+			if _, ok := err.(LastFrameError); ok && i == mol.NFrames() {
+				break
+			}
+			Te.Fatalf("Error at frame %d: %v", i, err)
+		}
+		if d := frame.At(5, 2) - mol.Coords[i].At(5, 2); math.Abs(d) > 0.00001 {
+			Te.Errorf("Frame %d differs from that read with XYZFileRead", i)
+		}
+	}
+	//Now a multi-model PDB, with one box per model.
+	pdb, err := PDBFileRead("test/2c9v.pdb", true)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	coords := []*v3.Matrix{pdb.Coords[0], v3.Zeros(pdb.Len()), v3.Zeros(pdb.Len())}
+	boxes := []*Box{NewOrthoBox(50, 50, 50), NewOrthoBox(51, 51, 51), NewOrthoBox(52, 52, 52)}
+	for i := 1; i < 3; i++ {
+		coords[i].AddFloat(pdb.Coords[0], float64(i))
+	}
+	out, err := os.Create("test/2c9vMulti.pdb")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if err := MultiPDBWrite(out, coords, pdb, nil, boxes...); err != nil {
+		Te.Fatal(err)
+	}
+	out.Close()
+	first2, ptraj, err := PDBFileAsTraj("test/2c9vMulti.pdb", true)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if first2.Len() != pdb.Len() || first2.Atom(10).Name != pdb.Atom(10).Name || first2.FrameBox(0) == nil {
+		Te.Fatalf("Wrong topology read from multi-model PDB")
+	}
+	var ctraj ConcTraj = ptraj
+	frames := []*v3.Matrix{v3.Zeros(ptraj.Len()), nil}
+	read := 0
+	for {
+		chans, err := ctraj.NextConc(frames)
+		if err != nil {
+			if _, ok := err.(LastFrameError); !ok {
+				Te.Fatal(err)
+			}
+		}
+		for i, c := range chans {
+			if c == nil {
+				continue
+			}
+			f := <-c
+			n := read + i
+			if math.Abs(f.At(7, 0)-coords[n].At(7, 0)) > 0.001 {
+				Te.Errorf("Model %d differs from the one written", n)
+			}
+		}
+		read += len(frames)
+		if err != nil {
+			break
+		}
+	}
+	if read != 4 {
+		Te.Errorf("Wrong number of models read: %d calls to NextConc instead of 2", read/2)
+	}
+	if b := ptraj.Box(); b == nil || math.Abs(b.Volume()-52*52*52) > 0.1 {
+		Te.Errorf("Wrong box for the last model: %v", b)
+	}
+}
+
+//TestExtendedXYZ reads an extended XYZ file with a lattice, energies and per-atom properties, writes
+//it back, and checks that the energies in ORCA and xtb comment lines are read.
+func TestExtendedXYZ(Te *testing.T) {
+	mol, err := XYZFileRead("test/sample.extxyz")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if mol.NFrames() != 2 || len(mol.Info) != 2 || len(mol.Boxes) != 2 {
+		Te.Fatalf("Wrong extended XYZ data: %d frames %d infos %d boxes", mol.NFrames(), len(mol.Info), len(mol.Boxes))
+	}
+	info := mol.Info[1]
+	if !info.HasEnergy || info.Energy != -76.4325 || info.Keys["config_type"] != "water dimer" || info.Keys["converged"] != "T" {
+		Te.Errorf("Wrong comment line data: %v", info)
+	}
+	f := info.Forces()
+	if f == nil || math.Abs(f.At(0, 2)-0.015) > 1e-8 {
+		Te.Errorf("Wrong forces read: %v", f)
+	}
+	if p := info.Property("fixed"); p == nil || p.Type != 'L' || p.Values[1] != 1 || p.Values[2] != 0 {
+		Te.Errorf("Wrong logical property read: %v", p)
+	}
+	if mol.Atom(0).Charge != -0.834 || math.Abs(mol.Coords[1].At(1, 1)-0.76) > 1e-8 {
+		Te.Errorf("Wrong charges or coordinates read")
+	}
+	if err := XYZFileWrite("test/sampleIO.extxyz", mol.Coords[1], mol, info); err != nil {
+		Te.Fatal(err)
+	}
+	mol2, err := XYZFileRead("test/sampleIO.extxyz")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	info2 := mol2.Info[0]
+	if info2.Energy != info.Energy || info2.Keys["pbc"] != "T T T" || mol2.FrameBox(0) == nil || len(info2.Properties) != 3 {
+		Te.Errorf("Extended XYZ data not written correctly: %v", info2)
+	}
+	if f2 := info2.Forces(); f2 == nil || math.Abs(f2.At(1, 2)-f.At(1, 2)) > 1e-6 {
+		Te.Errorf("Forces not written correctly")
+	}
+	for _, c := range [][2]string{{"Coordinates from ORCA-job input E -154.098765432", "-154.098765432"}, {" energy: -5.070544440612 gnorm: 0.000377220153 xtb: 6.4.1 (unknown)", "-5.070544440612"}} {
+		inf, _ := parseXYZComment(c[0])
+		if !inf.HasEnergy || strconv.FormatFloat(inf.Energy, 'f', -1, 64) != c[1] {
+			Te.Errorf("Energy not read from comment line %s: %v", c[0], inf)
+		}
+	}
+	//Comment lines with keys that can't be parsed are taken as plain comments.
+	for _, c := range []string{"cell Lattice=10 10 10", "Properties=species:S:1:pos:R", "E -1.5 Lattice=\"1 2\""} {
+		inf, layout := parseXYZComment(c)
+		if inf.Comment != c || inf.Box != nil || len(inf.Keys) != 0 || len(layout) != 2 {
+			Te.Errorf("Comment line %q not taken as a plain comment: %v", c, inf)
+		}
+	}
+	//Quotes and backslashes in values are escaped.
+	inf, _ := parseXYZComment(xyzCommentLine(&FrameInfo{Keys: map[string]string{"note": "a \"quoted\" \\ value", "x": "1"}}))
+	if inf.Keys["note"] != "a \"quoted\" \\ value" || inf.Keys["x"] != "1" {
+		Te.Errorf("Quoted values not written or read correctly: %v", inf.Keys)
+	}
+	//The per-atom properties follow the atoms when they are swapped or deleted.
+	fz := mol.Info[1].Forces().At(1, 2)
+	fixed := mol.Info[1].Property("fixed")
+	q1 := fixed.Values[1]
+	mol.Swap(0, 1)
+	if mol.Info[1].Forces().At(0, 2) != fz || fixed.Values[0] != q1 {
+		Te.Errorf("Per-atom properties not swapped")
+	}
+	if err := mol.Del(1); err != nil {
+		Te.Fatal(err)
+	}
+	if f := mol.Info[1].Forces(); f == nil || f.NVecs() != mol.Len() || len(fixed.Values) != mol.Len() || f.At(0, 2) != fz {
+		Te.Errorf("Per-atom properties not deleted correctly")
+	}
+	//The time and step are taken from the frame info, if available, and are NaN and -1 otherwise.
+	var traj TrajMeta = mol
+	mol.Info[1].Keys["Time"] = "1.5"
+	mol.Info[1].Keys["step"] = "20"
+	for i := 0; traj.Next(nil) == nil; i++ {
+		if i == 1 && (traj.Step() != 20 || traj.Time() != 1.5) {
+			Te.Errorf("Frame %d has step %d and time %f", i, traj.Step(), traj.Time())
+		} else if i != 1 && (traj.Step() != -1 || !math.IsNaN(traj.Time())) {
+			Te.Errorf("Frame %d without time or step has step %d and time %f", i, traj.Step(), traj.Time())
+		}
+	}
+}
+
+//TestGEN reads a cluster and a periodic GEN file, and writes and reads back the latter.
+func TestGEN(Te *testing.T) {
+	mol, err := GENFileRead("test/sample.gen")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if mol.Len() != 3 || mol.Atom(0).Symbol != "O" || mol.Atom(2).Symbol != "H" || len(mol.Boxes) != 0 {
+		Te.Errorf("Wrong cluster GEN file read")
+	}
+	if math.Abs(mol.Coords[0].At(1, 1)-0.763239) > 1e-8 {
+		Te.Errorf("Wrong coordinates read: %v", mol.Coords[0])
+	}
+	mol, err = GENFileRead("test/sample_frac.gen")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if mol.Len() != 2 || mol.Atom(1).Symbol != "Si" || mol.FrameBox(0) == nil {
+		Te.Fatalf("Wrong periodic GEN file read")
+	}
+	//The fractional coordinates are converted to cartesian.
+	if math.Abs(mol.Coords[0].At(1, 0)-1.357650) > 1e-6 || math.Abs(mol.Coords[0].At(1, 2)-1.357650) > 1e-6 {
+		Te.Errorf("Wrong fractional coordinates conversion: %v", mol.Coords[0])
+	}
+	if err := GENFileWrite("test/sampleIO.gen", mol.Coords[0], mol, mol.FrameBox(0)); err != nil {
+		Te.Fatal(err)
+	}
+	mol2, err := GENFileRead("test/sampleIO.gen")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if mol2.Len() != 2 || mol2.FrameBox(0) == nil || math.Abs(mol2.Coords[0].At(1, 1)-mol.Coords[0].At(1, 1)) > 1e-6 {
+		Te.Errorf("GEN file not written correctly")
+	}
+	if math.Abs(mol2.FrameBox(0).Vectors().At(2, 0)-2.7153) > 1e-6 {
+		Te.Errorf("Box not written correctly: %v", mol2.FrameBox(0).Vectors())
+	}
+	if _, err := GENRead(strings.NewReader("-2 C\nO H\n")); err == nil {
+		Te.Errorf("No error for a negative number of atoms")
+	}
+}
+
+//TestCompression writes and reads back the sample PDB file compressed in each supported format.
+//bzip2 and xz are only tested if the corresponding programs are available.
+func TestCompression(Te *testing.T) {
+	mol, err := PDBFileRead("test/2c9v.pdb", true)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for _, ext := range []string{".gz", ".bz2", ".xz"} {
+		comp := CompressionFromName("x" + ext)
+		if comp != Gzip {
+			if _, err := exec.LookPath(comp); err != nil {
+				Te.Logf("%s not found, %s compression not tested", comp, comp)
+				continue
+			}
+		}
+		name := "test/2c9vIO.pdb" + ext
+		if err := PDBFileWrite(name, mol.Coords[0], mol, mol.Bfactors[0]); err != nil {
+			Te.Fatal(err)
+		}
+		if c, err := Compression(name); err != nil || c != comp {
+			Te.Errorf("Compression of %s detected as %q, not %q: %v", name, c, comp, err)
+		}
+		mol2, err := PDBFileRead(name, true)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if mol2.Len() != mol.Len() || mol2.Coords[0].At(10, 1) != mol.Coords[0].At(10, 1) {
+			Te.Errorf("%s not read back correctly", name)
+		}
+		if comp != Xz {
+			continue
+		}
+		//A corrupt xz file gives an error, not just a truncated file.
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if err := ioutil.WriteFile("test/2c9vIOcorrupt.pdb.xz", data[:len(data)/2], 0644); err != nil {
+			Te.Fatal(err)
+		}
+		f, err := OpenFile("test/2c9vIOcorrupt.pdb.xz")
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(f); err == nil {
+			Te.Errorf("No error reading a corrupt xz file")
+		}
+		if err := f.Close(); err == nil {
+			Te.Errorf("No error closing a corrupt xz file")
+		}
+		//Closing the file before reading it to the end is fine.
+		f, err = OpenFile(name)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		f.Read(make([]byte, 10))
+		if err := f.Close(); err != nil {
+			Te.Errorf("Error closing an xz file early: %v", err)
+		}
+	}
+}
+
+//TestNeighbors compares the results of neighbor searches with those of brute-force searches.
+func TestNeighbors(Te *testing.T) {
+	mol, err := PDBFileRead("test/1uxm.pdb", false)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	coords := mol.Coords[0]
+	brute := func(i int, r float64, box *Box) []int {
+		ret := []int{}
+		for j := 0; j < coords.NVecs(); j++ {
+			if MinImageDistance(coords.VecView(i), coords.VecView(j), box) <= r {
+				ret = append(ret, j)
+			}
+		}
+		return ret
+	}
+	for _, box := range []*Box{nil, mol.FrameBox(0)} {
+		index := NewNeighborIndex(coords, 5, box)
+		for i := 0; i < coords.NVecs(); i += 997 {
+			for _, r := range []float64{1.6, 5, 12} {
+				got := index.Within(coords.VecView(i), r)
+				exp := brute(i, r, box)
+				if fmt.Sprint(got) != fmt.Sprint(exp) {
+					Te.Errorf("Atom %d, radius %.1f periodic %v: Expected %v, got %v", i, r, box != nil, exp, got)
+				}
+			}
+			near := index.KNearest(coords.VecView(i), 10)
+			if len(near) != 10 || near[0] != i {
+				Te.Errorf("Wrong k-nearest neighbors for %d: %v", i, near)
+			}
+			d9 := MinImageDistance(coords.VecView(i), coords.VecView(near[9]), box)
+			if len(brute(i, d9-0.00001, box)) > 9 {
+				Te.Errorf("Neighbors closer than the 10th nearest for %d were missed", i)
+			}
+		}
+	}
+	sel, _ := v3.NewMatrix([]float64{0, 0, 0, 0.9, 0, 0, 9.5, 0, 0, 5, 5, 5})
+	pairs := NewNeighborIndex(sel, 1, NewOrthoBox(10, 10, 10)).Pairs(1)
+	if fmt.Sprint(pairs) != "[[0 1] [0 2]]" {
+		Te.Errorf("Wrong periodic pairs: %v", pairs)
+	}
+}
+
 func TestWater(Te *testing.T) {
 	//	runtime.GOMAXPROCS(2) ///////////////////////////
 	mol, err := XYZFileRead("test/sample.xyz")
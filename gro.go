@@ -0,0 +1,343 @@
+/*
+ * gro.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/gochem/v3"
+)
+
+//nm2A converts nm, the GROMACS length unit, to A.
+const nm2A = 10.0
+
+//GROFileRead reads a GROMACS GRO file, which may contain several frames, and
+//returns a Molecule with the coordinates (in A), the periodic boxes and,
+//if present, the velocities (in A/ps). Returns error or nil.
+func GROFileRead(groname string) (*Molecule, error) {
+	grofile, err := OpenFile(groname)
+	if err != nil {
+		return nil, errDecorate(err, "GROFileRead")
+	}
+	defer grofile.Close()
+	mol, err := GRORead(grofile)
+	if err != nil {
+		return nil, errDecorate(err, "GROFileRead "+fmt.Sprintf("error in file %s", groname))
+	}
+	return mol, nil
+}
+
+//GRORead reads a GROMACS GRO file from an io.Reader. The topology is taken from the first
+//frame, only coordinates, velocities and boxes are read for the following frames.
+//Velocities are kept only if all frames contain them. Returns a Molecule and error or nil.
+func GRORead(grop io.Reader) (*Molecule, error) {
+	gro := bufio.NewReader(grop)
+	var top *Topology
+	coords := make([]*v3.Matrix, 0, 1)
+	vels := make([]*v3.Matrix, 0, 1)
+	boxes := make([]*Box, 0, 1)
+	for frame := 0; ; frame++ {
+		c, v, box, ats, err := groReadSnap(gro, frame == 0)
+		if err != nil {
+			//An empty file is only acceptable after the first frame.
+			if frame > 0 && strings.Contains(err.Error(), "Empty") {
+				break
+			}
+			return nil, errDecorate(err, "GRORead")
+		}
+		if frame == 0 {
+			top = NewTopology(0, 1, ats)
+		} else if c.NVecs() != top.Len() {
+			return nil, CError{fmt.Sprintf("Frame %d has %d atoms instead of %d", frame, c.NVecs(), top.Len()), []string{"GRORead"}}
+		}
+		coords = append(coords, c)
+		if v != nil {
+			vels = append(vels, v)
+		}
+		boxes = append(boxes, box)
+	}
+	bfactors := make([][]float64, len(coords), len(coords))
+	for key := range bfactors {
+		bfactors[key] = make([]float64, top.Len())
+	}
+	mol, err := NewMolecule(coords, top, bfactors)
+	if err != nil {
+		return nil, errDecorate(err, "GRORead")
+	}
+	if len(vels) == len(coords) {
+		mol.Velocities = vels
+	}
+	//A GRO file always has a box line, but a zero box means no box at all.
+	for _, b := range boxes {
+		if b == nil {
+			return mol, nil
+		}
+	}
+	mol.Boxes = boxes
+	return mol, nil
+}
+
+//groReadSnap reads one frame from a GRO file. It returns the coordinates, the velocities (nil if
+//the frame has none), the box (nil if the box line is zero), the atoms (only if readTopol is true) and
+//an error or nil.
+func groReadSnap(gro *bufio.Reader, readTopol bool) (*v3.Matrix, *v3.Matrix, *Box, []*Atom, error) {
+	line, err := gro.ReadString('\n')
+	if err != nil && (err != io.EOF || strings.TrimSpace(line) == "") {
+		return nil, nil, nil, nil, CError{"Empty GRO file", []string{"bufio.Reader.ReadString", "groReadSnap"}}
+	}
+	line, err = gro.ReadString('\n')
+	if err != nil {
+		return nil, nil, nil, nil, CError{fmt.Sprintf("Ill formatted GRO file: %s", err.Error()), []string{"bufio.Reader.ReadString", "groReadSnap"}}
+	}
+	natoms, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		return nil, nil, nil, nil, CError{fmt.Sprintf("Wrong header for a GRO file %s", err.Error()), []string{"strconv.Atoi", "groReadSnap"}}
+	}
+	var atoms []*Atom
+	if readTopol {
+		atoms = make([]*Atom, natoms, natoms)
+	}
+	coords := make([]float64, natoms*3, natoms*3)
+	var vels []float64
+	width := 0
+	for i := 0; i < natoms; i++ {
+		line, err = gro.ReadString('\n')
+		if err != nil && !(err == io.EOF && len(line) > 0) {
+			return nil, nil, nil, nil, CError{fmt.Sprintf("GRO file ended at atom %d of %d", i+1, natoms), []string{"bufio.Reader.ReadString", "groReadSnap"}}
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if width == 0 {
+			width, err = groFieldWidth(line)
+			if err != nil {
+				return nil, nil, nil, nil, errDecorate(err, "groReadSnap")
+			}
+		}
+		if len(line) < 20+3*width {
+			return nil, nil, nil, nil, CError{fmt.Sprintf("Line for atom %d ill formed", i+1), []string{"groReadSnap"}}
+		}
+		if readTopol {
+			atoms[i], err = groReadAtom(line, i)
+			if err != nil {
+				return nil, nil, nil, nil, errDecorate(err, "groReadSnap")
+			}
+		}
+		for j := 0; j < 3; j++ {
+			f := line[20+j*width : 20+(j+1)*width]
+			coords[i*3+j], err = strconv.ParseFloat(strings.TrimSpace(f), 64)
+			if err != nil {
+				return nil, nil, nil, nil, CError{err.Error(), []string{"strconv.ParseFloat", "groReadSnap"}}
+			}
+			coords[i*3+j] *= nm2A
+		}
+		//velocities use the same field width as coordinates (but one more decimal)
+		if i == 0 && len(line) >= 20+6*width {
+			vels = make([]float64, natoms*3, natoms*3)
+		}
+		if vels == nil {
+			continue
+		}
+		if len(line) < 20+6*width {
+			return nil, nil, nil, nil, CError{fmt.Sprintf("Missing velocities for atom %d", i+1), []string{"groReadSnap"}}
+		}
+		for j := 0; j < 3; j++ {
+			start := 20 + (3+j)*width
+			vels[i*3+j], err = strconv.ParseFloat(strings.TrimSpace(line[start:start+width]), 64)
+			if err != nil {
+				return nil, nil, nil, nil, CError{err.Error(), []string{"strconv.ParseFloat", "groReadSnap"}}
+			}
+			vels[i*3+j] *= nm2A
+		}
+	}
+	line, err = gro.ReadString('\n')
+	if err != nil && !(err == io.EOF && len(line) > 0) {
+		return nil, nil, nil, nil, CError{"Missing box line in GRO file", []string{"bufio.Reader.ReadString", "groReadSnap"}}
+	}
+	box, err := groReadBox(line)
+	if err != nil {
+		return nil, nil, nil, nil, errDecorate(err, "groReadSnap")
+	}
+	mcoords, err := v3.NewMatrix(coords)
+	if err != nil {
+		return nil, nil, nil, nil, errDecorate(err, "groReadSnap")
+	}
+	var mvels *v3.Matrix
+	if vels != nil {
+		mvels, err = v3.NewMatrix(vels)
+		if err != nil {
+			return nil, nil, nil, nil, errDecorate(err, "groReadSnap")
+		}
+	}
+	return mcoords, mvels, box, atoms, nil
+}
+
+//groFieldWidth obtains the width of the coordinate fields in a GRO atom line from
+//the distance between the first two decimal points, as GROMACS does.
+func groFieldWidth(line string) (int, error) {
+	if len(line) > 20 {
+		first := strings.Index(line[20:], ".")
+		if first >= 0 {
+			second := strings.Index(line[20+first+1:], ".")
+			if second >= 0 {
+				return second + 1, nil
+			}
+		}
+	}
+	return 0, CError{"Couldn't determine the precision of the GRO file", []string{"groFieldWidth"}}
+}
+
+//groReadAtom parses the fixed-column part of a GRO atom line, the atom index is used if
+//the atom number can't be read.
+func groReadAtom(line string, index int) (*Atom, error) {
+	var err error
+	atom := new(Atom)
+	atom.MolID, err = strconv.Atoi(strings.TrimSpace(line[0:5]))
+	if err != nil {
+		return nil, CError{err.Error(), []string{"strconv.Atoi", "groReadAtom"}}
+	}
+	atom.Molname = strings.TrimSpace(line[5:10])
+	atom.Molname1 = three2OneLetter[atom.Molname]
+	atom.Name = strings.TrimSpace(line[10:15])
+	atom.ID, err = strconv.Atoi(strings.TrimSpace(line[15:20]))
+	if err != nil {
+		atom.ID = index + 1 //GRO files don't really need the atom numbers.
+	}
+	atom.Chain = " "
+	atom.Symbol, _ = symbolFromName(atom.Name)
+	if atom.Symbol != "" {
+		atom.Mass = symbolMass[atom.Symbol]
+	}
+	return atom, nil
+}
+
+//groReadBox reads the last line of a GRO frame. It contains either the three
+//sides of a rectangular box, or the nine components of the box vectors in the
+//order v1(x) v2(y) v3(z) v1(y) v1(z) v2(x) v2(z) v3(x) v3(y), in nm.
+//It returns nil and no error for a zero box.
+func groReadBox(line string) (*Box, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 && len(fields) != 9 {
+		return nil, CError{fmt.Sprintf("Wrong box line in GRO file: %s", line), []string{"groReadBox"}}
+	}
+	vals := make([]float64, 9, 9)
+	zero := true
+	for i, f := range fields {
+		var err error
+		vals[i], err = strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, CError{err.Error(), []string{"strconv.ParseFloat", "groReadBox"}}
+		}
+		vals[i] *= nm2A
+		if vals[i] != 0 {
+			zero = false
+		}
+	}
+	if zero {
+		return nil, nil
+	}
+	vecs, _ := v3.NewMatrix([]float64{
+		vals[0], vals[3], vals[4],
+		vals[5], vals[1], vals[6],
+		vals[7], vals[8], vals[2]})
+	box, err := NewBox(vecs)
+	return box, errDecorate(err, "groReadBox")
+}
+
+//GROFileWrite writes all the frames of mol, with their boxes and, if present, velocities
+//to a GRO file with name groname, which will be overwritten if it exists.
+//The optional title is written as the title line of each frame.
+func GROFileWrite(groname string, mol *Molecule, title ...string) error {
+	out, err := CreateFile(groname)
+	if err != nil {
+		return errDecorate(err, "GROFileWrite")
+	}
+	err = GROWrite(out, mol, title...)
+	if err != nil {
+		out.Close()
+		return errDecorate(err, "GROFileWrite")
+	}
+	return errDecorate(out.Close(), "GROFileWrite")
+}
+
+//GROWrite writes all the frames of mol, with their boxes and, if present, velocities
+//to out in GRO format. Coordinates are expected in A, and velocities in A/ps.
+//Frames without a box get a zero box line. The optional title is written as the title line of each frame.
+func GROWrite(out io.Writer, mol *Molecule, title ...string) error {
+	iowriterError := func(err error) error {
+		return CError{"Failed to write in io.Writer" + err.Error(), []string{"io.Writer.Write", "GROWrite"}}
+	}
+	t := "Written by goChem"
+	if len(title) > 0 {
+		t = strings.Replace(title[0], "\n", " ", -1)
+	}
+	withvels := len(mol.Velocities) == len(mol.Coords)
+	w := bufio.NewWriter(out)
+	for frame, coords := range mol.Coords {
+		if coords.NVecs() != mol.Len() {
+			return CError{fmt.Sprintf("Frame %d and the molecule don't have the same number of atoms", frame), []string{"GROWrite"}}
+		}
+		if withvels && mol.Velocities[frame].NVecs() != mol.Len() {
+			return CError{fmt.Sprintf("Velocities and the molecule don't have the same number of atoms in frame %d", frame), []string{"GROWrite"}}
+		}
+		fmt.Fprintf(w, "%s\n%5d\n", t, mol.Len())
+		for i := 0; i < mol.Len(); i++ {
+			at := mol.Atom(i)
+			//GRO numbers wrap around after 99999
+			fmt.Fprintf(w, "%5d%-5s%5s%5d%8.3f%8.3f%8.3f", at.MolID%100000, at.Molname, at.Name, at.ID%100000,
+				coords.At(i, 0)/nm2A, coords.At(i, 1)/nm2A, coords.At(i, 2)/nm2A)
+			if withvels {
+				v := mol.Velocities[frame]
+				fmt.Fprintf(w, "%8.4f%8.4f%8.4f", v.At(i, 0)/nm2A, v.At(i, 1)/nm2A, v.At(i, 2)/nm2A)
+			}
+			w.WriteString("\n")
+		}
+		w.WriteString(groBoxLine(mol.FrameBox(frame)))
+	}
+	if err := w.Flush(); err != nil {
+		return iowriterError(err)
+	}
+	return nil
+}
+
+//groBoxLine returns the GRO box line for box, which is a zero box if box is nil.
+//Only the three sides are written for rectangular boxes.
+func groBoxLine(box *Box) string {
+	if box == nil {
+		return fmt.Sprintf("%10.5f%10.5f%10.5f\n", 0.0, 0.0, 0.0)
+	}
+	v := box.vecs
+	if v[0][1] == 0 && v[0][2] == 0 && v[1][0] == 0 && v[1][2] == 0 && v[2][0] == 0 && v[2][1] == 0 {
+		return fmt.Sprintf("%10.5f%10.5f%10.5f\n", v[0][0]/nm2A, v[1][1]/nm2A, v[2][2]/nm2A)
+	}
+	return fmt.Sprintf("%10.5f%10.5f%10.5f%10.5f%10.5f%10.5f%10.5f%10.5f%10.5f\n",
+		v[0][0]/nm2A, v[1][1]/nm2A, v[2][2]/nm2A, v[0][1]/nm2A, v[0][2]/nm2A,
+		v[1][0]/nm2A, v[1][2]/nm2A, v[2][0]/nm2A, v[2][1]/nm2A)
+}
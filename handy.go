@@ -608,7 +608,8 @@ func ScaleBond(C, H *v3.Matrix, bond float64) {
 	H.Sub(H, Odist)
 }
 
-//Merges A and B in a single topology which is returned
+//Merges A and B in a single topology which is returned.
+//The bonds, angles, dihedrals and impropers of A and B, if any, are also merged.
 func MergeAtomers(A, B Atomer) *Topology {
 	al := A.Len()
 	l := al + B.Len()
@@ -629,7 +630,26 @@ func MergeAtomers(A, B Atomer) *Topology {
 	} else {
 		multi = 1
 	}
-	return NewTopology(charge, multi,full)
+	top := NewTopology(charge, multi, full)
+	if a, ok := A.(Bonder); ok {
+		top.bonds = copyBonds(a.Bonds())
+	}
+	if b, ok := B.(Bonder); ok {
+		for _, v := range b.Bonds() {
+			top.bonds = append(top.bonds, &Bond{At1: v.At1 + al, At2: v.At2 + al, Order: v.Order})
+		}
+	}
+	if a, ok := A.(angler); ok {
+		top.angles = copyTuples(a.Angles())
+		top.dihedrals = copyTuples(a.Dihedrals())
+		top.impropers = copyTuples(a.Impropers())
+	}
+	if b, ok := B.(angler); ok {
+		top.angles = append(top.angles, offsetTuples(b.Angles(), al)...)
+		top.dihedrals = append(top.dihedrals, offsetTuples(b.Dihedrals(), al)...)
+		top.impropers = append(top.impropers, offsetTuples(b.Impropers(), al)...)
+	}
+	return top
 }
 
 //SelCone, Given a set of cartesian points in sellist, obtains a vector "plane" normal to the best plane passing through the points.
@@ -63,6 +63,71 @@ type ConcTraj interface {
 	Len() int
 }
 
+//BoxTraj is a trajectory that also contains a periodic box
+//for each frame.
+type BoxTraj interface {
+	Traj
+
+	//Box returns the periodic box for the last frame read,
+	//or nil if the frame has no box.
+	Box() *Box
+}
+
+//TrajMeta is a trajectory that also gives the time, step and box
+//of each frame, and the number of frames, if known.
+type TrajMeta interface {
+	BoxTraj
+
+	//Time returns the simulation time, in ps, for the last frame read,
+	//or NaN if it is not known.
+	Time() float64
+
+	//Step returns the simulation step for the last frame read,
+	//or -1 if it is not known.
+	Step() int
+
+	//NFrames returns the total number of frames in the trajectory,
+	//or -1 if it is not known.
+	NFrames() int
+}
+
+//VelForceTraj is a trajectory that can also contain velocities, forces
+//and the free-energy lambda for each frame.
+type VelForceTraj interface {
+	TrajMeta
+
+	//Velocities puts the velocities, in A/ps, of the last frame read in output.
+	//It returns false, and doesn't modify output, if the frame has no velocities.
+	Velocities(output *v3.Matrix) bool
+
+	//Forces puts the forces, in kJ/(mol A), of the last frame read in output.
+	//It returns false, and doesn't modify output, if the frame has no forces.
+	Forces(output *v3.Matrix) bool
+
+	//Lambda returns the free-energy lambda of the last frame read.
+	Lambda() float64
+}
+
+//SeekTraj is a trajectory that allows random access to its frames.
+type SeekTraj interface {
+	Traj
+
+	//NFrames returns the number of frames in the trajectory.
+	NFrames() int
+
+	//Seek sets the trajectory so the next frame read is frame.
+	//The first frame is 0.
+	Seek(frame int) error
+
+	//ReadFrame reads the frame i into output.
+	ReadFrame(i int, output *v3.Matrix) error
+
+	//SetRange sets the trajectory so only the frames start, start+step...
+	//up to, but not including, stop, are read. A negative stop means no limit.
+	//The frames in between are skipped, not decoded.
+	SetRange(start, stop, step int) error
+}
+
 //Atomer is the basic interface for a topology.
 type Atomer interface {
 
@@ -86,6 +151,14 @@ type AtomMultiCharger interface {
 	Multi() int
 }
 
+//Bonder is an Atomer that also contains the bonds between its atoms.
+type Bonder interface {
+	Atomer
+
+	//Bonds returns the bonds between the atoms.
+	Bonds() []*Bond
+}
+
 //Masser can  return a slice with the masses of each atom in the reference.
 type Masser interface {
 
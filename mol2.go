@@ -0,0 +1,385 @@
+/*
+ * mol2.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/gochem/v3"
+)
+
+//MOL2FileRead reads a Tripos MOL2 file. Returns a Molecule and error or nil. See MOL2Read for details.
+func MOL2FileRead(mol2name string) (*Molecule, error) {
+	mol2file, err := OpenFile(mol2name)
+	if err != nil {
+		return nil, errDecorate(err, "MOL2FileRead")
+	}
+	defer mol2file.Close()
+	mol, err := MOL2Read(mol2file)
+	if err != nil {
+		return nil, errDecorate(err, "MOL2FileRead "+fmt.Sprintf("error in file %s", mol2name))
+	}
+	return mol, nil
+}
+
+//MOL2Read reads Tripos MOL2 data from mol2p. The atom names, Tripos types and partial charges are put in the
+//Name, Type and Charge fields of each atom, and the substructure ids, names and chains in the MolID, Molname and
+//Chain fields. The bonds, with aromatic bonds having an order of 1.5, are also read.
+//If there are several molecule records, all of them must have the same atoms, and each will be a frame
+//of the returned molecule (as in the poses from docking programs). Returns a Molecule and error or nil.
+func MOL2Read(mol2p io.Reader) (*Molecule, error) {
+	mol2 := bufio.NewReader(mol2p)
+	var top *Topology
+	coords := make([]*v3.Matrix, 0, 1)
+	line, err := mol2SkipTo(mol2, "@<TRIPOS>MOLECULE")
+	if err != nil {
+		return nil, CError{"No molecule in MOL2 file", []string{"MOL2Read"}}
+	}
+	for frame := 0; ; frame++ {
+		var c *v3.Matrix
+		var ats []*Atom
+		var bonds []*Bond
+		c, ats, bonds, line, err = mol2ReadRecord(mol2, frame == 0)
+		if err != nil {
+			return nil, errDecorate(err, "MOL2Read")
+		}
+		if frame == 0 {
+			top = NewTopology(0, 1, ats)
+			top.SetBonds(bonds)
+		} else if c.NVecs() != top.Len() {
+			return nil, CError{fmt.Sprintf("Molecule %d in MOL2 file has %d atoms instead of %d", frame+1, c.NVecs(), top.Len()), []string{"MOL2Read"}}
+		}
+		coords = append(coords, c)
+		if !strings.HasPrefix(line, "@<TRIPOS>MOLECULE") {
+			break
+		}
+	}
+	mol, err := NewMolecule(coords, top, nil)
+	if err != nil {
+		return nil, errDecorate(err, "MOL2Read")
+	}
+	return mol, nil
+}
+
+//mol2SkipTo reads lines from mol2 until one starting with prefix is found, and returns that line.
+func mol2SkipTo(mol2 *bufio.Reader, prefix string) (string, error) {
+	for {
+		line, err := mol2.ReadString('\n')
+		if strings.HasPrefix(line, prefix) {
+			return line, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+//mol2ReadRecord reads a molecule record, whose @<TRIPOS>MOLECULE line has already been read, from mol2.
+//It returns the coordinates, the atoms and bonds (if readTopol is true), the line that started the next record
+//(empty if there is no other record) and error or nil.
+func mol2ReadRecord(mol2 *bufio.Reader, readTopol bool) (*v3.Matrix, []*Atom, []*Bond, string, error) {
+	var natoms, nbonds int
+	var coords []float64
+	var atoms []*Atom
+	var bonds []*Bond
+	chains := make(map[int]string)
+	section := "MOLECULE"
+	inSection := 0 //number of lines read in the current section
+	var line string
+	var readerr error
+	for readerr == nil {
+		line, readerr = mol2.ReadString('\n')
+		if readerr != nil && readerr != io.EOF {
+			return nil, nil, nil, "", CError{readerr.Error(), []string{"bufio.Reader.ReadString", "mol2ReadRecord"}}
+		}
+		if strings.HasPrefix(line, "@<TRIPOS>") {
+			section = strings.TrimSpace(line[len("@<TRIPOS>"):])
+			inSection = 0
+			if section == "MOLECULE" {
+				break
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		inSection++
+		var err error
+		switch section {
+		case "MOLECULE":
+			//The first line is the name, the second the number of atoms, bonds, etc.
+			if inSection != 2 {
+				continue
+			}
+			natoms, err = strconv.Atoi(fields[0])
+			if err == nil && len(fields) > 1 {
+				nbonds, err = strconv.Atoi(fields[1])
+			}
+			coords = make([]float64, 0, natoms*3)
+		case "ATOM":
+			if inSection > natoms {
+				return nil, nil, nil, "", CError{"More atoms than declared in MOL2 file", []string{"mol2ReadRecord"}}
+			}
+			var at *Atom
+			var c []float64
+			at, c, err = mol2ReadAtom(fields)
+			coords = append(coords, c...)
+			if readTopol && err == nil {
+				atoms = append(atoms, at)
+			}
+		case "BOND":
+			if !readTopol || inSection > nbonds {
+				continue
+			}
+			var b *Bond
+			b, err = mol2ReadBond(fields, natoms)
+			if err == nil {
+				bonds = append(bonds, b)
+			}
+		case "SUBSTRUCTURE":
+			if readTopol && len(fields) >= 6 && fields[5] != "****" {
+				var id int
+				id, err = strconv.Atoi(fields[0])
+				chains[id] = fields[5]
+			}
+		}
+		if err != nil {
+			return nil, nil, nil, "", CError{fmt.Sprintf("Wrong %s line in MOL2 file: %s %s", section, strings.TrimSpace(line), err.Error()), []string{"mol2ReadRecord"}}
+		}
+	}
+	if len(coords) != natoms*3 || natoms == 0 {
+		return nil, nil, nil, "", CError{fmt.Sprintf("Read %d atoms in MOL2 file, %d expected", len(coords)/3, natoms), []string{"mol2ReadRecord"}}
+	}
+	for _, at := range atoms {
+		at.Chain = chains[at.MolID]
+	}
+	mcoords, err := v3.NewMatrix(coords)
+	if err != nil {
+		return nil, nil, nil, "", errDecorate(err, "mol2ReadRecord")
+	}
+	if section != "MOLECULE" {
+		line = ""
+	}
+	return mcoords, atoms, bonds, line, nil
+}
+
+//mol2ReadAtom parses the fields of an ATOM line of a MOL2 file and returns the atom and its coordinates.
+func mol2ReadAtom(fields []string) (*Atom, []float64, error) {
+	if len(fields) < 6 {
+		return nil, nil, fmt.Errorf("Too few fields")
+	}
+	var err error
+	at := new(Atom)
+	c := make([]float64, 3, 3)
+	at.ID, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	at.Name = fields[1]
+	for i := 0; i < 3; i++ {
+		c[i], err = strconv.ParseFloat(fields[2+i], 64)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	at.Type = fields[5]
+	at.Symbol = strings.Title(strings.ToLower(strings.Split(at.Type, ".")[0]))
+	at.Mass = symbolMass[at.Symbol]
+	if len(fields) > 6 {
+		at.MolID, err = strconv.Atoi(fields[6])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(fields) > 7 {
+		at.Molname = fields[7]
+		at.Molname1 = three2OneLetter[at.Molname]
+	}
+	if len(fields) > 8 {
+		at.Charge, err = strconv.ParseFloat(fields[8], 64)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return at, c, nil
+}
+
+//mol2ReadBond parses the fields of a BOND line of a MOL2 file. The atoms in the returned bond are 0-based.
+func mol2ReadBond(fields []string, natoms int) (*Bond, error) {
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("Too few fields")
+	}
+	a1, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	a2, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	if a1 < 1 || a2 < 1 || a1 > natoms || a2 > natoms {
+		return nil, fmt.Errorf("Atom out of range")
+	}
+	var order float64
+	switch fields[3] {
+	case "ar":
+		order = 1.5
+	case "am":
+		order = 1
+	case "du", "un", "nc":
+		order = 0
+	default:
+		order, err = strconv.ParseFloat(fields[3], 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Bond{At1: a1 - 1, At2: a2 - 1, Order: order}, nil
+}
+
+//MOL2FileWrite writes the atoms of mol with the coordinates coords to a MOL2 file with name mol2name,
+//which will be overwritten if it exists. See MOL2Write for details.
+func MOL2FileWrite(mol2name string, coords *v3.Matrix, mol Atomer, name ...string) error {
+	out, err := CreateFile(mol2name)
+	if err != nil {
+		return errDecorate(err, "MOL2FileWrite")
+	}
+	err = MOL2Write(out, coords, mol, name...)
+	if err != nil {
+		out.Close()
+		return errDecorate(err, "MOL2FileWrite")
+	}
+	return errDecorate(out.Close(), "MOL2FileWrite")
+}
+
+//MOL2Write writes the atoms of mol with the coordinates coords to out in Tripos MOL2 format, with the optional
+//name as the molecule name. The Type of each atom is used as its Tripos type, or the Symbol if the Type is empty.
+//If mol is a Bonder, its bonds are also written. Each residue or molecule (given by the MolID, Molname and Chain
+//fields of the atoms) is written as a substructure.
+func MOL2Write(out io.Writer, coords *v3.Matrix, mol Atomer, name ...string) error {
+	if coords.NVecs() != mol.Len() {
+		return CError{"Ref and Coords dont have the same number of atoms", []string{"MOL2Write"}}
+	}
+	molname := "gochem"
+	if len(name) > 0 && name[0] != "" {
+		molname = name[0]
+	}
+	var bonds []*Bond
+	if b, ok := mol.(Bonder); ok {
+		bonds = b.Bonds()
+	}
+	orders := make([]string, len(bonds))
+	for i, b := range bonds {
+		var ok bool
+		if orders[i], ok = mol2BondOrder(b.Order); !ok {
+			return CError{fmt.Sprintf("Bond %d-%d has order %f, which can't be written in MOL2 format", b.At1+1, b.At2+1, b.Order), []string{"MOL2Write"}}
+		}
+	}
+	//the substructures, in order of appearance.
+	type subst struct {
+		id, root    int
+		name, chain string
+	}
+	substs := make([]*subst, 0)
+	atsubst := make([]int, mol.Len())
+	uniqueIDs := true
+	seen := make(map[int]bool)
+	for i := 0; i < mol.Len(); i++ {
+		at := mol.Atom(i)
+		last := len(substs) - 1
+		if last < 0 || substs[last].id != at.MolID || substs[last].chain != at.Chain || substs[last].name != at.Molname {
+			if seen[at.MolID] || at.MolID <= 0 {
+				uniqueIDs = false
+			}
+			seen[at.MolID] = true
+			substs = append(substs, &subst{id: at.MolID, root: i + 1, name: at.Molname, chain: at.Chain})
+		}
+		atsubst[i] = len(substs) - 1
+	}
+	//We keep the MolIDs as substructure ids if possible, otherwise they are just numbered.
+	for i, s := range substs {
+		if !uniqueIDs {
+			s.id = i + 1
+		}
+		s.name = mol2Field(s.name, "UNL")
+		s.chain = mol2Field(s.chain, "****")
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "@<TRIPOS>MOLECULE\n%s\n%5d %5d %5d 0 0\nSMALL\nUSER_CHARGES\n\n", molname, mol.Len(), len(bonds), len(substs))
+	w.WriteString("@<TRIPOS>ATOM\n")
+	for i := 0; i < mol.Len(); i++ {
+		at := mol.Atom(i)
+		t := at.Type
+		if t == "" {
+			t = at.Symbol
+		}
+		s := substs[atsubst[i]]
+		fmt.Fprintf(w, "%7d %-8s %10.4f %10.4f %10.4f %-6s %5d %-8s %10.4f\n", i+1, mol2Field(at.Name, at.Symbol), coords.At(i, 0),
+			coords.At(i, 1), coords.At(i, 2), mol2Field(t, "Du"), s.id, s.name, at.Charge)
+	}
+	w.WriteString("@<TRIPOS>BOND\n")
+	for i, b := range bonds {
+		fmt.Fprintf(w, "%6d %5d %5d %s\n", i+1, b.At1+1, b.At2+1, orders[i])
+	}
+	w.WriteString("@<TRIPOS>SUBSTRUCTURE\n")
+	for _, s := range substs {
+		fmt.Fprintf(w, "%6d %-8s %6d RESIDUE %4d %-4s %-8s 0\n", s.id, s.name, s.root, 1, s.chain, s.name)
+	}
+	if err := w.Flush(); err != nil {
+		return CError{"Failed to write in io.Writer" + err.Error(), []string{"io.Writer.Write", "MOL2Write"}}
+	}
+	return nil
+}
+
+//mol2BondOrder returns the Tripos bond type for the given order: "1", "2" or "3" for
+//integer orders, "ar" for 1.5 (aromatic) and "un" for 0 (unknown). It returns false for any other order.
+func mol2BondOrder(order float64) (string, bool) {
+	switch order {
+	case 0:
+		return "un", true
+	case 1, 2, 3:
+		return strconv.Itoa(int(order)), true
+	case 1.5:
+		return "ar", true
+	}
+	return "", false
+}
+
+//mol2Field returns s without spaces, so it can be written as a field of a MOL2 line, or def if s is empty.
+func mol2Field(s, def string) string {
+	s = strings.Replace(strings.TrimSpace(s), " ", "_", -1)
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,556 @@
+/*
+ * nc.go, part of gochem
+ *
+ * Copyright 2012 Raul Mera Adasme <rmera_changeforat_chem-dot-helsinki-dot-fi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License  as published by
+ * the Free Software Foundation; either version 2.1 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston,
+ * MA 02110-1301, USA.
+ */
+/*
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+//Package nc reads AMBER trajectories and restart files in the NetCDF format
+//(NetCDF classic and 64-bit offset files, also known as NetCDF-3).
+package nc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/rmera/gochem"
+	"github.com/rmera/gochem/v3"
+)
+
+//kcal2kJ converts the AMBER forces, in kcal/(mol A), to kJ/(mol A).
+const kcal2kJ = 4.184
+
+//NCObj is an AMBER NetCDF trajectory or restart file open for reading.
+type NCObj struct {
+	readable   bool
+	filename   string
+	file       io.ReaderAt
+	closer     io.Closer
+	h          *ncHeader
+	natoms     int
+	nframes    int
+	current    int //the next frame to be read
+	last       int //the last frame read
+	stop       int //frames from this one on are not read. Negative means no limit.
+	step       int //read one in every step frames
+	coords     *ncVar
+	velocities *ncVar
+	forces     *ncVar
+	time       *ncVar
+	lengths    *ncVar
+	angles     *ncVar
+	velScale   float64 //the scale_factor of the velocities
+	box        *chem.Box
+	raw        []byte    //buffer for reading
+	frame      []float64 //buffer for the frames read with Next
+	concBuffer [][]float64
+	indexes    []int //the atoms read, nil for all atoms
+}
+
+//New opens the AMBER NetCDF file filename and returns an NCObj to read it. The frames can be
+//read sequentially or in any order. Random access is needed to read NetCDF files, so compressed
+//files (see chem.OpenFile) are fully decompressed into memory. If a slice of indexes is given,
+//only those atoms are returned by Next, NextConc, ReadFrame, Velocities and Forces, in that order,
+//and Len returns the number of indexes.
+func New(filename string, indexes ...[]int) (*NCObj, error) {
+	N := &NCObj{filename: filename, stop: -1, step: 1}
+	if err := N.initRead(); err != nil {
+		return nil, errDecorate(err, "New")
+	}
+	if len(indexes) > 0 && indexes[0] != nil {
+		for _, v := range indexes[0] {
+			if v < 0 || v >= N.natoms {
+				N.Close()
+				return nil, Error{fmt.Sprintf("Index %d out of range for a trajectory with %d atoms", v, N.natoms), filename, []string{"New"}, true}
+			}
+		}
+		N.indexes = indexes[0]
+	}
+	return N, nil
+}
+
+//open opens the file for random access.
+func (N *NCObj) open() error {
+	comp, err := chem.Compression(N.filename)
+	if err != nil {
+		return Error{UnableToOpen + ": " + err.Error(), N.filename, []string{"chem.Compression", "open"}, true}
+	}
+	if comp == chem.NoCompression {
+		f, err := os.Open(N.filename)
+		if err != nil {
+			return Error{UnableToOpen + ": " + err.Error(), N.filename, []string{"os.Open", "open"}, true}
+		}
+		N.file, N.closer = f, f
+		return nil
+	}
+	f, err := chem.OpenFile(N.filename)
+	if err != nil {
+		return Error{UnableToOpen + ": " + err.Error(), N.filename, []string{"chem.OpenFile", "open"}, true}
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return Error{UnableToOpen + ": " + err.Error(), N.filename, []string{"ioutil.ReadAll", "open"}, true}
+	}
+	N.file = bytes.NewReader(data)
+	return nil
+}
+
+//initRead opens the file, reads the header and checks that it contains an AMBER trajectory.
+func (N *NCObj) initRead() error {
+	if err := N.open(); err != nil {
+		return errDecorate(err, "initRead")
+	}
+	var err error
+	N.h, err = readHeader(io.NewSectionReader(N.file, 0, 1<<62))
+	if err != nil {
+		N.Close()
+		return Error{WrongFormat + ": " + err.Error(), N.filename, []string{"readHeader", "initRead"}, true}
+	}
+	if c, ok := N.h.attrs["Conventions"]; ok && !strings.Contains(c.text, "AMBER") {
+		N.Close()
+		return Error{WrongFormat + ": Not an AMBER file, conventions: " + c.text, N.filename, []string{"initRead"}, true}
+	}
+	N.coords = N.h.vars["coordinates"]
+	if N.coords == nil || len(N.coords.shape) != 2 || N.coords.shape[1] != 3 {
+		N.Close()
+		return Error{WrongFormat + ": No coordinates", N.filename, []string{"initRead"}, true}
+	}
+	N.natoms = int(N.coords.shape[0])
+	//The other variables are optional, but must have the right shape.
+	shapes := map[string][]int64{"velocities": {int64(N.natoms), 3}, "forces": {int64(N.natoms), 3}, "time": nil, "cell_lengths": {3}, "cell_angles": {3}}
+	vars := map[string]**ncVar{"velocities": &N.velocities, "forces": &N.forces, "time": &N.time, "cell_lengths": &N.lengths, "cell_angles": &N.angles}
+	for name, v := range vars {
+		V := N.h.vars[name]
+		if V == nil {
+			continue
+		}
+		if fmt.Sprint(V.shape) != fmt.Sprint(shapes[name]) || V.record != N.coords.record {
+			N.Close()
+			return Error{WrongFormat + ": Wrong shape for the variable " + name, N.filename, []string{"initRead"}, true}
+		}
+		*v = V
+	}
+	N.velScale = 1
+	if N.velocities != nil {
+		if s, ok := N.velocities.attrs["scale_factor"]; ok && len(s.values) > 0 {
+			N.velScale = s.values[0]
+		}
+	}
+	N.nframes = 1 //a restart file
+	if N.coords.record {
+		N.nframes = int(N.h.numrecs)
+		if N.h.numrecs == ncStreaming {
+			N.nframes = N.streamingFrames()
+		}
+	}
+	N.frame = make([]float64, 3*N.natoms)
+	N.concBuffer = append(N.concBuffer, N.frame)
+	N.last = -1
+	runtime.SetFinalizer(N, func(N *NCObj) {
+		N.Close()
+	})
+	N.readable = true
+	return nil
+}
+
+//streamingFrames returns the number of complete frames in a file which was not closed properly,
+//and thus doesn't have the number of records in the header.
+func (N *NCObj) streamingFrames() int {
+	var size int64
+	switch f := N.file.(type) {
+	case *os.File:
+		info, err := f.Stat()
+		if err != nil {
+			return 0
+		}
+		size = info.Size()
+	case *bytes.Reader:
+		size = f.Size()
+	}
+	end := N.coords.begin + N.coords.size()*ncTypeSize(N.coords.typ)
+	if size < end || N.h.recsize == 0 {
+		return 0
+	}
+	return int((size-end)/N.h.recsize) + 1
+}
+
+//Readable returns true if the object is ready to be read from, false
+//otherwise. It doesn't guarantee that there is something to read.
+func (N *NCObj) Readable() bool {
+	return N.readable
+}
+
+//Close closes the file associated with the trajectory.
+//The trajectory can't be read after that.
+func (N *NCObj) Close() {
+	if N.closer != nil {
+		N.closer.Close()
+		N.closer = nil
+	}
+	N.file = nil
+	N.readable = false
+}
+
+//Len returns the number of atoms per frame in the NCObj, or the number
+//of atoms selected, if the NCObj was created with a slice of indexes.
+func (N *NCObj) Len() int {
+	if N.indexes != nil {
+		return len(N.indexes)
+	}
+	return N.natoms
+}
+
+//NFrames returns the number of frames in the trajectory, 1 for restart files.
+func (N *NCObj) NFrames() int {
+	return N.nframes
+}
+
+//readRaw reads the variable V for the frame into dst.
+func (N *NCObj) readRaw(V *ncVar, frame int, dst []float64) error {
+	if N.file == nil {
+		return Error{TrajUnIni, N.filename, []string{"readRaw"}, true} //the trajectory was closed
+	}
+	var err error
+	N.raw, err = readVar(N.file, N.h, V, frame, dst, N.raw)
+	if err != nil {
+		return Error{ReadError + ": " + err.Error(), N.filename, []string{"readVar", "readRaw"}, true}
+	}
+	return nil
+}
+
+//nextRaw reads the coordinates of the next frame in the range into dst, and the box of the frame.
+func (N *NCObj) nextRaw(dst []float64) error {
+	if !N.readable || N.current >= N.nframes || (N.stop >= 0 && N.current >= N.stop) {
+		N.readable = false
+		return newlastFrameError(N.filename, "nextRaw")
+	}
+	if err := N.readRaw(N.coords, N.current, dst); err != nil {
+		N.readable = false
+		return errDecorate(err, "nextRaw")
+	}
+	N.last = N.current
+	N.current += N.step
+	if err := N.setBox(); err != nil {
+		return errDecorate(err, "nextRaw")
+	}
+	return nil
+}
+
+//setBox reads the box of the last frame read, if the file has box information.
+func (N *NCObj) setBox() error {
+	N.box = nil
+	if N.lengths == nil || N.angles == nil {
+		return nil
+	}
+	cell := make([]float64, 6)
+	if err := N.readRaw(N.lengths, N.last, cell[:3]); err != nil {
+		return errDecorate(err, "setBox")
+	}
+	if err := N.readRaw(N.angles, N.last, cell[3:]); err != nil {
+		return errDecorate(err, "setBox")
+	}
+	if cell[0] <= 0 || cell[1] <= 0 || cell[2] <= 0 {
+		return nil
+	}
+	box, err := chem.NewBoxFromParams(cell[0], cell[1], cell[2], cell[3], cell[4], cell[5])
+	if err != nil {
+		return Error{err.Error(), N.filename, []string{"chem.NewBoxFromParams", "setBox"}, true}
+	}
+	N.box = box
+	return nil
+}
+
+//toMatrix puts the data for the atoms read from data in out, which must have enough space,
+//multiplied by factor.
+func (N *NCObj) toMatrix(data []float64, factor float64, out *v3.Matrix) {
+	if r, _ := out.Dims(); r < N.Len() {
+		panic("Buffer v3.Matrix too small to hold trajectory frame")
+	}
+	for j := 0; j < N.Len(); j++ {
+		l := 3 * j
+		if N.indexes != nil {
+			l = 3 * N.indexes[j]
+		}
+		out.Set(j, 0, factor*data[l])
+		out.Set(j, 1, factor*data[l+1])
+		out.Set(j, 2, factor*data[l+2])
+	}
+}
+
+//Next reads the next frame in the trajectory (or in the range set with SetRange) and puts its
+//coordinates in output, which must have space for Len() atoms. If output is nil, the frame is
+//discarded without reading it.
+func (N *NCObj) Next(output *v3.Matrix) error {
+	if output == nil {
+		if !N.readable || N.current >= N.nframes || (N.stop >= 0 && N.current >= N.stop) {
+			N.readable = false
+			return newlastFrameError(N.filename, "Next")
+		}
+		N.last = N.current
+		N.current += N.step
+		return errDecorate(N.setBox(), "Next")
+	}
+	if err := N.nextRaw(N.frame); err != nil {
+		return errDecorate(err, "Next")
+	}
+	N.toMatrix(N.frame, 1, output)
+	return nil
+}
+
+/*NextConc takes a slice of matrices and reads as many frames as elements the slice has
+from the trajectory. The frames are discarded if the corresponding element of the slice
+is nil. The function returns a slice of channels through each of each of which
+the coordinates of the corresponding frame will be transmited. Velocities, Forces, Box
+and the other metadata methods refer to the last frame of the batch after the call.*/
+func (N *NCObj) NextConc(frames []*v3.Matrix) ([]chan *v3.Matrix, error) {
+	if !N.readable {
+		return nil, Error{TrajUnIni, N.filename, []string{"NextConc"}, true}
+	}
+	for len(N.concBuffer) < len(frames) {
+		N.concBuffer = append(N.concBuffer, make([]float64, 3*N.natoms))
+	}
+	framechans := make([]chan *v3.Matrix, len(frames))
+	used := false
+	for key, val := range frames {
+		var err error
+		if val == nil {
+			err = N.Next(nil)
+		} else {
+			err = N.nextRaw(N.concBuffer[key])
+		}
+		if _, ok := err.(*lastFrameError); ok {
+			if !used {
+				return nil, errDecorate(err, "NextConc")
+			}
+			return framechans, errDecorate(err, "NextConc")
+		}
+		if err != nil {
+			return nil, errDecorate(err, "NextConc")
+		}
+		if val == nil {
+			continue
+		}
+		used = true
+		framechans[key] = make(chan *v3.Matrix)
+		go func(data []float64, goCoords *v3.Matrix, pipe chan *v3.Matrix) {
+			N.toMatrix(data, 1, goCoords)
+			pipe <- goCoords
+		}(N.concBuffer[key], val, framechans[key])
+	}
+	return framechans, nil
+}
+
+//Seek sets the trajectory so the next frame read is frame (the first frame is 0). The trajectory
+//becomes readable again if the last frame had been read.
+func (N *NCObj) Seek(frame int) error {
+	if frame < 0 || frame >= N.nframes {
+		return Error{fmt.Sprintf("Frame %d out of range for a trajectory with %d frames", frame, N.nframes), N.filename, []string{"Seek"}, true}
+	}
+	if N.file == nil {
+		return Error{TrajUnIni, N.filename, []string{"Seek"}, true}
+	}
+	N.current = frame
+	N.readable = true
+	return nil
+}
+
+//ReadFrame reads the frame i (the first one is 0) into output. After the call, the next frame read
+//with Next is the one after i, or the next one in the range set with SetRange.
+func (N *NCObj) ReadFrame(i int, output *v3.Matrix) error {
+	if err := N.Seek(i); err != nil {
+		return errDecorate(err, "ReadFrame")
+	}
+	return errDecorate(N.Next(output), "ReadFrame")
+}
+
+//SetRange sets the trajectory so Next and NextConc read only the frames
+//start, start+step, start+2*step... up to, but not including, stop. A negative
+//stop means that the frames are read until the end of the trajectory.
+func (N *NCObj) SetRange(start, stop, step int) error {
+	if start < 0 || step < 1 {
+		return Error{fmt.Sprintf("Invalid range %d:%d:%d", start, stop, step), N.filename, []string{"SetRange"}, true}
+	}
+	N.stop = stop
+	N.step = step
+	if start >= N.nframes {
+		N.current = start
+		N.readable = false
+		return nil
+	}
+	return errDecorate(N.Seek(start), "SetRange")
+}
+
+//Box returns the box of the last frame read, or nil if the file has no box information.
+//When frames are read with NextConc, it returns the box of the last frame of the batch.
+func (N *NCObj) Box() *chem.Box {
+	return N.box
+}
+
+//lastFrame returns the last frame read, or the first one, if no frame has been read.
+func (N *NCObj) lastFrame() int {
+	if N.last < 0 {
+		return 0
+	}
+	return N.last
+}
+
+//Time returns the time, in ps, of the last frame read, or of the first frame if no
+//frame has been read. If the file has no times, or it has been closed, NaN is returned.
+func (N *NCObj) Time() float64 {
+	if N.time == nil {
+		return math.NaN()
+	}
+	t := make([]float64, 1)
+	if err := N.readRaw(N.time, N.lastFrame(), t); err != nil {
+		return math.NaN()
+	}
+	return t[0]
+}
+
+//Step returns -1, as AMBER files don't contain the simulation step.
+func (N *NCObj) Step() int {
+	return -1
+}
+
+//Lambda returns 0, as AMBER trajectories don't contain the free-energy lambda.
+func (N *NCObj) Lambda() float64 {
+	return 0
+}
+
+//readLast reads the variable V for the last frame read (or the first one) into output,
+//multiplied by factor. It returns false if the variable is not in the file or can't be read.
+func (N *NCObj) readLast(V *ncVar, factor float64, output *v3.Matrix) bool {
+	if V == nil {
+		return false
+	}
+	data := make([]float64, 3*N.natoms)
+	if err := N.readRaw(V, N.lastFrame(), data); err != nil {
+		return false
+	}
+	N.toMatrix(data, factor, output)
+	return true
+}
+
+//Velocities puts the velocities, in A/ps, of the last frame read in output, which must have
+//space for Len() atoms. It returns false, and doesn't modify output, if the file has no velocities
+//or has been closed.
+func (N *NCObj) Velocities(output *v3.Matrix) bool {
+	return N.readLast(N.velocities, N.velScale, output)
+}
+
+//Forces puts the forces, in kJ/(mol A), of the last frame read in output, which must have
+//space for Len() atoms. It returns false, and doesn't modify output, if the file has no forces
+//or has been closed.
+func (N *NCObj) Forces(output *v3.Matrix) bool {
+	return N.readLast(N.forces, kcal2kJ, output)
+}
+
+//errDecorate is a helper function that asserts that the error is
+//implements chem.Error and decorates the error with the caller's name before returning it.
+//if used with a non-chem.Error error, it will cause a panic. A nil error is returned as it is.
+func errDecorate(err error, caller string) error {
+	if err == nil {
+		return nil
+	}
+	err2 := err.(chem.Error)
+	err2.Decorate(caller)
+	return err2
+}
+
+//Errors
+
+//Error is the general structure for NetCDF trajectory errors. It fullfills chem.Error and chem.TrajError
+type Error struct {
+	message  string
+	filename string //the input file that has problems, or empty string if none.
+	deco     []string
+	critical bool
+}
+
+func (err Error) Error() string {
+	return fmt.Sprintf("nc file %s error: %s", err.filename, err.message)
+}
+
+func (E Error) Decorate(deco string) []string {
+	//Even thought this method does not use a pointer as a receiver, and tries to alter the received,
+	//it should work, since E.deco is a slice, and hence a pointer itself.
+	if deco != "" {
+		E.deco = append(E.deco, deco)
+	}
+	return E.deco
+}
+
+func (err Error) FileName() string { return err.filename }
+
+func (err Error) Format() string { return "nc" }
+
+func (err Error) Critical() bool { return err.critical }
+
+const (
+	TrajUnIni    = "Traj object uninitialized to read"
+	ReadError    = "Error reading frame"
+	UnableToOpen = "Unable to open file"
+	WrongFormat  = "Wrong format in the NetCDF file"
+)
+
+//lastFrameError implements chem.LastFrameError
+type lastFrameError struct {
+	deco     []string
+	fileName string
+}
+
+//lastFrameError does nothing
+func (E lastFrameError) NormalLastFrameTermination() {}
+
+func (E lastFrameError) FileName() string { return E.fileName }
+
+func (E lastFrameError) Error() string { return "EOF" }
+
+func (E lastFrameError) Critical() bool { return false }
+
+func (E lastFrameError) Format() string { return "nc" }
+
+func (E lastFrameError) Decorate(deco string) []string {
+	//Even thought this method does not use a pointer as a receiver, and tries to alter the received,
+	//it should work, since E.deco is a slice, and hence a pointer itself.
+	if deco != "" {
+		E.deco = append(E.deco, deco)
+	}
+	return E.deco
+}
+
+func newlastFrameError(filename string, caller string) *lastFrameError {
+	e := new(lastFrameError)
+	e.fileName = filename
+	e.deco = []string{caller}
+	return e
+}
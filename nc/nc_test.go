@@ -0,0 +1,162 @@
+/*
+ * nc_test.go, part of gochem
+ *
+ * Copyright 2012 Raul Mera Adasme <rmera_changeforat_chem-dot-helsinki-dot-fi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ */
+/*
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+
+package nc
+
+import (
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/rmera/gochem"
+	"github.com/rmera/gochem/v3"
+)
+
+//The test files have 3 frames of 5 atoms. The atom i has the coordinates (i+0.5f, 2i, -i-0.25f)
+//in the frame f. sample.nc also has velocities, times and boxes, while sample_cdf1.nc, in the
+//classic format, has only coordinates, and lacks the number of frames in the header.
+func checkCoords(Te *testing.T, name string, f int, indexes []int, m *v3.Matrix) {
+	for j, i := range indexes {
+		expected := []float64{float64(i) + 0.5*float64(f), 2 * float64(i), -float64(i) - 0.25*float64(f)}
+		for k, v := range expected {
+			if m.At(j, k) != v {
+				Te.Errorf("%s: frame %d atom %d: %v, expected %v", name, f, i, m.VecView(j), expected)
+				break
+			}
+		}
+	}
+}
+
+func TestNC(Te *testing.T) {
+	//Compressed files are decompressed into memory.
+	data, err := ioutil.ReadFile("../test/sample.nc")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	gz, err := chem.CreateFile("../test/sampleIO.nc.gz")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		Te.Fatal(err)
+	}
+	all := []int{0, 1, 2, 3, 4}
+	for _, name := range []string{"../test/sample.nc", "../test/sample_cdf1.nc", "../test/sampleIO.nc.gz"} {
+		var traj chem.SeekTraj
+		traj, err := New(name)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		if traj.NFrames() != 3 {
+			Te.Errorf("%s: NFrames is %d, not 3", name, traj.NFrames())
+		}
+		m := v3.Zeros(traj.Len())
+		f := 0
+		for ; traj.Next(m) == nil; f++ {
+			checkCoords(Te, name, f, all, m)
+		}
+		if f != 3 {
+			Te.Errorf("%s: %d frames read", name, f)
+		}
+		if err := traj.ReadFrame(1, m); err != nil {
+			Te.Fatal(err)
+		}
+		checkCoords(Te, name, 1, all, m)
+		if err := traj.SetRange(2, -1, 2); err != nil {
+			Te.Fatal(err)
+		}
+		if err := traj.Next(m); err != nil {
+			Te.Fatal(err)
+		}
+		checkCoords(Te, name, 2, all, m)
+		//sample_cdf1.nc has no times.
+		if t := traj.(*NCObj).Time(); name == "../test/sample_cdf1.nc" && !math.IsNaN(t) {
+			Te.Errorf("%s: time %f read from a file without times", name, t)
+		}
+		if err := traj.Next(m); err == nil {
+			Te.Errorf("%s: frame read out of range", name)
+		}
+	}
+	//Corrupt headers with negative or huge list lengths give errors.
+	for _, n := range []string{"\xff\xff\xff\xff", "\x7f\xff\xff\xff"} {
+		header := "CDF\x01" + "\x00\x00\x00\x00" + "\x00\x00\x00\x0a" + n
+		if _, err := readHeader(strings.NewReader(header)); err == nil {
+			Te.Errorf("No error for a header with a list of % x elements", n)
+		}
+	}
+}
+
+//TestNCMeta checks the velocities, boxes and times, and reading a subset of the atoms with NextConc.
+func TestNCMeta(Te *testing.T) {
+	indexes := []int{4, 0}
+	traj, err := New("../test/sample.nc", indexes)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	var meta chem.VelForceTraj = traj
+	frames := []*v3.Matrix{v3.Zeros(2), nil, v3.Zeros(2)}
+	chans, err := traj.NextConc(frames)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	checkCoords(Te, "NextConc", 0, indexes, <-chans[0])
+	checkCoords(Te, "NextConc", 2, indexes, <-chans[2])
+	if meta.Time() != 14 || meta.Step() != -1 {
+		Te.Errorf("Wrong time or step: %f %d", meta.Time(), meta.Step())
+	}
+	if b := meta.Box(); b == nil || math.Abs(b.Volume()-32*31*32) > 1e-6 {
+		Te.Errorf("Wrong box: %v", b)
+	}
+	vel := v3.Zeros(2)
+	if !meta.Velocities(vel) {
+		Te.Fatal("No velocities read")
+	}
+	for j, i := range indexes {
+		expected := []float64{0.1 * float64(i), 0.2, 0.05}
+		for k, v := range expected {
+			if math.Abs(vel.At(j, k)-20.455*v) > 1e-4 {
+				Te.Errorf("Atom %d velocity %v, expected %v*20.455", i, vel.VecView(j), expected)
+				break
+			}
+		}
+	}
+	if meta.Forces(vel) {
+		Te.Error("Forces read from a file without them")
+	}
+	//A closed trajectory gives no data, but doesn't panic.
+	traj.Close()
+	if meta.Velocities(vel) || !math.IsNaN(meta.Time()) {
+		Te.Errorf("Data read from a closed trajectory")
+	}
+	if err := traj.Next(vel); err == nil {
+		Te.Errorf("No error reading the next frame of a closed trajectory")
+	}
+}
@@ -0,0 +1,304 @@
+/*
+ * netcdf.go, part of gochem
+ *
+ * Copyright 2012 Raul Mera Adasme <rmera_changeforat_chem-dot-helsinki-dot-fi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License  as published by
+ * the Free Software Foundation; either version 2.1 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston,
+ * MA 02110-1301, USA.
+ */
+/*
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package nc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+//This file contains a minimal reader for the NetCDF classic and 64-bit offset formats
+//(often called NetCDF-3), enough to read trajectories. The format is described in
+//https://docs.unidata.ucar.edu/netcdf-c/current/file_format_specifications.html
+
+//Tags and types in the NetCDF header.
+const (
+	ncDimension = 0x0A
+	ncVariable  = 0x0B
+	ncAttribute = 0x0C
+	ncByte      = 1
+	ncChar      = 2
+	ncShort     = 3
+	ncInt       = 4
+	ncFloat     = 5
+	ncDouble    = 6
+	ncStreaming = 0xFFFFFFFF //numrecs value for files being written
+)
+
+//ncTypeSize returns the size in bytes of the NetCDF type typ, or 0 for an unknown type.
+func ncTypeSize(typ int32) int64 {
+	switch typ {
+	case ncByte, ncChar:
+		return 1
+	case ncShort:
+		return 2
+	case ncInt, ncFloat:
+		return 4
+	case ncDouble:
+		return 8
+	}
+	return 0
+}
+
+//ncDim is a NetCDF dimension. A length of 0 means the record (unlimited) dimension.
+type ncDim struct {
+	name   string
+	length int64
+}
+
+//ncAttr is a NetCDF attribute. Text attributes are stored in text, numeric ones, in values.
+type ncAttr struct {
+	text   string
+	values []float64
+}
+
+//ncVar is a NetCDF variable.
+type ncVar struct {
+	name   string
+	shape  []int64 //the length of each dimension, excluding the record dimension
+	record bool    //is the first dimension the record one?
+	attrs  map[string]*ncAttr
+	typ    int32
+	begin  int64
+}
+
+//size returns the number of values in each record of the variable, or in the whole variable,
+//for non-record variables.
+func (V *ncVar) size() int64 {
+	n := int64(1)
+	for _, v := range V.shape {
+		n *= v
+	}
+	return n
+}
+
+//ncHeader contains the information in the header of a NetCDF file.
+type ncHeader struct {
+	numrecs int64
+	attrs   map[string]*ncAttr
+	vars    map[string]*ncVar
+	recsize int64 //the size of each record, including all the record variables
+}
+
+//ncReader reads the header data, keeping the first error found.
+type ncReader struct {
+	r      io.Reader
+	offset bool //64-bit offsets?
+	err    error
+}
+
+func (R *ncReader) int32() int32 {
+	var i int32
+	if R.err == nil {
+		R.err = binary.Read(R.r, binary.BigEndian, &i)
+	}
+	return i
+}
+
+func (R *ncReader) int64() int64 {
+	var i int64
+	if R.err == nil {
+		R.err = binary.Read(R.r, binary.BigEndian, &i)
+	}
+	return i
+}
+
+//bytes reads n bytes, plus the padding to 4 bytes.
+func (R *ncReader) bytes(n int64) []byte {
+	if R.err != nil {
+		return nil
+	}
+	if n < 0 || n > 1<<30 {
+		R.err = fmt.Errorf("wrong length %d in header", n)
+		return nil
+	}
+	b := make([]byte, (n+3)/4*4)
+	_, R.err = io.ReadFull(R.r, b)
+	return b[:n]
+}
+
+func (R *ncReader) name() string {
+	return string(R.bytes(int64(R.int32())))
+}
+
+//maxListLen is the largest number of elements accepted for a list in the header, to avoid
+//huge allocations with corrupt files. Real files have a few dozens at most.
+const maxListLen = 1 << 16
+
+//list reads the tag and number of elements of a list, and returns the number of elements.
+//An absent list is two zeros, and gives 0 elements. On error, it returns 0.
+func (R *ncReader) list(tag int32) int {
+	t := R.int32()
+	n := R.int32()
+	if R.err == nil && t != tag && (t != 0 || n != 0) {
+		R.err = fmt.Errorf("wrong tag %d in header, expected %d", t, tag)
+	}
+	if R.err == nil && (n < 0 || n > maxListLen) {
+		R.err = fmt.Errorf("wrong number of elements %d in header list", n)
+	}
+	if R.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (R *ncReader) attrs() map[string]*ncAttr {
+	n := R.list(ncAttribute)
+	attrs := make(map[string]*ncAttr, n)
+	for i := 0; i < n && R.err == nil; i++ {
+		name := R.name()
+		typ := R.int32()
+		nelems := int64(R.int32())
+		size := ncTypeSize(typ)
+		if R.err == nil && size == 0 {
+			R.err = fmt.Errorf("unknown type %d for attribute %s", typ, name)
+		}
+		data := R.bytes(nelems * size)
+		if R.err != nil {
+			break
+		}
+		if typ == ncChar {
+			attrs[name] = &ncAttr{text: string(data)}
+			continue
+		}
+		attrs[name] = &ncAttr{values: decode(data, typ, make([]float64, nelems))}
+	}
+	return attrs
+}
+
+//readHeader reads the header of a NetCDF classic or 64-bit offset file.
+func readHeader(r io.Reader) (*ncHeader, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic[:3]) != "CDF" || (magic[3] != 1 && magic[3] != 2) {
+		return nil, fmt.Errorf("not a NetCDF classic or 64-bit offset file")
+	}
+	R := &ncReader{r: r, offset: magic[3] == 2}
+	h := new(ncHeader)
+	h.numrecs = int64(uint32(R.int32()))
+	n := R.list(ncDimension)
+	dims := make([]ncDim, 0, n)
+	for i := 0; i < n && R.err == nil; i++ {
+		dims = append(dims, ncDim{R.name(), int64(R.int32())})
+	}
+	h.attrs = R.attrs()
+	n = R.list(ncVariable)
+	h.vars = make(map[string]*ncVar, n)
+	nrecvars := 0
+	var recvar *ncVar
+	for i := 0; i < n && R.err == nil; i++ {
+		v := &ncVar{name: R.name()}
+		ndims := int(R.int32())
+		for j := 0; j < ndims && R.err == nil; j++ {
+			id := int(R.int32())
+			if id < 0 || id >= len(dims) {
+				R.err = fmt.Errorf("wrong dimension %d for variable %s", id, v.name)
+				break
+			}
+			if dims[id].length == 0 {
+				if j != 0 {
+					R.err = fmt.Errorf("record dimension not first in variable %s", v.name)
+				}
+				v.record = true
+				continue
+			}
+			v.shape = append(v.shape, dims[id].length)
+		}
+		v.attrs = R.attrs()
+		v.typ = R.int32()
+		vsize := int64(uint32(R.int32()))
+		if R.offset {
+			v.begin = R.int64()
+		} else {
+			v.begin = int64(uint32(R.int32()))
+		}
+		if R.err == nil && ncTypeSize(v.typ) == 0 {
+			R.err = fmt.Errorf("unknown type %d for variable %s", v.typ, v.name)
+		}
+		if v.record {
+			nrecvars++
+			recvar = v
+			h.recsize += vsize
+		}
+		h.vars[v.name] = v
+	}
+	if R.err != nil {
+		return nil, R.err
+	}
+	//If there is only one record variable, its records are not padded.
+	if nrecvars == 1 {
+		h.recsize = recvar.size() * ncTypeSize(recvar.typ)
+	}
+	return h, nil
+}
+
+//decode puts the big-endian values of type typ in data into dst, and returns dst.
+func decode(data []byte, typ int32, dst []float64) []float64 {
+	B := binary.BigEndian
+	for i := range dst {
+		switch typ {
+		case ncByte:
+			dst[i] = float64(int8(data[i]))
+		case ncShort:
+			dst[i] = float64(int16(B.Uint16(data[2*i:])))
+		case ncInt:
+			dst[i] = float64(int32(B.Uint32(data[4*i:])))
+		case ncFloat:
+			dst[i] = float64(math.Float32frombits(B.Uint32(data[4*i:])))
+		case ncDouble:
+			dst[i] = math.Float64frombits(B.Uint64(data[8*i:]))
+		}
+	}
+	return dst
+}
+
+//readVar reads the values of the variable V for the record rec (ignored for non-record
+//variables) from r, into dst, which must have space for V.size() values. buf is used to
+//read the raw data, if it is large enough.
+func readVar(r io.ReaderAt, h *ncHeader, V *ncVar, rec int, dst []float64, buf []byte) ([]byte, error) {
+	n := V.size() * ncTypeSize(V.typ)
+	if int64(len(buf)) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	offset := V.begin
+	if V.record {
+		offset += int64(rec) * h.recsize
+	}
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return buf, err
+	}
+	decode(buf, V.typ, dst[:V.size()])
+	return buf, nil
+}
@@ -0,0 +1,307 @@
+/*
+ * neighbors.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"math"
+	"sort"
+
+	"github.com/rmera/gochem/v3"
+)
+
+//NeighborIndex is a spatial index (a cell list) built from a set of positions, which allows
+//distance-based searches (radius queries, k-nearest neighbors and all pairs within a cutoff)
+//that don't need to compare every position with every other. The index can be periodic,
+//in which case all distances are minimum-image distances in the given box.
+//The index keeps a copy of the positions, so it is not affected by later changes to them.
+type NeighborIndex struct {
+	pos   [][3]float64
+	box   *Box       //nil for non-periodic indexes
+	orig  [3]float64 //the origin of the grid (non-periodic only)
+	width [3]float64 //the width of the grid along each axis (the perpendicular widths of the box, if periodic).
+	ncell [3]int
+	head  []int //first position in each cell, or -1
+	next  []int //next position in the same cell, or -1
+}
+
+//DefaultCellSize is the cell size (in A) used by NewNeighborIndex if a non-positive one is given.
+const DefaultCellSize = 4.0
+
+//NewNeighborIndex builds a neighbor search index for the positions in coords. cellsize is the
+//approximate size (in A) of the cells in which the space is divided. Any size gives correct results,
+//but searches are fastest when it is similar to the radii used in the queries. If cellsize is not
+//positive, DefaultCellSize is used. If a box is given, the index is periodic in that box.
+func NewNeighborIndex(coords *v3.Matrix, cellsize float64, box ...*Box) *NeighborIndex {
+	if cellsize <= 0 {
+		cellsize = DefaultCellSize
+	}
+	N := &NeighborIndex{}
+	n := coords.NVecs()
+	N.pos = make([][3]float64, n)
+	for i := range N.pos {
+		N.pos[i] = getVec3(coords, i)
+	}
+	if len(box) > 0 && box[0] != nil {
+		N.box = box[0]
+		vol := N.box.Volume()
+		v := N.box.vecs
+		for i := 0; i < 3; i++ {
+			cr := cross3(v[(i+1)%3], v[(i+2)%3])
+			N.width[i] = vol / norm3(cr)
+		}
+	} else {
+		min := [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)}
+		max := [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+		for _, p := range N.pos {
+			for j := 0; j < 3; j++ {
+				min[j] = math.Min(min[j], p[j])
+				max[j] = math.Max(max[j], p[j])
+			}
+		}
+		for j := 0; j < 3; j++ {
+			if n == 0 {
+				min[j], max[j] = 0, 0
+			}
+			N.orig[j] = min[j]
+			N.width[j] = math.Max(max[j]-min[j], cellsize)
+		}
+	}
+	//We don't want way more cells than positions.
+	maxcells := 2*n + 27
+	for {
+		total := 1
+		for j := 0; j < 3; j++ {
+			N.ncell[j] = int(math.Max(1, math.Floor(N.width[j]/cellsize)))
+			total *= N.ncell[j]
+		}
+		if total <= maxcells {
+			break
+		}
+		cellsize *= 1.25
+	}
+	N.head = make([]int, N.ncell[0]*N.ncell[1]*N.ncell[2])
+	for i := range N.head {
+		N.head[i] = -1
+	}
+	N.next = make([]int, n)
+	for i, p := range N.pos {
+		c := N.cellOf(N.frac(p))
+		k := (c[0]*N.ncell[1]+c[1])*N.ncell[2] + c[2]
+		N.next[i] = N.head[k]
+		N.head[k] = i
+	}
+	return N
+}
+
+//Len returns the number of positions in the index.
+func (N *NeighborIndex) Len() int {
+	return len(N.pos)
+}
+
+//Box returns the box of a periodic index, or nil if the index is not periodic.
+func (N *NeighborIndex) Box() *Box {
+	return N.box
+}
+
+//frac returns the position p in fractional coordinates of the grid
+//wrapped into the box, if the index is periodic.
+func (N *NeighborIndex) frac(p [3]float64) [3]float64 {
+	if N.box != nil {
+		f := N.box.toFrac(p)
+		for j := range f {
+			f[j] -= math.Floor(f[j])
+		}
+		return f
+	}
+	var f [3]float64
+	for j := range f {
+		f[j] = (p[j] - N.orig[j]) / N.width[j]
+	}
+	return f
+}
+
+//cellOf returns the cell that contains the fractional position f, which is
+//assumed to be inside the grid.
+func (N *NeighborIndex) cellOf(f [3]float64) [3]int {
+	var c [3]int
+	for j := range c {
+		c[j] = int(f[j] * float64(N.ncell[j]))
+		if c[j] >= N.ncell[j] {
+			c[j] = N.ncell[j] - 1
+		}
+		if c[j] < 0 {
+			c[j] = 0
+		}
+	}
+	return c
+}
+
+//cellRange returns the cells along the axis ax that need to be searched
+//to find all the positions closer than r to a point with fractional coordinate f along that axis.
+func (N *NeighborIndex) cellRange(f, r float64, ax int) []int {
+	n := N.ncell[ax]
+	span := r / N.width[ax]
+	lo := int(math.Floor((f - span) * float64(n)))
+	hi := int(math.Floor((f + span) * float64(n)))
+	ret := make([]int, 0, hi-lo+1)
+	if N.box != nil {
+		if hi-lo+1 >= n {
+			lo, hi = 0, n-1
+		}
+		for c := lo; c <= hi; c++ {
+			ret = append(ret, ((c%n)+n)%n)
+		}
+		return ret
+	}
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > n-1 {
+		hi = n - 1
+	}
+	for c := lo; c <= hi; c++ {
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+//dist2 returns the squared (minimum-image, if the index is periodic) distance between p and q.
+func (N *NeighborIndex) dist2(p, q [3]float64) float64 {
+	d := [3]float64{q[0] - p[0], q[1] - p[1], q[2] - p[2]}
+	if N.box != nil {
+		d = N.box.minImage(d)
+	}
+	return dot3(d, d)
+}
+
+//search calls found with the index and squared distance of each position closer than r to p.
+func (N *NeighborIndex) search(p [3]float64, r float64, found func(i int, d2 float64)) {
+	f := N.frac(p)
+	r2 := r * r
+	xs := N.cellRange(f[0], r, 0)
+	ys := N.cellRange(f[1], r, 1)
+	zs := N.cellRange(f[2], r, 2)
+	for _, x := range xs {
+		for _, y := range ys {
+			for _, z := range zs {
+				for i := N.head[(x*N.ncell[1]+y)*N.ncell[2]+z]; i >= 0; i = N.next[i] {
+					if d2 := N.dist2(p, N.pos[i]); d2 <= r2 {
+						found(i, d2)
+					}
+				}
+			}
+		}
+	}
+}
+
+//Within returns, in increasing order, the indexes of the positions that are at a distance
+//of r or less from point (the first vector in the matrix).
+func (N *NeighborIndex) Within(point *v3.Matrix, r float64) []int {
+	ret := make([]int, 0, 8)
+	N.search(getVec3(point, 0), r, func(i int, d2 float64) {
+		ret = append(ret, i)
+	})
+	sort.Ints(ret)
+	return ret
+}
+
+//neighborDist is an index and its squared distance to some point.
+type neighborDist struct {
+	i  int
+	d2 float64
+}
+
+//KNearest returns the indexes of the k positions closest to point (the first vector in the matrix),
+//ordered from the closest to the farthest. If the index has less than k positions, all of them are returned.
+func (N *NeighborIndex) KNearest(point *v3.Matrix, k int) []int {
+	if k > len(N.pos) {
+		k = len(N.pos)
+	}
+	if k <= 0 {
+		return []int{}
+	}
+	p := getVec3(point, 0)
+	//The largest radius we could need.
+	maxr := 0.0
+	for _, w := range N.width {
+		maxr += w * w
+	}
+	maxr = math.Sqrt(maxr)
+	if N.box == nil {
+		//the distance from the point to the grid could be much larger than the grid.
+		maxr += math.Sqrt(N.dist2(p, N.orig))
+	}
+	r := math.Min(N.width[0]/float64(N.ncell[0]), maxr)
+	var found []neighborDist
+	for {
+		found = found[:0]
+		N.search(p, r, func(i int, d2 float64) {
+			found = append(found, neighborDist{i, d2})
+		})
+		if len(found) >= k || r >= maxr {
+			break
+		}
+		r = math.Min(2*r, maxr)
+	}
+	sort.Slice(found, func(a, b int) bool {
+		if found[a].d2 == found[b].d2 {
+			return found[a].i < found[b].i
+		}
+		return found[a].d2 < found[b].d2
+	})
+	ret := make([]int, 0, k)
+	for _, v := range found[:k] {
+		ret = append(ret, v.i)
+	}
+	return ret
+}
+
+//Pairs returns all the pairs of indexes i, j, with i<j, of positions at a distance of
+//cutoff or less from each other. The pairs are sorted by i and then by j.
+func (N *NeighborIndex) Pairs(cutoff float64) [][2]int {
+	ret := make([][2]int, 0, len(N.pos))
+	var row []int
+	for i, p := range N.pos {
+		row = row[:0]
+		N.search(p, cutoff, func(j int, d2 float64) {
+			if j > i {
+				row = append(row, j)
+			}
+		})
+		sort.Ints(row)
+		for _, j := range row {
+			ret = append(ret, [2]int{i, j})
+		}
+	}
+	return ret
+}
+
+//cross3 returns the cross product of u and v.
+func cross3(u, v [3]float64) [3]float64 {
+	return [3]float64{u[1]*v[2] - u[2]*v[1], u[2]*v[0] - u[0]*v[2], u[0]*v[1] - u[1]*v[0]}
+}
@@ -0,0 +1,325 @@
+/*
+ * prmtop.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//AMBER charges are stored multiplied by this factor, so Coulomb's law needs no constant.
+const amberChargeFactor = 18.2223
+
+//PrmtopFileRead reads the AMBER parameter/topology file prmtopname and returns the topology in it.
+//See PrmtopRead for details.
+func PrmtopFileRead(prmtopname string) (*Topology, error) {
+	prmtopfile, err := OpenFile(prmtopname)
+	if err != nil {
+		return nil, errDecorate(err, "PrmtopFileRead")
+	}
+	defer prmtopfile.Close()
+	top, err := PrmtopRead(prmtopfile)
+	if err != nil {
+		return nil, errDecorate(err, "PrmtopFileRead "+fmt.Sprintf("error in file %s", prmtopname))
+	}
+	return top, nil
+}
+
+//PrmtopRead reads an AMBER prmtop topology from prmtopp. The atom names, AMBER atom types, partial charges (in e)
+//and masses are put in the Name, Type, Charge and Mass fields of each atom, and the residue names and numbers
+//in the Molname and MolID fields. The element symbols are taken from the atomic numbers, if the file has them, or
+//guessed from the masses. The bonds (with order 0), angles, proper and improper dihedrals are also read. The charge of the
+//topology is the sum of the atomic charges, rounded, and the multiplicity is set to 1.
+func PrmtopRead(prmtopp io.Reader) (*Topology, error) {
+	sec, err := prmtopSections(prmtopp)
+	if err != nil {
+		return nil, errDecorate(err, "PrmtopRead")
+	}
+	pointers, err := prmtopInts(sec, "POINTERS", 12)
+	if err != nil {
+		return nil, errDecorate(err, "PrmtopRead")
+	}
+	natoms, nres := pointers[0], pointers[11]
+	names, err := prmtopStrings(sec, "ATOM_NAME", natoms)
+	if err != nil {
+		return nil, errDecorate(err, "PrmtopRead")
+	}
+	types, err := prmtopStrings(sec, "AMBER_ATOM_TYPE", natoms)
+	if err != nil {
+		return nil, errDecorate(err, "PrmtopRead")
+	}
+	charges, err := prmtopFloats(sec, "CHARGE", natoms)
+	if err != nil {
+		return nil, errDecorate(err, "PrmtopRead")
+	}
+	masses, err := prmtopFloats(sec, "MASS", natoms)
+	if err != nil {
+		return nil, errDecorate(err, "PrmtopRead")
+	}
+	resnames, err := prmtopStrings(sec, "RESIDUE_LABEL", nres)
+	if err != nil {
+		return nil, errDecorate(err, "PrmtopRead")
+	}
+	respointers, err := prmtopInts(sec, "RESIDUE_POINTER", nres)
+	if err != nil {
+		return nil, errDecorate(err, "PrmtopRead")
+	}
+	var numbers []int
+	if _, ok := sec["ATOMIC_NUMBER"]; ok { //older files don't have atomic numbers.
+		numbers, err = prmtopInts(sec, "ATOMIC_NUMBER", natoms)
+		if err != nil {
+			return nil, errDecorate(err, "PrmtopRead")
+		}
+	}
+	ats := make([]*Atom, natoms)
+	res := 0
+	charge := 0.0
+	for i := range ats {
+		for res < nres-1 && respointers[res+1]-1 <= i {
+			res++
+		}
+		at := new(Atom)
+		at.ID = i + 1
+		at.Name = names[i]
+		at.Type = types[i]
+		at.Charge = charges[i] / amberChargeFactor
+		at.Mass = masses[i]
+		at.MolID = res + 1
+		at.Molname = resnames[res]
+		at.Molname1 = three2OneLetter[at.Molname]
+		at.Chain = " "
+		if numbers != nil {
+			at.Symbol, _ = symbolFromNumber(numbers[i])
+		}
+		if at.Symbol == "" {
+			at.Symbol, _ = symbolFromMass(at.Mass)
+		}
+		if at.Symbol == "" {
+			at.Symbol, _ = symbolFromName(at.Name)
+		}
+		charge += at.Charge
+		ats[i] = at
+	}
+	top := NewTopology(int(math.Floor(charge+0.5)), 1, ats)
+	var bonds []*Bond
+	for _, flag := range []string{"BONDS_INC_HYDROGEN", "BONDS_WITHOUT_HYDROGEN"} {
+		b, err := prmtopTuples(sec, flag, 3, 2, natoms)
+		if err != nil {
+			return nil, errDecorate(err, "PrmtopRead")
+		}
+		for _, v := range b {
+			bonds = append(bonds, &Bond{At1: v[0], At2: v[1]})
+		}
+	}
+	top.SetBonds(bonds)
+	var angles [][]int
+	for _, flag := range []string{"ANGLES_INC_HYDROGEN", "ANGLES_WITHOUT_HYDROGEN"} {
+		a, err := prmtopTuples(sec, flag, 4, 3, natoms)
+		if err != nil {
+			return nil, errDecorate(err, "PrmtopRead")
+		}
+		angles = append(angles, a...)
+	}
+	top.SetAngles(angles)
+	var dihedrals, impropers [][]int
+	seen := make(map[[4]int]bool)
+	for _, flag := range []string{"DIHEDRALS_INC_HYDROGEN", "DIHEDRALS_WITHOUT_HYDROGEN"} {
+		d, err := prmtopTuples(sec, flag, 5, 4, natoms)
+		if err != nil {
+			return nil, errDecorate(err, "PrmtopRead")
+		}
+		for _, v := range d {
+			//a negative fourth index marks an improper. Dihedrals with several
+			//terms appear once per term, but we only want them once.
+			key := [4]int{v[0], v[1], v[2], v[3]}
+			if key[2] < 0 {
+				key[2] = -key[2]
+			}
+			if key[3] < 0 {
+				key[3] = -key[3]
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if v[3] < 0 {
+				impropers = append(impropers, key[:])
+			} else {
+				dihedrals = append(dihedrals, key[:])
+			}
+		}
+	}
+	top.SetDihedrals(dihedrals)
+	top.SetImpropers(impropers)
+	return top, nil
+}
+
+//prmtopSections reads all the sections of a prmtop file and returns a map from the name of each section
+//to its items, as strings, split according to the format of the section.
+func prmtopSections(prmtopp io.Reader) (map[string][]string, error) {
+	prmtop := bufio.NewReader(prmtopp)
+	sec := make(map[string][]string)
+	flag := ""
+	width := 0
+	for {
+		line, err := prmtop.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, CError{"Error reading prmtop file: " + err.Error(), []string{"prmtopSections"}}
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "%FLAG"):
+			flag = strings.TrimSpace(line[5:])
+			sec[flag] = nil
+			width = 0
+		case strings.HasPrefix(line, "%FORMAT"):
+			width, err = prmtopWidth(line)
+			if err != nil {
+				return nil, errDecorate(err, "prmtopSections")
+			}
+		case strings.HasPrefix(line, "%"): //%VERSION and %COMMENT
+		case flag != "":
+			if width == 0 {
+				return nil, CError{"No format for section " + flag + " in prmtop file", []string{"prmtopSections"}}
+			}
+			for i := 0; i < len(line); i += width {
+				end := i + width
+				if end > len(line) {
+					end = len(line)
+				}
+				if item := strings.TrimSpace(line[i:end]); item != "" {
+					sec[flag] = append(sec[flag], item)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if len(sec) == 0 {
+		return nil, CError{"Not a prmtop file", []string{"prmtopSections"}}
+	}
+	return sec, nil
+}
+
+//prmtopWidth returns the width of each item from a format line, such as "%FORMAT(10I8)" or "%FORMAT(5E16.8)".
+func prmtopWidth(line string) (int, error) {
+	f := strings.TrimSpace(line[len("%FORMAT"):])
+	f = strings.ToUpper(strings.Trim(f, "()"))
+	i := strings.IndexAny(f, "AIEF")
+	if i < 0 {
+		return 0, CError{"Unknown prmtop format: " + line, []string{"prmtopWidth"}}
+	}
+	w := f[i+1:]
+	if j := strings.Index(w, "."); j >= 0 {
+		w = w[:j]
+	}
+	width, err := strconv.Atoi(w)
+	if err != nil || width <= 0 {
+		return 0, CError{"Unknown prmtop format: " + line, []string{"strconv.Atoi", "prmtopWidth"}}
+	}
+	return width, nil
+}
+
+//prmtopStrings returns the first n items of the section flag.
+func prmtopStrings(sec map[string][]string, flag string, n int) ([]string, error) {
+	s, ok := sec[flag]
+	if !ok {
+		return nil, CError{"No section " + flag + " in prmtop file", []string{"prmtopStrings"}}
+	}
+	if len(s) < n {
+		return nil, CError{fmt.Sprintf("Section %s in prmtop file has %d items instead of %d", flag, len(s), n), []string{"prmtopStrings"}}
+	}
+	return s[:n], nil
+}
+
+//prmtopInts returns the first n items of the section flag as integers.
+func prmtopInts(sec map[string][]string, flag string, n int) ([]int, error) {
+	s, err := prmtopStrings(sec, flag, n)
+	if err != nil {
+		return nil, errDecorate(err, "prmtopInts")
+	}
+	ret := make([]int, n)
+	for i, v := range s {
+		ret[i], err = strconv.Atoi(v)
+		if err != nil {
+			return nil, CError{fmt.Sprintf("Malformed integer %s in section %s of prmtop file", v, flag), []string{"strconv.Atoi", "prmtopInts"}}
+		}
+	}
+	return ret, nil
+}
+
+//prmtopFloats returns the first n items of the section flag as floats.
+func prmtopFloats(sec map[string][]string, flag string, n int) ([]float64, error) {
+	s, err := prmtopStrings(sec, flag, n)
+	if err != nil {
+		return nil, errDecorate(err, "prmtopFloats")
+	}
+	ret := make([]float64, n)
+	for i, v := range s {
+		ret[i], err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, CError{fmt.Sprintf("Malformed number %s in section %s of prmtop file", v, flag), []string{"strconv.ParseFloat", "prmtopFloats"}}
+		}
+	}
+	return ret, nil
+}
+
+//prmtopTuples reads the bonds, angles or dihedrals in the section flag, which has groups of size
+//integers, the first atoms of which are the atom indexes, times 3, and the last, the parameter index.
+//It returns, for each group, the 0-based indexes of the atoms, which keep their sign, as the
+//sign marks the dihedrals that are improper or that lack 1-4 interactions.
+func prmtopTuples(sec map[string][]string, flag string, size, atoms, natoms int) ([][]int, error) {
+	s, ok := sec[flag]
+	if !ok {
+		return nil, nil
+	}
+	if len(s)%size != 0 {
+		return nil, CError{fmt.Sprintf("Section %s in prmtop file has %d items, not a multiple of %d", flag, len(s), size), []string{"prmtopTuples"}}
+	}
+	ints, err := prmtopInts(sec, flag, len(s))
+	if err != nil {
+		return nil, errDecorate(err, "prmtopTuples")
+	}
+	ret := make([][]int, 0, len(s)/size)
+	for i := 0; i < len(ints); i += size {
+		t := make([]int, atoms)
+		for j := range t {
+			t[j] = ints[i+j] / 3
+			if t[j] >= natoms || -t[j] >= natoms || ints[i+j]%3 != 0 {
+				return nil, CError{fmt.Sprintf("Wrong atom index %d in section %s of prmtop file", ints[i+j], flag), []string{"prmtopTuples"}}
+			}
+		}
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
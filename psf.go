@@ -0,0 +1,263 @@
+/*
+ * psf.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//PSFFileRead reads the CHARMM/NAMD/X-PLOR PSF file psfname and returns the topology in it.
+//See PSFRead for details.
+func PSFFileRead(psfname string) (*Topology, error) {
+	psffile, err := OpenFile(psfname)
+	if err != nil {
+		return nil, errDecorate(err, "PSFFileRead")
+	}
+	defer psffile.Close()
+	top, err := PSFRead(psffile)
+	if err != nil {
+		return nil, errDecorate(err, "PSFFileRead "+fmt.Sprintf("error in file %s", psfname))
+	}
+	return top, nil
+}
+
+//PSFRead reads a PSF topology, in the standard, EXT or XPLOR variant, from psfp.
+//The atom IDs, names, residue names and IDs, types, partial charges and masses are put in the ID, Name,
+//Molname, MolID, Type, Charge and Mass fields of each atom, and the segment names in the Chain field.
+//The element symbols are guessed from the masses or, if that fails, from the atom names. The bonds (with order 0, as PSF
+//files don't give bond orders), angles, proper and improper dihedrals are also read. The charge of the topology is
+//the sum of the atomic charges, rounded, and the multiplicity is set to 1.
+func PSFRead(psfp io.Reader) (*Topology, error) {
+	psf := bufio.NewReader(psfp)
+	line, err := psfNextLine(psf)
+	if err != nil || !strings.HasPrefix(line, "PSF") {
+		return nil, CError{"Not a PSF file", []string{"PSFRead"}}
+	}
+	ext := false
+	for _, v := range strings.Fields(line)[1:] {
+		if v == "EXT" {
+			ext = true
+		}
+	}
+	var top *Topology
+	for {
+		line, err = psfNextLine(psf)
+		if err == io.EOF && top != nil {
+			break //some PSF files end after the bonds, or even after the atoms.
+		}
+		if err != nil {
+			return nil, CError{"Error reading PSF file: " + err.Error(), []string{"PSFRead"}}
+		}
+		n, section, err := psfSection(line)
+		if err != nil {
+			return nil, errDecorate(err, "PSFRead")
+		}
+		if section != "NATOM" && section != "NTITLE" && top == nil {
+			return nil, CError{"No atoms before section " + section + " in PSF file", []string{"PSFRead"}}
+		}
+		switch section {
+		case "NTITLE":
+			for i := 0; i < n; i++ {
+				if _, err = psf.ReadString('\n'); err != nil {
+					return nil, CError{"Error reading PSF title: " + err.Error(), []string{"PSFRead"}}
+				}
+			}
+		case "NATOM":
+			ats := make([]*Atom, 0, n)
+			charge := 0.0
+			for i := 0; i < n; i++ {
+				line, err = psf.ReadString('\n')
+				if err != nil && (err != io.EOF || line == "") {
+					return nil, CError{fmt.Sprintf("Error reading atom %d from PSF file: %s", i+1, err.Error()), []string{"PSFRead"}}
+				}
+				at, err := psfReadAtom(line, ext)
+				if err != nil {
+					return nil, errDecorate(err, "PSFRead")
+				}
+				charge += at.Charge
+				ats = append(ats, at)
+			}
+			top = NewTopology(int(math.Floor(charge+0.5)), 1, ats)
+		case "NBOND":
+			b, err := psfReadTuples(psf, n, 2, top.Len())
+			if err != nil {
+				return nil, errDecorate(err, "PSFRead: bonds")
+			}
+			bonds := make([]*Bond, 0, n)
+			for _, v := range b {
+				bonds = append(bonds, &Bond{At1: v[0], At2: v[1]})
+			}
+			top.SetBonds(bonds)
+		case "NTHETA":
+			a, err := psfReadTuples(psf, n, 3, top.Len())
+			if err != nil {
+				return nil, errDecorate(err, "PSFRead: angles")
+			}
+			top.SetAngles(a)
+		case "NPHI":
+			d, err := psfReadTuples(psf, n, 4, top.Len())
+			if err != nil {
+				return nil, errDecorate(err, "PSFRead: dihedrals")
+			}
+			top.SetDihedrals(d)
+		case "NIMPHI":
+			d, err := psfReadTuples(psf, n, 4, top.Len())
+			if err != nil {
+				return nil, errDecorate(err, "PSFRead: impropers")
+			}
+			top.SetImpropers(d)
+			return top, nil //The rest of the file (donors, acceptors, groups, etc.) is not read.
+		default:
+			return top, nil
+		}
+	}
+	return top, nil
+}
+
+//psfNextLine returns the next non-empty line in psf.
+func psfNextLine(psf *bufio.Reader) (string, error) {
+	for {
+		line, err := psf.ReadString('\n')
+		if strings.TrimSpace(line) != "" {
+			return strings.TrimSpace(line), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+//psfSection parses a section header, such as "12 !NBOND: bonds", and returns
+//the number of entries and the name of the section.
+func psfSection(line string) (int, string, error) {
+	i := strings.Index(line, "!")
+	if i < 0 {
+		return 0, "", CError{"Expected a section header in PSF file, got: " + line, []string{"psfSection"}}
+	}
+	fields := strings.Fields(line[:i])
+	if len(fields) == 0 {
+		return 0, "", CError{"Malformed section header in PSF file: " + line, []string{"psfSection"}}
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, "", CError{"Malformed section header in PSF file: " + line, []string{"strconv.Atoi", "psfSection"}}
+	}
+	if n < 0 {
+		return 0, "", CError{"Negative count in PSF section header: " + line, []string{"psfSection"}}
+	}
+	name := strings.Fields(line[i+1:])
+	if len(name) == 0 {
+		return 0, "", CError{"Malformed section header in PSF file: " + line, []string{"psfSection"}}
+	}
+	return n, strings.TrimSuffix(name[0], ":"), nil
+}
+
+//psfReadAtom parses an atom line of a PSF file. The fields are separated by spaces
+//in almost all files, but in the fixed-column format some of them can be empty (like the segment names)
+//or touch each other, so the names are taken from the columns if the line doesn't have all the fields.
+func psfReadAtom(line string, ext bool) (*Atom, error) {
+	var err error
+	fields := strings.Fields(line)
+	if len(fields) < 9 {
+		//The column widths of the CHARMM format.
+		w, s := 8, 4
+		if ext {
+			w, s = 10, 8
+		}
+		if len(line) < w+4*(s+1)+1 {
+			return nil, CError{"Malformed atom line in PSF file: " + line, []string{"psfReadAtom"}}
+		}
+		fields = []string{line[:w]}
+		for i := 0; i < 4; i++ {
+			fields = append(fields, strings.TrimSpace(line[w+1+i*(s+1):w+(i+1)*(s+1)]))
+		}
+		fields = append(fields, strings.Fields(line[w+4*(s+1):])...)
+		if len(fields) < 8 {
+			return nil, CError{"Malformed atom line in PSF file: " + line, []string{"psfReadAtom"}}
+		}
+	}
+	at := new(Atom)
+	at.ID, err = strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return nil, CError{"Malformed atom ID in PSF file: " + line, []string{"strconv.Atoi", "psfReadAtom"}}
+	}
+	at.Chain = fields[1]
+	//the residue ID can have an insertion code, which we ignore.
+	resid := strings.TrimRightFunc(fields[2], func(r rune) bool { return r < '0' || r > '9' })
+	at.MolID, err = strconv.Atoi(resid)
+	if err != nil {
+		return nil, CError{"Malformed residue ID in PSF file: " + line, []string{"strconv.Atoi", "psfReadAtom"}}
+	}
+	at.Molname = fields[3]
+	at.Molname1 = three2OneLetter[at.Molname]
+	at.Name = fields[4]
+	at.Type = fields[5]
+	at.Charge, err = strconv.ParseFloat(fields[6], 64)
+	if err != nil {
+		return nil, CError{"Malformed charge in PSF file: " + line, []string{"strconv.ParseFloat", "psfReadAtom"}}
+	}
+	at.Mass, err = strconv.ParseFloat(fields[7], 64)
+	if err != nil {
+		return nil, CError{"Malformed mass in PSF file: " + line, []string{"strconv.ParseFloat", "psfReadAtom"}}
+	}
+	at.Symbol, _ = symbolFromNameMass(at.Name, at.Mass)
+	return at, nil
+}
+
+//psfReadTuples reads n groups of size atom indexes from psf, and returns them
+//as 0-based indexes. natoms is the number of atoms in the topology, used to check the indexes.
+func psfReadTuples(psf *bufio.Reader, n, size, natoms int) ([][]int, error) {
+	ret := make([][]int, 0, n)
+	cur := make([]int, 0, size)
+	for len(ret) < n {
+		line, err := psf.ReadString('\n')
+		for _, v := range strings.Fields(line) {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, CError{"Malformed atom index in PSF file: " + line, []string{"strconv.Atoi", "psfReadTuples"}}
+			}
+			if i < 1 || i > natoms {
+				return nil, CError{fmt.Sprintf("Atom index %d out of range in PSF file", i), []string{"psfReadTuples"}}
+			}
+			cur = append(cur, i-1)
+			if len(cur) == size {
+				ret = append(ret, cur)
+				cur = make([]int, 0, size)
+			}
+		}
+		if err != nil && len(ret) < n {
+			return nil, CError{fmt.Sprintf("Expected %d entries, read %d: %s", n, len(ret), err.Error()), []string{"psfReadTuples"}}
+		}
+	}
+	return ret, nil
+}
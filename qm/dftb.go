@@ -0,0 +1,431 @@
+/*
+ * dftb.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package qm
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/gochem"
+	"github.com/rmera/gochem/v3"
+)
+
+//DFTBPlusHandle builds inputs for, runs, and reads results from DFTB+ calculations.
+//As DFTB+ always uses the same names for its input and output files, each calculation is
+//set in a directory with the name of the calculation.
+//Note that the default methods and basis vary with each program, and even
+//for a given program they are NOT considered part of the API, so they can always change.
+type DFTBPlusHandle struct {
+	defmethod string
+	skdir     string
+	command   string
+	inputname string
+}
+
+func NewDFTBPlusHandle() *DFTBPlusHandle {
+	run := new(DFTBPlusHandle)
+	run.SetDefaults()
+	return run
+}
+
+//DFTBPlusHandle methods
+
+//SetName sets the name of the calculation, which is also the name of the
+//directory where the calculation is set.
+func (O *DFTBPlusHandle) SetName(name string) {
+	O.inputname = name
+}
+
+func (O *DFTBPlusHandle) SetCommand(name string) {
+	O.command = name
+}
+
+//SetSKDir sets the directory with the Slater-Koster files to be used, which must be named as
+//Element1-Element2.skf (for instance, C-H.skf), as in the 3ob and mio sets.
+func (O *DFTBPlusHandle) SetSKDir(dir string) {
+	O.skdir = dir
+}
+
+//SetDefaults sets defaults for a DFTB+ calculation. Default is a single-point at the SCC-DFTB (DFTB2) level.
+//The Slater-Koster files are taken from the directory in the $SKDIR environment variable, and the DFTB+
+//command is set to dftb+, which needs to be in the PATH.
+func (O *DFTBPlusHandle) SetDefaults() {
+	O.defmethod = "SCC-DFTB"
+	O.skdir = os.Getenv("SKDIR")
+	O.command = "dftb+"
+}
+
+//BuildInput builds an input for DFTB+ based int the data in atoms, coords and C, in a
+//directory with the name of the calculation. The method can be DFTB (no SCC), SCC-DFTB (or DFTB2)
+//and DFTB3, which uses the 3ob parameters for the third-order terms. The basis set is not used, the
+//Slater-Koster files are set with SetSKDir. Only cartesian constraints are supported, and
+//solvation and frequency calculations are not. returns only error.
+func (O *DFTBPlusHandle) BuildInput(coords *v3.Matrix, atoms chem.AtomMultiCharger, Q *Calc) error {
+	if atoms == nil || coords == nil {
+		return Error{ErrMissingCharges, DFTBPlus, O.inputname, "", []string{"BuildInput"}, true}
+	}
+	if Q.IConstraints != nil {
+		return Error{"goChem/QM: Internal constraints not supported", DFTBPlus, O.inputname, "", []string{"BuildInput"}, true}
+	}
+	if Q.Dielectric > 0 {
+		log.Printf("solvation is not supported for DFTB+ calculations, will run in vacuum\n")
+	}
+	method := strings.ToUpper(Q.Method)
+	if method == "" {
+		log.Printf("no method assigned for DFTB+ calculation, will used the default %s, \n", O.defmethod)
+		method = O.defmethod
+	}
+	if method != "DFTB" && method != "SCC-DFTB" && method != "DFTB2" && method != "DFTB3" {
+		return Error{"goChem/QM: Method not supported", DFTBPlus, O.inputname, Q.Method, []string{"BuildInput"}, true}
+	}
+	scc := method != "DFTB"
+	//The elements, in order of appearance.
+	elements := make([]string, 0, 5)
+	for i := 0; i < atoms.Len(); i++ {
+		if s := atoms.Atom(i).Symbol; !isInString(elements, s) {
+			elements = append(elements, s)
+		}
+	}
+	hamiltonian := make([]string, 0, 20)
+	if scc {
+		hamiltonian = append(hamiltonian, "SCC = Yes", "SCCTolerance = "+dftbSCFTight[Q.SCFTightness])
+		if s := dftbSCFConv[Q.SCFConvHelp]; s != "" {
+			hamiltonian = append(hamiltonian, s)
+		}
+	} else {
+		hamiltonian = append(hamiltonian, "SCC = No")
+	}
+	hamiltonian = append(hamiltonian, fmt.Sprintf("Charge = %d", atoms.Charge()))
+	angular := make([]string, 0, len(elements)+2)
+	angular = append(angular, "MaxAngularMomentum {")
+	for _, v := range elements {
+		l, ok := dftbAngular[v]
+		if !ok {
+			return Error{"goChem/QM: Element not supported", DFTBPlus, O.inputname, v, []string{"BuildInput"}, true}
+		}
+		angular = append(angular, fmt.Sprintf("   %s = \"%s\"", v, l))
+	}
+	angular = append(angular, "}")
+	hamiltonian = append(hamiltonian, angular...)
+	if atoms.Multi() != 1 {
+		if !scc {
+			return Error{"goChem/QM: Open-shell systems need SCC", DFTBPlus, O.inputname, "", []string{"BuildInput"}, true}
+		}
+		spin := []string{"SpinPolarisation = Colinear {", fmt.Sprintf("   UnpairedElectrons = %d", atoms.Multi()-1), "}", "SpinConstants {", "   ShellResolvedSpin = No"}
+		for _, v := range elements {
+			w, ok := dftbSpinConstants[v]
+			if !ok {
+				return Error{"goChem/QM: No spin constant for element", DFTBPlus, O.inputname, v, []string{"BuildInput"}, true}
+			}
+			spin = append(spin, fmt.Sprintf("   %s = {%6.4f}", v, w))
+		}
+		hamiltonian = append(hamiltonian, append(spin, "}")...)
+	}
+	if method == "DFTB3" {
+		derivs := []string{"ThirdOrderFull = Yes", "HCorrection = Damping {", "   Exponent = 4.00", "}", "HubbardDerivs {"}
+		for _, v := range elements {
+			d, ok := dftb3obHubbardDerivs[v]
+			if !ok {
+				return Error{"goChem/QM: No Hubbard derivative for element", DFTBPlus, O.inputname, v, []string{"BuildInput"}, true}
+			}
+			derivs = append(derivs, fmt.Sprintf("   %s = %6.4f", v, d))
+		}
+		hamiltonian = append(hamiltonian, append(derivs, "}")...)
+	}
+	if Q.Dispersion != "" {
+		d, ok := dftbDisp[Q.Dispersion]
+		if !ok {
+			return Error{"goChem/QM: Dispersion correction not supported", DFTBPlus, O.inputname, Q.Dispersion, []string{"BuildInput"}, true}
+		}
+		if d != "" {
+			hamiltonian = append(hamiltonian, d)
+		}
+	}
+	skdir := O.skdir
+	if skdir != "" && !strings.HasSuffix(skdir, "/") {
+		skdir = skdir + "/"
+	}
+	hamiltonian = append(hamiltonian, "SlaterKosterFiles = Type2FileNames {", fmt.Sprintf("   Prefix = \"%s\"", skdir), "   Separator = \"-\"", "   Suffix = \".skf\"", "}")
+	driver := ""
+	analysis := ""
+	var err error
+	jc := jobChoose{}
+	jc.opti = func() {
+		moved := make([]string, 0, atoms.Len())
+		for i := 0; i < atoms.Len(); i++ {
+			if !isInInt(Q.CConstraints, i) {
+				moved = append(moved, strconv.Itoa(i+1))
+			}
+		}
+		if len(moved) == 0 {
+			err = Error{ErrCantInput, DFTBPlus, O.inputname, "All atoms are constrained in optimization", []string{"BuildInput"}, true}
+			return
+		}
+		driver = fmt.Sprintf("Driver = GeometryOptimization {\n   Optimizer = Rational {}\n   MovedAtoms = %s\n   MaxSteps = 1000\n   OutputPrefix = \"geo_end\"\n   Convergence {\n      GradElem = 1E-4\n   }\n}\n\n", strings.Join(moved, " "))
+	}
+	jc.freq = func() {
+		err = Error{ErrCantInput, DFTBPlus, O.inputname, "Frequency calculations not supported for DFTB+", []string{"BuildInput"}, true}
+	}
+	jc.forces = func() {
+		analysis = "Analysis {\n   PrintForces = Yes\n}\n\n"
+	}
+	Q.Job.Do(jc)
+	if err != nil {
+		return err
+	}
+	//Now lets write the thing
+	if O.inputname == "" {
+		O.inputname = "gochem"
+	}
+	if err := os.Mkdir(O.inputname, os.FileMode(0755)); err != nil && !os.IsExist(err) {
+		return Error{ErrCantInput, DFTBPlus, O.inputname, err.Error(), []string{"os.Mkdir", "BuildInput"}, true}
+	}
+	if err := chem.GENFileWrite(O.inputname+"/geo.gen", coords, atoms); err != nil {
+		return errDecorate(err, "qm.BuildInput "+DFTBPlus+" "+O.inputname+" "+ErrCantInput)
+	}
+	file, err := os.Create(O.inputname + "/dftb_in.hsd")
+	if err != nil {
+		return Error{ErrCantInput, DFTBPlus, O.inputname, err.Error(), []string{"os.Create", "BuildInput"}, true}
+	}
+	defer file.Close()
+	_, err = fmt.Fprint(file, "Geometry = GenFormat {\n   <<< \"geo.gen\"\n}\n\n")
+	if err != nil {
+		return Error{ErrCantInput, DFTBPlus, O.inputname, err.Error(), []string{"fmt.Fprint", "BuildInput"}, true}
+	}
+	fmt.Fprint(file, driver)
+	fmt.Fprintf(file, "Hamiltonian = DFTB {\n   %s\n}\n\n", strings.Join(hamiltonian, "\n   "))
+	fmt.Fprint(file, analysis)
+	fmt.Fprint(file, "Options {\n   WriteDetailedOut = Yes\n}\n")
+	if Q.Others != "" {
+		fmt.Fprintf(file, "\n%s\n", Q.Others)
+	}
+	return nil
+}
+
+var dftbSCFTight = map[int]string{
+	0: "1e-5",
+	1: "1e-7",
+	2: "1e-9",
+}
+
+var dftbSCFConv = map[int]string{
+	0: "",
+	1: "Mixer = Broyden {\n      MixingParameter = 0.1\n   }\n   MaxSCCIterations = 500",
+	2: "Mixer = Broyden {\n      MixingParameter = 0.05\n   }\n   MaxSCCIterations = 1000",
+}
+
+//The highest angular momentum in the 3ob and mio Slater-Koster sets.
+var dftbAngular = map[string]string{
+	"H":  "s",
+	"C":  "p",
+	"N":  "p",
+	"O":  "p",
+	"F":  "p",
+	"Na": "p",
+	"Mg": "p",
+	"P":  "d",
+	"S":  "d",
+	"Cl": "d",
+	"K":  "p",
+	"Ca": "p",
+	"Zn": "d",
+	"Br": "d",
+	"I":  "d",
+}
+
+//Hubbard derivatives for DFTB3 with the 3ob set.
+var dftb3obHubbardDerivs = map[string]float64{
+	"H":  -0.1857,
+	"C":  -0.1492,
+	"N":  -0.1535,
+	"O":  -0.1575,
+	"F":  -0.1623,
+	"Na": -0.0454,
+	"Mg": -0.02,
+	"P":  -0.14,
+	"S":  -0.11,
+	"Cl": -0.0697,
+	"K":  -0.0339,
+	"Ca": -0.0340,
+	"Zn": -0.03,
+	"Br": -0.0573,
+	"I":  -0.0433,
+}
+
+//Spin constants (not shell-resolved) for open-shell calculations.
+var dftbSpinConstants = map[string]float64{
+	"H": -0.072,
+	"C": -0.023,
+	"N": -0.026,
+	"O": -0.028,
+}
+
+//D3 is taken as D3BJ, with the parameters for the 3ob set.
+var dftbDisp = map[string]string{
+	"nodisp": "",
+	"D3":     "Dispersion = DftD3 {\n      Damping = BeckeJohnson {\n         a1 = 0.5719\n         a2 = 3.6017\n      }\n      s6 = 1.0\n      s8 = 0.5883\n   }",
+	"D3BJ":   "Dispersion = DftD3 {\n      Damping = BeckeJohnson {\n         a1 = 0.5719\n         a2 = 3.6017\n      }\n      s6 = 1.0\n      s8 = 0.5883\n   }",
+	"D3bj":   "Dispersion = DftD3 {\n      Damping = BeckeJohnson {\n         a1 = 0.5719\n         a2 = 3.6017\n      }\n      s6 = 1.0\n      s8 = 0.5883\n   }",
+	"D4":     "Dispersion = DftD4 {\n      s6 = 1.0\n      s8 = 0.6635015\n      s9 = 1.0\n      a1 = 0.5523240\n      a2 = 4.3537076\n   }",
+}
+
+//Run runs the command given by the string O.command in the directory of the calculation.
+//The output is written to the file dftb.out in that directory.
+//it waits or not for the result depending on wait.
+//Not waiting for results works
+//only for unix-compatible systems, as it uses sh and nohup.
+func (O *DFTBPlusHandle) Run(wait bool) (err error) {
+	command := exec.Command("sh", "-c", "nohup "+O.command+" > dftb.out")
+	command.Dir = O.inputname
+	if wait == true {
+		err = command.Run()
+	} else {
+		err = command.Start()
+	}
+	if err != nil {
+		err = Error{ErrNotRunning, DFTBPlus, O.inputname, err.Error(), []string{"exec.Run/Start", "Run"}, true}
+	}
+	return err
+}
+
+//Energy returns the total energy from the detailed.out file of the calculation, in kcal/mol.
+//Returns the energy AND error ("Probable problem in calculation") if the calculation didn't
+//end normally.
+func (O *DFTBPlusHandle) Energy() (float64, error) {
+	var err error
+	if !O.dftbNormalTermination() {
+		err = Error{ErrProbableProblem, DFTBPlus, O.inputname, "", []string{"Energy"}, false}
+	}
+	f, err1 := os.Open(O.inputname + "/detailed.out")
+	if err1 != nil {
+		return 0, Error{ErrNoEnergy, DFTBPlus, O.inputname, err1.Error(), []string{"os.Open", "Energy"}, true}
+	}
+	defer f.Close()
+	out := bufio.NewReader(f)
+	energy := 0.0
+	found := false
+	for {
+		line, err1 := out.ReadString('\n')
+		//Total energy:                      -4.0781540375 H         -110.9723 eV
+		if strings.HasPrefix(line, "Total energy:") {
+			fields := strings.Fields(line)
+			energy, err1 = strconv.ParseFloat(fields[2], 64)
+			if err1 != nil {
+				return 0, Error{ErrNoEnergy, DFTBPlus, O.inputname, err1.Error(), []string{"strconv.ParseFloat", "Energy"}, true}
+			}
+			found = true
+		}
+		if err1 != nil {
+			break
+		}
+	}
+	if !found {
+		return 0, Error{ErrNoEnergy, DFTBPlus, O.inputname, "", []string{"Energy"}, true}
+	}
+	return energy * chem.H2Kcal, err
+}
+
+//OptimizedGeometry reads the optimized geometry from the geo_end.gen file of the calculation.
+//Returns the geometry AND error ("Probable problem in calculation") if the calculation didn't end normally
+//or the optimization didn't converge.
+func (O *DFTBPlusHandle) OptimizedGeometry(atoms chem.Atomer) (*v3.Matrix, error) {
+	var err error
+	if !O.dftbNormalTermination() || searchFromEnd("Geometry did NOT converge", O.inputname+"/dftb.out") {
+		err = Error{ErrProbableProblem, DFTBPlus, O.inputname, "", []string{"OptimizedGeometry"}, false}
+	}
+	mol, err1 := chem.GENFileRead(O.inputname + "/geo_end.gen")
+	if err1 != nil {
+		return nil, errDecorate(err1, "qm.OptimizedGeometry "+DFTBPlus+" "+O.inputname+" "+ErrNoGeometry)
+	}
+	if atoms != nil && mol.Len() != atoms.Len() {
+		return nil, Error{ErrNoGeometry, DFTBPlus, O.inputname, "Wrong number of atoms", []string{"OptimizedGeometry"}, true}
+	}
+	return mol.Coords[0], err
+}
+
+//Gradient reads the forces from the detailed.out file of the calculation, which are printed for
+//force calculations and optimizations, and returns the gradient in kcal/(mol A). Returns the gradient AND
+//error ("Probable problem in calculation") if the calculation didn't end normally.
+func (O *DFTBPlusHandle) Gradient() (*v3.Matrix, error) {
+	var err error
+	if !O.dftbNormalTermination() {
+		err = Error{ErrProbableProblem, DFTBPlus, O.inputname, "", []string{"Gradient"}, false}
+	}
+	f, err1 := os.Open(O.inputname + "/detailed.out")
+	if err1 != nil {
+		return nil, Error{ErrNoGradient, DFTBPlus, O.inputname, err1.Error(), []string{"os.Open", "Gradient"}, true}
+	}
+	defer f.Close()
+	//The forces come after the "Total Forces" line, one atom per line, optionally preceded
+	//by the atom number, and end with an empty line.
+	var forces []float64
+	reading := false
+	out := bufio.NewReader(f)
+	for {
+		line, err1 := out.ReadString('\n')
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "Total Forces"):
+			reading = true
+			forces = nil
+		case reading && len(fields) >= 3:
+			for _, v := range fields[len(fields)-3:] {
+				c, err2 := strconv.ParseFloat(v, 64)
+				if err2 != nil {
+					return nil, Error{ErrNoGradient, DFTBPlus, O.inputname, err2.Error(), []string{"strconv.ParseFloat", "Gradient"}, true}
+				}
+				forces = append(forces, c)
+			}
+		default:
+			reading = false
+		}
+		if err1 != nil {
+			break
+		}
+	}
+	if len(forces) == 0 {
+		return nil, Error{ErrNoGradient, DFTBPlus, O.inputname, "", []string{"Gradient"}, true}
+	}
+	grad, err1 := v3.NewMatrix(forces)
+	if err1 != nil {
+		return nil, Error{ErrNoGradient, DFTBPlus, O.inputname, err1.Error(), []string{"v3.NewMatrix", "Gradient"}, true}
+	}
+	grad.Scale(-1*chem.H2Kcal*chem.A2Bohr, grad) //The gradient is minus the force.
+	return grad, err
+}
+
+//dftbNormalTermination checks that a DFTB+ calculation has terminated normally, in which case
+//the table with the running times is printed at the end of the output.
+func (O *DFTBPlusHandle) dftbNormalTermination() bool {
+	return searchFromEnd("DFTB+ running times", O.inputname+"/dftb.out")
+}
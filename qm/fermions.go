@@ -141,7 +141,13 @@ func (O *FermionsHandle) BuildInput(coords *v3.Matrix, atoms chem.AtomMultiCharg
 			dloptions = fmt.Sprintf("%s*end\n", dloptions)
 		}
 	}
+	jc.freq = func() {
+		err = Error{ErrCantInput, Fermions, O.inputname, "Frequency calculations not supported for Fermions++", []string{"BuildInput"}, true}
+	}
 	Q.Job.Do(jc)
+	if err != nil {
+		return err
+	}
 	cosmo := ""
 	if Q.Dielectric > 0 {
 		cosmo = fmt.Sprintf("*start::solvate\n pcm_model cpcm\n epsilon %f\n cavity_model bondi\n*end\n", Q.Dielectric)
@@ -339,6 +345,11 @@ func searchFromEnd(templa, filename string) bool {
 	return ret
 }
 
+//Gradient is not implemented for Fermions++, so it always returns an error.
+func (O *FermionsHandle) Gradient() (*v3.Matrix, error) {
+	return nil, Error{ErrNoGradient, Fermions, O.inputname, "Gradients not supported for Fermions++", []string{"Gradient"}, true}
+}
+
 //I don't have this implemented so far, sorry.
 func (O *FermionsHandle) OptimizedGeometry(atoms chem.Atomer) (*v3.Matrix, error) {
 	return nil, nil
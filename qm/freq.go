@@ -0,0 +1,281 @@
+/*
+ * freq.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package qm
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/gochem"
+	"github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/mat"
+)
+
+//Modes with frequencies smaller than this, in cm-1, are taken to be translations or rotations.
+//All the supported programs project these out of the Hessian, so their frequencies are printed as zero.
+const transRotCutoff = 1.0
+
+//Vibrations contains the results of a frequency calculation. Only the vibrational modes are
+//included, not the translations and rotations.
+type Vibrations struct {
+	Freqs         []float64    //Frequencies, in cm-1. Imaginary frequencies are given as negative numbers.
+	Modes         []*v3.Matrix //Normal modes, as normalized cartesian displacements, one per frequency.
+	IRIntensities []float64    //IR intensities, in km/mol, or nil if not available.
+}
+
+//Imaginary returns the indexes of the modes with imaginary frequencies.
+func (V *Vibrations) Imaginary() []int {
+	ret := make([]int, 0, 1)
+	for i, v := range V.Freqs {
+		if v < 0 {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+//newVibrations builds a Vibrations from the frequencies, modes and IR intensities (which can
+//be nil) of all the modes printed by a program, leaving out the translations and rotations.
+//Each mode has the 3N cartesian components.
+func newVibrations(freqs []float64, modes [][]float64, ir []float64) (*Vibrations, error) {
+	if len(modes) != len(freqs) || (ir != nil && len(ir) != len(freqs)) {
+		return nil, fmt.Errorf("%d frequencies, %d modes and %d IR intensities read", len(freqs), len(modes), len(ir))
+	}
+	V := new(Vibrations)
+	for i, f := range freqs {
+		if math.Abs(f) < transRotCutoff {
+			continue
+		}
+		norm := 0.0
+		for _, v := range modes[i] {
+			norm += v * v
+		}
+		norm = math.Sqrt(norm)
+		if norm == 0 || len(modes[i])%3 != 0 {
+			return nil, fmt.Errorf("Wrong normal mode %d", i+1)
+		}
+		m := make([]float64, len(modes[i]))
+		for j, v := range modes[i] {
+			m[j] = v / norm
+		}
+		mode, err := v3.NewMatrix(m)
+		if err != nil {
+			return nil, err
+		}
+		V.Freqs = append(V.Freqs, f)
+		V.Modes = append(V.Modes, mode)
+		if ir != nil {
+			V.IRIntensities = append(V.IRIntensities, ir[i])
+		}
+	}
+	if len(V.Freqs) == 0 {
+		return nil, fmt.Errorf("No vibrational modes found")
+	}
+	return V, nil
+}
+
+//columns returns the columns of the n by n matrix with the elements in data, in row-major order.
+//The normal modes are the columns of the matrices printed by most programs.
+func columns(data []float64, n int) [][]float64 {
+	ret := make([][]float64, n)
+	for i := range ret {
+		ret[i] = make([]float64, n)
+		for j := range ret[i] {
+			ret[i][j] = data[j*n+i]
+		}
+	}
+	return ret
+}
+
+//hessianFromAU returns a Hessian in kcal/(mol A^2) from the elements of a Hessian in
+//hartree/bohr^2, in row-major order.
+func hessianFromAU(data []float64) (*mat.Dense, error) {
+	n := int(math.Sqrt(float64(len(data))) + 0.5)
+	if n == 0 || n*n != len(data) || n%3 != 0 {
+		return nil, fmt.Errorf("Read %d Hessian elements, not a 3Nx3N matrix", len(data))
+	}
+	hess := mat.NewDense(n, n, data)
+	hess.Scale(chem.H2Kcal*chem.A2Bohr*chem.A2Bohr, hess)
+	return hess, nil
+}
+
+//parseFortranFloat parses a number which can have a Fortran-style exponent (1.0D+00).
+func parseFortranFloat(s string) (float64, error) {
+	return strconv.ParseFloat(strings.Replace(strings.ToUpper(s), "D", "E", 1), 64)
+}
+
+//tmSection returns all the numbers in the section name (for instance "$hessian") of a Turbomole-formatted
+//file, in order. The lines can start with the row number and the number of the line for that row, which
+//are not returned. xtb writes its hessian and vibspectrum files in the same format.
+func tmSection(f *bufio.Reader, name string) ([]float64, error) {
+	reading := false
+	var ret []float64
+	for {
+		line, err := f.ReadString('\n')
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "$") {
+			if reading {
+				break
+			}
+			reading = strings.HasPrefix(trimmed, name)
+		} else if reading && !strings.HasPrefix(trimmed, "#") {
+			fields := strings.Fields(trimmed)
+			//the indexes are the integers at the beginning of the line, at most 2.
+			for i := 0; i < 2 && len(fields) > 0 && !strings.ContainsAny(fields[0], ".EeDd"); i++ {
+				fields = fields[1:]
+			}
+			for _, v := range fields {
+				n, err := parseFortranFloat(v)
+				if err != nil {
+					return nil, err
+				}
+				ret = append(ret, n)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("No %s section found", name)
+	}
+	return ret, nil
+}
+
+//tmSectionFile returns all the numbers in the section name of the Turbomole-formatted file filename.
+func tmSectionFile(filename, name string) ([]float64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return tmSection(bufio.NewReader(f), name)
+}
+
+//tmVibSpectrum reads the frequencies and IR intensities from the $vibrational spectrum
+//section of a Turbomole or xtb vibspectrum file.
+func tmVibSpectrum(f *bufio.Reader) ([]float64, []float64, error) {
+	var freqs, ir []float64
+	reading := false
+	for {
+		line, err := f.ReadString('\n')
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "$") {
+			if reading {
+				break
+			}
+			reading = strings.HasPrefix(trimmed, "$vibrational spectrum")
+		} else if reading && !strings.HasPrefix(trimmed, "#") && trimmed != "" {
+			//mode, symmetry (which can be empty), frequency, IR intensity and the 2 selection rules.
+			fields := strings.Fields(trimmed)
+			if len(fields) < 5 {
+				return nil, nil, fmt.Errorf("Malformed line in vibrational spectrum: %s", trimmed)
+			}
+			fr, err1 := strconv.ParseFloat(fields[len(fields)-4], 64)
+			in, err2 := strconv.ParseFloat(fields[len(fields)-3], 64)
+			if err1 != nil || err2 != nil {
+				return nil, nil, fmt.Errorf("Malformed line in vibrational spectrum: %s", trimmed)
+			}
+			freqs = append(freqs, fr)
+			ir = append(ir, in)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(freqs) == 0 {
+		return nil, nil, fmt.Errorf("No vibrational spectrum found")
+	}
+	return freqs, ir, nil
+}
+
+//gaussianFreqs reads the frequencies, IR intensities and normal modes from the last frequency
+//section in a Gaussian-formatted output, as written by Gaussian and by xtb (in the g98.out file).
+//The modes are given with 3 (or less) modes in each block, and only the vibrational modes are printed.
+//The high-precision modes (freq=HPModes) are printed in a different format, and are not read.
+func gaussianFreqs(f *bufio.Reader) ([]float64, []float64, [][]float64, error) {
+	var freqs, ir []float64
+	var modes [][]float64
+	block := 0 //the index of the first mode of the current block
+	inatoms := false
+	for {
+		line, err := f.ReadString('\n')
+		fields := strings.Fields(line)
+		switch {
+		case strings.Contains(line, "Harmonic frequencies"):
+			freqs, ir, modes = nil, nil, nil
+			inatoms = false
+		case len(fields) > 2 && fields[0] == "Frequencies" && fields[1] == "--":
+			block = len(freqs)
+			for _, v := range fields[2:] {
+				fr, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return nil, nil, nil, fmt.Errorf("Malformed frequencies: %s", line)
+				}
+				freqs = append(freqs, fr)
+				modes = append(modes, nil)
+			}
+		case len(fields) > 3 && fields[0] == "IR" && fields[1] == "Inten" && fields[2] == "--":
+			for _, v := range fields[3:] {
+				in, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return nil, nil, nil, fmt.Errorf("Malformed IR intensities: %s", line)
+				}
+				ir = append(ir, in)
+			}
+		case len(fields) > 2 && fields[0] == "Atom" && fields[1] == "AN":
+			inatoms = true
+		case inatoms && len(fields) == 2+3*(len(freqs)-block):
+			for i := block; i < len(freqs); i++ {
+				for _, v := range fields[2+3*(i-block) : 5+3*(i-block)] {
+					c, err := strconv.ParseFloat(v, 64)
+					if err != nil {
+						return nil, nil, nil, fmt.Errorf("Malformed normal mode: %s", line)
+					}
+					modes[i] = append(modes[i], c)
+				}
+			}
+		default:
+			inatoms = false
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(freqs) == 0 {
+		return nil, nil, nil, fmt.Errorf("No frequencies found")
+	}
+	if len(ir) != len(freqs) {
+		ir = nil
+	}
+	return freqs, ir, modes, nil
+}
@@ -0,0 +1,577 @@
+/*
+ * gaussian.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package qm
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/gochem"
+	"github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/mat"
+)
+
+//GaussianHandle builds inputs for, runs, and reads results from Gaussian (16) calculations.
+//Note that the default methods and basis vary with each program, and even
+//for a given program they are NOT considered part of the API, so they can always change.
+type GaussianHandle struct {
+	defmethod  string
+	defbasis   string
+	previousMO string
+	command    string
+	inputname  string
+	nCPU       int
+}
+
+func NewGaussianHandle() *GaussianHandle {
+	run := new(GaussianHandle)
+	run.SetDefaults()
+	return run
+}
+
+//GaussianHandle methods
+
+//Sets the number of CPU to be used
+func (O *GaussianHandle) SetnCPU(cpu int) {
+	O.nCPU = cpu
+}
+
+func (O *GaussianHandle) SetName(name string) {
+	O.inputname = name
+}
+
+func (O *GaussianHandle) SetCommand(name string) {
+	O.command = name
+}
+
+//SetMOName sets the name of a checkpoint file from which the initial guess
+//will be read if Calc.OldMO is set.
+func (O *GaussianHandle) SetMOName(name string) {
+	O.previousMO = name
+}
+
+//SetDefaults sets defaults for a Gaussian calculation. Default is a single-point at
+//BLYP/def2-SVP with density fitting, and all the available CPUs. The Gaussian
+//command is set to $GAUSS_EXEDIR/g16, or to g16 if GAUSS_EXEDIR is not defined.
+func (O *GaussianHandle) SetDefaults() {
+	O.defmethod = "BLYP"
+	O.defbasis = "def2-SVP"
+	O.command = os.ExpandEnv("${GAUSS_EXEDIR}/g16")
+	if O.command == "/g16" { //if GAUSS_EXEDIR was not defined
+		O.command = "g16"
+	}
+	O.nCPU = runtime.NumCPU()
+}
+
+//BuildInput builds an input for Gaussian based int the data in atoms, coords and C.
+//Different basis sets for some atoms or elements are not supported.
+//returns only error.
+func (O *GaussianHandle) BuildInput(coords *v3.Matrix, atoms chem.AtomMultiCharger, Q *Calc) error {
+	if atoms == nil || coords == nil {
+		return Error{ErrMissingCharges, Gaussian, O.inputname, "", []string{"BuildInput"}, true}
+	}
+	if Q.Basis == "" && !strings.Contains(Q.Method, "3c") {
+		log.Printf("no basis set assigned for Gaussian calculation, will used the default %s, \n", O.defbasis)
+		Q.Basis = O.defbasis
+	}
+	if Q.Method == "" {
+		log.Printf("no method assigned for Gaussian calculation, will used the default %s, \n", O.defmethod)
+		Q.Method = O.defmethod
+	}
+	if Q.HBAtoms != nil || Q.LBAtoms != nil || Q.HBElements != nil || Q.LBElements != nil {
+		log.Printf("different basis for some atoms or elements are not supported for Gaussian calculations, will use %s for all atoms\n", Q.Basis)
+	}
+	method := Q.Method
+	//Gaussian uses restricted methods unless asked otherwise.
+	if atoms.Multi() != 1 && !strings.HasPrefix(strings.ToUpper(method), "U") && !strings.HasPrefix(strings.ToUpper(method), "RO") {
+		method = "U" + method
+	}
+	//Gaussian names the Karlsruhe basis without the dash.
+	basis := strings.Replace(Q.Basis, "def2-", "def2", 1)
+	theory := method
+	if basis != "" {
+		theory = method + "/" + basis
+		if Q.RI || Q.RIJ {
+			theory = theory + "/Auto" //density fitting, only used by Gaussian for pure functionals.
+		}
+	}
+	disp := ""
+	if Q.Dispersion != "" {
+		d, ok := gaussianDisp[Q.Dispersion]
+		if !ok {
+			return Error{"goChem/QM: Dispersion correction not supported", Gaussian, O.inputname, Q.Dispersion, []string{"BuildInput"}, true}
+		}
+		if d != "" {
+			disp = "EmpiricalDispersion=" + d
+		}
+	}
+	scf := make([]string, 0, 2)
+	if s := gaussianSCFTight[Q.SCFTightness]; s != "" {
+		scf = append(scf, s)
+	}
+	if s := gaussianSCFConv[Q.SCFConvHelp]; s != "" {
+		scf = append(scf, s)
+	}
+	scfstr := ""
+	if len(scf) > 0 {
+		scfstr = fmt.Sprintf("SCF=(%s)", strings.Join(scf, ","))
+	}
+	grid := ""
+	if g, ok := gaussianGrid[Q.Grid]; ok {
+		grid = fmt.Sprintf("Integral=(Grid=%s)", g)
+	}
+	job := ""
+	jc := jobChoose{}
+	jc.opti = func() {
+		opts := make([]string, 0, 2)
+		if Q.CConstraints != nil || Q.IConstraints != nil {
+			opts = append(opts, "ModRedundant")
+		}
+		if Q.CartesianOpt {
+			opts = append(opts, "Cartesian")
+		}
+		job = "Opt"
+		if len(opts) > 0 {
+			job = fmt.Sprintf("Opt=(%s)", strings.Join(opts, ","))
+		}
+	}
+	jc.freq = func() {
+		job = "Freq" //the archive entry, at the end of the log file, contains the Hessian.
+	}
+	jc.forces = func() {
+		job = "Force"
+	}
+	Q.Job.Do(jc)
+	modredundant := ""
+	if Q.Job.Opti {
+		var err error
+		modredundant, err = O.buildConstraints(Q.CConstraints, Q.IConstraints)
+		if err != nil {
+			return errDecorate(err, "BuildInput")
+		}
+	}
+	solvent, solventinput := "", ""
+	if Q.Dielectric > 0 {
+		solvent = "SCRF=(PCM,Solvent=Generic,Read)"
+		solventinput = fmt.Sprintf("Eps=%4.2f\nEpsInf=1.69\n\n", Q.Dielectric)
+	}
+	guess := Q.Guess
+	oldchk := ""
+	if Q.OldMO && O.previousMO != "" {
+		oldchk = fmt.Sprintf("%%OldChk=%s\n", O.previousMO)
+		guess = "Guess=Read"
+	}
+	mem := ""
+	if Q.Memory != 0 {
+		mem = fmt.Sprintf("%%Mem=%dMB\n", Q.Memory)
+	}
+	pal := ""
+	if O.nCPU > 1 {
+		pal = fmt.Sprintf("%%NProcShared=%d\n", O.nCPU)
+	}
+	//NoSymm keeps the molecule in the input orientation, so the geometries and gradients read
+	//correspond to the input coordinates.
+	route := []string{"#P", theory, disp, scfstr, grid, job, solvent, guess, "NoSymm", Q.Others}
+	routeline := make([]string, 0, len(route))
+	for _, v := range route {
+		if v != "" {
+			routeline = append(routeline, v)
+		}
+	}
+	//Now lets write the thing
+	if O.inputname == "" {
+		O.inputname = "gochem"
+	}
+	file, err := os.Create(fmt.Sprintf("%s.gjf", O.inputname))
+	if err != nil {
+		return Error{ErrCantInput, Gaussian, O.inputname, err.Error(), []string{"os.Create", "BuildInput"}, true}
+	}
+	defer file.Close()
+	_, err = fmt.Fprint(file, pal, mem, oldchk)
+	if err != nil {
+		return Error{ErrCantInput, Gaussian, O.inputname, err.Error(), []string{"fmt.Fprint", "BuildInput"}, true}
+	}
+	fmt.Fprintf(file, "%%Chk=%s.chk\n", O.inputname)
+	fmt.Fprintf(file, "%s\n\n", strings.Join(routeline, " "))
+	fmt.Fprintf(file, "%s input generated by goChem\n\n", O.inputname)
+	fmt.Fprintf(file, "%d %d\n", atoms.Charge(), atoms.Multi())
+	for i := 0; i < atoms.Len(); i++ {
+		fmt.Fprintf(file, "%-2s  %12.6f%12.6f%12.6f\n", atoms.Atom(i).Symbol, coords.At(i, 0), coords.At(i, 1), coords.At(i, 2))
+	}
+	fmt.Fprint(file, "\n")
+	fmt.Fprint(file, modredundant)
+	fmt.Fprint(file, solventinput)
+	fmt.Fprint(file, "\n")
+	return nil
+}
+
+//buildConstraints transforms the lists of cartesian and internal constraints in the Calc structure
+//into a ModRedundant section for Gaussian. Gaussian numbers atoms from 1.
+func (O *GaussianHandle) buildConstraints(C []int, IC []*IConstraint) (string, error) {
+	if C == nil && IC == nil {
+		return "", nil
+	}
+	constraints := make([]string, 0, len(C)+len(IC)+1)
+	for _, v := range C {
+		constraints = append(constraints, fmt.Sprintf("X %d F\n", v+1))
+	}
+	for _, v := range IC {
+		if iConstraintOrder[v.Class] != len(v.CAtoms) {
+			return "", Error{"Internal constraint ill-formated", Gaussian, O.inputname, "", []string{"buildConstraints"}, true}
+		}
+		c := make([]string, 0, 6)
+		c = append(c, string(v.Class))
+		for _, w := range v.CAtoms {
+			c = append(c, strconv.Itoa(w+1))
+		}
+		//if UseVal is false, the coordinate is frozen at its value in the starting structure.
+		if v.UseVal {
+			c = append(c, fmt.Sprintf("%2.3f", v.Val))
+		}
+		c = append(c, "F")
+		constraints = append(constraints, strings.Join(c, " ")+"\n")
+	}
+	constraints = append(constraints, "\n")
+	return strings.Join(constraints, ""), nil
+}
+
+var gaussianSCFTight = map[int]string{
+	0: "",
+	1: "Tight",
+	2: "VeryTight",
+}
+
+var gaussianSCFConv = map[int]string{
+	0: "",
+	1: "XQC",
+	2: "QC",
+}
+
+var gaussianGrid = map[int]string{
+	1: "CoarseGrid",
+	2: "SG1Grid",
+	3: "FineGrid",
+	4: "UltraFine",
+	5: "SuperFineGrid",
+}
+
+var gaussianDisp = map[string]string{
+	"nodisp": "",
+	"D2":     "GD2",
+	"D3":     "GD3",
+	"D3ZERO": "GD3",
+	"D3Zero": "GD3",
+	"D3zero": "GD3",
+	"D3BJ":   "GD3BJ",
+	"D3bj":   "GD3BJ",
+}
+
+//Run runs the command given by the string O.command
+//it waits or not for the result depending on wait.
+//Gaussian writes its output to the .log file with the name of the input.
+//Not waiting for results works
+//only for unix-compatible systems, as it uses sh and nohup.
+func (O *GaussianHandle) Run(wait bool) (err error) {
+	if wait == true {
+		command := exec.Command(O.command, fmt.Sprintf("%s.gjf", O.inputname))
+		err = command.Run()
+	} else {
+		command := exec.Command("sh", "-c", "nohup "+O.command+fmt.Sprintf(" %s.gjf > /dev/null &", O.inputname))
+		err = command.Start()
+	}
+	if err != nil {
+		err = Error{ErrNotRunning, Gaussian, O.inputname, err.Error(), []string{"exec.Start", "Run"}, true}
+	}
+	return err
+}
+
+//Energy returns the last SCF energy in the .log file of a previous Gaussian calculation,
+//in kcal/mol. Returns error if problem, and also if the energy returned is product of an
+//abnormally-terminated Gaussian calculation. (in this case error is "Probable problem
+//in calculation")
+func (O *GaussianHandle) Energy() (float64, error) {
+	var err error
+	if !O.gaussianNormalTermination() {
+		err = Error{ErrProbableProblem, Gaussian, O.inputname, "", []string{"Energy"}, false}
+	}
+	f, err1 := os.Open(fmt.Sprintf("%s.log", O.inputname))
+	if err1 != nil {
+		return 0, Error{ErrNoEnergy, Gaussian, O.inputname, err1.Error(), []string{"os.Open", "Energy"}, true}
+	}
+	defer f.Close()
+	out := bufio.NewReader(f)
+	energy := 0.0
+	found := false
+	for {
+		line, err1 := out.ReadString('\n')
+		//SCF Done:  E(RB3LYP) =  -76.4089543     A.U. after   10 cycles
+		if strings.Contains(line, "SCF Done:") {
+			fields := strings.Fields(line)
+			if len(fields) < 5 {
+				return 0, Error{ErrNoEnergy, Gaussian, O.inputname, "Malformed energy line", []string{"Energy"}, true}
+			}
+			energy, err1 = strconv.ParseFloat(fields[4], 64)
+			if err1 != nil {
+				return 0, Error{ErrNoEnergy, Gaussian, O.inputname, err1.Error(), []string{"strconv.ParseFloat", "Energy"}, true}
+			}
+			found = true
+		}
+		if err1 != nil {
+			break
+		}
+	}
+	if !found {
+		return 0, Error{ErrNoEnergy, Gaussian, O.inputname, "", []string{"Energy"}, true}
+	}
+	return energy * chem.H2Kcal, err
+}
+
+//OptimizedGeometry reads the last geometry in the .log file of a previous Gaussian calculation.
+//Returns the geometry AND error if the geometry read is not the product of a correctly ended
+//Gaussian calculation. In this case the error is "probable problem in calculation".
+func (O *GaussianHandle) OptimizedGeometry(atoms chem.Atomer) (*v3.Matrix, error) {
+	var err error
+	if !O.gaussianNormalTermination() {
+		err = Error{ErrProbableProblem, Gaussian, O.inputname, "", []string{"OptimizedGeometry"}, false}
+	}
+	//The coordinates are the last 3 fields of each line in the orientation block.
+	input, standard, err1 := O.lastBlocks([]string{"Input orientation:", "Standard orientation:"}, 3)
+	if err1 != nil {
+		return nil, errDecorate(err1, "OptimizedGeometry")
+	}
+	geo := input
+	if geo == nil {
+		geo = standard
+	}
+	if geo == nil || (atoms != nil && len(geo) != 3*atoms.Len()) {
+		return nil, Error{ErrNoGeometry, Gaussian, O.inputname, "", []string{"OptimizedGeometry"}, true}
+	}
+	coords, err1 := v3.NewMatrix(geo)
+	if err1 != nil {
+		return nil, Error{ErrNoGeometry, Gaussian, O.inputname, err1.Error(), []string{"v3.NewMatrix", "OptimizedGeometry"}, true}
+	}
+	return coords, err
+}
+
+//Gradient reads the last forces printed in the .log file of a previous Gaussian calculation, which are
+//printed for Force jobs and for each step of optimizations, and returns the gradient in kcal/(mol A).
+//Returns the gradient AND error if the calculation didn't end normally. In this case
+//the error is "Probable problem in calculation".
+func (O *GaussianHandle) Gradient() (*v3.Matrix, error) {
+	var err error
+	if !O.gaussianNormalTermination() {
+		err = Error{ErrProbableProblem, Gaussian, O.inputname, "", []string{"Gradient"}, false}
+	}
+	forces, _, err1 := O.lastBlocks([]string{"Forces (Hartrees/Bohr)"}, 3)
+	if err1 != nil {
+		return nil, errDecorate(err1, "Gradient")
+	}
+	if forces == nil {
+		return nil, Error{ErrNoGradient, Gaussian, O.inputname, "", []string{"Gradient"}, true}
+	}
+	grad, err1 := v3.NewMatrix(forces)
+	if err1 != nil {
+		return nil, Error{ErrNoGradient, Gaussian, O.inputname, err1.Error(), []string{"v3.NewMatrix", "Gradient"}, true}
+	}
+	grad.Scale(-1*chem.H2Kcal*chem.A2Bohr, grad) //The gradient is minus the force.
+	return grad, err
+}
+
+//Vibrations reads the frequencies, normal modes and IR intensities from the .log file of a
+//previous Gaussian frequency calculation. Returns the vibrations AND error if the calculation
+//didn't end normally. In this case the error is "Probable problem in calculation".
+func (O *GaussianHandle) Vibrations() (*Vibrations, error) {
+	var err error
+	if !O.gaussianNormalTermination() {
+		err = Error{ErrProbableProblem, Gaussian, O.inputname, "", []string{"Vibrations"}, false}
+	}
+	f, err1 := os.Open(fmt.Sprintf("%s.log", O.inputname))
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, Gaussian, O.inputname, err1.Error(), []string{"os.Open", "Vibrations"}, true}
+	}
+	defer f.Close()
+	freqs, ir, modes, err1 := gaussianFreqs(bufio.NewReader(f))
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, Gaussian, O.inputname, err1.Error(), []string{"gaussianFreqs", "Vibrations"}, true}
+	}
+	vib, err1 := newVibrations(freqs, modes, ir)
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, Gaussian, O.inputname, err1.Error(), []string{"newVibrations", "Vibrations"}, true}
+	}
+	return vib, err
+}
+
+//Hessian reads the cartesian Hessian, in kcal/(mol A^2), from the archive entry at the end of the .log
+//file of a previous Gaussian frequency calculation. Returns the Hessian AND error if the calculation
+//didn't end normally. In this case the error is "Probable problem in calculation".
+func (O *GaussianHandle) Hessian() (*mat.Dense, error) {
+	var err error
+	if !O.gaussianNormalTermination() {
+		err = Error{ErrProbableProblem, Gaussian, O.inputname, "", []string{"Hessian"}, false}
+	}
+	f, err1 := os.Open(fmt.Sprintf("%s.log", O.inputname))
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, Gaussian, O.inputname, err1.Error(), []string{"os.Open", "Hessian"}, true}
+	}
+	defer f.Close()
+	//The archive entry starts with 1\1\ and ends with \\@. Its lines are broken at any point,
+	//so they are joined before splitting the entry in sections, which are separated by \\.
+	var archive []string
+	reading := false
+	out := bufio.NewReader(f)
+	for {
+		line, err1 := out.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, `1\1\`) {
+			reading = true
+			archive = archive[:0]
+		}
+		if reading {
+			archive = append(archive, line)
+			if strings.HasSuffix(line, `\\@`) {
+				reading = false
+			}
+		}
+		if err1 != nil {
+			break
+		}
+	}
+	sections := strings.Split(strings.Join(archive, ""), `\\`)
+	//The lower triangle of the Hessian comes in the section after the one with the
+	//properties, which contains the number of imaginary frequencies.
+	var lower []float64
+	for i, v := range sections {
+		if !strings.Contains(v, "NImag=") || i+1 >= len(sections) {
+			continue
+		}
+		for _, w := range strings.Split(sections[i+1], ",") {
+			h, err1 := strconv.ParseFloat(strings.TrimSpace(w), 64)
+			if err1 != nil {
+				return nil, Error{ErrNoFreq, Gaussian, O.inputname, err1.Error(), []string{"strconv.ParseFloat", "Hessian"}, true}
+			}
+			lower = append(lower, h)
+		}
+		break
+	}
+	n := 0
+	for n*(n+1)/2 < len(lower) {
+		n++
+	}
+	if n == 0 || n*(n+1)/2 != len(lower) {
+		return nil, Error{ErrNoFreq, Gaussian, O.inputname, "No Hessian in archive entry", []string{"Hessian"}, true}
+	}
+	data := make([]float64, n*n)
+	k := 0
+	for i := 0; i < n; i++ {
+		for j := 0; j <= i; j++ {
+			data[i*n+j] = lower[k]
+			data[j*n+i] = lower[k]
+			k++
+		}
+	}
+	hess, err1 := hessianFromAU(data)
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, Gaussian, O.inputname, err1.Error(), []string{"hessianFromAU", "Hessian"}, true}
+	}
+	return hess, err
+}
+
+//lastBlocks reads the .log file and returns, for the first 2 headers given, the last
+//numbers of each line (ncols per line) of the last table after a line containing the header.
+//Gaussian prints these tables between dashed lines, with column names. Each line in the table
+//starts with the atom number. A nil slice is returned for a header that is not found.
+func (O *GaussianHandle) lastBlocks(headers []string, ncols int) ([]float64, []float64, error) {
+	f, err := os.Open(fmt.Sprintf("%s.log", O.inputname))
+	if err != nil {
+		return nil, nil, Error{err.Error(), Gaussian, O.inputname, "", []string{"os.Open", "lastBlocks"}, true}
+	}
+	defer f.Close()
+	ret := make([][]float64, 2)
+	var current []float64
+	reading := -1
+	out := bufio.NewReader(f)
+	for {
+		line, err := out.ReadString('\n')
+		fields := strings.Fields(line)
+		if reading < 0 {
+			for i, v := range headers {
+				if strings.Contains(line, v) {
+					reading = i
+					current = make([]float64, 0, len(ret[i]))
+				}
+			}
+		} else if strings.HasPrefix(strings.TrimSpace(line), "-----") {
+			if len(current) > 0 { //the end of the table
+				ret[reading] = current
+				reading = -1
+			}
+		} else if len(fields) > ncols {
+			//Lines with the column names don't start with a number.
+			if _, err1 := strconv.Atoi(fields[0]); err1 == nil {
+				for _, v := range fields[len(fields)-ncols:] {
+					c, err := strconv.ParseFloat(v, 64)
+					if err != nil {
+						return nil, nil, Error{err.Error(), Gaussian, O.inputname, line, []string{"strconv.ParseFloat", "lastBlocks"}, true}
+					}
+					current = append(current, c)
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return ret[0], ret[1], nil
+}
+
+//gaussianNormalTermination checks that a Gaussian calculation has terminated normally.
+func (O *GaussianHandle) gaussianNormalTermination() bool {
+	f, err := os.Open(fmt.Sprintf("%s.log", O.inputname))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	f.Seek(-1, 2) //We start at the end of the file
+	//Gaussian prints some lines with file information after the normal termination line.
+	for i := 0; i < 10; i++ {
+		line, err := getTailLine(f)
+		if err != nil {
+			return false
+		}
+		if strings.Contains(line, "Normal termination of Gaussian") {
+			return true
+		}
+	}
+	return false
+}
@@ -99,6 +99,12 @@ func (O *MopacHandle) BuildInput(coords *v3.Matrix, atoms chem.AtomMultiCharger,
 		opt = "1SCF"
 	}
 	jc.opti = func() {}
+	jc.freq = func() {
+		opt = "FORCE" //The geometry should be optimized first.
+	}
+	jc.forces = func() {
+		opt = "1SCF GRADIENTS"
+	}
 	Q.Job.Do(jc)
 	//If this flag is set we'll look for a suitable MO file.
 	//If not found, we'll just use the default ORCA guess
@@ -296,6 +302,110 @@ func (O *MopacHandle) OptimizedGeometry(atoms chem.Atomer) (*v3.Matrix, error) {
 	return mcoords, err
 }
 
+/*Gradient reads the gradient from a MOPAC2009/2012 output, which is printed for
+  calculations with the GRADIENTS keyword, in kcal/(mol A). MOPAC only prints the gradient
+  for the coordinates that are not frozen, the others are set to zero. The number of atoms is
+  taken from the input file of the calculation, if it is present. Return error if fail.
+  Returns Error ("Probable problem in calculation") if there is a gradient
+  but the calculation didnt end properly*/
+func (O *MopacHandle) Gradient() (*v3.Matrix, error) {
+	file, err := os.Open(fmt.Sprintf("%s.out", O.inputname))
+	if err != nil {
+		return nil, Error{ErrNoGradient, Mopac, O.inputname, err.Error(), []string{"os.Open", "Gradient"}, true}
+	}
+	defer file.Close()
+	out := bufio.NewReader(file)
+	var grad []float64
+	trust_radius_warning := false
+	for {
+		line, err := out.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if strings.Contains(line, "TRUST RADIUS NOW LESS THAN 0.00010 OPTIMIZATION TERMINATING") {
+			trust_radius_warning = true
+			continue
+		}
+		if strings.Contains(line, "FINAL  POINT  AND  DERIVATIVES") {
+			grad = grad[:0] //we only want the last gradient.
+			continue
+		}
+		//The lines look like: 1  1  O  CARTESIAN X  0.000000  0.123456  KCAL/ANGSTROM
+		fields := strings.Fields(line)
+		c := -1
+		for i, v := range fields {
+			if v == "CARTESIAN" {
+				c = i
+				break
+			}
+		}
+		if c < 2 || len(fields) < c+4 {
+			continue
+		}
+		at, err1 := strconv.Atoi(fields[1])
+		axis := strings.Index("XYZ", fields[c+1])
+		g, err2 := strconv.ParseFloat(fields[c+3], 64)
+		if err1 != nil || err2 != nil || at < 1 || axis < 0 || len(fields[c+1]) != 1 {
+			return nil, Error{ErrNoGradient, Mopac, O.inputname, line, []string{"Gradient"}, true}
+		}
+		for len(grad) < at*3 {
+			grad = append(grad, 0)
+		}
+		grad[(at-1)*3+axis] = g
+	}
+	if len(grad) == 0 {
+		return nil, Error{ErrNoGradient, Mopac, O.inputname, "", []string{"Gradient"}, true}
+	}
+	//Frozen atoms are not printed, so the gradient is sized from the number of atoms in the input, if available.
+	if natoms, err := mopacNAtoms(fmt.Sprintf("%s.mop", O.inputname)); err == nil {
+		if len(grad) > natoms*3 {
+			return nil, Error{ErrNoGradient, Mopac, O.inputname, "More atoms in output than in input", []string{"Gradient"}, true}
+		}
+		for len(grad) < natoms*3 {
+			grad = append(grad, 0)
+		}
+	}
+	mgrad, err := v3.NewMatrix(grad)
+	if err != nil {
+		return nil, Error{ErrNoGradient, Mopac, O.inputname, err.Error(), []string{"v3.NewMatrix", "Gradient"}, true}
+	}
+	if trust_radius_warning {
+		return mgrad, Error{ErrProbableProblem, Mopac, O.inputname, "", []string{"Gradient"}, false}
+	}
+	return mgrad, nil
+}
+
+//mopacNAtoms returns the number of atoms in the MOPAC input file name, as written by BuildInput:
+//comment lines starting with *, the keywords and title lines, and then one line per atom, until
+//an empty line or the end of the file.
+func mopacNAtoms(name string) (int, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	in := bufio.NewReader(file)
+	header := 0
+	natoms := 0
+	for {
+		line, err := in.ReadString('\n')
+		if strings.HasPrefix(line, "*") {
+			continue
+		}
+		if header < 2 {
+			header++
+		} else if strings.TrimSpace(line) == "" {
+			break
+		} else {
+			natoms++
+		}
+		if err != nil {
+			break
+		}
+	}
+	return natoms, nil
+}
+
 //Support function, gets a slice of errors and returns the first
 //non-nil error found, or nil if all errors are nil.
 func parseErrorSlice(errorsl []error) error {
@@ -29,9 +29,11 @@
 package qm
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/rmera/gochem"
 	"github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/mat"
 	"log"
 	"os"
 	"os/exec"
@@ -243,6 +245,12 @@ func (O *NWChemHandle) BuildInput(coords *v3.Matrix, atoms chem.AtomMultiCharger
 		driver = fmt.Sprintf("%s\ndriver\n maxiter 200\n%s trust 0.05\n xyz %s\nend\n", driver, eprec, O.inputname)
 		//Old criteria (ORCA): gmax 0.003\n grms 0.0001\n xmax 0.004 \n xrms 0.002\n
 	}
+	jc.freq = func() {
+		task = "dft freq"
+	}
+	jc.forces = func() {
+		task = "dft gradient"
+	}
 	Q.Job.Do(jc)
 	//////////////////////////////////////////////////////////////
 	//Now lets write the thing. Ill process/write the basis later
@@ -519,6 +527,195 @@ func (O *NWChemHandle) Energy() (float64, error) {
 	return energy * chem.H2Kcal, err
 }
 
+//Gradient reads the last gradient printed in the output of a previous NWChem calculation, which
+//is printed for gradient calculations and for each step of optimizations. The gradient is returned
+//in kcal/(mol A). Returns the gradient AND error if the calculation didn't end normally. In this case
+//the error is "Probable problem in calculation".
+func (O *NWChemHandle) Gradient() (*v3.Matrix, error) {
+	var err error
+	if !O.nwchemNormalTermination() {
+		err = Error{ErrProbableProblem, NWChem, O.inputname, "", []string{"Gradient"}, false}
+	}
+	f, err1 := os.Open(fmt.Sprintf("%s.out", O.inputname))
+	if err1 != nil {
+		return nil, Error{ErrNoGradient, NWChem, O.inputname, err1.Error(), []string{"os.Open", "Gradient"}, true}
+	}
+	defer f.Close()
+	out := bufio.NewReader(f)
+	var grad, current []float64
+	reading := false
+	for {
+		line, err1 := out.ReadString('\n')
+		if err1 != nil {
+			break
+		}
+		if strings.Contains(line, "ENERGY GRADIENTS") {
+			reading = true
+			current = make([]float64, 0, len(grad))
+			continue
+		}
+		if !reading {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			//a blank line and 2 lines with column names come before
+			//the gradients, and a blank line after them.
+			if len(current) > 0 {
+				reading = false
+				grad = current
+			}
+			continue
+		}
+		for _, v := range fields[len(fields)-3:] {
+			g, err2 := strconv.ParseFloat(v, 64)
+			if err2 != nil {
+				return nil, Error{ErrNoGradient, NWChem, O.inputname, err2.Error(), []string{"strconv.ParseFloat", "Gradient"}, true}
+			}
+			current = append(current, g)
+		}
+	}
+	if reading {
+		grad = current
+	}
+	if len(grad) == 0 {
+		return nil, Error{ErrNoGradient, NWChem, O.inputname, "", []string{"Gradient"}, true}
+	}
+	ret, err1 := v3.NewMatrix(grad)
+	if err1 != nil {
+		return nil, Error{ErrNoGradient, NWChem, O.inputname, err1.Error(), []string{"v3.NewMatrix", "Gradient"}, true}
+	}
+	ret.Scale(chem.H2Kcal*chem.A2Bohr, ret)
+	return ret, err
+}
+
+//Vibrations reads the frequencies, normal modes and IR intensities from the output of a previous NWChem
+//frequency calculation. The projected frequencies and modes (the last ones printed) are used, and only the
+//vibrational modes are returned. Returns the vibrations AND error if the calculation didn't end normally.
+//In this case the error is "Probable problem in calculation".
+func (O *NWChemHandle) Vibrations() (*Vibrations, error) {
+	var err error
+	if !O.nwchemNormalTermination() {
+		err = Error{ErrProbableProblem, NWChem, O.inputname, "", []string{"Vibrations"}, false}
+	}
+	f, err1 := os.Open(fmt.Sprintf("%s.out", O.inputname))
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, NWChem, O.inputname, err1.Error(), []string{"os.Open", "Vibrations"}, true}
+	}
+	defer f.Close()
+	out := bufio.NewReader(f)
+	var freqs, ir []float64
+	var modes [][]float64
+	block := 0 //the index of the first mode in the current block.
+	readingmodes := false
+	for {
+		line, err1 := out.ReadString('\n')
+		fields := strings.Fields(line)
+		switch {
+		case strings.Contains(line, "NORMAL MODE EIGENVECTORS IN CARTESIAN COORDINATES"):
+			readingmodes = true
+			freqs, modes = nil, nil
+		case strings.Contains(line, "Infra Red Intensities"):
+			readingmodes = false
+			ir = nil
+		case readingmodes && len(fields) > 1 && (fields[0] == "Frequency" || fields[0] == "P.Frequency"):
+			block = len(freqs)
+			for _, v := range fields[1:] {
+				fr, err2 := strconv.ParseFloat(v, 64)
+				if err2 != nil {
+					return nil, Error{ErrNoFreq, NWChem, O.inputname, err2.Error(), []string{"strconv.ParseFloat", "Vibrations"}, true}
+				}
+				freqs = append(freqs, fr)
+				modes = append(modes, nil)
+			}
+		case readingmodes && len(fields) == 1+len(freqs)-block && strings.Contains(line, "."):
+			//The row index, and one component of each mode in the block.
+			for i, v := range fields[1:] {
+				c, err2 := strconv.ParseFloat(v, 64)
+				if err2 != nil {
+					return nil, Error{ErrNoFreq, NWChem, O.inputname, err2.Error(), []string{"strconv.ParseFloat", "Vibrations"}, true}
+				}
+				modes[block+i] = append(modes[block+i], c)
+			}
+		case readingmodes && strings.Contains(line, "-----") && len(freqs) > 0:
+			readingmodes = false
+		case len(fields) == 7 && fields[2] == "||":
+			//mode, frequency, ||, and the intensity in a.u., (debye/A)^2, km/mol and arbitrary units.
+			if _, err2 := strconv.Atoi(fields[0]); err2 != nil {
+				break //the column names
+			}
+			in, err2 := strconv.ParseFloat(fields[5], 64)
+			if err2 != nil {
+				return nil, Error{ErrNoFreq, NWChem, O.inputname, err2.Error(), []string{"strconv.ParseFloat", "Vibrations"}, true}
+			}
+			ir = append(ir, in)
+		}
+		if err1 != nil {
+			break
+		}
+	}
+	if len(ir) != len(freqs) {
+		ir = nil
+	}
+	vib, err1 := newVibrations(freqs, modes, ir)
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, NWChem, O.inputname, err1.Error(), []string{"newVibrations", "Vibrations"}, true}
+	}
+	return vib, err
+}
+
+//Hessian reads the cartesian Hessian from the .hess file written by a previous NWChem frequency calculation.
+//The Hessian is returned in kcal/(mol A^2). Returns the Hessian AND error if the calculation didn't
+//end normally. In this case the error is "Probable problem in calculation".
+func (O *NWChemHandle) Hessian() (*mat.Dense, error) {
+	var err error
+	if !O.nwchemNormalTermination() {
+		err = Error{ErrProbableProblem, NWChem, O.inputname, "", []string{"Hessian"}, false}
+	}
+	f, err1 := os.Open(fmt.Sprintf("%s.hess", O.inputname))
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, NWChem, O.inputname, err1.Error(), []string{"os.Open", "Hessian"}, true}
+	}
+	defer f.Close()
+	//The file contains the lower triangle of the Hessian, one element per line.
+	var lower []float64
+	out := bufio.NewReader(f)
+	for {
+		line, err1 := out.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			v, err2 := parseFortranFloat(line)
+			if err2 != nil {
+				return nil, Error{ErrNoFreq, NWChem, O.inputname, err2.Error(), []string{"parseFortranFloat", "Hessian"}, true}
+			}
+			lower = append(lower, v)
+		}
+		if err1 != nil {
+			break
+		}
+	}
+	n := 0
+	for n*(n+1)/2 < len(lower) {
+		n++
+	}
+	if n*(n+1)/2 != len(lower) {
+		return nil, Error{ErrNoFreq, NWChem, O.inputname, "Wrong number of elements in Hessian", []string{"Hessian"}, true}
+	}
+	data := make([]float64, n*n)
+	k := 0
+	for i := 0; i < n; i++ {
+		for j := 0; j <= i; j++ {
+			data[i*n+j] = lower[k]
+			data[j*n+i] = lower[k]
+			k++
+		}
+	}
+	hess, err1 := hessianFromAU(data)
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, NWChem, O.inputname, err1.Error(), []string{"hessianFromAU", "Hessian"}, true}
+	}
+	return hess, err
+}
+
 //This checks that an NWChem calculation has terminated normally
 //I know this duplicates code, I wrote this one first and then the other one.
 func (O *NWChemHandle) nwchemNormalTermination() bool {
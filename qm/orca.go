@@ -29,6 +29,7 @@
 package qm
 
 import (
+	"bufio"
 	"fmt"
 	"log"
 	"os"
@@ -39,6 +40,7 @@ import (
 
 	"github.com/rmera/gochem"
 	"github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/mat"
 )
 
 //Note that the default methods and basis vary with each program, and even
@@ -151,6 +153,12 @@ func (O *OrcaHandle) BuildInput(coords *v3.Matrix, atoms chem.AtomMultiCharger,
 		opt = "Opt"
 		trustradius = "%geom trust 0.3\nend\n\n" //Orca uses a fixed trust radius by default. This goChem makes an input that activates variable trust radius.
 	}
+	jc.freq = func() {
+		opt = "Freq" //the frequencies, normal modes and Hessian are written to the .hess file.
+	}
+	jc.forces = func() {
+		opt = "EnGrad" //the gradient is written to the .engrad file.
+	}
 	Q.Job.Do(jc)
 	//If this flag is set we'll look for a suitable MO file.
 	//If not found, we'll just use the default ORCA guess
@@ -495,6 +503,194 @@ func (O *OrcaHandle) Energy() (float64, error) {
 	return energy * chem.H2Kcal, err
 }
 
+//Gradient reads the gradient from the .engrad file of a previous ORCA calculation, which is written
+//for EnGrad calculations and for each step of optimizations. The gradient is returned in kcal/(mol A).
+//Returns the gradient AND error if the calculation didn't end normally. In this case
+//the error is "Probable problem in calculation".
+func (O *OrcaHandle) Gradient() (*v3.Matrix, error) {
+	var err error
+	if trust := O.orcaNormalTermination(); !trust {
+		err = Error{ErrProbableProblem, Orca, O.inputname, "", []string{"Gradient"}, false}
+	}
+	f, err1 := os.Open(fmt.Sprintf("%s.engrad", O.inputname))
+	if err1 != nil {
+		return nil, Error{ErrNoGradient, Orca, O.inputname, err1.Error(), []string{"os.Open", "Gradient"}, true}
+	}
+	defer f.Close()
+	//The file has the number of atoms, the energy, and the 3N gradient components,
+	//one number per line, each preceded by comment lines starting with #.
+	var values []float64
+	natoms := -1
+	out := bufio.NewReader(f)
+	for {
+		line, err1 := out.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			v, err2 := strconv.ParseFloat(line, 64)
+			if err2 != nil {
+				return nil, Error{ErrNoGradient, Orca, O.inputname, err2.Error(), []string{"strconv.ParseFloat", "Gradient"}, true}
+			}
+			values = append(values, v)
+			if natoms < 0 {
+				natoms = int(v)
+			}
+		}
+		if err1 != nil || (natoms > 0 && len(values) == 2+3*natoms) {
+			break
+		}
+	}
+	if natoms <= 0 || len(values) != 2+3*natoms {
+		return nil, Error{ErrNoGradient, Orca, O.inputname, "", []string{"Gradient"}, true}
+	}
+	grad, err1 := v3.NewMatrix(values[2:])
+	if err1 != nil {
+		return nil, Error{ErrNoGradient, Orca, O.inputname, err1.Error(), []string{"v3.NewMatrix", "Gradient"}, true}
+	}
+	grad.Scale(chem.H2Kcal*chem.A2Bohr, grad)
+	return grad, err
+}
+
+//Vibrations reads the frequencies, normal modes and IR intensities from the .hess file
+//of a previous ORCA frequency calculation. Only the vibrational modes are returned.
+//Returns the vibrations AND error ("Probable problem in calculation") if the calculation didn't end normally.
+func (O *OrcaHandle) Vibrations() (*Vibrations, error) {
+	var err error
+	if trust := O.orcaNormalTermination(); !trust {
+		err = Error{ErrProbableProblem, Orca, O.inputname, "", []string{"Vibrations"}, false}
+	}
+	sections, err1 := orcaHessFile(O.inputname + ".hess")
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, Orca, O.inputname, err1.Error(), []string{"orcaHessFile", "Vibrations"}, true}
+	}
+	freqs := make([]float64, 0, len(sections["vibrational_frequencies"]))
+	for _, v := range sections["vibrational_frequencies"] {
+		f, err1 := strconv.ParseFloat(v[len(v)-1], 64)
+		if err1 != nil {
+			return nil, Error{ErrNoFreq, Orca, O.inputname, err1.Error(), []string{"strconv.ParseFloat", "Vibrations"}, true}
+		}
+		freqs = append(freqs, f)
+	}
+	data, n, err1 := orcaMatrix(sections["normal_modes"])
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, Orca, O.inputname, err1.Error(), []string{"orcaMatrix", "Vibrations"}, true}
+	}
+	//The frequency, (from ORCA 5 on) the molar absorption coefficient, the intensity in km/mol, and the
+	//components of the transition dipole.
+	var ir []float64
+	for _, v := range sections["ir_spectrum"] {
+		col := 1
+		if len(v) >= 6 {
+			col = 2
+		}
+		in, err1 := strconv.ParseFloat(v[col], 64)
+		if err1 != nil {
+			return nil, Error{ErrNoFreq, Orca, O.inputname, err1.Error(), []string{"strconv.ParseFloat", "Vibrations"}, true}
+		}
+		ir = append(ir, in)
+	}
+	if len(ir) != len(freqs) {
+		ir = nil
+	}
+	vib, err1 := newVibrations(freqs, columns(data, n), ir)
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, Orca, O.inputname, err1.Error(), []string{"newVibrations", "Vibrations"}, true}
+	}
+	return vib, err
+}
+
+//Hessian reads the cartesian Hessian from the .hess file of a previous ORCA frequency calculation,
+//in kcal/(mol A^2). Returns the Hessian AND error ("Probable problem in calculation") if the
+//calculation didn't end normally.
+func (O *OrcaHandle) Hessian() (*mat.Dense, error) {
+	var err error
+	if trust := O.orcaNormalTermination(); !trust {
+		err = Error{ErrProbableProblem, Orca, O.inputname, "", []string{"Hessian"}, false}
+	}
+	sections, err1 := orcaHessFile(O.inputname + ".hess")
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, Orca, O.inputname, err1.Error(), []string{"orcaHessFile", "Hessian"}, true}
+	}
+	data, _, err1 := orcaMatrix(sections["hessian"])
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, Orca, O.inputname, err1.Error(), []string{"orcaMatrix", "Hessian"}, true}
+	}
+	hess, err1 := hessianFromAU(data)
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, Orca, O.inputname, err1.Error(), []string{"hessianFromAU", "Hessian"}, true}
+	}
+	return hess, err
+}
+
+//orcaHessFile reads the sections of an ORCA .hess file. Each section is returned, under its name without the $,
+//as the fields of each of its lines, leaving out the line with the dimensions of the section.
+func orcaHessFile(name string) (map[string][][]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sections := make(map[string][][]string)
+	current := ""
+	dimensions := false
+	out := bufio.NewReader(f)
+	for {
+		line, err := out.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "$") {
+			current = strings.TrimPrefix(line, "$")
+			dimensions = true
+		} else if current != "" && line != "" && !strings.HasPrefix(line, "#") {
+			if dimensions {
+				dimensions = false
+			} else {
+				sections[current] = append(sections[current], strings.Fields(line))
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return sections, nil
+}
+
+//orcaMatrix returns the elements, in row-major order, and the number of columns, of a square matrix
+//from an ORCA .hess file. The matrix is printed in blocks of columns, each starting with a line
+//containing the column indexes. Each line in a block starts with the row index.
+func orcaMatrix(lines [][]string) ([]float64, int, error) {
+	var rows [][]float64
+	for _, v := range lines {
+		if !strings.Contains(strings.Join(v, " "), ".") {
+			continue //the column indexes
+		}
+		r, err := strconv.Atoi(v[0])
+		if err != nil {
+			return nil, 0, err
+		}
+		for len(rows) <= r {
+			rows = append(rows, nil)
+		}
+		for _, w := range v[1:] {
+			e, err := strconv.ParseFloat(w, 64)
+			if err != nil {
+				return nil, 0, err
+			}
+			rows[r] = append(rows[r], e)
+		}
+	}
+	n := len(rows)
+	data := make([]float64, 0, n*n)
+	for _, v := range rows {
+		if len(v) != n {
+			return nil, 0, fmt.Errorf("Matrix is not square")
+		}
+		data = append(data, v...)
+	}
+	if n == 0 {
+		return nil, 0, fmt.Errorf("Empty matrix")
+	}
+	return data, n, nil
+}
+
 //Gets previous line of the file f
 func getTailLine(f *os.File) (line string, err error) {
 	var i int64 = 1
@@ -0,0 +1,483 @@
+/*
+ * psi4.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package qm
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/gochem"
+	"github.com/rmera/gochem/v3"
+)
+
+//Psi4Handle builds inputs (in the psithon format) for, runs, and reads results from Psi4 calculations.
+//Note that the default methods and basis vary with each program, and even
+//for a given program they are NOT considered part of the API, so they can always change.
+type Psi4Handle struct {
+	defmethod string
+	defbasis  string
+	command   string
+	inputname string
+	nCPU      int
+}
+
+func NewPsi4Handle() *Psi4Handle {
+	run := new(Psi4Handle)
+	run.SetDefaults()
+	return run
+}
+
+//Psi4Handle methods
+
+//Sets the number of CPU to be used
+func (O *Psi4Handle) SetnCPU(cpu int) {
+	O.nCPU = cpu
+}
+
+func (O *Psi4Handle) SetName(name string) {
+	O.inputname = name
+}
+
+func (O *Psi4Handle) SetCommand(name string) {
+	O.command = name
+}
+
+//SetDefaults sets defaults for a Psi4 calculation. Default is a single-point at
+//BLYP/def2-SVP with density fitting, and all the available CPUs. The Psi4 command
+//is set to psi4, which needs to be in the PATH.
+func (O *Psi4Handle) SetDefaults() {
+	O.defmethod = "BLYP"
+	O.defbasis = "def2-SVP"
+	O.command = "psi4"
+	O.nCPU = runtime.NumCPU()
+}
+
+//BuildInput builds an input for Psi4 based int the data in atoms, coords and C.
+//Different basis for some atoms (but not for some elements) are not supported.
+//returns only error.
+func (O *Psi4Handle) BuildInput(coords *v3.Matrix, atoms chem.AtomMultiCharger, Q *Calc) error {
+	if atoms == nil || coords == nil {
+		return Error{ErrMissingCharges, Psi4, O.inputname, "", []string{"BuildInput"}, true}
+	}
+	if Q.Basis == "" && !strings.Contains(Q.Method, "3c") {
+		log.Printf("no basis set assigned for Psi4 calculation, will used the default %s, \n", O.defbasis)
+		Q.Basis = O.defbasis
+	}
+	if Q.Method == "" {
+		log.Printf("no method assigned for Psi4 calculation, will used the default %s, \n", O.defmethod)
+		Q.Method = O.defmethod
+	}
+	if Q.HBAtoms != nil || Q.LBAtoms != nil {
+		log.Printf("different basis for some atoms are not supported for Psi4 calculations, will use %s for those atoms\n", Q.Basis)
+	}
+	//Psi4 takes the dispersion correction as part of the method name.
+	method := strings.ToLower(Q.Method)
+	if strings.Contains(method, "3c") {
+		method = strings.Replace(method, "-", "", -1) //hf3c, pbeh3c. These include their own corrections.
+	} else if Q.Dispersion != "" {
+		d, ok := psi4Disp[Q.Dispersion]
+		if !ok {
+			return Error{"goChem/QM: Dispersion correction not supported", Psi4, O.inputname, Q.Dispersion, []string{"BuildInput"}, true}
+		}
+		if d != "" {
+			method = method + "-" + d
+		}
+	}
+	options := make([]string, 0, 10)
+	if !strings.Contains(method, "3c") {
+		options = append(options, "basis "+strings.ToLower(Q.Basis))
+	}
+	//RI is density fitting in Psi4 parlance. Psi4 chooses the auxiliary basis.
+	if Q.RI || Q.RIJ {
+		options = append(options, "scf_type df")
+	} else {
+		options = append(options, "scf_type pk")
+	}
+	if atoms.Multi() != 1 {
+		options = append(options, "reference uhf")
+	}
+	if s := psi4SCFTight[Q.SCFTightness]; s != "" {
+		options = append(options, s)
+	}
+	if s := psi4SCFConv[Q.SCFConvHelp]; s != "" {
+		options = append(options, s)
+	}
+	if g, ok := psi4Grid[Q.Grid]; ok {
+		options = append(options, g)
+	}
+	if Q.Guess != "" {
+		options = append(options, "guess "+Q.Guess)
+	}
+	call := "energy"
+	optking := ""
+	jc := jobChoose{}
+	jc.opti = func() {
+		call = "optimize"
+	}
+	jc.freq = func() {
+		call = "frequency"
+	}
+	jc.forces = func() {
+		call = "gradient"
+	}
+	Q.Job.Do(jc)
+	if Q.Job.Opti {
+		var err error
+		optking, err = O.buildConstraints(Q.CConstraints, Q.IConstraints, Q.CartesianOpt)
+		if err != nil {
+			return errDecorate(err, "BuildInput")
+		}
+	}
+	basisblock := ""
+	if (Q.HBElements != nil || Q.LBElements != nil) && !strings.Contains(method, "3c") {
+		elementbasis := make([]string, 0, len(Q.HBElements)+len(Q.LBElements)+3)
+		elementbasis = append(elementbasis, "basis {\n", fmt.Sprintf("   assign %s\n", strings.ToLower(Q.Basis)))
+		for _, val := range Q.HBElements {
+			elementbasis = append(elementbasis, fmt.Sprintf("   assign %s %s\n", val, strings.ToLower(Q.HighBasis)))
+		}
+		for _, val := range Q.LBElements {
+			elementbasis = append(elementbasis, fmt.Sprintf("   assign %s %s\n", val, strings.ToLower(Q.LowBasis)))
+		}
+		elementbasis = append(elementbasis, "}\n\n")
+		basisblock = strings.Join(elementbasis, "")
+		options = options[1:] //the basis is given in the block.
+	}
+	pcm := ""
+	if Q.Dielectric > 0 {
+		options = append(options, "pcm true", "pcm_scf_type total")
+		pcm = fmt.Sprintf("pcm = {\n   Units = Angstrom\n   Medium {\n      SolverType = CPCM\n      Solvent = Explicit\n      ProbeRadius = 1.385\n      Green<inside> {\n         Type = Vacuum\n      }\n      Green<outside> {\n         Type = UniformDielectric\n         Der = Derivative\n         Eps = %4.2f\n         EpsDyn = 1.78\n      }\n   }\n   Cavity {\n      Type = GePol\n      Area = 0.3\n      Mode = Implicit\n   }\n}\n\n", Q.Dielectric)
+	}
+	//Now lets write the thing
+	if O.inputname == "" {
+		O.inputname = "gochem"
+	}
+	file, err := os.Create(fmt.Sprintf("%s.inp", O.inputname))
+	if err != nil {
+		return Error{ErrCantInput, Psi4, O.inputname, err.Error(), []string{"os.Create", "BuildInput"}, true}
+	}
+	defer file.Close()
+	if Q.Memory != 0 {
+		_, err = fmt.Fprintf(file, "memory %d mb\n\n", Q.Memory)
+		if err != nil {
+			return Error{ErrCantInput, Psi4, O.inputname, err.Error(), []string{"fmt.Fprintf", "BuildInput"}, true}
+		}
+	}
+	//The molecule is kept in the input orientation, so the geometries and gradients read
+	//correspond to the input coordinates.
+	fmt.Fprintf(file, "molecule %s {\n", psi4Name(O.inputname))
+	fmt.Fprintf(file, "%d %d\n", atoms.Charge(), atoms.Multi())
+	for i := 0; i < atoms.Len(); i++ {
+		fmt.Fprintf(file, "%-2s  %12.6f%12.6f%12.6f\n", atoms.Atom(i).Symbol, coords.At(i, 0), coords.At(i, 1), coords.At(i, 2))
+	}
+	fmt.Fprint(file, "units angstrom\nno_reorient\nno_com\nsymmetry c1\n}\n\n")
+	fmt.Fprint(file, basisblock)
+	fmt.Fprintf(file, "set {\n   %s\n}\n\n", strings.Join(options, "\n   "))
+	fmt.Fprint(file, optking)
+	fmt.Fprint(file, pcm)
+	if Q.Others != "" {
+		fmt.Fprintf(file, "%s\n\n", Q.Others)
+	}
+	fmt.Fprintf(file, "%s('%s')\n", call, method)
+	return nil
+}
+
+//psi4Name returns a name that can be used as a Python identifier for the molecule.
+func psi4Name(name string) string {
+	ret := []byte(name)
+	for i, v := range ret {
+		if !(v >= 'a' && v <= 'z' || v >= 'A' && v <= 'Z' || v >= '0' && v <= '9' || v == '_') {
+			ret[i] = '_'
+		}
+	}
+	if len(ret) == 0 || (ret[0] >= '0' && ret[0] <= '9') {
+		ret = append([]byte("mol_"), ret...)
+	}
+	return string(ret)
+}
+
+//buildConstraints transforms the lists of cartesian and internal constraints in the Calc structure
+//into an optking options block for Psi4. Psi4 numbers atoms from 1.
+func (O *Psi4Handle) buildConstraints(C []int, IC []*IConstraint, cartesian bool) (string, error) {
+	if C == nil && IC == nil && !cartesian {
+		return "", nil
+	}
+	options := make([]string, 0, 8)
+	if cartesian {
+		options = append(options, "opt_coordinates cartesian")
+	}
+	if C != nil {
+		frozen := make([]string, 0, len(C))
+		for _, v := range C {
+			frozen = append(frozen, fmt.Sprintf("%d xyz", v+1))
+		}
+		options = append(options, fmt.Sprintf("frozen_cartesian \"%s\"", strings.Join(frozen, " ")))
+	}
+	//The constraints without a value are frozen at their value in the starting structure.
+	//The others are fixed at the given value.
+	frozen := map[byte][]string{}
+	fixed := map[byte][]string{}
+	for _, v := range IC {
+		if iConstraintOrder[v.Class] != len(v.CAtoms) {
+			return "", Error{"Internal constraint ill-formated", Psi4, O.inputname, "", []string{"buildConstraints"}, true}
+		}
+		c := make([]string, 0, 5)
+		for _, w := range v.CAtoms {
+			c = append(c, strconv.Itoa(w+1))
+		}
+		if v.UseVal {
+			c = append(c, fmt.Sprintf("%2.3f", v.Val))
+			fixed[v.Class] = append(fixed[v.Class], strings.Join(c, " "))
+		} else {
+			frozen[v.Class] = append(frozen[v.Class], strings.Join(c, " "))
+		}
+	}
+	for _, class := range []byte{'B', 'A', 'D'} {
+		if f, ok := frozen[class]; ok {
+			options = append(options, fmt.Sprintf("frozen_%s \"%s\"", psi4Coord[class], strings.Join(f, " ")))
+		}
+		if f, ok := fixed[class]; ok {
+			options = append(options, fmt.Sprintf("fixed_%s \"%s\"", psi4Coord[class], strings.Join(f, " ")))
+		}
+	}
+	return fmt.Sprintf("set optking {\n   %s\n}\n\n", strings.Join(options, "\n   ")), nil
+}
+
+var psi4Coord = map[byte]string{
+	'B': "distance",
+	'A': "bend",
+	'D': "dihedral",
+}
+
+var psi4SCFTight = map[int]string{
+	0: "",
+	1: "e_convergence 1e-8\n   d_convergence 1e-8",
+	2: "e_convergence 1e-10\n   d_convergence 1e-10",
+}
+
+var psi4SCFConv = map[int]string{
+	0: "",
+	1: "damping_percentage 20",
+	2: "damping_percentage 40\n   soscf true",
+}
+
+var psi4Grid = map[int]string{
+	1: "dft_radial_points 50\n   dft_spherical_points 194",
+	2: "dft_radial_points 75\n   dft_spherical_points 302",
+	3: "dft_radial_points 75\n   dft_spherical_points 434",
+	4: "dft_radial_points 99\n   dft_spherical_points 590",
+	5: "dft_radial_points 150\n   dft_spherical_points 974",
+}
+
+var psi4Disp = map[string]string{
+	"nodisp": "",
+	"D2":     "d2",
+	"D3":     "d3zero",
+	"D3ZERO": "d3zero",
+	"D3Zero": "d3zero",
+	"D3zero": "d3zero",
+	"D3BJ":   "d3bj",
+	"D3bj":   "d3bj",
+}
+
+//Run runs the command given by the string O.command
+//it waits or not for the result depending on wait.
+//Not waiting for results works
+//only for unix-compatible systems, as it uses sh and nohup.
+func (O *Psi4Handle) Run(wait bool) (err error) {
+	args := []string{"-n", strconv.Itoa(O.nCPU), fmt.Sprintf("%s.inp", O.inputname), fmt.Sprintf("%s.out", O.inputname)}
+	if wait == true {
+		command := exec.Command(O.command, args...)
+		err = command.Run()
+	} else {
+		command := exec.Command("sh", "-c", "nohup "+O.command+" "+strings.Join(args, " ")+" > /dev/null &")
+		err = command.Start()
+	}
+	if err != nil {
+		err = Error{ErrNotRunning, Psi4, O.inputname, err.Error(), []string{"exec.Start", "Run"}, true}
+	}
+	return err
+}
+
+//Energy returns the last total energy in the output of a previous Psi4 calculation, in kcal/mol.
+//For optimizations, this is the energy of the optimized geometry.
+//Returns error if problem, and also if the energy returned is product of an
+//abnormally-terminated Psi4 calculation. (in this case error is "Probable problem
+//in calculation")
+func (O *Psi4Handle) Energy() (float64, error) {
+	var err error
+	if !O.psi4NormalTermination() {
+		err = Error{ErrProbableProblem, Psi4, O.inputname, "", []string{"Energy"}, false}
+	}
+	f, err1 := os.Open(fmt.Sprintf("%s.out", O.inputname))
+	if err1 != nil {
+		return 0, Error{ErrNoEnergy, Psi4, O.inputname, err1.Error(), []string{"os.Open", "Energy"}, true}
+	}
+	defer f.Close()
+	out := bufio.NewReader(f)
+	energy := 0.0
+	found := false
+	for {
+		line, err1 := out.ReadString('\n')
+		//    Total Energy =                        -76.4089543210362233
+		if strings.Contains(line, "Total Energy =") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				return 0, Error{ErrNoEnergy, Psi4, O.inputname, "Malformed energy line", []string{"Energy"}, true}
+			}
+			energy, err1 = strconv.ParseFloat(fields[3], 64)
+			if err1 != nil {
+				return 0, Error{ErrNoEnergy, Psi4, O.inputname, err1.Error(), []string{"strconv.ParseFloat", "Energy"}, true}
+			}
+			found = true
+		}
+		if err1 != nil {
+			break
+		}
+	}
+	if !found {
+		return 0, Error{ErrNoEnergy, Psi4, O.inputname, "", []string{"Energy"}, true}
+	}
+	return energy * chem.H2Kcal, err
+}
+
+//OptimizedGeometry reads the last geometry in the output of a previous Psi4 calculation.
+//Returns the geometry AND error if the geometry read is not the product of a correctly ended
+//Psi4 calculation. In this case the error is "probable problem in calculation".
+func (O *Psi4Handle) OptimizedGeometry(atoms chem.Atomer) (*v3.Matrix, error) {
+	var err error
+	if !O.psi4NormalTermination() {
+		err = Error{ErrProbableProblem, Psi4, O.inputname, "", []string{"OptimizedGeometry"}, false}
+	}
+	geo, err1 := O.lastBlock("Geometry (in Angstrom)")
+	if err1 != nil {
+		return nil, errDecorate(err1, "OptimizedGeometry")
+	}
+	if geo == nil || (atoms != nil && len(geo) != 3*atoms.Len()) {
+		return nil, Error{ErrNoGeometry, Psi4, O.inputname, "", []string{"OptimizedGeometry"}, true}
+	}
+	coords, err1 := v3.NewMatrix(geo)
+	if err1 != nil {
+		return nil, Error{ErrNoGeometry, Psi4, O.inputname, err1.Error(), []string{"v3.NewMatrix", "OptimizedGeometry"}, true}
+	}
+	return coords, err
+}
+
+//Gradient reads the last gradient in the output of a previous Psi4 calculation, which is printed
+//for gradient calculations and for each step of optimizations, in kcal/(mol A). Returns the
+//gradient AND error if the calculation didn't end normally. In this case the error is
+//"Probable problem in calculation".
+func (O *Psi4Handle) Gradient() (*v3.Matrix, error) {
+	var err error
+	if !O.psi4NormalTermination() {
+		err = Error{ErrProbableProblem, Psi4, O.inputname, "", []string{"Gradient"}, false}
+	}
+	g, err1 := O.lastBlock("-Total Gradient:")
+	if err1 != nil {
+		return nil, errDecorate(err1, "Gradient")
+	}
+	if g == nil {
+		return nil, Error{ErrNoGradient, Psi4, O.inputname, "", []string{"Gradient"}, true}
+	}
+	grad, err1 := v3.NewMatrix(g)
+	if err1 != nil {
+		return nil, Error{ErrNoGradient, Psi4, O.inputname, err1.Error(), []string{"v3.NewMatrix", "Gradient"}, true}
+	}
+	grad.Scale(chem.H2Kcal*chem.A2Bohr, grad)
+	return grad, err
+}
+
+//lastBlock returns the x, y and z values from the last block in the output that comes after a line containing
+//header. The lines in the block start with the atom symbol or number, followed by the 3 values,
+//and the block ends with an empty line. Lines with column names or dashes before the block are skipped.
+//A nil slice is returned if the header is not found.
+func (O *Psi4Handle) lastBlock(header string) ([]float64, error) {
+	f, err := os.Open(fmt.Sprintf("%s.out", O.inputname))
+	if err != nil {
+		return nil, Error{err.Error(), Psi4, O.inputname, "", []string{"os.Open", "lastBlock"}, true}
+	}
+	defer f.Close()
+	var ret, current []float64
+	reading := false
+	out := bufio.NewReader(f)
+	for {
+		line, err := out.ReadString('\n')
+		fields := strings.Fields(line)
+		switch {
+		case strings.Contains(line, header):
+			reading = true
+			current = make([]float64, 0, len(ret))
+		case reading && len(fields) == 0 && len(current) > 0:
+			reading = false
+			ret = current
+		case reading && len(fields) >= 4:
+			xyz := make([]float64, 3)
+			var err1 error
+			for i := range xyz {
+				if xyz[i], err1 = strconv.ParseFloat(fields[i+1], 64); err1 != nil {
+					break
+				}
+			}
+			if err1 == nil { //otherwise, it's a line with column names or dashes.
+				current = append(current, xyz...)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if reading && len(current) > 0 {
+		ret = current
+	}
+	return ret, nil
+}
+
+//psi4NormalTermination checks that a Psi4 calculation has terminated normally.
+func (O *Psi4Handle) psi4NormalTermination() bool {
+	f, err := os.Open(fmt.Sprintf("%s.out", O.inputname))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	f.Seek(-1, 2) //We start at the end of the file
+	for i := 0; i < 5; i++ {
+		line, err := getTailLine(f)
+		if err != nil {
+			return false
+		}
+		if strings.Contains(line, "Psi4 exiting successfully") {
+			return true
+		}
+	}
+	return false
+}
@@ -33,6 +33,7 @@ import (
 
 	"github.com/rmera/gochem"
 	"github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/mat"
 )
 
 //builds an input for a QM calculation
@@ -73,6 +74,26 @@ type EnergyGeo interface {
 	//in calculation") if there is a geometry but the calculation didnt
 	//end properly*
 	OptimizedGeometry(atoms chem.Atomer) (*v3.Matrix, error)
+
+	//Gradient reads the last gradient of the energy with respect to the
+	//atomic coordinates from a calculation, in kcal/(mol A), so it is consistent
+	//with the energies and coordinates. Returns error if fail. Returns
+	//Error ("Probable problem in calculation") if there is a gradient but
+	//the calculation didnt end properly.
+	Gradient() (*v3.Matrix, error)
+}
+
+//Allows to recover the results of a frequency calculation (a calculation with Job.Freq set).
+type FreqReader interface {
+
+	//Vibrations reads the frequencies, normal modes and, if available,
+	//IR intensities from a frequency calculation. Translations and rotations
+	//are not included. Returns error if fail.
+	Vibrations() (*Vibrations, error)
+
+	//Hessian reads the cartesian Hessian from a frequency calculation, in kcal/(mol A^2),
+	//so it is consistent with the gradients. Returns error if fail.
+	Hessian() (*mat.Dense, error)
 }
 
 //This allows to set QM calculations using different programs.
@@ -86,6 +107,8 @@ const (
 	ErrMissingCharges  = "goChem/QM: Missing charges or coordinates"
 	ErrNoEnergy        = "goChem/QM: No energy in output"
 	ErrNoGeometry      = "gochem/QM: Unable to read Geometry from input"
+	ErrNoGradient      = "goChem/QM: No gradient in output"
+	ErrNoFreq          = "goChem/QM: No frequencies or Hessian in output"
 	ErrNotRunning      = "gochem/QM: Couldn't run calculation"
 	ErrCantInput       = "goChem/QM: Can't build input file"
 )
@@ -97,6 +120,9 @@ const (
 	NWChem    = "NWChem"
 	Fermions  = "Fermions++"
 	XTB       = "XTB" //this may go away if Orca starts supporting XTB.
+	Gaussian  = "Gaussian"
+	Psi4      = "Psi4"
+	DFTBPlus  = "DFTB+"
 )
 
 //errors
@@ -146,16 +172,18 @@ func errDecorate(err error, caller string) error {
 //jobChoose is a structure where each QM handler has to provide a closure that makes the proper arrangements for each supported case.
 type jobChoose struct {
 	opti   func()
+	freq   func()
 	forces func()
 	sp     func()
 }
 
 //This is what the user actually deasl with. The user should set one of these to true,
 //and goChem will see that the proper actions are taken. If the user sets more than one of the
-//fields to true, the priority will be Opti>Forces>SP (i.e. if you set Forces and SP to true,
+//fields to true, the priority will be Opti>Freq>Forces>SP (i.e. if you set Forces and SP to true,
 //only the function handling forces will be called).
 type Job struct {
 	Opti   bool
+	Freq   bool //vibrational frequencies (and the Hessian).
 	Forces bool
 	SP     bool
 }
@@ -171,6 +199,10 @@ func (J *Job) Do(plan jobChoose) {
 		plan.opti()
 		return
 	}
+	if J.Freq && plan.freq != nil {
+		plan.freq()
+		return
+	}
 	if J.Forces && plan.forces != nil {
 		plan.forces()
 		return
@@ -30,6 +30,8 @@ package qm
 
 import (
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
 	"strings"
 	"testing"
@@ -246,6 +248,66 @@ func TestFermions(Te *testing.T) {
 }
 */
 
+//TestGradient reads the gradient of the same water molecule from outputs of
+//ORCA, NWChem, MOPAC, Turbomole, xtb and Psi4. The NWChem and Turbomole files
+//contain an earlier gradient that should be skipped.
+func TestGradient(Te *testing.T) {
+	original_dir, _ := os.Getwd()
+	if err := os.Chdir("../test"); err != nil {
+		Te.Fatal(err)
+	}
+	defer os.Chdir(original_dir)
+	orca := NewOrcaHandle()
+	orca.SetName("gradorca")
+	nw := NewNWChemHandle()
+	nw.SetName("gradnw")
+	mopac := NewMopacHandle()
+	mopac.SetName("gradmopac")
+	tm := NewTMHandle()
+	tm.SetName("gradtm")
+	xtb := NewXTBHandle()
+	xtb.SetName("gradxtb")
+	psi4 := NewPsi4Handle()
+	psi4.SetName("gradpsi4")
+	//in kcal/(mol A)
+	expected := []float64{0, 0, 23.9295, 14.5856, 0, -11.9648, -14.5856, 0, -11.9648}
+	for _, h := range []Handle{orca, nw, mopac, tm, xtb, psi4} {
+		grad, err := h.Gradient()
+		if err != nil {
+			Te.Fatalf("%T: %s", h, err.Error())
+		}
+		if grad.NVecs() != 3 {
+			Te.Fatalf("%T: Wrong number of atoms in gradient: %d", h, grad.NVecs())
+		}
+		for i, v := range expected {
+			if g := grad.At(i/3, i%3); g-v > 0.01 || v-g > 0.01 {
+				Te.Errorf("%T: Wrong gradient component %d: %f instead of %f", h, i, g, v)
+			}
+		}
+	}
+	//The frozen atom at the end is not printed by MOPAC, but it is in the gradient.
+	mopac.SetName("gradmopacfrozen")
+	grad, err := mopac.Gradient()
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if grad.NVecs() != 3 || grad.At(1, 0) != 14.5858 || grad.At(2, 0) != 0 {
+		Te.Errorf("Wrong MOPAC gradient with frozen atoms: %v", grad)
+	}
+	orca.SetName("nonexistent")
+	if _, err := orca.Gradient(); err == nil {
+		Te.Errorf("No error for missing gradient file")
+	}
+	//grad or rdgrad are run after the SCF program, so the gradient file is written.
+	for _, v := range [][2]string{{"ridft", "ridft && rdgrad"}, {"dscf", "dscf && grad"}} {
+		tm.command = v[0]
+		tm.jobCommand(&Calc{Job: Job{Forces: true}})
+		if tm.command != v[1] {
+			Te.Errorf("Wrong Turbomole command for a forces job: %s", tm.command)
+		}
+	}
+}
+
 func qderror_handler(err error, Te *testing.T) {
 	if err != nil {
 		if strings.Contains("NonFatal", err.Error()) {
@@ -355,3 +417,377 @@ func TestXtb(Te *testing.T) {
 	chem.XYZFileWrite("optiXTB.xyz", newg, mol)
 
 }
+
+func TestFreq(Te *testing.T) {
+	original_dir, _ := os.Getwd()
+	if err := os.Chdir("../test"); err != nil {
+		Te.Fatal(err)
+	}
+	defer os.Chdir(original_dir)
+	orca := NewOrcaHandle()
+	orca.SetName("freqorca")
+	nw := NewNWChemHandle()
+	nw.SetName("freqnw")
+	tm := NewTMHandle()
+	tm.SetName("freqtm")
+	xtb := NewXTBHandle()
+	xtb.SetName("freqxtb")
+	freqs := []float64{1641.28, 3800.12, 3900.32}
+	ir := []float64{67.36, 5.21, 48.77}
+	//the x component of the first H in the first mode, normalized.
+	mode0 := -0.43 / math.Sqrt(0.07*0.07+2*(0.43*0.43+0.56*0.56))
+	for _, h := range []FreqReader{orca, nw, tm, xtb} {
+		vib, err := h.Vibrations()
+		if err != nil {
+			Te.Fatalf("%T: %s", h, err.Error())
+		}
+		if len(vib.Freqs) != 3 || len(vib.Modes) != 3 || len(vib.IRIntensities) != 3 {
+			Te.Fatalf("%T: Wrong number of modes: %d %d %d", h, len(vib.Freqs), len(vib.Modes), len(vib.IRIntensities))
+		}
+		for i, v := range freqs {
+			if math.Abs(vib.Freqs[i]-v) > 0.01 || math.Abs(vib.IRIntensities[i]-ir[i]) > 0.01 {
+				Te.Errorf("%T: Wrong frequency or intensity %d: %f %f", h, i, vib.Freqs[i], vib.IRIntensities[i])
+			}
+			if norm := vib.Modes[i].Norm(2); math.Abs(norm-1) > 1e-6 {
+				Te.Errorf("%T: Mode %d not normalized: %f", h, i, norm)
+			}
+		}
+		if m := vib.Modes[0].At(1, 0); math.Abs(m-mode0) > 0.01 {
+			Te.Errorf("%T: Wrong normal mode component: %f instead of %f", h, m, mode0)
+		}
+		if len(vib.Imaginary()) != 0 {
+			Te.Errorf("%T: Spurious imaginary frequencies", h)
+		}
+		hess, err := h.Hessian()
+		if err != nil {
+			Te.Fatalf("%T: %s", h, err.Error())
+		}
+		if r, c := hess.Dims(); r != 9 || c != 9 {
+			Te.Fatalf("%T: Wrong Hessian dimensions: %d %d", h, r, c)
+		}
+		conv := chem.H2Kcal * chem.A2Bohr * chem.A2Bohr
+		if math.Abs(hess.At(2, 5)-0.018*conv) > 0.01 || math.Abs(hess.At(5, 2)-0.018*conv) > 0.01 || math.Abs(hess.At(8, 8)-0.9*conv) > 0.01 {
+			Te.Errorf("%T: Wrong Hessian elements: %f %f %f", h, hess.At(2, 5), hess.At(5, 2), hess.At(8, 8))
+		}
+	}
+	orca.SetName("nonexistent")
+	if _, err := orca.Vibrations(); err == nil {
+		Te.Errorf("No error for missing frequency file")
+	}
+	//aoforce is run after the SCF program, while optimizations only run the SCF program.
+	tm.command = "ridft"
+	tm.jobCommand(&Calc{Job: Job{Freq: true}})
+	if tm.command != "ridft && aoforce" {
+		Te.Errorf("Wrong Turbomole command for a frequency job: %s", tm.command)
+	}
+	tm.command = "ridft"
+	tm.jobCommand(&Calc{Job: Job{Opti: true, Freq: true}})
+	if tm.command != "ridft" {
+		Te.Errorf("Wrong Turbomole command for an optimization: %s", tm.command)
+	}
+}
+
+func TestThermo(Te *testing.T) {
+	water, err := chem.XYZRead(strings.NewReader("3\n\nO 0.0 0.0 -0.067959\nH 0.756950 0.0 0.539328\nH -0.756950 0.0 0.539328\n"))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	water.SetMulti(1)
+	for i, m := range []float64{15.999, 1.008, 1.008} {
+		water.Atom(i).Mass = m
+	}
+	freqs := []float64{1641.28, 3800.12, 3900.32}
+	t, err := RRHO(water.Coords[0], water, freqs, 298.15, 1, 2)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	//Reference values, in cal/(mol K), from the Sackur-Tetrode equation, and the ZPE in kcal/mol.
+	if math.Abs(t.STrans*1000-34.608) > 0.01 {
+		Te.Errorf("Wrong translational entropy: %f", t.STrans*1000)
+	}
+	if zpe := 0.5 * (freqs[0] + freqs[1] + freqs[2]) * 0.0028591; math.Abs(t.ZPE-zpe) > 0.001 {
+		Te.Errorf("Wrong ZPE: %f instead of %f", t.ZPE, zpe)
+	}
+	if t.SRot <= 0 || t.SVib <= 0 || t.SElec != 0 || math.Abs(t.H-t.U-0.59248) > 0.0001 || math.Abs(t.G-(t.H-298.15*t.S)) > 1e-6 {
+		Te.Errorf("Inconsistent thermochemistry: %+v", t)
+	}
+	fmt.Printf("Water RRHO: %+v\n", t)
+	soft := append([]float64{-150, 20}, freqs...)
+	rrho, err := RRHO(water.Coords[0], water, soft, 298.15, 1, 2)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	qrrho, err := QRRHO(water.Coords[0], water, soft, 298.15, 1, 2, 100)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if len(qrrho.Imaginary) != 1 || qrrho.Imaginary[0] != -150 {
+		Te.Errorf("Imaginary frequency not detected: %v", qrrho.Imaginary)
+	}
+	if qrrho.SVib >= rrho.SVib || qrrho.U != rrho.U {
+		Te.Errorf("Wrong quasi-RRHO correction: %f %f", qrrho.SVib, rrho.SVib)
+	}
+	argon, err := chem.XYZRead(strings.NewReader("1\n\nAr 0.0 0.0 0.0\n"))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	argon.SetMulti(1)
+	argon.Atom(0).Mass = 39.948
+	t, err = RRHO(argon.Coords[0], argon, nil, 298.15, 1, 1)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if math.Abs(t.S*1000-36.98) > 0.01 || t.SRot != 0 || math.Abs(t.U-1.5*0.0019872*298.15) > 0.001 {
+		Te.Errorf("Wrong thermochemistry for argon: %+v", t)
+	}
+}
+
+//TestGaussian builds Gaussian inputs, and "runs" them with a stand-in for the Gaussian
+//executable, which just writes a previously prepared output.
+func TestGaussian(Te *testing.T) {
+	mol, err := chem.XYZRead(strings.NewReader("3\n\nO 0.0 0.0 -0.074082\nH 0.756950 0.0 0.537042\nH -0.756950 0.0 0.537042\n"))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	mol.SetCharge(0)
+	mol.SetMulti(1)
+	calc := new(Calc)
+	calc.RI = true
+	calc.Job = Job{Opti: true}
+	calc.Method = "B3LYP"
+	calc.Basis = "def2-SVP"
+	calc.Dispersion = "D3BJ"
+	calc.SCFTightness = 2
+	calc.SCFConvHelp = 1
+	calc.Dielectric = 4
+	calc.Grid = 4
+	calc.Memory = 1000
+	calc.CConstraints = []int{0}
+	calc.IConstraints = []*IConstraint{{CAtoms: []int{0, 1}, Class: 'B', Val: 0.97, UseVal: true}}
+	g16 := NewGaussianHandle()
+	g16.SetName("gochemg16")
+	g16.SetnCPU(4)
+	g16.SetCommand("./fakeg16")
+	original_dir, _ := os.Getwd()
+	if err := os.Chdir("../test"); err != nil {
+		Te.Fatal(err)
+	}
+	defer os.Chdir(original_dir)
+	if err := g16.BuildInput(mol.Coords[0], mol, calc); err != nil {
+		Te.Fatal(err)
+	}
+	input, err := ioutil.ReadFile("gochemg16.gjf")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for _, v := range []string{"%NProcShared=4\n", "%Mem=1000MB\n", "#P B3LYP/def2SVP/Auto EmpiricalDispersion=GD3BJ SCF=(VeryTight,XQC) Integral=(Grid=UltraFine) Opt=(ModRedundant) SCRF=(PCM,Solvent=Generic,Read) NoSymm\n", "\n0 1\nO ", "X 1 F\n", "B 1 2 0.970 F\n", "Eps=4.00\n"} {
+		if !strings.Contains(string(input), v) {
+			Te.Errorf("Gaussian input doesn't contain %q:\n%s", v, input)
+		}
+	}
+	if err := g16.Run(true); err != nil {
+		Te.Fatal(err)
+	}
+	energy, err := g16.Energy()
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if math.Abs(energy-(-76.4089543210*chem.H2Kcal)) > 0.0001 {
+		Te.Errorf("Wrong Gaussian energy: %f", energy)
+	}
+	geo, err := g16.OptimizedGeometry(mol)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if math.Abs(geo.At(0, 2)-(-0.067959)) > 1e-6 || math.Abs(geo.At(2, 0)-(-0.75695)) > 1e-6 {
+		Te.Errorf("Wrong Gaussian optimized geometry: %v", geo)
+	}
+	grad, err := g16.Gradient()
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if math.Abs(grad.At(0, 2)-0.000012*chem.H2Kcal*chem.A2Bohr) > 1e-6 || math.Abs(grad.At(1, 0)-0.000008*chem.H2Kcal*chem.A2Bohr) > 1e-6 {
+		Te.Errorf("Wrong Gaussian gradient: %v", grad)
+	}
+	vib, err := g16.Vibrations()
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if len(vib.Freqs) != 3 || vib.Freqs[2] != 3900.32 || vib.IRIntensities[0] != 67.36 {
+		Te.Errorf("Wrong Gaussian frequencies: %v %v", vib.Freqs, vib.IRIntensities)
+	}
+	hess, err := g16.Hessian()
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if conv := chem.H2Kcal * chem.A2Bohr * chem.A2Bohr; math.Abs(hess.At(2, 5)-0.018*conv) > 0.01 || math.Abs(hess.At(8, 8)-0.9*conv) > 0.01 {
+		Te.Errorf("Wrong Gaussian Hessian elements: %f %f", hess.At(2, 5), hess.At(8, 8))
+	}
+	calc.Job = Job{Freq: true}
+	if err := g16.BuildInput(mol.Coords[0], mol, calc); err != nil {
+		Te.Fatal(err)
+	}
+	input, err = ioutil.ReadFile("gochemg16.gjf")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if !strings.Contains(string(input), " Freq ") || strings.Contains(string(input), "X 1 F") {
+		Te.Errorf("Wrong Gaussian frequency input:\n%s", input)
+	}
+}
+
+//TestPsi4 builds Psi4 inputs and reads previously prepared outputs.
+func TestPsi4(Te *testing.T) {
+	mol, err := chem.XYZRead(strings.NewReader("3\n\nO 0.0 0.0 -0.074082\nH 0.756950 0.0 0.537042\nH -0.756950 0.0 0.537042\n"))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	mol.SetCharge(0)
+	mol.SetMulti(1)
+	calc := new(Calc)
+	calc.RI = true
+	calc.Job = Job{Opti: true}
+	calc.Method = "B3LYP"
+	calc.Basis = "def2-SVP"
+	calc.Dispersion = "D3BJ"
+	calc.SCFTightness = 1
+	calc.Dielectric = 4
+	calc.Memory = 1000
+	calc.CConstraints = []int{0}
+	calc.IConstraints = []*IConstraint{{CAtoms: []int{0, 1}, Class: 'B', Val: 0.97, UseVal: true}, {CAtoms: []int{1, 0, 2}, Class: 'A'}}
+	psi4 := NewPsi4Handle()
+	original_dir, _ := os.Getwd()
+	if err := os.Chdir("../test"); err != nil {
+		Te.Fatal(err)
+	}
+	defer os.Chdir(original_dir)
+	psi4.SetName("gochempsi4")
+	if err := psi4.BuildInput(mol.Coords[0], mol, calc); err != nil {
+		Te.Fatal(err)
+	}
+	input, err := ioutil.ReadFile("gochempsi4.inp")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for _, v := range []string{"memory 1000 mb\n", "molecule gochempsi4 {\n0 1\nO ", "basis def2-svp\n", "scf_type df\n", "e_convergence 1e-8\n", "frozen_cartesian \"1 xyz\"\n", "frozen_bend \"2 1 3\"\n", "fixed_distance \"1 2 0.970\"\n", "Eps = 4.00\n", "optimize('b3lyp-d3bj')\n"} {
+		if !strings.Contains(string(input), v) {
+			Te.Errorf("Psi4 input doesn't contain %q:\n%s", v, input)
+		}
+	}
+	psi4.SetName("psi4opt")
+	energy, err := psi4.Energy()
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if math.Abs(energy-(-76.4089543210*chem.H2Kcal)) > 0.0001 {
+		Te.Errorf("Wrong Psi4 energy: %f", energy)
+	}
+	geo, err := psi4.OptimizedGeometry(mol)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if math.Abs(geo.At(0, 2)-(-0.067959)) > 1e-6 || math.Abs(geo.At(2, 0)-(-0.75695)) > 1e-6 {
+		Te.Errorf("Wrong Psi4 optimized geometry: %v", geo)
+	}
+	grad, err := psi4.Gradient()
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if math.Abs(grad.At(0, 2)-0.000012*chem.H2Kcal*chem.A2Bohr) > 1e-6 || math.Abs(grad.At(1, 0)-0.000008*chem.H2Kcal*chem.A2Bohr) > 1e-6 {
+		Te.Errorf("Wrong Psi4 gradient: %v", grad)
+	}
+}
+
+func TestDFTBPlus(Te *testing.T) {
+	mol, err := chem.XYZRead(strings.NewReader("3\n\nO 0.0 0.0 0.119262\nH 0.0 0.763239 -0.477047\nH 0.0 -0.763239 -0.477047\n"))
+	if err != nil {
+		Te.Fatal(err)
+	}
+	mol.SetCharge(0)
+	mol.SetMulti(1)
+	calc := new(Calc)
+	calc.Job = Job{Opti: true}
+	calc.Method = "DFTB3"
+	calc.Dispersion = "D3BJ"
+	calc.SCFTightness = 1
+	calc.CConstraints = []int{0}
+	dftb := NewDFTBPlusHandle()
+	dftb.SetSKDir("/opt/3ob-3-1")
+	original_dir, _ := os.Getwd()
+	if err := os.Chdir("../test"); err != nil {
+		Te.Fatal(err)
+	}
+	defer os.Chdir(original_dir)
+	dftb.SetName("gochemdftb")
+	if err := dftb.BuildInput(mol.Coords[0], mol, calc); err != nil {
+		Te.Fatal(err)
+	}
+	input, err := ioutil.ReadFile("gochemdftb/dftb_in.hsd")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for _, v := range []string{"<<< \"geo.gen\"", "Driver = GeometryOptimization {", "MovedAtoms = 2 3\n", "SCC = Yes\n", "SCCTolerance = 1e-7\n", "Charge = 0\n", "O = \"p\"\n", "H = \"s\"\n", "ThirdOrderFull = Yes\n", "H = -0.1857\n", "Damping = BeckeJohnson {", "Prefix = \"/opt/3ob-3-1/\"\n"} {
+		if !strings.Contains(string(input), v) {
+			Te.Errorf("DFTB+ input doesn't contain %q:\n%s", v, input)
+		}
+	}
+	if strings.Contains(string(input), "SpinPolarisation") {
+		Te.Errorf("Spin polarisation set for a closed-shell system")
+	}
+	geo, err := chem.GENFileRead("gochemdftb/geo.gen")
+	if err != nil || geo.Len() != 3 {
+		Te.Errorf("Wrong geometry file for DFTB+: %v", err)
+	}
+	//The spin constants are set for open-shell systems.
+	mol.SetCharge(1)
+	mol.SetMulti(2)
+	if err := dftb.BuildInput(mol.Coords[0], mol, calc); err != nil {
+		Te.Fatal(err)
+	}
+	input, err = ioutil.ReadFile("gochemdftb/dftb_in.hsd")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for _, v := range []string{"UnpairedElectrons = 1\n", "SpinConstants {\n      ShellResolvedSpin = No\n      O = {-0.0280}\n"} {
+		if !strings.Contains(string(input), v) {
+			Te.Errorf("DFTB+ input doesn't contain %q:\n%s", v, input)
+		}
+	}
+	//Optimizations with all atoms frozen, frequencies and internal constraints are not supported.
+	calc.CConstraints = []int{0, 1, 2}
+	if err := dftb.BuildInput(mol.Coords[0], mol, calc); err == nil {
+		Te.Errorf("No error for a DFTB+ optimization with all atoms frozen")
+	}
+	calc.CConstraints = nil
+	calc.Job = Job{Freq: true}
+	if err := dftb.BuildInput(mol.Coords[0], mol, calc); err == nil {
+		Te.Errorf("No error for a DFTB+ frequency calculation")
+	}
+	calc.Job = Job{Opti: true}
+	calc.IConstraints = []*IConstraint{{CAtoms: []int{0, 1}, Class: 'B'}}
+	if err := dftb.BuildInput(mol.Coords[0], mol, calc); err == nil {
+		Te.Errorf("No error for internal constraints in DFTB+")
+	}
+	dftb.SetName("dftbcanned")
+	energy, err := dftb.Energy()
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if math.Abs(energy-(-3.8760147622*chem.H2Kcal)) > 0.0001 {
+		Te.Errorf("Wrong DFTB+ energy: %f", energy)
+	}
+	opt, err := dftb.OptimizedGeometry(mol)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if math.Abs(opt.At(1, 1)-0.763239) > 1e-6 {
+		Te.Errorf("Wrong DFTB+ optimized geometry: %v", opt)
+	}
+	grad, err := dftb.Gradient()
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if grad.NVecs() != 3 || math.Abs(grad.At(0, 2)-(-0.000048325719*chem.H2Kcal*chem.A2Bohr)) > 1e-6 {
+		Te.Errorf("Wrong DFTB+ gradient: %v", grad)
+	}
+}
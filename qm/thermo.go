@@ -0,0 +1,205 @@
+/*
+ * thermo.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package qm
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/rmera/gochem"
+	"github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/mat"
+)
+
+//Physical constants, in SI units, for the thermochemistry.
+const (
+	planck    = 6.62607015e-34 //J s
+	boltzmann = 1.380649e-23   //J/K
+	avogadro  = 6.02214076e23  //1/mol
+	lightC    = 2.99792458e10  //cm/s, so h*c*freq is an energy if freq is in cm-1
+	amu2kg    = 1.66053906660e-27
+	atm2Pa    = 101325.0
+	gasR      = boltzmann * avogadro / 4184.0 //kcal/(mol K)
+)
+
+//Bav is the average moment of inertia, in kg m^2, used to limit the moments of inertia
+//of the free rotors in the quasi-RRHO approximation.
+const qrrhoBav = 1e-44
+
+//Thermo contains the thermochemical corrections for a molecule, obtained from its frequencies in
+//the ideal gas/rigid rotor/harmonic oscillator approximation (or the quasi-RRHO approximation).
+//The energies are corrections to be added to the electronic energy, in kcal/mol. The entropies are in kcal/(mol K).
+type Thermo struct {
+	T         float64   //Temperature, K.
+	P         float64   //Pressure, atm.
+	ZPE       float64   //Zero-point energy.
+	U         float64   //Thermal correction to the internal energy, including the ZPE.
+	H         float64   //Thermal correction to the enthalpy.
+	G         float64   //Thermal correction to the Gibbs free energy.
+	S         float64   //Total entropy.
+	STrans    float64   //Translational entropy.
+	SRot      float64   //Rotational entropy.
+	SVib      float64   //Vibrational entropy.
+	SElec     float64   //Electronic entropy, from the multiplicity.
+	Imaginary []float64 //Imaginary frequencies (as negative numbers), which are not included in the vibrational terms.
+}
+
+//RRHO returns the thermochemical corrections at temperature T (K) and pressure P (atm) for the molecule with the given
+//coordinates (A) and atoms, and the vibrational frequencies freqs, in cm-1, such as those in Vibrations.Freqs.
+//The translations and rotations must not be included in freqs. symmetry is the rotational symmetry number
+//(1 if there is no symmetry). The masses of the atoms must be set.
+func RRHO(coords *v3.Matrix, atoms chem.AtomMultiCharger, freqs []float64, T, P float64, symmetry int) (*Thermo, error) {
+	t, err := thermo(coords, atoms, freqs, T, P, symmetry, 0)
+	if err != nil {
+		return nil, errDecorate(err, "RRHO")
+	}
+	return t, nil
+}
+
+//QRRHO is like RRHO, but uses the quasi-RRHO approximation by Grimme (Chem. Eur. J. 2012, 18, 9955) for the vibrational
+//entropy. The entropy of the modes with frequencies close to or below cutoff (cm-1) is interpolated towards that of a free
+//rotor, so the low frequencies, which are often not well described as harmonic, don't dominate the entropy.
+//A cutoff of 100 cm-1 is usually employed. The energies are the same as in RRHO.
+func QRRHO(coords *v3.Matrix, atoms chem.AtomMultiCharger, freqs []float64, T, P float64, symmetry int, cutoff float64) (*Thermo, error) {
+	if cutoff <= 0 {
+		return nil, Error{"goChem/QM: The cutoff must be positive", "", "", fmt.Sprintf("cutoff: %5.3f", cutoff), []string{"QRRHO"}, true}
+	}
+	t, err := thermo(coords, atoms, freqs, T, P, symmetry, cutoff)
+	if err != nil {
+		return nil, errDecorate(err, "QRRHO")
+	}
+	return t, nil
+}
+
+//thermo does the actual work for RRHO and QRRHO. A cutoff of 0 means that no quasi-RRHO interpolation is done.
+func thermo(coords *v3.Matrix, atoms chem.AtomMultiCharger, freqs []float64, T, P float64, symmetry int, cutoff float64) (*Thermo, error) {
+	if T <= 0 || P <= 0 || symmetry < 1 {
+		return nil, Error{"goChem/QM: Wrong thermochemistry parameters", "", "", fmt.Sprintf("T: %5.3f, P: %5.3f, symmetry: %d", T, P, symmetry), []string{"thermo"}, true}
+	}
+	if coords.NVecs() != atoms.Len() {
+		return nil, Error{"goChem/QM: Mismatched number of atoms and coordinates", "", "", "", []string{"thermo"}, true}
+	}
+	masses := make([]float64, atoms.Len())
+	totalmass := 0.0
+	for i := range masses {
+		masses[i] = atoms.Atom(i).Mass
+		if masses[i] <= 0 {
+			return nil, Error{"goChem/QM: Atom with no mass", "", "", fmt.Sprintf("atom %d", i), []string{"thermo"}, true}
+		}
+		totalmass += masses[i]
+	}
+	t := &Thermo{T: T, P: P}
+	kT := boltzmann * T
+	RT := gasR * T
+
+	//translation
+	m := totalmass * amu2kg
+	qtrans := math.Pow(2*math.Pi*m*kT/(planck*planck), 1.5) * kT / (P * atm2Pa)
+	t.STrans = gasR * (math.Log(qtrans) + 2.5)
+	t.U = 1.5 * RT
+
+	//rotation
+	inertia, err := principalMoments(coords, masses)
+	if err != nil {
+		return nil, errDecorate(err, "thermo")
+	}
+	const linearcutoff = 1e-3 //amu A^2
+	//the rotational temperature, in K, for a moment of inertia in amu A^2.
+	rotconst := func(I float64) float64 {
+		return planck * planck / (8 * math.Pi * math.Pi * I * amu2kg * 1e-20 * boltzmann)
+	}
+	switch {
+	case inertia[2] < linearcutoff: //a single atom
+	case inertia[0] < linearcutoff:
+		t.SRot = gasR * (math.Log(T/(float64(symmetry)*rotconst(inertia[2]))) + 1)
+		t.U += RT
+	default:
+		qrot := math.Sqrt(math.Pi) / float64(symmetry) * math.Pow(T, 1.5) / math.Sqrt(rotconst(inertia[0])*rotconst(inertia[1])*rotconst(inertia[2]))
+		t.SRot = gasR * (math.Log(qrot) + 1.5)
+		t.U += 1.5 * RT
+	}
+
+	//vibration
+	for _, v := range freqs {
+		if v < 0 {
+			t.Imaginary = append(t.Imaginary, v)
+			continue
+		}
+		if v == 0 {
+			continue
+		}
+		theta := planck * lightC * v / boltzmann //K
+		x := theta / T
+		t.ZPE += gasR * theta / 2
+		t.U += gasR * theta * (0.5 + 1/math.Expm1(x))
+		svib := gasR * (x/math.Expm1(x) - math.Log(-math.Expm1(-x)))
+		if cutoff > 0 {
+			//Grimme's interpolation between the harmonic oscillator and a free rotor with the same frequency.
+			mu := planck / (8 * math.Pi * math.Pi * lightC * v)
+			mu = mu * qrrhoBav / (mu + qrrhoBav)
+			srot := gasR * (0.5 + math.Log(math.Sqrt(8*math.Pi*math.Pi*math.Pi*mu*kT/(planck*planck))))
+			w := 1 / (1 + math.Pow(cutoff/v, 4))
+			svib = w*svib + (1-w)*srot
+		}
+		t.SVib += svib
+	}
+
+	//electronic
+	t.SElec = gasR * math.Log(float64(atoms.Multi()))
+
+	t.S = t.STrans + t.SRot + t.SVib + t.SElec
+	t.H = t.U + RT
+	t.G = t.H - T*t.S
+	return t, nil
+}
+
+//principalMoments returns the principal moments of inertia, in amu A^2 and in increasing order, for
+//the coordinates coords (A) and masses (amu).
+func principalMoments(coords *v3.Matrix, masses []float64) ([]float64, error) {
+	moment, err := chem.MomentTensor(coords, masses)
+	if err != nil {
+		return nil, errDecorate(err, "principalMoments")
+	}
+	//The moment tensor is sum(m*r*r^T), so the inertia tensor is trace(moment)*I-moment.
+	trace := moment.At(0, 0) + moment.At(1, 1) + moment.At(2, 2)
+	inertia := mat.NewSymDense(3, nil)
+	for i := 0; i < 3; i++ {
+		for j := i; j < 3; j++ {
+			v := -moment.At(i, j)
+			if i == j {
+				v += trace
+			}
+			inertia.SetSym(i, j, v)
+		}
+	}
+	var eigen mat.EigenSym
+	if ok := eigen.Factorize(inertia, false); !ok {
+		return nil, Error{"goChem/QM: Couldn't diagonalize the inertia tensor", "", "", "", []string{"mat.EigenSym.Factorize", "principalMoments"}, true}
+	}
+	return eigen.Values(nil), nil //gonum returns them in ascending order.
+}
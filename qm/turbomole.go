@@ -45,6 +45,7 @@ import (
 
 	"github.com/rmera/gochem"
 	"github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/mat"
 )
 
 //This imlpementation supports only singlets and doublets.
@@ -388,6 +389,7 @@ func (O *TMHandle) BuildInput(coords *v3.Matrix, atoms chem.AtomMultiCharger, Q
 			O.command = O.command + " -c 200"
 		}
 	}
+	O.jobCommand(Q)
 	//Now modify control
 	args := make([]string, 1, 2)
 	args[0], ok = tMDisp[Q.Dispersion]
@@ -411,6 +413,27 @@ func (O *TMHandle) BuildInput(coords *v3.Matrix, atoms chem.AtomMultiCharger, Q
 	return nil
 }
 
+//jobCommand adds to the command the programs needed for the job in Q, after the SCF program
+//(dscf or ridft) which must already be in O.command. Optimizations are not set here, so they
+//run only the SCF program, as before.
+func (O *TMHandle) jobCommand(Q *Calc) {
+	jc := jobChoose{}
+	jc.opti = func() {}
+	jc.freq = func() {
+		//aoforce needs converged orbitals, so the SCF (dscf or ridft) is run first.
+		O.command = O.command + " && aoforce"
+	}
+	jc.forces = func() {
+		//grad goes after dscf, and rdgrad after ridft.
+		if strings.HasPrefix(O.command, "ridft") {
+			O.command = O.command + " && rdgrad"
+		} else {
+			O.command = O.command + " && grad"
+		}
+	}
+	Q.Job.Do(jc)
+}
+
 var tMMethods = map[string]string{
 	"HF":     "hf",
 	"hf":     "hf",
@@ -444,9 +467,14 @@ var tMDisp = map[string]string{
 func (O *TMHandle) Run(wait bool) (err error) {
 	os.Chdir(O.inputname)
 	defer os.Chdir("..")
-	filename := strings.Fields(O.command)
-	//fmt.Println("nohup " + O.command + " > " + filename[0] + ".out")
-	command := exec.Command("sh", "-c", "nohup "+O.command+" >"+filename[0]+".out")
+	//The command can be several programs, separated by &&. The output of each goes to a file named after it.
+	commands := strings.Split(O.command, "&&")
+	for i, v := range commands {
+		filename := strings.Fields(v)
+		commands[i] = "nohup " + strings.TrimSpace(v) + " >" + filename[0] + ".out"
+	}
+	//fmt.Println(strings.Join(commands, " && "))
+	command := exec.Command("sh", "-c", strings.Join(commands, " && "))
 	if wait == true {
 		err = command.Run()
 	} else {
@@ -503,6 +531,108 @@ func (O *TMHandle) OptimizedGeometry(atoms chem.Atomer) (*v3.Matrix, error) {
 
 }
 
+//Gradient returns the gradient of the last cycle in the gradient file of the calculation, in kcal/(mol A).
+//The gradient file is written by jobex optimizations, and by grad or rdgrad, which are run for Forces jobs.
+func (O *TMHandle) Gradient() (*v3.Matrix, error) {
+	os.Chdir(O.inputname)
+	defer os.Chdir("..")
+	f, err := os.Open("gradient")
+	if err != nil {
+		return nil, Error{ErrNoGradient, Turbomole, O.inputname, err.Error(), []string{"os.Open", "Gradient"}, true}
+	}
+	defer f.Close()
+	grad, err := tmGradient(bufio.NewReader(f))
+	if err != nil {
+		return nil, Error{ErrNoGradient, Turbomole, O.inputname, err.Error(), []string{"tmGradient", "Gradient"}, true}
+	}
+	return grad, nil
+}
+
+//Vibrations returns the frequencies, normal modes and IR intensities from a previous aoforce calculation,
+//read from the vibspectrum and vib_normal_modes files. Only the vibrational modes are returned.
+func (O *TMHandle) Vibrations() (*Vibrations, error) {
+	os.Chdir(O.inputname)
+	defer os.Chdir("..")
+	f, err := os.Open("vibspectrum")
+	if err != nil {
+		return nil, Error{ErrNoFreq, Turbomole, O.inputname, err.Error(), []string{"os.Open", "Vibrations"}, true}
+	}
+	defer f.Close()
+	freqs, ir, err := tmVibSpectrum(bufio.NewReader(f))
+	if err != nil {
+		return nil, Error{ErrNoFreq, Turbomole, O.inputname, err.Error(), []string{"tmVibSpectrum", "Vibrations"}, true}
+	}
+	data, err := tmSectionFile("vib_normal_modes", "$vibrational normal modes")
+	if err != nil {
+		return nil, Error{ErrNoFreq, Turbomole, O.inputname, err.Error(), []string{"tmSectionFile", "Vibrations"}, true}
+	}
+	if len(data) != len(freqs)*len(freqs) {
+		return nil, Error{ErrNoFreq, Turbomole, O.inputname, "Wrong number of normal mode components", []string{"Vibrations"}, true}
+	}
+	vib, err := newVibrations(freqs, columns(data, len(freqs)), ir)
+	if err != nil {
+		return nil, Error{ErrNoFreq, Turbomole, O.inputname, err.Error(), []string{"newVibrations", "Vibrations"}, true}
+	}
+	return vib, nil
+}
+
+//Hessian returns the cartesian Hessian, in kcal/(mol A^2), from the hessian file of a previous aoforce calculation.
+func (O *TMHandle) Hessian() (*mat.Dense, error) {
+	os.Chdir(O.inputname)
+	defer os.Chdir("..")
+	data, err := tmSectionFile("hessian", "$hessian")
+	if err != nil {
+		return nil, Error{ErrNoFreq, Turbomole, O.inputname, err.Error(), []string{"tmSectionFile", "Hessian"}, true}
+	}
+	hess, err := hessianFromAU(data)
+	if err != nil {
+		return nil, Error{ErrNoFreq, Turbomole, O.inputname, err.Error(), []string{"hessianFromAU", "Hessian"}, true}
+	}
+	return hess, nil
+}
+
+//tmGradient reads the gradient of the last cycle in a Turbomole-formatted gradient file, and
+//returns it in kcal/(mol A). Each cycle has a line with the energy, then one line with the coordinates and
+//the element for each atom, and one line with the gradient, with Fortran-style exponents, for each atom.
+//xtb writes its gradients in the same format.
+func tmGradient(f *bufio.Reader) (*v3.Matrix, error) {
+	var grad, current []float64
+	for {
+		line, err := f.ReadString('\n')
+		fields := strings.Fields(line)
+		switch {
+		case strings.Contains(line, "cycle ="), strings.HasPrefix(strings.TrimSpace(line), "$"):
+			if len(current) > 0 {
+				grad = current
+			}
+			current = nil
+		case len(fields) == 3:
+			for _, v := range fields {
+				g, err := strconv.ParseFloat(strings.Replace(strings.ToUpper(v), "D", "E", 1), 64)
+				if err != nil {
+					return nil, err
+				}
+				current = append(current, g)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(current) > 0 {
+		grad = current
+	}
+	if len(grad) == 0 {
+		return nil, fmt.Errorf("No gradient found")
+	}
+	ret, err := v3.NewMatrix(grad)
+	if err != nil {
+		return nil, err
+	}
+	ret.Scale(chem.H2Kcal*chem.A2Bohr, ret)
+	return ret, nil
+}
+
 //Gets the second to last line in a turbomole energy file given as a bufio.Reader.
 //expensive on the CPU but rather easy on the memory, as the file is read line by line.
 func getSecondToLastLine(f *bufio.Reader) (string, error) {
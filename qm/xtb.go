@@ -36,6 +36,7 @@ import (
 	"fmt"
 	"github.com/rmera/gochem"
 	"github.com/rmera/gochem/v3"
+	"gonum.org/v1/gonum/mat"
 	"os"
 	"os/exec"
 	"runtime"
@@ -120,6 +121,12 @@ func (O *XTBHandle) BuildInput(coords *v3.Matrix, atoms chem.AtomMultiCharger, Q
 	jc.opti = func() {
 		O.options = append(O.options, "-opt")
 	}
+	jc.freq = func() {
+		O.options = append(O.options, "-hess")
+	}
+	jc.forces = func() {
+		O.options = append(O.options, "-grad")
+	}
 	jc.sp = func() {
 		O.options = append(O.options, "-sp")
 	}
@@ -253,3 +260,67 @@ func (O *XTBHandle) Energy() (float64, error) {
 
 	return energy * chem.H2Kcal, err //dummy thin
 }
+
+//Gradient reads the gradient of a previous XTB calculation, in kcal/(mol A). The gradient is only written for
+//gradient calculations. As with the energy, the file has always the same name, so trying to run several calculations
+//in parallel in the same directory will fail. Returns the gradient AND error ("Probable problem in calculation")
+//if the calculation didn't end normally.
+func (O *XTBHandle) Gradient() (*v3.Matrix, error) {
+	var err error
+	if !O.normalTermination() {
+		err = Error{ErrProbableProblem, XTB, O.inputname, "", []string{"Gradient"}, false}
+	}
+	file, err1 := os.Open("gradient")
+	if err1 != nil {
+		return nil, Error{ErrNoGradient, XTB, O.inputname, err1.Error(), []string{"os.Open", "Gradient"}, true}
+	}
+	defer file.Close()
+	grad, err1 := tmGradient(bufio.NewReader(file))
+	if err1 != nil {
+		return nil, Error{ErrNoGradient, XTB, O.inputname, err1.Error(), []string{"tmGradient", "Gradient"}, true}
+	}
+	return grad, err
+}
+
+//Vibrations reads the frequencies, normal modes and IR intensities of a previous XTB Hessian calculation from the
+//g98.out file that XTB writes in the current directory. As with the energy, the file has always the same name, so
+//trying to run several calculations in parallel in the same directory will fail. Returns the vibrations AND
+//error ("Probable problem in calculation") if the calculation didn't end normally.
+func (O *XTBHandle) Vibrations() (*Vibrations, error) {
+	var err error
+	if !O.normalTermination() {
+		err = Error{ErrProbableProblem, XTB, O.inputname, "", []string{"Vibrations"}, false}
+	}
+	file, err1 := os.Open("g98.out")
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, XTB, O.inputname, err1.Error(), []string{"os.Open", "Vibrations"}, true}
+	}
+	defer file.Close()
+	freqs, ir, modes, err1 := gaussianFreqs(bufio.NewReader(file))
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, XTB, O.inputname, err1.Error(), []string{"gaussianFreqs", "Vibrations"}, true}
+	}
+	vib, err1 := newVibrations(freqs, modes, ir)
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, XTB, O.inputname, err1.Error(), []string{"newVibrations", "Vibrations"}, true}
+	}
+	return vib, err
+}
+
+//Hessian reads the cartesian Hessian of a previous XTB Hessian calculation, in kcal/(mol A^2), from the hessian file
+//in the current directory. The same caveats as for Vibrations apply.
+func (O *XTBHandle) Hessian() (*mat.Dense, error) {
+	var err error
+	if !O.normalTermination() {
+		err = Error{ErrProbableProblem, XTB, O.inputname, "", []string{"Hessian"}, false}
+	}
+	data, err1 := tmSectionFile("hessian", "$hessian")
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, XTB, O.inputname, err1.Error(), []string{"tmSectionFile", "Hessian"}, true}
+	}
+	hess, err1 := hessianFromAU(data)
+	if err1 != nil {
+		return nil, Error{ErrNoFreq, XTB, O.inputname, err1.Error(), []string{"hessianFromAU", "Hessian"}, true}
+	}
+	return hess, err
+}
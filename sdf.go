@@ -0,0 +1,467 @@
+/*
+ * sdf.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/gochem/v3"
+)
+
+//sdfNameKey is the key of the data maps used for the name (first line) of an SD record.
+const sdfNameKey = "_Name"
+
+//SDFFileRead reads all the records of an MDL SD file, or a MOL file, which is read as an SD file with a single record.
+//See SDFRead for details.
+func SDFFileRead(sdfname string) ([]*Molecule, []map[string]string, error) {
+	sdffile, err := OpenFile(sdfname)
+	if err != nil {
+		return nil, nil, errDecorate(err, "SDFFileRead")
+	}
+	defer sdffile.Close()
+	mols, data, err := SDFRead(sdffile)
+	if err != nil {
+		return nil, nil, errDecorate(err, "SDFFileRead "+fmt.Sprintf("error in file %s", sdfname))
+	}
+	return mols, data, nil
+}
+
+//SDFRead reads all the records in the MDL SD data from sdfp, which can be in the V2000 or V3000 formats.
+//It returns a molecule, with its bonds, and a map with the data items for each record. The
+//name of each record (the first line) is included in the map with the key "_Name". The formal
+//charges are put in the Charge field of each atom, and their sum is used as the charge of the
+//molecule. Aromatic bonds have an order of 1.5. Returns error or nil.
+func SDFRead(sdfp io.Reader) ([]*Molecule, []map[string]string, error) {
+	sdf := bufio.NewReader(sdfp)
+	mols := make([]*Molecule, 0, 1)
+	data := make([]map[string]string, 0, 1)
+	for {
+		mol, d, err := sdfReadRecord(sdf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, errDecorate(err, fmt.Sprintf("SDFRead: record %d", len(mols)+1))
+		}
+		mols = append(mols, mol)
+		data = append(data, d)
+	}
+	if len(mols) == 0 {
+		return nil, nil, CError{"No records in SD file", []string{"SDFRead"}}
+	}
+	return mols, data, nil
+}
+
+//sdfReadRecord reads a record from an SD file. It returns io.EOF if there are no more records.
+func sdfReadRecord(sdf *bufio.Reader) (*Molecule, map[string]string, error) {
+	header := make([]string, 4, 4)
+	for i := range header {
+		line, err := sdf.ReadString('\n')
+		if err != nil && (line == "" || i < 3) {
+			if i == 0 && err == io.EOF && strings.TrimSpace(line) == "" {
+				return nil, nil, io.EOF
+			}
+			return nil, nil, CError{"Incomplete header in SD record", []string{"bufio.Reader.ReadString", "sdfReadRecord"}}
+		}
+		header[i] = strings.TrimRight(line, "\r\n")
+	}
+	data := map[string]string{sdfNameKey: strings.TrimSpace(header[0])}
+	var atoms []*Atom
+	var coords []float64
+	var bonds []*Bond
+	var err error
+	if strings.Contains(header[3], "V3000") {
+		atoms, coords, bonds, err = sdfReadV3000(sdf)
+	} else {
+		atoms, coords, bonds, err = sdfReadV2000(sdf, header[3])
+	}
+	if err != nil {
+		return nil, nil, errDecorate(err, "sdfReadRecord")
+	}
+	if err := sdfReadData(sdf, data); err != nil {
+		return nil, nil, errDecorate(err, "sdfReadRecord")
+	}
+	charge := 0.0
+	for i, at := range atoms {
+		at.ID = i + 1
+		at.Name = at.Symbol
+		at.Molname = "UNK"
+		at.MolID = 1
+		at.Mass = symbolMass[at.Symbol]
+		charge += at.Charge
+	}
+	mcoords, err := v3.NewMatrix(coords)
+	if err != nil {
+		return nil, nil, errDecorate(err, "sdfReadRecord")
+	}
+	top := NewTopology(int(charge), 1, atoms)
+	top.SetBonds(bonds)
+	mol, err := NewMolecule([]*v3.Matrix{mcoords}, top, nil)
+	if err != nil {
+		return nil, nil, errDecorate(err, "sdfReadRecord")
+	}
+	return mol, data, nil
+}
+
+//sdfV2000Charges maps the charge codes of the atom block of V2000 files to charges.
+var sdfV2000Charges = map[int]float64{1: 3, 2: 2, 3: 1, 4: 0, 5: -1, 6: -2, 7: -3}
+
+//sdfReadV2000 reads the atom, bond and properties blocks of a V2000 record, up to the "M  END" line.
+//counts is the counts line of the record.
+func sdfReadV2000(sdf *bufio.Reader, counts string) ([]*Atom, []float64, []*Bond, error) {
+	if len(counts) < 6 {
+		return nil, nil, nil, CError{"Wrong counts line in V2000 record", []string{"sdfReadV2000"}}
+	}
+	natoms, err1 := strconv.Atoi(strings.TrimSpace(counts[0:3]))
+	nbonds, err2 := strconv.Atoi(strings.TrimSpace(counts[3:6]))
+	if err1 != nil || err2 != nil {
+		return nil, nil, nil, CError{"Wrong counts line in V2000 record", []string{"strconv.Atoi", "sdfReadV2000"}}
+	}
+	if natoms < 0 || nbonds < 0 {
+		return nil, nil, nil, CError{"Negative number of atoms or bonds in V2000 record", []string{"sdfReadV2000"}}
+	}
+	atoms := make([]*Atom, natoms, natoms)
+	coords := make([]float64, natoms*3, natoms*3)
+	bonds := make([]*Bond, 0, nbonds)
+	chgprop := false //charges in "M  CHG" lines replace those in the atom block.
+	for i := 0; ; i++ {
+		line, err := sdf.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, nil, nil, CError{"V2000 record ended before the M  END line", []string{"bufio.Reader.ReadString", "sdfReadV2000"}}
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case i < natoms:
+			if len(line) < 34 {
+				return nil, nil, nil, CError{fmt.Sprintf("Atom line %d too short", i+1), []string{"sdfReadV2000"}}
+			}
+			at := new(Atom)
+			for j := 0; j < 3; j++ {
+				coords[i*3+j], err = strconv.ParseFloat(strings.TrimSpace(line[j*10:j*10+10]), 64)
+				if err != nil {
+					return nil, nil, nil, CError{err.Error(), []string{"strconv.ParseFloat", "sdfReadV2000"}}
+				}
+			}
+			at.Symbol = strings.TrimSpace(line[31:34])
+			if len(line) >= 39 {
+				code, _ := strconv.Atoi(strings.TrimSpace(line[36:39]))
+				at.Charge = sdfV2000Charges[code]
+			}
+			atoms[i] = at
+		case i < natoms+nbonds:
+			if len(line) < 9 {
+				return nil, nil, nil, CError{fmt.Sprintf("Bond line %d too short", i-natoms+1), []string{"sdfReadV2000"}}
+			}
+			var b [3]int
+			for j := range b {
+				b[j], err = strconv.Atoi(strings.TrimSpace(line[j*3 : j*3+3]))
+				if err != nil {
+					return nil, nil, nil, CError{err.Error(), []string{"strconv.Atoi", "sdfReadV2000"}}
+				}
+			}
+			bond, err := sdfBond(b[0], b[1], b[2], natoms)
+			if err != nil {
+				return nil, nil, nil, errDecorate(err, "sdfReadV2000")
+			}
+			bonds = append(bonds, bond)
+		case strings.HasPrefix(line, "M  END"):
+			return atoms, coords, bonds, nil
+		case strings.HasPrefix(line, "M  CHG"):
+			if !chgprop {
+				for _, at := range atoms {
+					at.Charge = 0
+				}
+				chgprop = true
+			}
+			fields := strings.Fields(line)
+			for j := 3; j+1 < len(fields); j += 2 {
+				a, err1 := strconv.Atoi(fields[j])
+				c, err2 := strconv.Atoi(fields[j+1])
+				if err1 != nil || err2 != nil || a < 1 || a > natoms {
+					return nil, nil, nil, CError{"Wrong M  CHG line: " + line, []string{"sdfReadV2000"}}
+				}
+				atoms[a-1].Charge = float64(c)
+			}
+		}
+	}
+}
+
+//sdfReadV3000 reads the CTAB block of a V3000 record, up to the "M  END" line.
+func sdfReadV3000(sdf *bufio.Reader) ([]*Atom, []float64, []*Bond, error) {
+	var atoms []*Atom
+	var coords []float64
+	var bonds []*Bond
+	block := ""
+	logical := "" //V3000 lines ending with "-" continue in the next line
+	for {
+		line, err := sdf.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, nil, nil, CError{"V3000 record ended before the M  END line", []string{"bufio.Reader.ReadString", "sdfReadV3000"}}
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "M  END") {
+			break
+		}
+		if !strings.HasPrefix(line, "M  V30 ") {
+			continue
+		}
+		logical += line[len("M  V30 "):]
+		if strings.HasSuffix(logical, "-") {
+			logical = logical[:len(logical)-1]
+			continue
+		}
+		fields := strings.Fields(logical)
+		logical = ""
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case fields[0] == "BEGIN" && len(fields) > 1:
+			block = fields[1]
+		case fields[0] == "END":
+			block = ""
+		case block == "ATOM":
+			if len(fields) < 5 {
+				return nil, nil, nil, CError{"Wrong V3000 atom line", []string{"sdfReadV3000"}}
+			}
+			at := new(Atom)
+			at.Symbol = fields[1]
+			for j := 2; j < 5; j++ {
+				c, err := strconv.ParseFloat(fields[j], 64)
+				if err != nil {
+					return nil, nil, nil, CError{err.Error(), []string{"strconv.ParseFloat", "sdfReadV3000"}}
+				}
+				coords = append(coords, c)
+			}
+			for _, f := range fields[5:] {
+				if strings.HasPrefix(f, "CHG=") {
+					c, err := strconv.Atoi(f[len("CHG="):])
+					if err != nil {
+						return nil, nil, nil, CError{err.Error(), []string{"strconv.Atoi", "sdfReadV3000"}}
+					}
+					at.Charge = float64(c)
+				}
+			}
+			atoms = append(atoms, at)
+		case block == "BOND":
+			if len(fields) < 4 {
+				return nil, nil, nil, CError{"Wrong V3000 bond line", []string{"sdfReadV3000"}}
+			}
+			var b [3]int
+			for j := range b {
+				b[j], err = strconv.Atoi(fields[j+1])
+				if err != nil {
+					return nil, nil, nil, CError{err.Error(), []string{"strconv.Atoi", "sdfReadV3000"}}
+				}
+			}
+			bond, err := sdfBond(b[1], b[2], b[0], len(atoms))
+			if err != nil {
+				return nil, nil, nil, errDecorate(err, "sdfReadV3000")
+			}
+			bonds = append(bonds, bond)
+		}
+	}
+	return atoms, coords, bonds, nil
+}
+
+//sdfBond returns a bond between the 1-based atoms a1 and a2, with the MDL bond type btype.
+//Aromatic bonds have an order of 1.5, query bond types an order of 0.
+func sdfBond(a1, a2, btype, natoms int) (*Bond, error) {
+	if a1 < 1 || a2 < 1 || a1 > natoms || a2 > natoms {
+		return nil, CError{fmt.Sprintf("Bond between atoms %d and %d out of range", a1, a2), []string{"sdfBond"}}
+	}
+	order := float64(btype)
+	if btype == 4 {
+		order = 1.5
+	} else if btype > 4 || btype < 0 {
+		order = 0
+	}
+	return &Bond{At1: a1 - 1, At2: a2 - 1, Order: order}, nil
+}
+
+//sdfReadData reads the data items of an SD record, up to the "$$$$" line or the end of the file,
+//and puts them in data.
+func sdfReadData(sdf *bufio.Reader, data map[string]string) error {
+	key := ""
+	var value []string
+	for {
+		line, err := sdf.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return CError{err.Error(), []string{"bufio.Reader.ReadString", "sdfReadData"}}
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "$$$$") || (err == io.EOF && line == "") {
+			break
+		}
+		switch {
+		case key == "" && strings.HasPrefix(line, ">"):
+			start := strings.Index(line, "<")
+			end := strings.Index(line[start+1:], ">") + start + 1
+			if start > 0 && end > start+1 {
+				key = line[start+1 : end]
+				value = value[:0]
+			}
+		case key != "" && strings.TrimSpace(line) == "":
+			data[key] = strings.Join(value, "\n")
+			key = ""
+		case key != "":
+			value = append(value, line)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if key != "" {
+		data[key] = strings.Join(value, "\n")
+	}
+	return nil
+}
+
+//SDFFileWrite writes a single SD record with the atoms of mol, the coordinates coords and the data items
+//in data to the file sdfname, which will be overwritten if it exists. See SDFWrite for details.
+func SDFFileWrite(sdfname string, coords *v3.Matrix, mol Atomer, data map[string]string) error {
+	out, err := CreateFile(sdfname)
+	if err != nil {
+		return errDecorate(err, "SDFFileWrite")
+	}
+	err = SDFWrite(out, coords, mol, data)
+	if err != nil {
+		out.Close()
+		return errDecorate(err, "SDFFileWrite")
+	}
+	return errDecorate(out.Close(), "SDFFileWrite")
+}
+
+//SDFWrite writes an SD record with the atoms of mol, the coordinates coords and the data items in data
+//(which can be nil) to out. The value for the "_Name" key of data, if any, is used as the name of the record.
+//Multi-record files can be written by calling SDFWrite several times on the same io.Writer.
+//The V2000 format is used unless there are more than 999 atoms or bonds. If mol is a Bonder, its bonds
+//are written. The Charge of the atoms is written as formal charge if it is an integer.
+func SDFWrite(out io.Writer, coords *v3.Matrix, mol Atomer, data map[string]string) error {
+	if coords.NVecs() != mol.Len() {
+		return CError{"Ref and Coords dont have the same number of atoms", []string{"SDFWrite"}}
+	}
+	var bonds []*Bond
+	if b, ok := mol.(Bonder); ok {
+		bonds = b.Bonds()
+	}
+	charges := make([]int, mol.Len())
+	for i := range charges {
+		if c := mol.Atom(i).Charge; c == math.Trunc(c) {
+			charges[i] = int(c)
+		}
+	}
+	w := bufio.NewWriter(out)
+	name := strings.Replace(data[sdfNameKey], "\n", " ", -1)
+	fmt.Fprintf(w, "%s\n  gochem          3D\n\n", name)
+	if mol.Len() > 999 || len(bonds) > 999 {
+		sdfWriteV3000(w, coords, mol, bonds, charges)
+	} else {
+		sdfWriteV2000(w, coords, mol, bonds, charges)
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		if k != sdfNameKey {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, ">  <%s>\n%s\n\n", k, data[k])
+	}
+	w.WriteString("$$$$\n")
+	if err := w.Flush(); err != nil {
+		return CError{"Failed to write in io.Writer" + err.Error(), []string{"io.Writer.Write", "SDFWrite"}}
+	}
+	return nil
+}
+
+//sdfBondType returns the MDL bond type for a bond order.
+func sdfBondType(order float64) int {
+	if order == 1.5 {
+		return 4
+	}
+	if order < 1 || order > 3 {
+		return 8 //"any" bond
+	}
+	return int(order)
+}
+
+//sdfWriteV2000 writes the counts line and the connection table of a V2000 record to w.
+func sdfWriteV2000(w *bufio.Writer, coords *v3.Matrix, mol Atomer, bonds []*Bond, charges []int) {
+	fmt.Fprintf(w, "%3d%3d  0  0  0  0  0  0  0  0999 V2000\n", mol.Len(), len(bonds))
+	codes := map[int]int{3: 1, 2: 2, 1: 3, -1: 5, -2: 6, -3: 7}
+	charged := make([]int, 0)
+	for i := 0; i < mol.Len(); i++ {
+		if charges[i] != 0 {
+			charged = append(charged, i)
+		}
+		fmt.Fprintf(w, "%10.4f%10.4f%10.4f %-3s 0%3d  0  0  0  0  0  0  0  0  0  0\n", coords.At(i, 0), coords.At(i, 1),
+			coords.At(i, 2), mol.Atom(i).Symbol, codes[charges[i]])
+	}
+	for _, b := range bonds {
+		fmt.Fprintf(w, "%3d%3d%3d  0\n", b.At1+1, b.At2+1, sdfBondType(b.Order))
+	}
+	//at most 8 charges per line
+	for i := 0; i < len(charged); i += 8 {
+		end := i + 8
+		if end > len(charged) {
+			end = len(charged)
+		}
+		fmt.Fprintf(w, "M  CHG%3d", end-i)
+		for _, j := range charged[i:end] {
+			fmt.Fprintf(w, " %3d %3d", j+1, charges[j])
+		}
+		w.WriteString("\n")
+	}
+	w.WriteString("M  END\n")
+}
+
+//sdfWriteV3000 writes the counts line and the connection table of a V3000 record to w.
+func sdfWriteV3000(w *bufio.Writer, coords *v3.Matrix, mol Atomer, bonds []*Bond, charges []int) {
+	w.WriteString("  0  0  0     0  0            999 V3000\nM  V30 BEGIN CTAB\n")
+	fmt.Fprintf(w, "M  V30 COUNTS %d %d 0 0 0\nM  V30 BEGIN ATOM\n", mol.Len(), len(bonds))
+	for i := 0; i < mol.Len(); i++ {
+		fmt.Fprintf(w, "M  V30 %d %s %.4f %.4f %.4f 0", i+1, mol.Atom(i).Symbol, coords.At(i, 0), coords.At(i, 1), coords.At(i, 2))
+		if charges[i] != 0 {
+			fmt.Fprintf(w, " CHG=%d", charges[i])
+		}
+		w.WriteString("\n")
+	}
+	w.WriteString("M  V30 END ATOM\nM  V30 BEGIN BOND\n")
+	for i, b := range bonds {
+		fmt.Fprintf(w, "M  V30 %d %d %d %d\n", i+1, sdfBondType(b.Order), b.At1+1, b.At2+1)
+	}
+	w.WriteString("M  V30 END BOND\nM  V30 END CTAB\nM  END\n")
+}
@@ -0,0 +1,475 @@
+/*
+ * selection.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/rmera/gochem/v3"
+)
+
+//Selection is a compiled atom selection expression. It can be evaluated against
+//any Atomer (and, for geometric clauses, a set of coordinates) to obtain the indexes
+//of the selected atoms, which can then be given to SomeVecs, SomeAtoms, RMSD, etc.
+//
+//The expressions are made of the following clauses, which can be combined with
+//"and", "or", "not" and parentheses ("not" binds tighter than "and", which binds tighter than "or"):
+//
+//	all, none                  every atom / no atom.
+//	hydrogen, heavy            atoms with/without the symbol H.
+//	backbone                   non-HETATM atoms named N, CA, C or O.
+//	protein, water, het        amino acid residues, water molecules and HETATM atoms.
+//	name, resname, chain,
+//	element (or symbol) V...   atoms where the field (ignoring leading and trailing blanks) matches any of the values given.
+//	                           The values can contain shell-like wildcards (*, ? and []).
+//	resid, index, id, tag N... atoms where the field (MolID, position in the Atomer, ID or Tag)
+//	                           matches any of the values given. The values can be numbers or
+//	                           inclusive ranges written as N-M, N:M or N to M. index is 0-based.
+//	within R of S              atoms closer than R A to any atom selected by S, which is the
+//	                           clause or parenthesized expression right after "of". Requires coordinates.
+//
+//For instance: "chain A and resid 10-50 and name CA", "within 5 of resname HEM", "not hydrogen".
+//Keywords are case-insensitive, values are not.
+type Selection struct {
+	expr string
+	root selNode
+}
+
+//NewSelection compiles the selection expression expr, and returns the
+//corresponding Selection, or an error if the expression is not valid.
+func NewSelection(expr string) (*Selection, error) {
+	p := &selParser{toks: selTokenize(expr)}
+	if len(p.toks) == 0 {
+		return nil, CError{"goChem: Empty selection expression", []string{"NewSelection"}}
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, errDecorate(err, "NewSelection")
+	}
+	if p.pos < len(p.toks) {
+		return nil, CError{fmt.Sprintf("goChem: Unexpected '%s' in selection expression", p.toks[p.pos]), []string{"NewSelection"}}
+	}
+	return &Selection{expr: expr, root: root}, nil
+}
+
+//String returns the expression from which the selection was compiled.
+func (S *Selection) String() string {
+	return S.expr
+}
+
+//Geometric returns true if the selection contains clauses that require coordinates.
+func (S *Selection) Geometric() bool {
+	return S.root.geometric()
+}
+
+//Indexes returns the indexes of the atoms in mol selected by S, in increasing order.
+//If the selection contains geometric clauses, the coordinates for mol must be given, otherwise
+//they are ignored. Only the first coords matrix is used.
+func (S *Selection) Indexes(mol Atomer, coords ...*v3.Matrix) ([]int, error) {
+	c := &selContext{mol: mol}
+	if len(coords) > 0 && coords[0] != nil {
+		c.coords = coords[0]
+		if c.coords.NVecs() != mol.Len() {
+			return nil, CError{"goChem: Ref and Coords dont have the same number of atoms", []string{"Selection.Indexes"}}
+		}
+	}
+	if c.coords == nil && S.root.geometric() {
+		return nil, CError{"goChem: Selection requires coordinates", []string{"Selection.Indexes"}}
+	}
+	mask := S.root.eval(c)
+	ret := make([]int, 0, len(mask))
+	for i, v := range mask {
+		if v {
+			ret = append(ret, i)
+		}
+	}
+	return ret, nil
+}
+
+//Select compiles the selection expression expr and evaluates it against mol (and, if needed,
+//the coordinates coords[0]). It returns the indexes of the selected atoms, in increasing
+//order, or an error. See the documentation of Selection for the syntax of the expressions.
+func Select(mol Atomer, expr string, coords ...*v3.Matrix) ([]int, error) {
+	sel, err := NewSelection(expr)
+	if err != nil {
+		return nil, errDecorate(err, "Select")
+	}
+	ret, err := sel.Indexes(mol, coords...)
+	if err != nil {
+		return nil, errDecorate(err, "Select")
+	}
+	return ret, nil
+}
+
+/***The nodes of the compiled selection***/
+
+type selContext struct {
+	mol    Atomer
+	coords *v3.Matrix
+}
+
+//selNode is a node in the tree of a compiled selection. eval returns, for each
+//atom, whether the atom is selected.
+type selNode interface {
+	eval(c *selContext) []bool
+	geometric() bool
+}
+
+//selTest selects the atoms for which test returns true.
+type selTest struct {
+	test func(at *Atom, i int) bool
+}
+
+func (s *selTest) eval(c *selContext) []bool {
+	ret := make([]bool, c.mol.Len())
+	for i := range ret {
+		ret[i] = s.test(c.mol.Atom(i), i)
+	}
+	return ret
+}
+
+func (s *selTest) geometric() bool { return false }
+
+type selNot struct {
+	n selNode
+}
+
+func (s *selNot) eval(c *selContext) []bool {
+	ret := s.n.eval(c)
+	for i, v := range ret {
+		ret[i] = !v
+	}
+	return ret
+}
+
+func (s *selNot) geometric() bool { return s.n.geometric() }
+
+//selBinary is an "and" (if or is false) or "or" (if or is true) node.
+type selBinary struct {
+	l, r selNode
+	or   bool
+}
+
+func (s *selBinary) eval(c *selContext) []bool {
+	ret := s.l.eval(c)
+	r := s.r.eval(c)
+	for i, v := range r {
+		if s.or {
+			ret[i] = ret[i] || v
+		} else {
+			ret[i] = ret[i] && v
+		}
+	}
+	return ret
+}
+
+func (s *selBinary) geometric() bool { return s.l.geometric() || s.r.geometric() }
+
+//selWithin selects the atoms closer than r to any atom selected by n.
+type selWithin struct {
+	r float64
+	n selNode
+}
+
+func (s *selWithin) eval(c *selContext) []bool {
+	ref := s.n.eval(c)
+	ret := make([]bool, len(ref))
+	index := NewNeighborIndex(c.coords, s.r)
+	for j, v := range ref {
+		if !v {
+			continue
+		}
+		for _, i := range index.Within(c.coords.VecView(j), s.r) {
+			ret[i] = true
+		}
+	}
+	return ret
+}
+
+func (s *selWithin) geometric() bool { return true }
+
+/***The parser***/
+
+//selTokenize splits expr in tokens, separated by blanks. Parentheses are
+//always tokens by themselves.
+func selTokenize(expr string) []string {
+	expr = strings.Replace(expr, "(", " ( ", -1)
+	expr = strings.Replace(expr, ")", " ) ", -1)
+	return strings.Fields(expr)
+}
+
+type selParser struct {
+	toks []string
+	pos  int
+}
+
+//peek returns the current token in lowercase, or an empty string if there are no more tokens.
+func (p *selParser) peek() string {
+	if p.pos >= len(p.toks) {
+		return ""
+	}
+	return strings.ToLower(p.toks[p.pos])
+}
+
+func (p *selParser) parseOr() (selNode, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &selBinary{l: l, r: r, or: true}
+	}
+	return l, nil
+}
+
+func (p *selParser) parseAnd() (selNode, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.pos++
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = &selBinary{l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *selParser) parseNot() (selNode, error) {
+	if p.peek() == "not" {
+		p.pos++
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &selNot{n}, nil
+	}
+	return p.parseClause()
+}
+
+//values returns the tokens from the current one up to the next operator,
+//parenthesis, or the end of the expression.
+func (p *selParser) values() []string {
+	start := p.pos
+	for ; p.pos < len(p.toks); p.pos++ {
+		switch p.peek() {
+		case "and", "or", "not", "(", ")":
+			return p.toks[start:p.pos]
+		}
+	}
+	return p.toks[start:]
+}
+
+var selWaterNames = []string{"HOH", "WAT", "SOL", "TIP3", "TIP4", "H2O"}
+
+//Amino acid names, in addition to those in three2OneLetter, such as Amber's protonation states.
+var selExtraProteinNames = []string{"HID", "HIE", "HIP", "HSD", "HSE", "HSP", "CYX", "CYM", "ASH", "GLH", "LYN"}
+
+func (p *selParser) parseClause() (selNode, error) {
+	kw := p.peek()
+	if kw == "" {
+		return nil, CError{"goChem: Unexpected end of selection expression", []string{"selParser.parseClause"}}
+	}
+	p.pos++
+	switch kw {
+	case "(":
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, CError{"goChem: Unbalanced parentheses in selection expression", []string{"selParser.parseClause"}}
+		}
+		p.pos++
+		return n, nil
+	case "all":
+		return &selTest{func(at *Atom, i int) bool { return true }}, nil
+	case "none":
+		return &selTest{func(at *Atom, i int) bool { return false }}, nil
+	case "hydrogen":
+		return &selTest{func(at *Atom, i int) bool { return at.Symbol == "H" }}, nil
+	case "heavy":
+		return &selTest{func(at *Atom, i int) bool { return at.Symbol != "H" }}, nil
+	case "het":
+		return &selTest{func(at *Atom, i int) bool { return at.Het }}, nil
+	case "backbone":
+		return &selTest{func(at *Atom, i int) bool {
+			return !at.Het && isInString([]string{"N", "CA", "C", "O"}, strings.TrimSpace(at.Name))
+		}}, nil
+	case "water":
+		return &selTest{func(at *Atom, i int) bool { return isInString(selWaterNames, strings.TrimSpace(at.Molname)) }}, nil
+	case "protein":
+		return &selTest{func(at *Atom, i int) bool {
+			name := strings.TrimSpace(at.Molname)
+			_, ok := three2OneLetter[name]
+			return ok || isInString(selExtraProteinNames, name)
+		}}, nil
+	case "name", "resname", "chain", "element", "symbol":
+		return p.parseStrings(kw)
+	case "resid", "index", "id", "tag":
+		return p.parseInts(kw)
+	case "within":
+		return p.parseWithin()
+	}
+	return nil, CError{fmt.Sprintf("goChem: Unknown keyword '%s' in selection expression", p.toks[p.pos-1]), []string{"selParser.parseClause"}}
+}
+
+func (p *selParser) parseStrings(kw string) (selNode, error) {
+	vals := p.values()
+	if len(vals) == 0 {
+		return nil, CError{fmt.Sprintf("goChem: No values given for '%s' in selection expression", kw), []string{"selParser.parseStrings"}}
+	}
+	for _, v := range vals {
+		if _, err := path.Match(v, ""); err != nil {
+			return nil, CError{fmt.Sprintf("goChem: Malformed pattern '%s' in selection expression", v), []string{"path.Match", "selParser.parseStrings"}}
+		}
+	}
+	var field func(at *Atom) string
+	switch kw {
+	case "name":
+		field = func(at *Atom) string { return at.Name }
+	case "resname":
+		field = func(at *Atom) string { return at.Molname }
+	case "chain":
+		field = func(at *Atom) string { return at.Chain }
+	default:
+		field = func(at *Atom) string { return at.Symbol }
+	}
+	test := func(at *Atom, i int) bool {
+		f := strings.TrimSpace(field(at)) //some readers keep the padding of the fields.
+		for _, v := range vals {
+			if v == f {
+				return true
+			}
+			if strings.ContainsAny(v, "*?[") {
+				if m, _ := path.Match(v, f); m {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return &selTest{test}, nil
+}
+
+//intRange is an inclusive range of integers.
+type intRange [2]int
+
+func (p *selParser) parseInts(kw string) (selNode, error) {
+	vals := p.values()
+	if len(vals) == 0 {
+		return nil, CError{fmt.Sprintf("goChem: No values given for '%s' in selection expression", kw), []string{"selParser.parseInts"}}
+	}
+	ranges := make([]intRange, 0, len(vals))
+	for i := 0; i < len(vals); i++ {
+		v := vals[i]
+		if i+2 < len(vals) && strings.ToLower(vals[i+1]) == "to" {
+			v = v + ":" + vals[i+2]
+			i += 2
+		}
+		r, err := parseIntRange(v)
+		if err != nil {
+			return nil, errDecorate(err, "selParser.parseInts")
+		}
+		ranges = append(ranges, r)
+	}
+	var field func(at *Atom, i int) int
+	switch kw {
+	case "resid":
+		field = func(at *Atom, i int) int { return at.MolID }
+	case "index":
+		field = func(at *Atom, i int) int { return i }
+	case "id":
+		field = func(at *Atom, i int) int { return at.ID }
+	default:
+		field = func(at *Atom, i int) int { return at.Tag }
+	}
+	test := func(at *Atom, i int) bool {
+		f := field(at, i)
+		for _, r := range ranges {
+			if f >= r[0] && f <= r[1] {
+				return true
+			}
+		}
+		return false
+	}
+	return &selTest{test}, nil
+}
+
+//parseIntRange parses a string with an integer or a range N-M or N:M.
+//The first number can be negative.
+func parseIntRange(s string) (intRange, error) {
+	sep := strings.IndexAny(s[1:], "-:") + 1
+	if sep == 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return intRange{}, CError{fmt.Sprintf("goChem: Invalid number '%s' in selection expression", s), []string{"strconv.Atoi", "parseIntRange"}}
+		}
+		return intRange{n, n}, nil
+	}
+	n1, err1 := strconv.Atoi(s[:sep])
+	n2, err2 := strconv.Atoi(s[sep+1:])
+	if err1 != nil || err2 != nil {
+		return intRange{}, CError{fmt.Sprintf("goChem: Invalid range '%s' in selection expression", s), []string{"strconv.Atoi", "parseIntRange"}}
+	}
+	if n1 > n2 {
+		n1, n2 = n2, n1
+	}
+	return intRange{n1, n2}, nil
+}
+
+func (p *selParser) parseWithin() (selNode, error) {
+	if p.pos+1 >= len(p.toks) || p.peek() == "" {
+		return nil, CError{"goChem: Incomplete 'within' clause in selection expression", []string{"selParser.parseWithin"}}
+	}
+	r, err := strconv.ParseFloat(p.toks[p.pos], 64)
+	if err != nil || r < 0 {
+		return nil, CError{fmt.Sprintf("goChem: Invalid distance '%s' in selection expression", p.toks[p.pos]), []string{"strconv.ParseFloat", "selParser.parseWithin"}}
+	}
+	p.pos++
+	if p.peek() != "of" {
+		return nil, CError{"goChem: Expected 'of' after the distance in 'within' clause", []string{"selParser.parseWithin"}}
+	}
+	p.pos++
+	n, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return &selWithin{r: r, n: n}, nil
+}
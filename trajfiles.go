@@ -0,0 +1,352 @@
+/*
+ * trajfiles.go, part of gochem.
+ *
+ *
+ * Copyright 2012 Raul Mera <rmera{at}chemDOThelsinkiDOTfi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ *
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package chem
+
+import (
+	"bufio"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/rmera/gochem/v3"
+)
+
+//XYZTraj is a multi-XYZ file read frame by frame, so the whole file doesn't need to be loaded in memory.
+//It implements Traj, ConcTraj and BoxTraj.
+type XYZTraj struct {
+	natoms   int
+	filename string
+	file     io.ReadCloser
+	xyz      *bufio.Reader
+	frame    int        //number of frames read
+	info     *FrameInfo //information for the last frame read
+	readable bool
+}
+
+//XYZFileAsTraj opens the multi-XYZ file xyzname and returns a Molecule with the topology and the first frame of the file,
+//and an XYZTraj that reads the file, starting from the first frame. Returns error or nil.
+func XYZFileAsTraj(xyzname string) (*Molecule, *XYZTraj, error) {
+	xyzfile, err := OpenFile(xyzname)
+	if err != nil {
+		return nil, nil, errDecorate(err, "XYZFileAsTraj")
+	}
+	coords, atoms, info, err := xyzReadSnap(bufio.NewReader(xyzfile), true)
+	xyzfile.Close()
+	if err != nil {
+		return nil, nil, errDecorate(err, "XYZFileAsTraj")
+	}
+	mol, err := NewMolecule([]*v3.Matrix{coords}, NewTopology(0, 1, atoms), nil)
+	if err != nil {
+		return nil, nil, errDecorate(err, "XYZFileAsTraj")
+	}
+	mol.Info = []*FrameInfo{info}
+	if info.Box != nil {
+		mol.Boxes = []*Box{info.Box}
+	}
+	traj := &XYZTraj{natoms: len(atoms), filename: xyzname}
+	traj.file, err = OpenFile(xyzname)
+	if err != nil {
+		return nil, nil, errDecorate(err, "XYZFileAsTraj")
+	}
+	traj.xyz = bufio.NewReader(traj.file)
+	traj.readable = true
+	runtime.SetFinalizer(traj, func(X *XYZTraj) {
+		X.file.Close()
+	})
+	return mol, traj, nil
+}
+
+//Readable returns true if the trajectory is ready to be read.
+func (X *XYZTraj) Readable() bool {
+	return X.readable
+}
+
+//Len returns the number of atoms per frame.
+func (X *XYZTraj) Len() int {
+	return X.natoms
+}
+
+//Close closes the file associated with the trajectory.
+//The trajectory can't be read after that.
+func (X *XYZTraj) Close() {
+	if X.file != nil {
+		X.file.Close()
+	}
+	X.readable = false
+}
+
+//nextRaw reads the next frame and returns its coordinates. It returns a lastFrameError if there are no more frames.
+func (X *XYZTraj) nextRaw() (*v3.Matrix, error) {
+	if !X.readable {
+		return nil, &trajError{"Trajectory not readable", X.filename, "xyz", []string{"nextRaw"}, true}
+	}
+	coords, _, info, err := xyzReadSnap(X.xyz, false)
+	if err != nil {
+		X.Close()
+		//As in XYZRead, a missing or wrong header means that there are no more frames.
+		if errm := err.Error(); strings.Contains(errm, "Empty") || strings.Contains(errm, "header") {
+			return nil, newlastFrameError(X.filename, X.frame, "xyz")
+		}
+		return nil, &trajError{err.Error(), X.filename, "xyz", []string{"xyzReadSnap", "nextRaw"}, true}
+	}
+	if coords.NVecs() != X.natoms {
+		X.Close()
+		return nil, &trajError{"Frame with a wrong number of atoms", X.filename, "xyz", []string{"nextRaw"}, true}
+	}
+	X.frame++
+	X.info = info
+	return coords, nil
+}
+
+//Info returns the information in the comment line and the extra columns of the last frame read,
+//or nil if no frame has been read.
+func (X *XYZTraj) Info() *FrameInfo {
+	return X.info
+}
+
+//Box returns the box given in the Lattice of the last frame read, or nil if there is none.
+func (X *XYZTraj) Box() *Box {
+	if X.info == nil {
+		return nil
+	}
+	return X.info.Box
+}
+
+//Next reads the next frame into output, or discards it if output is nil.
+//It returns a LastFrameError when there are no more frames to read.
+func (X *XYZTraj) Next(output *v3.Matrix) error {
+	coords, err := X.nextRaw()
+	if err != nil {
+		return errDecorate(err, "XYZTraj.Next")
+	}
+	if output != nil {
+		output.Copy(coords)
+	}
+	return nil
+}
+
+//NextConc reads as many frames as elements in frames, and returns a slice of channels
+//through each of which the corresponding frame is transmitted, in the matrix given in
+//frames. Frames for which the matrix is nil are read and discarded, and their channels are nil.
+func (X *XYZTraj) NextConc(frames []*v3.Matrix) ([]chan *v3.Matrix, error) {
+	return nextConcTraj(X.nextRaw, frames, "XYZTraj.NextConc")
+}
+
+//nextConcTraj implements NextConc for the file-based trajectories of the package, using the next function
+//to read each frame.
+func nextConcTraj(next func() (*v3.Matrix, error), frames []*v3.Matrix, caller string) ([]chan *v3.Matrix, error) {
+	framechans := make([]chan *v3.Matrix, len(frames))
+	used := false
+	for key, val := range frames {
+		coords, err := next()
+		if _, ok := err.(*lastFrameError); ok {
+			if !used {
+				return nil, errDecorate(err, caller)
+			}
+			return framechans, errDecorate(err, caller)
+		}
+		if err != nil {
+			return nil, errDecorate(err, caller)
+		}
+		if val == nil {
+			continue
+		}
+		used = true
+		framechans[key] = make(chan *v3.Matrix)
+		go func(in, out *v3.Matrix, pipe chan *v3.Matrix) {
+			out.Copy(in)
+			pipe <- out
+		}(coords, val, framechans[key])
+	}
+	return framechans, nil
+}
+
+//PDBTraj is a multi-model PDB file read model by model, so the whole file doesn't need to be loaded in memory.
+//It implements Traj, ConcTraj and BoxTraj.
+type PDBTraj struct {
+	natoms   int
+	filename string
+	file     io.ReadCloser
+	pdb      *bufio.Reader
+	frame    int  //number of frames read
+	box      *Box //the last box read from a CRYST1 record
+	readable bool
+}
+
+//PDBFileAsTraj opens the PDB file pdbname and returns a Molecule with the topology and the first model of the file,
+//and a PDBTraj that reads the file, starting from the first model. Each model must be between MODEL and ENDMDL
+//records. If read_additional is true, the symbols and charges are read from the file. Returns error or nil.
+func PDBFileAsTraj(pdbname string, read_additional bool) (*Molecule, *PDBTraj, error) {
+	pdbfile, err := OpenFile(pdbname)
+	if err != nil {
+		return nil, nil, errDecorate(err, "PDBFileAsTraj")
+	}
+	coords, bfactors, atoms, box, err := pdbReadModel(bufio.NewReader(pdbfile), true, read_additional)
+	pdbfile.Close()
+	if err != nil {
+		return nil, nil, errDecorate(err, "PDBFileAsTraj")
+	}
+	if coords == nil {
+		return nil, nil, CError{"No atoms in PDB file", []string{"PDBFileAsTraj"}}
+	}
+	mol, err := NewMolecule([]*v3.Matrix{coords}, NewTopology(0, 1, atoms), [][]float64{bfactors})
+	if err != nil {
+		return nil, nil, errDecorate(err, "PDBFileAsTraj")
+	}
+	if box != nil {
+		mol.Boxes = []*Box{box}
+	}
+	traj := &PDBTraj{natoms: len(atoms), filename: pdbname}
+	traj.file, err = OpenFile(pdbname)
+	if err != nil {
+		return nil, nil, errDecorate(err, "PDBFileAsTraj")
+	}
+	traj.pdb = bufio.NewReader(traj.file)
+	traj.readable = true
+	runtime.SetFinalizer(traj, func(P *PDBTraj) {
+		P.file.Close()
+	})
+	return mol, traj, nil
+}
+
+//pdbReadModel reads the ATOM and HETATM records of a PDB file until the end of the file or an ENDMDL or END record,
+//and returns the coordinates, b-factors, atoms (only if readTopol is true) and the box, if a CRYST1 record was found.
+//Models with no atoms are skipped. The returned coordinates are nil if there are no more atoms in the file.
+func pdbReadModel(pdb *bufio.Reader, readTopol, read_additional bool) (*v3.Matrix, []float64, []*Atom, *Box, error) {
+	var coords, bfactors []float64
+	var atoms []*Atom
+	var box *Box
+	for contlines := 1; ; contlines++ {
+		line, err := pdb.ReadString('\n')
+		if err != nil && line == "" {
+			break
+		}
+		var c []float64
+		var bfac float64
+		var at *Atom
+		switch {
+		case strings.HasPrefix(line, "ATOM") || strings.HasPrefix(line, "HETATM"):
+			if readTopol {
+				at, c, bfac, err = read_full_pdb_line(line, read_additional, contlines)
+				atoms = append(atoms, at)
+			} else {
+				c, bfac, err = read_onlycoords_pdb_line(line, contlines)
+			}
+			if err != nil {
+				return nil, nil, nil, nil, errDecorate(err, "pdbReadModel")
+			}
+			coords = append(coords, c...)
+			bfactors = append(bfactors, bfac)
+		case strings.HasPrefix(line, "CRYST1"):
+			box, err = readCryst1(line)
+			if err != nil {
+				return nil, nil, nil, nil, errDecorate(err, "pdbReadModel")
+			}
+		case strings.HasPrefix(line, "END"): //also ENDMDL
+			if len(coords) > 0 {
+				mcoords, err := v3.NewMatrix(coords)
+				return mcoords, bfactors, atoms, box, errDecorate(err, "pdbReadModel")
+			}
+		}
+	}
+	if len(coords) == 0 {
+		return nil, nil, nil, box, nil
+	}
+	mcoords, err := v3.NewMatrix(coords)
+	return mcoords, bfactors, atoms, box, errDecorate(err, "pdbReadModel")
+}
+
+//Readable returns true if the trajectory is ready to be read.
+func (P *PDBTraj) Readable() bool {
+	return P.readable
+}
+
+//Len returns the number of atoms per frame.
+func (P *PDBTraj) Len() int {
+	return P.natoms
+}
+
+//Box returns the box for the last model read, which is the one given
+//in the last CRYST1 record read, or nil if there are no CRYST1 records.
+func (P *PDBTraj) Box() *Box {
+	return P.box
+}
+
+//Close closes the file associated with the trajectory.
+//The trajectory can't be read after that.
+func (P *PDBTraj) Close() {
+	if P.file != nil {
+		P.file.Close()
+	}
+	P.readable = false
+}
+
+//nextRaw reads the next model and returns its coordinates. It returns a lastFrameError if there are no more models.
+func (P *PDBTraj) nextRaw() (*v3.Matrix, error) {
+	if !P.readable {
+		return nil, &trajError{"Trajectory not readable", P.filename, "pdb", []string{"nextRaw"}, true}
+	}
+	coords, _, _, box, err := pdbReadModel(P.pdb, false, false)
+	if err != nil {
+		P.Close()
+		return nil, &trajError{err.Error(), P.filename, "pdb", []string{"pdbReadModel", "nextRaw"}, true}
+	}
+	if box != nil {
+		P.box = box
+	}
+	if coords == nil {
+		P.Close()
+		return nil, newlastFrameError(P.filename, P.frame, "pdb")
+	}
+	if coords.NVecs() != P.natoms {
+		P.Close()
+		return nil, &trajError{"Model with a wrong number of atoms", P.filename, "pdb", []string{"nextRaw"}, true}
+	}
+	P.frame++
+	return coords, nil
+}
+
+//Next reads the next model into output, or discards it if output is nil.
+//It returns a LastFrameError when there are no more models to read.
+func (P *PDBTraj) Next(output *v3.Matrix) error {
+	coords, err := P.nextRaw()
+	if err != nil {
+		return errDecorate(err, "PDBTraj.Next")
+	}
+	if output != nil {
+		output.Copy(coords)
+	}
+	return nil
+}
+
+//NextConc reads as many models as elements in frames, and returns a slice of channels
+//through each of which the corresponding model is transmitted, in the matrix given in
+//frames. Models for which the matrix is nil are read and discarded, and their channels are nil.
+func (P *PDBTraj) NextConc(frames []*v3.Matrix) ([]chan *v3.Matrix, error) {
+	return nextConcTraj(P.nextRaw, frames, "PDBTraj.NextConc")
+}
@@ -0,0 +1,559 @@
+/*
+ * trr.go, part of gochem
+ *
+ * Copyright 2012 Raul Mera Adasme <rmera_changeforat_chem-dot-helsinki-dot-fi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License  as published by
+ * the Free Software Foundation; either version 2.1 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston,
+ * MA 02110-1301, USA.
+ */
+/*
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+//Package trr reads GROMACS TRR trajectories, which can contain positions,
+//velocities and forces for each frame, in single or double precision.
+package trr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/rmera/gochem"
+	"github.com/rmera/gochem/v3"
+)
+
+const trrMagic = 1993
+
+//Conversion factors from GROMACS units.
+const (
+	nm2A      = 10  //nm and nm/ps to A and A/ps
+	forceConv = 0.1 //kJ/(mol nm) to kJ/(mol A)
+)
+
+//trrFrame contains the data of one TRR frame, in the units of the file (nm, ps, kJ/mol).
+type trrFrame struct {
+	natoms int
+	step   int
+	time   float64
+	lambda float64
+	double bool
+	hasBox bool
+	box    [9]float64
+	x      []float64 //natoms*3 elements, nil if the frame has no positions
+	v      []float64
+	f      []float64
+	//sizes of each block, in bytes
+	irSize, eSize, boxSize, virSize, presSize, topSize, symSize, xSize, vSize, fSize int
+}
+
+//readReals reads len(dst) reals, float64 if double is true, float32 otherwise, into dst.
+func readReals(r io.Reader, double bool, dst []float64) error {
+	if double {
+		return binary.Read(r, binary.BigEndian, dst)
+	}
+	buf := make([]float32, len(dst))
+	if err := binary.Read(r, binary.BigEndian, buf); err != nil {
+		return err
+	}
+	for i, v := range buf {
+		dst[i] = float64(v)
+	}
+	return nil
+}
+
+//noEOF turns an io.EOF into an io.ErrUnexpectedEOF. It is used when the EOF happens in the
+//middle of a frame.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+//readHeader reads the header of a frame into f. It returns io.EOF only if there are no more frames.
+func readHeader(r io.Reader, f *trrFrame) error {
+	var magic int32
+	if err := binary.Read(r, binary.BigEndian, &magic); err != nil {
+		return err //the only place where an io.EOF is fine.
+	}
+	if magic != trrMagic {
+		return fmt.Errorf("%s: wrong magic number %d", WrongFormat, magic)
+	}
+	//The version string, "GMX_trn_file", preceded by its length+1, and by its length, and padded to 4 bytes.
+	var slen [2]int32
+	if err := binary.Read(r, binary.BigEndian, slen[:]); err != nil {
+		return noEOF(err)
+	}
+	if slen[1] < 0 || slen[1] > 128 {
+		return fmt.Errorf("%s: wrong version string length %d", WrongFormat, slen[1])
+	}
+	if _, err := io.ReadFull(r, make([]byte, (slen[1]+3)/4*4)); err != nil {
+		return noEOF(err)
+	}
+	var ints [13]int32
+	if err := binary.Read(r, binary.BigEndian, ints[:]); err != nil {
+		return noEOF(err)
+	}
+	sizes := []*int{&f.irSize, &f.eSize, &f.boxSize, &f.virSize, &f.presSize, &f.topSize, &f.symSize, &f.xSize, &f.vSize, &f.fSize}
+	for i, v := range sizes {
+		*v = int(ints[i])
+	}
+	f.natoms = int(ints[10])
+	f.step = int(ints[11])
+	if f.irSize != 0 || f.eSize != 0 || f.topSize != 0 || f.symSize != 0 {
+		return fmt.Errorf("%s: obsolete TRR format not supported", WrongFormat)
+	}
+	//The size of the reals is obtained from the size of any of the blocks present.
+	realsize := 0
+	switch {
+	case f.boxSize != 0:
+		realsize = f.boxSize / 9
+	case f.virSize != 0:
+		realsize = f.virSize / 9
+	case f.presSize != 0:
+		realsize = f.presSize / 9
+	case f.natoms > 0 && f.xSize != 0:
+		realsize = f.xSize / (3 * f.natoms)
+	case f.natoms > 0 && f.vSize != 0:
+		realsize = f.vSize / (3 * f.natoms)
+	case f.natoms > 0 && f.fSize != 0:
+		realsize = f.fSize / (3 * f.natoms)
+	}
+	if realsize != 4 && realsize != 8 {
+		return fmt.Errorf("%s: can't determine the precision of the frame", WrongFormat)
+	}
+	f.double = realsize == 8
+	tl := make([]float64, 2)
+	if err := readReals(r, f.double, tl); err != nil {
+		return noEOF(err)
+	}
+	f.time, f.lambda = tl[0], tl[1]
+	return nil
+}
+
+//readFrame reads the data of a frame, which header must have been read into f already. The
+//coordinate slices of f are reused if they have the right size.
+func readFrame(r io.Reader, f *trrFrame) error {
+	realsize := 4
+	if f.double {
+		realsize = 8
+	}
+	f.hasBox = f.boxSize != 0
+	if f.hasBox {
+		if f.boxSize != 9*realsize {
+			return fmt.Errorf("%s: wrong box size", WrongFormat)
+		}
+		if err := readReals(r, f.double, f.box[:]); err != nil {
+			return noEOF(err)
+		}
+	}
+	//We don't use the virial and pressure tensors.
+	for _, size := range []int{f.virSize, f.presSize} {
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			return noEOF(err)
+		}
+	}
+	for _, b := range []struct {
+		size int
+		data *[]float64
+	}{{f.xSize, &f.x}, {f.vSize, &f.v}, {f.fSize, &f.f}} {
+		if b.size == 0 {
+			*b.data = nil
+			continue
+		}
+		if b.size != 3*f.natoms*realsize {
+			return fmt.Errorf("%s: wrong block size %d for %d atoms", WrongFormat, b.size, f.natoms)
+		}
+		if len(*b.data) != 3*f.natoms {
+			*b.data = make([]float64, 3*f.natoms)
+		}
+		if err := readReals(r, f.double, *b.data); err != nil {
+			return noEOF(err)
+		}
+	}
+	return nil
+}
+
+//TRRObj is a GROMACS TRR trajectory file open for reading.
+type TRRObj struct {
+	readable   bool
+	natoms     int
+	filename   string
+	file       io.ReadCloser
+	trr        *bufio.Reader
+	frame      *trrFrame //buffer for the frames read with Next
+	last       *trrFrame //the last frame read
+	concBuffer []*trrFrame
+	buffSize   int
+	box        *chem.Box //box of the last frame read
+	indexes    []int     //the atoms read, nil for all atoms
+}
+
+//New opens the TRR file filename for reading and returns a TRRObj for it. The file
+//can be compressed with gzip, bzip2 or xz (see chem.OpenFile). If a slice of indexes
+//is given, only those atoms are returned by Next, NextConc, Velocities and Forces,
+//in that order, and Len returns the number of indexes.
+func New(filename string, indexes ...[]int) (*TRRObj, error) {
+	traj := new(TRRObj)
+	if err := traj.initRead(filename); err != nil {
+		return nil, errDecorate(err, "New")
+	}
+	if len(indexes) > 0 && indexes[0] != nil {
+		for _, v := range indexes[0] {
+			if v < 0 || v >= traj.natoms {
+				traj.Close()
+				return nil, Error{fmt.Sprintf("Index %d out of range for a trajectory with %d atoms", v, traj.natoms), filename, []string{"New"}, true}
+			}
+		}
+		traj.indexes = indexes[0]
+	}
+	return traj, nil
+}
+
+//initRead opens the file and reads the number of atoms from the first header.
+func (T *TRRObj) initRead(name string) error {
+	var err error
+	T.filename = name
+	T.file, err = chem.OpenFile(name)
+	if err != nil {
+		return Error{UnableToOpen + ": " + err.Error(), T.filename, []string{"chem.OpenFile", "initRead"}, true}
+	}
+	T.trr = bufio.NewReader(T.file)
+	//We peek at the first header to get the number of atoms. The header is much smaller than
+	//this, but the frame could be smaller too, so we don't check the error from Peek.
+	head, _ := T.trr.Peek(512)
+	first := new(trrFrame)
+	if err := readHeader(bytes.NewReader(head), first); err != nil {
+		T.file.Close()
+		return Error{WrongFormat + ": " + err.Error(), T.filename, []string{"readHeader", "initRead"}, true}
+	}
+	T.natoms = first.natoms
+	T.frame = first
+	T.last = first
+	T.concBuffer = append(T.concBuffer, T.frame)
+	T.buffSize = 1
+	runtime.SetFinalizer(T, func(T *TRRObj) {
+		T.file.Close()
+	})
+	T.readable = true
+	return nil
+}
+
+//Readable returns true if the object is ready to be read from, false
+//otherwise. It doesn't guarantee that there is something to read.
+func (T *TRRObj) Readable() bool {
+	return T.readable
+}
+
+//Close closes the file associated with the trajectory.
+//The trajectory can't be read after that.
+func (T *TRRObj) Close() {
+	if T.file != nil {
+		T.file.Close()
+	}
+	T.readable = false
+}
+
+//Len returns the number of atoms per frame in the TRRObj, or the number
+//of atoms selected, if the TRRObj was created with a slice of indexes.
+func (T *TRRObj) Len() int {
+	if T.indexes != nil {
+		return len(T.indexes)
+	}
+	return T.natoms
+}
+
+//nextRaw reads the next frame into f. It returns a lastFrameError if there are no more frames.
+func (T *TRRObj) nextRaw(f *trrFrame) error {
+	err := readHeader(T.trr, f)
+	if err == io.EOF {
+		T.readable = false
+		return newlastFrameError(T.filename, "nextRaw")
+	}
+	if err == nil && f.natoms != T.natoms {
+		err = fmt.Errorf("%s: frame with %d atoms in a trajectory with %d", WrongFormat, f.natoms, T.natoms)
+	}
+	if err == nil {
+		err = readFrame(T.trr, f)
+	}
+	if err != nil {
+		T.readable = false
+		return Error{ReadError + ": " + err.Error(), T.filename, []string{"nextRaw"}, true}
+	}
+	T.last = f
+	T.setBox(f)
+	return nil
+}
+
+//Next reads the next frame in the trajectory and puts its positions, in A, in output,
+//which must have space for Len() atoms. If output is nil, the frame is discarded. A frame
+//without positions can only be discarded, since GROMACS can write frames with only
+//velocities or forces. For those, an error is returned.
+func (T *TRRObj) Next(output *v3.Matrix) error {
+	if !T.Readable() {
+		return Error{TrajUnIni, T.filename, []string{"Next"}, true}
+	}
+	if err := T.nextRaw(T.frame); err != nil {
+		return errDecorate(err, "Next")
+	}
+	if output == nil {
+		return nil //Just drop the frame
+	}
+	if T.frame.x == nil {
+		return Error{"Frame without positions", T.filename, []string{"Next"}, false}
+	}
+	if r, _ := output.Dims(); r < T.Len() {
+		panic("Buffer v3.Matrix too small to hold trajectory frame")
+	}
+	T.toMatrix(T.frame.x, nm2A, output)
+	return nil
+}
+
+//toMatrix puts the data for the atoms read from data in out, which must have enough space,
+//multiplied by factor.
+func (T *TRRObj) toMatrix(data []float64, factor float64, out *v3.Matrix) {
+	for j := 0; j < T.Len(); j++ {
+		l := 3 * j
+		if T.indexes != nil {
+			l = 3 * T.indexes[j]
+		}
+		out.Set(j, 0, factor*data[l])
+		out.Set(j, 1, factor*data[l+1])
+		out.Set(j, 2, factor*data[l+2])
+	}
+}
+
+//setBox sets the box of the TRRObj from the frame f.
+func (T *TRRObj) setBox(f *trrFrame) {
+	T.box = nil
+	if !f.hasBox {
+		return
+	}
+	data := make([]float64, 9)
+	zero := true
+	for i, v := range f.box {
+		data[i] = nm2A * v
+		if v != 0 {
+			zero = false
+		}
+	}
+	if zero {
+		return
+	}
+	vecs, err := v3.NewMatrix(data)
+	if err != nil {
+		return
+	}
+	T.box, _ = chem.NewBox(vecs)
+}
+
+//Box returns the box of the last frame read, or nil if the frame
+//has no box. When frames are read with NextConc, it returns the box
+//of the last frame of the batch.
+func (T *TRRObj) Box() *chem.Box {
+	return T.box
+}
+
+//Velocities puts the velocities, in A/ps, of the last frame read in output, which must have
+//space for Len() atoms. It returns false, and doesn't modify output, if the frame has no velocities.
+//When frames are read with NextConc, the last frame of the batch is used.
+func (T *TRRObj) Velocities(output *v3.Matrix) bool {
+	if T.last.v == nil {
+		return false
+	}
+	T.toMatrix(T.last.v, nm2A, output)
+	return true
+}
+
+//Forces puts the forces, in kJ/(mol A), of the last frame read in output, which must have
+//space for Len() atoms. It returns false, and doesn't modify output, if the frame has no forces.
+//When frames are read with NextConc, the last frame of the batch is used.
+func (T *TRRObj) Forces(output *v3.Matrix) bool {
+	if T.last.f == nil {
+		return false
+	}
+	T.toMatrix(T.last.f, forceConv, output)
+	return true
+}
+
+//Lambda returns the free-energy lambda of the last frame read, or of the
+//first frame, if no frame has been read.
+func (T *TRRObj) Lambda() float64 {
+	return T.last.lambda
+}
+
+//Time returns the simulation time, in ps, of the last frame read, or of the
+//first frame, if no frame has been read.
+func (T *TRRObj) Time() float64 {
+	return T.last.time
+}
+
+//Step returns the simulation step of the last frame read, or of the
+//first frame, if no frame has been read.
+func (T *TRRObj) Step() int {
+	return T.last.step
+}
+
+//Double returns true if the last frame read (or the first frame) is in double precision.
+func (T *TRRObj) Double() bool {
+	return T.last.double
+}
+
+//NFrames returns -1, as the number of frames in a TRR file can't be known
+//without reading the whole file.
+func (T *TRRObj) NFrames() int {
+	return -1
+}
+
+//setConcBuffer makes sure that there are batchsize frame buffers for NextConc.
+func (T *TRRObj) setConcBuffer(batchsize int) {
+	for len(T.concBuffer) < batchsize {
+		T.concBuffer = append(T.concBuffer, new(trrFrame))
+	}
+	T.buffSize = batchsize
+}
+
+/*NextConc takes a slice of matrices and reads as many frames as elements the slice has
+from the trajectory. The frames are discarded if the corresponding element of the slice
+is nil. The function returns a slice of channels through each of each of which
+the positions of the corresponding frame will be transmited. Velocities, Forces, Box
+and the other metadata methods refer to the last frame of the batch after the call.*/
+func (T *TRRObj) NextConc(frames []*v3.Matrix) ([]chan *v3.Matrix, error) {
+	if T.natoms == 0 || !T.Readable() {
+		return nil, Error{TrajUnIni, T.filename, []string{"NextConc"}, true}
+	}
+	if T.buffSize < len(frames) {
+		T.setConcBuffer(len(frames))
+	}
+	framechans := make([]chan *v3.Matrix, len(frames)) //the slice of chans that will be returned
+	used := false
+	for key, val := range frames {
+		err := T.nextRaw(T.concBuffer[key])
+		if _, ok := err.(*lastFrameError); ok {
+			if !used {
+				return nil, errDecorate(err, "NextConc") //This is not really an error and
+			}
+			return framechans, errDecorate(err, "NextConc") //should be catched in the calling function
+		}
+		if err != nil {
+			return nil, errDecorate(err, "NextConc")
+		}
+		if val == nil {
+			framechans[key] = nil //ignored frame
+			continue
+		}
+		if T.concBuffer[key].x == nil {
+			return nil, Error{"Frame without positions", T.filename, []string{"NextConc"}, false}
+		}
+		if r, _ := val.Dims(); r < T.Len() {
+			panic("Buffer v3.Matrix too small to hold trajectory frame")
+		}
+		used = true
+		framechans[key] = make(chan *v3.Matrix)
+		//Now the parallel part
+		go func(x []float64, goCoords *v3.Matrix, pipe chan *v3.Matrix) {
+			T.toMatrix(x, nm2A, goCoords)
+			pipe <- goCoords
+		}(T.concBuffer[key].x, val, framechans[key])
+	}
+	return framechans, nil
+}
+
+//errDecorate is a helper function that asserts that the error is
+//implements chem.Error and decorates the error with the caller's name before returning it.
+//if used with a non-chem.Error error, it will cause a panic.
+func errDecorate(err error, caller string) error {
+	err2 := err.(chem.Error)
+	err2.Decorate(caller)
+	return err2
+}
+
+//Errors
+
+//Error is the general structure for TRR trajectory errors. It fullfills chem.Error and chem.TrajError
+type Error struct {
+	message  string
+	filename string //the input file that has problems, or empty string if none.
+	deco     []string
+	critical bool
+}
+
+func (err Error) Error() string {
+	return fmt.Sprintf("trr file %s error: %s", err.filename, err.message)
+}
+
+func (E Error) Decorate(deco string) []string {
+	//Even thought this method does not use a pointer as a receiver, and tries to alter the received,
+	//it should work, since E.deco is a slice, and hence a pointer itself.
+	if deco != "" {
+		E.deco = append(E.deco, deco)
+	}
+	return E.deco
+}
+
+func (err Error) FileName() string { return err.filename }
+
+func (err Error) Format() string { return "trr" }
+
+func (err Error) Critical() bool { return err.critical }
+
+const (
+	TrajUnIni    = "Traj object uninitialized to read"
+	ReadError    = "Error reading frame"
+	UnableToOpen = "Unable to open file"
+	WrongFormat  = "Wrong format in the TRR file or frame"
+)
+
+//lastFrameError implements chem.LastFrameError
+type lastFrameError struct {
+	deco     []string
+	fileName string
+}
+
+//lastFrameError does nothing
+func (E lastFrameError) NormalLastFrameTermination() {}
+
+func (E lastFrameError) FileName() string { return E.fileName }
+
+func (E lastFrameError) Error() string { return "EOF" }
+
+func (E lastFrameError) Critical() bool { return false }
+
+func (E lastFrameError) Format() string { return "trr" }
+
+func (E lastFrameError) Decorate(deco string) []string {
+	//Even thought this method does not use a pointer as a receiver, and tries to alter the received,
+	//it should work, since E.deco is a slice, and hence a pointer itself.
+	if deco != "" {
+		E.deco = append(E.deco, deco)
+	}
+	return E.deco
+}
+
+func newlastFrameError(filename string, caller string) *lastFrameError {
+	e := new(lastFrameError)
+	e.fileName = filename
+	e.deco = []string{caller}
+	return e
+}
@@ -0,0 +1,136 @@
+/*
+ * trr_test.go, part of gochem
+ *
+ * Copyright 2012 Raul Mera Adasme <rmera_changeforat_chem-dot-helsinki-dot-fi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as
+ * published by the Free Software Foundation; either version 2.1 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General
+ * Public License along with this program.  If not, see
+ * <http://www.gnu.org/licenses/>.
+ */
+/*
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+
+package trr
+
+import (
+	"math"
+	"testing"
+
+	"github.com/rmera/gochem"
+	"github.com/rmera/gochem/v3"
+)
+
+//expected returns the values written in the test files for the atom i in the frame f, for
+//positions (what=0), velocities (1) and forces (2), in goChem units.
+func expected(what, i, f int) []float64 {
+	switch what {
+	case 0:
+		return []float64{float64(i) + 0.1*float64(f), 2 * float64(i), -float64(i)}
+	case 1:
+		return []float64{10 * float64(i), 10 * float64(f), 10}
+	}
+	return []float64{float64(i), float64(f), -1}
+}
+
+func checkFrame(Te *testing.T, name string, what, f int, indexes []int, m *v3.Matrix) {
+	for j, i := range indexes {
+		for k, v := range expected(what, i, f) {
+			if math.Abs(m.At(j, k)-v) > 1e-5 {
+				Te.Errorf("%s: frame %d, atom %d, data %d: %v, expected %v", name, f, i, what, m.VecView(j), expected(what, i, f))
+				break
+			}
+		}
+	}
+}
+
+//TestTRR reads a single-precision test file with a full frame, a frame with positions only
+//and a frame with velocities and forces only.
+func TestTRR(Te *testing.T) {
+	var traj chem.VelForceTraj
+	traj, err := New("../test/sample.trr")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	all := []int{0, 1, 2, 3}
+	m := v3.Zeros(traj.Len())
+	if err := traj.Next(m); err != nil {
+		Te.Fatal(err)
+	}
+	checkFrame(Te, "sample", 0, 0, all, m)
+	if !traj.Velocities(m) {
+		Te.Fatal("No velocities read")
+	}
+	checkFrame(Te, "sample", 1, 0, all, m)
+	if !traj.Forces(m) {
+		Te.Fatal("No forces read")
+	}
+	checkFrame(Te, "sample", 2, 0, all, m)
+	if b := traj.Box(); b == nil || math.Abs(b.Volume()-60000) > 1e-6 {
+		Te.Errorf("Wrong box read: %v", b)
+	}
+	if err := traj.Next(m); err != nil {
+		Te.Fatal(err)
+	}
+	checkFrame(Te, "sample", 0, 1, all, m)
+	if traj.Velocities(m) || traj.Forces(m) || traj.Box() != nil {
+		Te.Error("Velocities, forces or box read from a frame without them")
+	}
+	if traj.Time() != 0.5 || traj.Step() != 100 || math.Abs(traj.Lambda()-0.1) > 1e-7 {
+		Te.Errorf("Wrong time, step or lambda: %f %d %f", traj.Time(), traj.Step(), traj.Lambda())
+	}
+	err = traj.Next(m)
+	if err == nil || err.(chem.TrajError).Critical() {
+		Te.Errorf("Frame without positions not signaled correctly: %v", err)
+	}
+	if !traj.Forces(m) {
+		Te.Fatal("No forces read")
+	}
+	checkFrame(Te, "sample", 2, 2, all, m)
+	if err := traj.Next(nil); err == nil {
+		Te.Error("Extra frames read")
+	} else if _, ok := err.(chem.LastFrameError); !ok {
+		Te.Error(err)
+	}
+}
+
+//TestTRRDouble reads a subset of the atoms from a double-precision file with NextConc.
+func TestTRRDouble(Te *testing.T) {
+	indexes := []int{3, 1}
+	traj, err := New("../test/sample_d.trr", indexes)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if traj.Len() != 2 || !traj.Double() {
+		Te.Errorf("Wrong number of atoms (%d) or precision", traj.Len())
+	}
+	frames := []*v3.Matrix{v3.Zeros(2), v3.Zeros(2), v3.Zeros(2)}
+	chans, err := traj.NextConc(frames)
+	if _, ok := err.(chem.LastFrameError); !ok {
+		Te.Fatalf("The end of the trajectory was not signaled: %v", err)
+	}
+	for f, c := range chans[:2] {
+		checkFrame(Te, "double", 0, f, indexes, <-c)
+	}
+	m := v3.Zeros(2)
+	if !traj.Velocities(m) {
+		Te.Fatal("No velocities read")
+	}
+	checkFrame(Te, "double", 1, 1, indexes, m)
+}
@@ -0,0 +1,661 @@
+/*
+ * xdr.go, part of gochem
+ *
+ * Copyright 2012 Raul Mera Adasme <rmera_changeforat_chem-dot-helsinki-dot-fi>
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License  as published by
+ * the Free Software Foundation; either version 2.1 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston,
+ * MA 02110-1301, USA.
+ */
+/*
+ *
+ * Gochem is developed at the laboratory for instruction in Swedish, Department of Chemistry,
+ * University of Helsinki, Finland.
+ *
+ *
+ */
+/***Dedicated to the long life of the Ven. Khenpo Phuntzok Tenzin Rinpoche***/
+
+package xtc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+//This file contains a pure-Go implementation of the reading and writing of XTC frames,
+//including the compression algorithm for the coordinates. It follows closely the
+//implementation in the xdrfile library from GROMACS, so it produces the same files.
+
+const xtcMagic = 1995
+
+//xtcMaxAtoms is the largest number of atoms accepted in a frame header, to avoid
+//huge allocations with corrupt files.
+const xtcMaxAtoms = 1 << 27
+
+var (
+	errWrongFormat = errors.New(WrongFormat)
+	errOverflow    = errors.New("Internal overflow compressing coordinates")
+)
+
+//The frames of 9 atoms or less are not compressed.
+const xtcMinCompress = 9
+
+//magicInts are the sizes used to encode the small differences between consecutive atoms.
+//The number of bits needed to encode 3 integers smaller than magicInts[i] is i.
+var magicInts = [...]int{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 8, 10, 12, 16, 20, 25, 32, 40, 50, 64,
+	80, 101, 128, 161, 203, 256, 322, 406, 512, 645, 812, 1024, 1290,
+	1625, 2048, 2580, 3250, 4096, 5060, 6501, 8192, 10321, 13003,
+	16384, 20642, 26007, 32768, 41285, 52015, 65536, 82570, 104031,
+	131072, 165140, 208063, 262144, 330280, 416127, 524287, 660561,
+	832255, 1048576, 1321122, 1664510, 2097152, 2642245, 3329021,
+	4194304, 5284491, 6658042, 8388607, 10568983, 13316085, 16777216,
+}
+
+const firstIdx = 9
+
+var lastIdx = len(magicInts)
+
+//xtcFrame contains the data of one XTC frame, in the units of the file (nm and ps).
+type xtcFrame struct {
+	natoms int
+	step   int
+	time   float32
+	box    [9]float32
+	prec   float32
+	coords []float32 //natoms*3 elements
+}
+
+//xdr reading and writing helpers. XDR is always big endian, and pads opaque data to 4 bytes.
+
+func readInt32(r io.Reader) (int32, error) {
+	var i int32
+	err := binary.Read(r, binary.BigEndian, &i)
+	return i, err
+}
+
+func readFloat32(r io.Reader) (float32, error) {
+	var f float32
+	err := binary.Read(r, binary.BigEndian, &f)
+	return f, err
+}
+
+//readHeader reads the header of a frame, and returns the number of atoms, step and time in it.
+//It returns io.EOF only if there are no more frames.
+func readHeader(r io.Reader, f *xtcFrame) error {
+	magic, err := readInt32(r)
+	if err != nil {
+		return err //this is the only place where a io.EOF is fine.
+	}
+	if magic != xtcMagic {
+		return errWrongFormat
+	}
+	var h [2]int32
+	if err := binary.Read(r, binary.BigEndian, h[:]); err != nil {
+		return noEOF(err)
+	}
+	if h[0] <= 0 || h[0] > xtcMaxAtoms {
+		return errWrongFormat
+	}
+	f.natoms = int(h[0])
+	f.step = int(h[1])
+	if f.time, err = readFloat32(r); err != nil {
+		return noEOF(err)
+	}
+	return nil
+}
+
+//readFrame reads the frame after the header, which must have been read into f already.
+//f.coords must have space for f.natoms atoms.
+func readFrame(r io.Reader, f *xtcFrame) error {
+	if err := binary.Read(r, binary.BigEndian, f.box[:]); err != nil {
+		return noEOF(err)
+	}
+	lsize, err := readInt32(r)
+	if err != nil {
+		return noEOF(err)
+	}
+	if int(lsize) != f.natoms || len(f.coords) < 3*f.natoms {
+		return errWrongFormat
+	}
+	coords := f.coords[:3*f.natoms]
+	if f.natoms <= xtcMinCompress {
+		f.prec = 0
+		return noEOF(binary.Read(r, binary.BigEndian, coords))
+	}
+	if f.prec, err = readFloat32(r); err != nil {
+		return noEOF(err)
+	}
+	var ints [7]int32 //minint, maxint and smallidx
+	if err := binary.Read(r, binary.BigEndian, ints[:]); err != nil {
+		return noEOF(err)
+	}
+	nbytes, err := readInt32(r)
+	if err != nil {
+		return noEOF(err)
+	}
+	if nbytes < 0 {
+		return errWrongFormat
+	}
+	buf := make([]byte, (nbytes+3)/4*4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return noEOF(err)
+	}
+	return decompress(buf[:nbytes], coords, f.prec, ints[0:3], ints[3:6], int(ints[6]))
+}
+
+//writeFrame writes the frame f in XTC format to w.
+func writeFrame(w io.Writer, f *xtcFrame) error {
+	head := []interface{}{int32(xtcMagic), int32(f.natoms), int32(f.step), f.time, f.box, int32(f.natoms)}
+	for _, v := range head {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	coords := f.coords[:3*f.natoms]
+	if f.natoms <= xtcMinCompress {
+		return binary.Write(w, binary.BigEndian, coords)
+	}
+	prec := f.prec
+	if prec <= 0 {
+		prec = 1000
+	}
+	minint, maxint, smallidx, data, err := compress(coords, prec)
+	if err != nil {
+		return err
+	}
+	body := []interface{}{prec, minint, maxint, int32(smallidx), int32(len(data))}
+	for _, v := range body {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	//The data is padded with zeros to a multiple of 4 bytes.
+	data = append(data, make([]byte, (4-len(data)%4)%4)...)
+	_, err = w.Write(data)
+	return err
+}
+
+//noEOF transforms an EOF in an unexpected EOF, for when the file ends in the middle of a frame.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+/****The bit-level encoding****/
+
+//bitReader reads numbers with arbitrary number of bits from a byte slice, most significant bits first.
+type bitReader struct {
+	buf []byte
+	pos int //in bits
+}
+
+func (b *bitReader) receiveBits(nbits int) (int, error) {
+	if b.pos+nbits > 8*len(b.buf) {
+		return 0, errWrongFormat
+	}
+	var v uint64
+	for nbits > 0 {
+		off := b.pos & 7
+		avail := 8 - off
+		take := avail
+		if nbits < take {
+			take = nbits
+		}
+		bits := (uint64(b.buf[b.pos>>3]) >> uint(avail-take)) & (1<<uint(take) - 1)
+		v = v<<uint(take) | bits
+		b.pos += take
+		nbits -= take
+	}
+	return int(v), nil
+}
+
+//receiveInts reads 3 integers smaller than sizes, respectively, which were encoded together
+//in nbits bits.
+func (b *bitReader) receiveInts(nbits int, sizes [3]int, nums []int) error {
+	var bytes [32]int
+	nbytes := 0
+	for nbits > 8 {
+		v, err := b.receiveBits(8)
+		if err != nil {
+			return err
+		}
+		bytes[nbytes] = v
+		nbytes++
+		nbits -= 8
+	}
+	if nbits > 0 {
+		v, err := b.receiveBits(nbits)
+		if err != nil {
+			return err
+		}
+		bytes[nbytes] = v
+		nbytes++
+	}
+	for i := 2; i > 0; i-- {
+		num := 0
+		for j := nbytes - 1; j >= 0; j-- {
+			num = num<<8 | bytes[j]
+			p := num / sizes[i]
+			bytes[j] = p
+			num = num - p*sizes[i]
+		}
+		nums[i] = num
+	}
+	nums[0] = bytes[0] | bytes[1]<<8 | bytes[2]<<16 | bytes[3]<<24
+	return nil
+}
+
+//bitWriter writes numbers with arbitrary number of bits to a byte slice, most significant bits first.
+type bitWriter struct {
+	buf []byte
+	pos int //in bits
+}
+
+func (b *bitWriter) sendBits(nbits int, num int) {
+	for nbits > 0 {
+		if b.pos>>3 >= len(b.buf) {
+			b.buf = append(b.buf, 0)
+		}
+		off := b.pos & 7
+		avail := 8 - off
+		take := avail
+		if nbits < take {
+			take = nbits
+		}
+		bits := (uint64(num) >> uint(nbits-take)) & (1<<uint(take) - 1)
+		b.buf[b.pos>>3] |= byte(bits << uint(avail-take))
+		b.pos += take
+		nbits -= take
+	}
+}
+
+//sendInts writes the 3 integers in nums, each smaller than the corresponding element in sizes,
+//encoded together in nbits bits.
+func (b *bitWriter) sendInts(nbits int, sizes [3]int, nums []int) {
+	var bytes [32]int
+	nbytes := 0
+	tmp := nums[0]
+	for {
+		bytes[nbytes] = tmp & 0xff
+		nbytes++
+		tmp >>= 8
+		if tmp == 0 {
+			break
+		}
+	}
+	for i := 1; i < 3; i++ {
+		tmp = nums[i]
+		bytecnt := 0
+		for ; bytecnt < nbytes; bytecnt++ {
+			tmp = bytes[bytecnt]*sizes[i] + tmp
+			bytes[bytecnt] = tmp & 0xff
+			tmp >>= 8
+		}
+		for tmp != 0 {
+			bytes[bytecnt] = tmp & 0xff
+			bytecnt++
+			tmp >>= 8
+		}
+		nbytes = bytecnt
+	}
+	if nbits >= nbytes*8 {
+		for i := 0; i < nbytes; i++ {
+			b.sendBits(8, bytes[i])
+		}
+		b.sendBits(nbits-nbytes*8, 0)
+		return
+	}
+	for i := 0; i < nbytes-1; i++ {
+		b.sendBits(8, bytes[i])
+	}
+	b.sendBits(nbits-(nbytes-1)*8, bytes[nbytes-1])
+}
+
+//sizeOfInt returns the number of bits needed to store numbers smaller than size.
+func sizeOfInt(size int) int {
+	num := 1
+	nbits := 0
+	for size >= num && nbits < 32 {
+		nbits++
+		num <<= 1
+	}
+	return nbits
+}
+
+//sizeOfInts returns the number of bits needed to store together 3 numbers smaller
+//than the corresponding elements of sizes.
+func sizeOfInts(sizes [3]int) int {
+	var bytes [32]int
+	nbytes := 1
+	bytes[0] = 1
+	nbits := 0
+	for i := 0; i < 3; i++ {
+		tmp := 0
+		bytecnt := 0
+		for ; bytecnt < nbytes; bytecnt++ {
+			tmp = bytes[bytecnt]*sizes[i] + tmp
+			bytes[bytecnt] = tmp & 0xff
+			tmp >>= 8
+		}
+		for tmp != 0 {
+			bytes[bytecnt] = tmp & 0xff
+			bytecnt++
+			tmp >>= 8
+		}
+		nbytes = bytecnt
+	}
+	num := 1
+	nbytes--
+	for bytes[nbytes] >= num {
+		nbits++
+		num *= 2
+	}
+	return nbits + nbytes*8
+}
+
+//sizesBits returns the number of bits used for the "large" integers, given the minimum and maximum
+//of each coordinate. If the sizes are too large to be multiplied, it returns 0 and the
+//number of bits for each integer.
+func sizesBits(minint, maxint []int32) ([3]int, int, [3]int) {
+	var sizeint, bitsizeint [3]int
+	for i := range sizeint {
+		sizeint[i] = int(maxint[i]) - int(minint[i]) + 1
+	}
+	if (sizeint[0] | sizeint[1] | sizeint[2]) > 0xffffff {
+		for i := range bitsizeint {
+			bitsizeint[i] = sizeOfInt(sizeint[i])
+		}
+		return sizeint, 0, bitsizeint
+	}
+	return sizeint, sizeOfInts(sizeint), bitsizeint
+}
+
+/****The compression algorithm****/
+
+//decompress decodes the compressed coordinates in buf into coords.
+func decompress(buf []byte, coords []float32, prec float32, minint, maxint []int32, smallidx int) error {
+	natoms := len(coords) / 3
+	//A corrupt frame could have ranges that make sizeOfInts loop or panic.
+	for i := 0; i < 3; i++ {
+		if maxint[i] < minint[i] || float64(maxint[i])-float64(minint[i]) >= math.MaxInt32-2 {
+			return errWrongFormat
+		}
+	}
+	sizeint, bitsize, bitsizeint := sizesBits(minint, maxint)
+	if smallidx < firstIdx || smallidx >= lastIdx {
+		return errWrongFormat
+	}
+	tmp := smallidx - 1
+	if tmp < firstIdx {
+		tmp = firstIdx
+	}
+	smaller := magicInts[tmp] / 2
+	smallnum := magicInts[smallidx] / 2
+	sizesmall := [3]int{magicInts[smallidx], magicInts[smallidx], magicInts[smallidx]}
+	invprec := 1 / prec
+	b := &bitReader{buf: buf}
+	var thiscoord, prevcoord [3]int
+	var err error
+	run := 0
+	out := 0 //the next coordinate to be written in coords.
+	put := func(c [3]int) error {
+		if out+3 > len(coords) {
+			return errWrongFormat
+		}
+		for j := 0; j < 3; j++ {
+			coords[out+j] = float32(c[j]) * invprec
+		}
+		out += 3
+		return nil
+	}
+	for i := 0; i < natoms; {
+		if bitsize == 0 {
+			for j := 0; j < 3; j++ {
+				if thiscoord[j], err = b.receiveBits(bitsizeint[j]); err != nil {
+					return err
+				}
+			}
+		} else if err = b.receiveInts(bitsize, sizeint, thiscoord[:]); err != nil {
+			return err
+		}
+		i++
+		for j := 0; j < 3; j++ {
+			thiscoord[j] += int(minint[j])
+		}
+		prevcoord = thiscoord
+		flag, err := b.receiveBits(1)
+		if err != nil {
+			return err
+		}
+		issmaller := 0
+		if flag == 1 {
+			if run, err = b.receiveBits(5); err != nil {
+				return err
+			}
+			issmaller = run % 3
+			run -= issmaller
+			issmaller--
+		}
+		if run > 0 {
+			for k := 0; k < run; k += 3 {
+				if err = b.receiveInts(smallidx, sizesmall, thiscoord[:]); err != nil {
+					return err
+				}
+				i++
+				for j := 0; j < 3; j++ {
+					thiscoord[j] += prevcoord[j] - smallnum
+				}
+				if k == 0 {
+					//the first and second atoms are interchanged
+					//for better compression of water molecules.
+					thiscoord, prevcoord = prevcoord, thiscoord
+					if err = put(prevcoord); err != nil {
+						return err
+					}
+				} else {
+					prevcoord = thiscoord
+				}
+				if err = put(thiscoord); err != nil {
+					return err
+				}
+			}
+		} else if err = put(thiscoord); err != nil {
+			return err
+		}
+		smallidx += issmaller
+		if smallidx < firstIdx || smallidx >= lastIdx {
+			return errWrongFormat
+		}
+		if issmaller < 0 {
+			smallnum = smaller
+			if smallidx > firstIdx {
+				smaller = magicInts[smallidx-1] / 2
+			} else {
+				smaller = 0
+			}
+		} else if issmaller > 0 {
+			smaller = smallnum
+			smallnum = magicInts[smallidx] / 2
+		}
+		sizesmall = [3]int{magicInts[smallidx], magicInts[smallidx], magicInts[smallidx]}
+	}
+	if out != len(coords) {
+		return errWrongFormat
+	}
+	return nil
+}
+
+func iabs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+//compress encodes the coordinates in coords with the precision prec. It returns the minimum and maximum
+//integer coordinates, the initial size index for small differences and the encoded data.
+func compress(coords []float32, prec float32) ([]int32, []int32, int, []byte, error) {
+	natoms := len(coords) / 3
+	ints := make([]int, len(coords))
+	minint := []int32{math.MaxInt32, math.MaxInt32, math.MaxInt32}
+	maxint := []int32{math.MinInt32, math.MinInt32, math.MinInt32}
+	mindiff := math.MaxInt32
+	var old [3]int
+	for i := 0; i < natoms; i++ {
+		diff := 0
+		for j := 0; j < 3; j++ {
+			lf := float32(coords[3*i+j] * prec)
+			if lf >= 0 {
+				lf = lf + 0.5
+			} else {
+				lf = lf - 0.5
+			}
+			if math.Abs(float64(lf)) > math.MaxInt32-2 {
+				return nil, nil, 0, nil, errOverflow
+			}
+			l := int32(lf)
+			if l < minint[j] {
+				minint[j] = l
+			}
+			if l > maxint[j] {
+				maxint[j] = l
+			}
+			ints[3*i+j] = int(l)
+			diff += iabs(old[j] - int(l))
+			old[j] = int(l)
+		}
+		if diff < mindiff && i > 0 {
+			mindiff = diff
+		}
+	}
+	for j := 0; j < 3; j++ {
+		if float64(maxint[j])-float64(minint[j]) >= math.MaxInt32-2 {
+			return nil, nil, 0, nil, errOverflow
+		}
+	}
+	sizeint, bitsize, bitsizeint := sizesBits(minint, maxint)
+	smallidx := firstIdx
+	for smallidx < lastIdx && magicInts[smallidx] < mindiff {
+		smallidx++
+	}
+	initsmallidx := smallidx
+	maxidx := smallidx + 8
+	if maxidx > lastIdx-1 {
+		maxidx = lastIdx - 1 //xdrfile uses lastIdx here, which would overflow magicInts
+	}
+	minidx := maxidx - 8 //often the same as smallidx
+	tmp := smallidx - 1
+	if tmp < firstIdx {
+		tmp = firstIdx
+	}
+	smaller := magicInts[tmp] / 2
+	smallnum := magicInts[smallidx] / 2
+	sizesmall := [3]int{magicInts[smallidx], magicInts[smallidx], magicInts[smallidx]}
+	larger := magicInts[maxidx] / 2
+	b := &bitWriter{buf: make([]byte, 0, len(coords)*2)}
+	var prevcoord [3]int
+	var tmpcoord [30]int
+	prevrun := -1
+	for i := 0; i < natoms; {
+		issmall := false
+		issmaller := 0
+		this := ints[3*i : 3*i+3]
+		if smallidx < maxidx && i >= 1 && iabs(this[0]-prevcoord[0]) < larger &&
+			iabs(this[1]-prevcoord[1]) < larger && iabs(this[2]-prevcoord[2]) < larger {
+			issmaller = 1
+		} else if smallidx > minidx {
+			issmaller = -1
+		}
+		if i+1 < natoms {
+			next := ints[3*i+3 : 3*i+6]
+			if iabs(this[0]-next[0]) < smallnum && iabs(this[1]-next[1]) < smallnum && iabs(this[2]-next[2]) < smallnum {
+				//the first and second atoms are interchanged
+				//for better compression of water molecules.
+				for j := 0; j < 3; j++ {
+					this[j], next[j] = next[j], this[j]
+				}
+				issmall = true
+			}
+		}
+		for j := 0; j < 3; j++ {
+			tmpcoord[j] = this[j] - int(minint[j])
+		}
+		if bitsize == 0 {
+			for j := 0; j < 3; j++ {
+				b.sendBits(bitsizeint[j], tmpcoord[j])
+			}
+		} else {
+			b.sendInts(bitsize, sizeint, tmpcoord[:3])
+		}
+		copy(prevcoord[:], this)
+		i++
+		run := 0
+		if !issmall && issmaller == -1 {
+			issmaller = 0
+		}
+		for issmall && run < 8*3 {
+			this = ints[3*i : 3*i+3]
+			tmpsum := 0
+			for j := 0; j < 3; j++ {
+				d := this[j] - prevcoord[j]
+				tmpsum += d * d
+			}
+			if issmaller == -1 && tmpsum >= smaller*smaller {
+				issmaller = 0
+			}
+			for j := 0; j < 3; j++ {
+				tmpcoord[run] = this[j] - prevcoord[j] + smallnum
+				run++
+			}
+			copy(prevcoord[:], this)
+			i++
+			issmall = false
+			if i < natoms {
+				this = ints[3*i : 3*i+3]
+				if iabs(this[0]-prevcoord[0]) < smallnum && iabs(this[1]-prevcoord[1]) < smallnum &&
+					iabs(this[2]-prevcoord[2]) < smallnum {
+					issmall = true
+				}
+			}
+		}
+		if run != prevrun || issmaller != 0 {
+			prevrun = run
+			b.sendBits(1, 1) //flag the change in run-length
+			b.sendBits(5, run+issmaller+1)
+		} else {
+			b.sendBits(1, 0) //flag the fact that the run-length did not change
+		}
+		for k := 0; k < run; k += 3 {
+			b.sendInts(smallidx, sizesmall, tmpcoord[k:k+3])
+		}
+		if issmaller != 0 {
+			smallidx += issmaller
+			if issmaller < 0 {
+				smallnum = smaller
+				smaller = magicInts[smallidx-1] / 2
+			} else {
+				smaller = smallnum
+				smallnum = magicInts[smallidx] / 2
+			}
+			sizesmall = [3]int{magicInts[smallidx], magicInts[smallidx], magicInts[smallidx]}
+		}
+	}
+	return minint, maxint, initsmallidx, b.buf[:(b.pos+7)/8], nil
+}
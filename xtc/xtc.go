@@ -29,38 +29,54 @@
 
 package xtc
 
-// #cgo CFLAGS:  -I.
-// #cgo LDFLAGS:  -L.  -lnsl -lm   -lxdrfile
-//#include <xtc.h>
-//#include <stdio.h>
-//#include <stdlib.h>
-//#include <xdrfile_xtc.h>
-//#include <xdrfile_trr.h>
-//#include <xdrfile.h>
-import "C"
-import "fmt"
-import "runtime"
-import "github.com/rmera/gochem/v3"
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/rmera/gochem"
+	"github.com/rmera/gochem/v3"
+)
 
 //Container for an GROMACS XTC binary trajectory file.
 type XTCObj struct {
 	readable   bool
 	natoms     int
 	filename   string
-	fp         *C.XDRFILE //pointer to the XDRFILE
-	goCoords   []float64
-	concBuffer [][]C.float
-	cCoords    []C.float
+	file       io.ReadCloser
+	xtc        *bufio.Reader
+	frame      *xtcFrame //buffer for the frames read with Next
+	concBuffer []*xtcFrame
+	box        *chem.Box //box of the last frame read
 	buffSize   int
+	indexes    []int   //the atoms read, nil for all atoms
+	step       int     //step of the last frame read
+	time       float64 //time of the last frame read, in ps
+	prec       float64 //precision of the last frame read
 }
 
-func New(filename string) (*XTCObj, error) {
+//New opens the XTC file filename for reading and returns an XTCObj for it. The file
+//can be compressed with gzip, bzip2 or xz (see chem.OpenFile). If a slice of indexes
+//is given, only those atoms are returned by Next and NextConc, in that order, and
+//Len returns the number of indexes.
+func New(filename string, indexes ...[]int) (*XTCObj, error) {
 	traj := new(XTCObj)
 	if err := traj.initRead(filename); err != nil {
 		err := err.(Error) //I know that is the type returned byt initRead
 		err.Decorate("New")
 		return nil, err
 	}
+	if len(indexes) > 0 && indexes[0] != nil {
+		for _, v := range indexes[0] {
+			if v < 0 || v >= traj.natoms {
+				traj.Close()
+				return nil, Error{fmt.Sprintf("Index %d out of range for a trajectory with %d atoms", v, traj.natoms), filename, []string{"New"}, true}
+			}
+		}
+		traj.indexes = indexes[0]
+	}
 	return traj, nil
 
 }
@@ -78,27 +94,94 @@ func (X *XTCObj) Readable() bool {
 //InitRead initializes a XTCObj for reading.
 //It requires only the filename, which must be valid
 func (X *XTCObj) initRead(name string) error {
-	Cfilename := C.CString(name)
-	Cnatoms := C.read_natoms(Cfilename)
-	X.natoms = int(Cnatoms)
-	totalcoords := X.natoms * 3
-	X.fp = C.openfile(Cfilename)
-	if X.fp == nil {
-		return Error{UnableToOpen, X.filename, []string{"initRead"}, true}
+	var err error
+	X.filename = name
+	X.file, err = chem.OpenFile(name)
+	if err != nil {
+		return Error{UnableToOpen + ": " + err.Error(), X.filename, []string{"chem.OpenFile", "initRead"}, true}
+	}
+	X.xtc = bufio.NewReader(X.file)
+	//We peek at the first header to get the number of atoms. Peeking, instead of seeking back,
+	//allows reading compressed files.
+	head, err := X.xtc.Peek(16)
+	first := new(xtcFrame)
+	if err == nil {
+		err = readHeader(bytes.NewReader(head), first)
 	}
+	if err != nil {
+		X.file.Close()
+		return Error{WrongFormat + ": " + err.Error(), X.filename, []string{"readHeader", "initRead"}, true}
+	}
+	X.natoms = first.natoms
+	X.step, X.time = first.step, float64(first.time)
 	//The idea is to reserve less memory, using the same buffer many times.
-	//X.goCoords = make([]float64, totalcoords, totalcoords)
-	X.cCoords = make([]C.float, totalcoords, totalcoords)
-	X.concBuffer = append(X.concBuffer, X.cCoords)
+	X.frame = &xtcFrame{coords: make([]float32, 3*X.natoms)}
+	X.concBuffer = append(X.concBuffer, X.frame)
 	X.buffSize = 1
 	//This should close the file.
 	runtime.SetFinalizer(X, func(X *XTCObj) {
-		C.xtc_close(X.fp)
+		X.file.Close()
 	})
 	X.readable = true
 	return nil
 }
 
+//Close closes the file associated with the trajectory.
+//The trajectory can't be read after that.
+func (X *XTCObj) Close() {
+	if X.file != nil {
+		X.file.Close()
+	}
+	X.readable = false
+}
+
+//nextRaw reads the next frame into f. It returns a lastFrameError if there are no more frames.
+func (X *XTCObj) nextRaw(f *xtcFrame) error {
+	err := readHeader(X.xtc, f)
+	if err == io.EOF {
+		X.readable = false
+		return newlastFrameError(X.filename, "nextRaw") //This is not really an error and should be catched in the calling function
+	}
+	if err == nil && f.natoms != X.natoms {
+		err = fmt.Errorf("%s: frame with %d atoms in a trajectory with %d", WrongFormat, f.natoms, X.natoms)
+	}
+	if err == nil {
+		err = readFrame(X.xtc, f)
+	}
+	if err != nil {
+		X.readable = false
+		return Error{ReadError + ": " + err.Error(), X.filename, []string{"nextRaw"}, true}
+	}
+	X.setBox(f.box)
+	X.step, X.time, X.prec = f.step, float64(f.time), float64(f.prec)
+	return nil
+}
+
+//Step returns the simulation step of the last frame read, or of the first
+//frame if no frame has been read.
+func (X *XTCObj) Step() int {
+	return X.step
+}
+
+//Time returns the simulation time, in ps, of the last frame read, or of the first
+//frame if no frame has been read.
+func (X *XTCObj) Time() float64 {
+	return X.time
+}
+
+//Precision returns the precision of the compressed coordinates of the last frame read,
+//i.e. 1000 means that the coordinates are given to 0.001 nm. It is 0 if no frame
+//has been read, or if the last frame had too few atoms to be compressed.
+func (X *XTCObj) Precision() float64 {
+	return X.prec
+}
+
+//NFrames returns -1, as the number of frames in an XTC file can't be known
+//without reading the whole file.
+func (X *XTCObj) NFrames() int {
+	return -1
+}
+
 //Next Reads the next frame in a XTCObj that has been initialized for read
 //With initread. If keep is true, returns a pointer to matrix.DenseMatrix
 //With the coordinates read, otherwiser, it discards the coordinates and
@@ -107,32 +190,66 @@ func (X *XTCObj) Next(output *v3.Matrix) error {
 	if !X.Readable() {
 		return Error{TrajUnIni, X.filename, []string{"Next"}, true}
 	}
-	cnatoms := C.int(X.natoms)
-	worked := C.get_coords(X.fp, &X.cCoords[0], cnatoms)
-	if worked == 11 {
-		X.readable = false
-		return newlastFrameError(X.filename, "Next") //This is not really an error and should be catched in the calling function
-	}
-	if worked != 0 {
-		X.readable = false
-		return Error{ReadError, X.filename, []string{"Next"}, true}
+	if err := X.nextRaw(X.frame); err != nil {
+		return errDecorate(err, "Next")
 	}
 	if output != nil { //col the frame
-		r, c := output.Dims()
-		if r < (X.natoms) {
+		r, _ := output.Dims()
+		if r < X.Len() {
 			panic("Buffer v3.Matrix too small to hold trajectory frame")
 		}
-		for j := 0; j < r; j++ {
-			for k := 0; k < c; k++ {
-				l := k + (3 * j)
-				output.Set(j, k, (10 * float64(X.cCoords[l]))) //nm to Angstroms
-			}
-		}
+		X.toMatrix(X.frame.coords, output)
 		return nil
 	}
 	return nil //Just drop the frame
 }
 
+//toMatrix puts the coordinates of the atoms read from coords in out, which must have enough space,
+//converting them from nm to A.
+func (X *XTCObj) toMatrix(coords []float32, out *v3.Matrix) {
+	for j := 0; j < X.Len(); j++ {
+		l := 3 * j
+		if X.indexes != nil {
+			l = 3 * X.indexes[j]
+		}
+		out.Set(j, 0, 10*float64(coords[l])) //nm to Angstroms
+		out.Set(j, 1, 10*float64(coords[l+1]))
+		out.Set(j, 2, 10*float64(coords[l+2]))
+	}
+}
+
+//setBox sets the box of the XTCObj from the box of the last frame read.
+func (X *XTCObj) setBox(box [9]float32) {
+	data := make([]float64, 9)
+	zero := true
+	for i, v := range box {
+		data[i] = 10 * float64(v) //nm to Angstroms
+		if v != 0 {
+			zero = false
+		}
+	}
+	if zero {
+		X.box = nil
+		return
+	}
+	vecs, err := v3.NewMatrix(data)
+	if err != nil {
+		X.box = nil
+		return
+	}
+	X.box, err = chem.NewBox(vecs)
+	if err != nil {
+		X.box = nil
+	}
+}
+
+//Box returns the box of the last frame read, or nil if the frame
+//has no box. When frames are read with NextConc, it returns the box
+//of the last frame of the batch.
+func (X *XTCObj) Box() *chem.Box {
+	return X.box
+}
+
 //SetConcBuffer
 func (X *XTCObj) setConcBuffer(batchsize int) error {
 	l := X.buffSize
@@ -147,7 +264,7 @@ func (X *XTCObj) setConcBuffer(batchsize int) error {
 		return nil
 	}
 	for i := 0; i < batchsize-l; i++ {
-		tmp := make([]C.float, X.Len()*3)
+		tmp := &xtcFrame{coords: make([]float32, X.natoms*3)}
 		X.concBuffer = append(X.concBuffer, tmp)
 	}
 	X.buffSize = batchsize
@@ -162,28 +279,23 @@ func (X *XTCObj) NextConc(frames []*v3.Matrix) ([]chan *v3.Matrix, error) {
 	if X.buffSize < len(frames) {
 		X.setConcBuffer(len(frames))
 	}
-	if X.natoms == 0 {
+	if X.natoms == 0 || !X.Readable() {
 		return nil, Error{TrajUnIni, X.filename, []string{"NextConc"}, true}
 	}
 	framechans := make([]chan *v3.Matrix, len(frames)) //the slice of chans that will be returned
-	cnatoms := C.int(X.natoms)
 	used := false
 	for key, val := range frames {
-		//cCoords:=X.concBuffer[key]
-		worked := C.get_coords(X.fp, &X.concBuffer[key][0], cnatoms)
+		err := X.nextRaw(X.concBuffer[key])
 		//Error handling
-		if worked == 11 {
+		if _, ok := err.(*lastFrameError); ok {
 			if used == false {
-				X.readable = false
-				return nil, newlastFrameError(X.filename, "NextConc") //This is not really an error and
+				return nil, errDecorate(err, "NextConc") //This is not really an error and
 			} else { //should be catched in the calling function
-				X.readable = false
-				return framechans, newlastFrameError(X.filename, "NextConc") //same
+				return framechans, errDecorate(err, "NextConc") //same
 			}
 		}
-		if worked != 0 {
-			X.readable = false
-			return nil, Error{ReadError, X.filename, []string{"NextConc"}, true}
+		if err != nil {
+			return nil, errDecorate(err, "NextConc")
 		}
 		if val == nil {
 			framechans[key] = nil //ignored frame
@@ -192,26 +304,133 @@ func (X *XTCObj) NextConc(frames []*v3.Matrix) ([]chan *v3.Matrix, error) {
 		used = true
 		framechans[key] = make(chan *v3.Matrix)
 		//Now the parallel part
-		go func(natoms int, cCoords []C.float, goCoords *v3.Matrix, pipe chan *v3.Matrix) {
-			r, c := goCoords.Dims()
-			for j := 0; j < r; j++ {
-				for k := 0; k < c; k++ {
-					l := k + (3 * j)
-					goCoords.Set(j, k, (10 * float64(cCoords[l]))) //nm to Angstroms
-				}
-			}
+		if r, _ := val.Dims(); r < X.Len() {
+			panic("Buffer v3.Matrix too small to hold trajectory frame")
+		}
+		go func(coords []float32, goCoords *v3.Matrix, pipe chan *v3.Matrix) {
+			X.toMatrix(coords, goCoords)
 			pipe <- goCoords
-		}(X.natoms, X.concBuffer[key], val, framechans[key])
+		}(X.concBuffer[key].coords, val, framechans[key])
 	}
 	return framechans, nil
 }
 
-//Natoms returns the number of atoms per frame in the XTCObj.
+//Len returns the number of atoms per frame in the XTCObj, or the number
+//of atoms selected, if the XTCObj was created with a slice of indexes.
 //XTCObj must be initialized. 0 means an uninitialized object.
 func (X *XTCObj) Len() int {
+	if X.indexes != nil {
+		return len(X.indexes)
+	}
 	return X.natoms
 }
 
+/***Writing***/
+
+//XTCWObj is a GROMACS XTC trajectory file open for writing.
+type XTCWObj struct {
+	natoms   int
+	filename string
+	file     io.WriteCloser
+	xtc      *bufio.Writer
+	frame    *xtcFrame
+	dt       float64
+	writable bool
+}
+
+//NewWriter creates the file filename and returns an XTCWObj to write
+//frames with natoms atoms to it. By default the coordinates are stored with a
+//precision of 0.001 nm, and the frames are 1 ps apart. The file is compressed
+//if its name ends in .gz, .bz2 or .xz (see chem.CreateFile).
+func NewWriter(filename string, natoms int) (*XTCWObj, error) {
+	W := new(XTCWObj)
+	W.filename = filename
+	W.natoms = natoms
+	var err error
+	W.file, err = chem.CreateFile(filename)
+	if err != nil {
+		return nil, Error{UnableToOpen + ": " + err.Error(), filename, []string{"chem.CreateFile", "NewWriter"}, true}
+	}
+	W.xtc = bufio.NewWriter(W.file)
+	W.frame = &xtcFrame{natoms: natoms, prec: 1000, coords: make([]float32, 3*natoms)}
+	W.dt = 1
+	W.writable = true
+	return W, nil
+}
+
+//SetPrecision sets the precision with which the coordinates are stored. They
+//are stored as integer multiples of 1/prec nm, so larger numbers mean more precision (and
+//larger files). The default is 1000.
+func (W *XTCWObj) SetPrecision(prec float64) {
+	W.frame.prec = float32(prec)
+}
+
+//SetTimeStep sets the time between frames, in ps, which is 1 by default.
+func (W *XTCWObj) SetTimeStep(dt float64) {
+	W.dt = dt
+}
+
+//Len returns the number of atoms per frame in the trajectory.
+func (W *XTCWObj) Len() int {
+	return W.natoms
+}
+
+//WNext writes the coordinates in coords (in A) as the next frame of the trajectory.
+//If a box is given, it is stored with the frame.
+func (W *XTCWObj) WNext(coords *v3.Matrix, box ...*chem.Box) error {
+	if !W.writable {
+		return Error{TrajUnIni, W.filename, []string{"WNext"}, true}
+	}
+	if coords.NVecs() != W.natoms {
+		return Error{fmt.Sprintf("Frame with %d atoms for a trajectory with %d", coords.NVecs(), W.natoms), W.filename, []string{"WNext"}, true}
+	}
+	for i := 0; i < W.natoms; i++ {
+		for j := 0; j < 3; j++ {
+			W.frame.coords[3*i+j] = float32(coords.At(i, j) / 10) //Angstroms to nm
+		}
+	}
+	W.frame.box = [9]float32{}
+	if len(box) > 0 && box[0] != nil {
+		vecs := box[0].Vectors()
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				W.frame.box[3*i+j] = float32(vecs.At(i, j) / 10)
+			}
+		}
+	}
+	W.frame.time = float32(float64(W.frame.step) * W.dt)
+	if err := writeFrame(W.xtc, W.frame); err != nil {
+		return Error{err.Error(), W.filename, []string{"writeFrame", "WNext"}, true}
+	}
+	W.frame.step++
+	return nil
+}
+
+//Close writes any remaining data and closes the file. The XTCWObj can't be used after that.
+func (W *XTCWObj) Close() error {
+	if !W.writable {
+		return nil
+	}
+	W.writable = false
+	if err := W.xtc.Flush(); err != nil {
+		W.file.Close()
+		return Error{err.Error(), W.filename, []string{"bufio.Writer.Flush", "Close"}, true}
+	}
+	if err := W.file.Close(); err != nil {
+		return Error{err.Error(), W.filename, []string{"io.WriteCloser.Close", "Close"}, true}
+	}
+	return nil
+}
+
+//errDecorate is a helper function that asserts that the error is
+//implements chem.Error and decorates the error with the caller's name before returning it.
+//if used with a non-chem.Error error, it will cause a panic.
+func errDecorate(err error, caller string) error {
+	err2 := err.(chem.Error)
+	err2.Decorate(caller)
+	return err2
+}
+
 //Errors
 
 type Error struct {
@@ -245,6 +464,7 @@ const (
 	TrajUnIni    = "Traj object uninitialized to read"
 	ReadError    = "Error reading frame"
 	UnableToOpen = "Unable to open file"
+	WrongFormat  = "Wrong format in the XTC file or frame"
 	EOF          = "EOF"
 )
 
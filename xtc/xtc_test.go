@@ -28,7 +28,12 @@
 
 package xtc
 
+import "bytes"
+import "encoding/binary"
 import "fmt"
+import "io"
+import "io/ioutil"
+import "math"
 import "testing"
 import "github.com/rmera/gochem"
 import "github.com/rmera/gochem/v3"
@@ -65,6 +70,152 @@ reading:
 	fmt.Println("Over! frames read:", i)
 }
 
+//TestXTCBox checks that the box of the frames is read.
+func TestXTCBox(Te *testing.T) {
+	traj, err := New("../test/test.xtc")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if err := traj.Next(nil); err != nil {
+		Te.Fatal(err)
+	}
+	box := traj.Box()
+	if box == nil {
+		Te.Fatal("No box read")
+	}
+	a, b, c, alpha, beta, gamma := box.Params()
+	fmt.Println("Box:", box, box.Volume())
+	if math.Abs(a-90.0) > 0.01 || math.Abs(b-90.0) > 0.01 || math.Abs(c-90.0) > 0.01 {
+		Te.Errorf("Wrong box lengths %f %f %f", a, b, c)
+	}
+	if math.Abs(alpha-60) > 0.01 || math.Abs(beta-60) > 0.01 || math.Abs(gamma-90) > 0.01 {
+		Te.Errorf("Wrong box angles %f %f %f", alpha, beta, gamma)
+	}
+}
+
+//TestXTCWrite writes the frames of the test xtc file to a new file, and checks
+//that the new file contains the same coordinates and boxes.
+func TestXTCWrite(Te *testing.T) {
+	traj, err := New("../test/test.xtc")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	var frames []*v3.Matrix
+	var boxes []*chem.Box
+	for {
+		coords := v3.Zeros(traj.Len())
+		if err := traj.Next(coords); err != nil {
+			if _, ok := err.(chem.LastFrameError); ok {
+				break
+			}
+			Te.Fatal(err)
+		}
+		frames = append(frames, coords)
+		boxes = append(boxes, traj.Box())
+	}
+	//The second file is gzip-compressed.
+	for _, name := range []string{"../test/testW.xtc", "../test/testW.xtc.gz"} {
+		w, err := NewWriter(name, traj.Len())
+		if err != nil {
+			Te.Fatal(err)
+		}
+		for i, frame := range frames {
+			if err := w.WNext(frame, boxes[i]); err != nil {
+				Te.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			Te.Fatal(err)
+		}
+		traj2, err := New(name)
+		if err != nil {
+			Te.Fatal(err)
+		}
+		coords := v3.Zeros(traj2.Len())
+		for i, frame := range frames {
+			if err := traj2.Next(coords); err != nil {
+				Te.Fatal(err)
+			}
+			for j := 0; j < coords.NVecs(); j++ {
+				for k := 0; k < 3; k++ {
+					if math.Abs(coords.At(j, k)-frame.At(j, k)) > 0.0101 {
+						Te.Fatalf("%s: Frame %d atom %d differs: %v %v", name, i, j, coords.VecView(j), frame.VecView(j))
+					}
+				}
+			}
+			if traj2.Box() == nil || math.Abs(traj2.Box().Volume()-boxes[i].Volume()) > 1 {
+				Te.Errorf("%s: Frame %d box differs", name, i)
+			}
+		}
+		if err := traj2.Next(nil); err == nil {
+			Te.Errorf("%s: The written trajectory has extra frames", name)
+		}
+	}
+}
+
+//TestXTCMeta checks the time, step and precision read from the frames of the test file.
+func TestXTCMeta(Te *testing.T) {
+	var traj chem.TrajMeta
+	traj, err := New("../test/test.xtc")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if traj.NFrames() != -1 {
+		Te.Errorf("NFrames is %d, not -1", traj.NFrames())
+	}
+	//The frames in the test file are 2 ns (1000000 steps) apart.
+	for i := 0; traj.Next(nil) == nil; i++ {
+		if traj.Time() != float64(2000*i) || traj.Step() != 1000000*i || traj.(*XTCObj).Precision() != 1000 {
+			Te.Errorf("Frame %d has time %f, step %d and precision %f", i, traj.Time(), traj.Step(), traj.(*XTCObj).Precision())
+		}
+	}
+}
+
+//TestXTCCompression checks that the compressed coordinates of each frame in the test
+//file are the same after decompressing and compressing them again.
+func TestXTCCompression(Te *testing.T) {
+	data, err := ioutil.ReadFile("../test/test.xtc")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	r := bytes.NewReader(data)
+	for i := 0; ; i++ {
+		start := len(data) - r.Len()
+		f := new(xtcFrame)
+		if err := readHeader(r, f); err == io.EOF {
+			break
+		} else if err != nil {
+			Te.Fatal(err)
+		}
+		f.coords = make([]float32, 3*f.natoms)
+		if err := readFrame(r, f); err != nil {
+			Te.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := writeFrame(&out, f); err != nil {
+			Te.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), data[start:len(data)-r.Len()]) {
+			Te.Errorf("Frame %d is not the same after decompressing and compressing", i)
+		}
+	}
+	//Headers with a wrong number of atoms give an error.
+	for _, n := range []int32{-3, 0, math.MaxInt32} {
+		var header bytes.Buffer
+		binary.Write(&header, binary.BigEndian, []int32{xtcMagic, n, 0, 0})
+		if err := readHeader(&header, new(xtcFrame)); err == nil {
+			Te.Errorf("No error for a header with %d atoms", n)
+		}
+	}
+	//Frames with wrong ranges give an error, not a panic.
+	coords := make([]float32, 9)
+	for _, v := range [][2][]int32{{{10, 0, 0}, {0, 5, 5}}, {{math.MinInt32, 0, 0}, {math.MaxInt32, 5, 5}}} {
+		if err := decompress(make([]byte, 64), coords, 1000, v[0], v[1], firstIdx); err == nil {
+			Te.Errorf("No error for wrong ranges %v %v", v[0], v[1])
+		}
+	}
+}
+
 /*
 //TestFrameXTC reads the frames of the test xtc file from the first to
 // the forth frame skipping one frame for each read one. It uses the
@@ -83,6 +234,60 @@ func TestFrameXTC(Te *testing.T) {
 	fmt.Println(len(Coords), read, VecView(Coords[read-1],4))
 }
 */
+
+//TestXTCIndexes checks that reading a subset of the atoms gives the same coordinates
+//as reading all of them, with Next and NextConc.
+func TestXTCIndexes(Te *testing.T) {
+	indexes := []int{52298, 7, 0, 1000}
+	traj, err := New("../test/test.xtc")
+	if err != nil {
+		Te.Fatal(err)
+	}
+	sub, err := New("../test/test.xtc", indexes)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	if sub.Len() != len(indexes) {
+		Te.Fatalf("Len is %d for %d indexes", sub.Len(), len(indexes))
+	}
+	full := v3.Zeros(traj.Len())
+	frames := []*v3.Matrix{v3.Zeros(sub.Len()), nil, v3.Zeros(sub.Len())}
+	for i := 0; i < 2; i++ {
+		if err := sub.Next(frames[0]); err != nil {
+			Te.Fatal(err)
+		}
+		if err := traj.Next(full); err != nil {
+			Te.Fatal(err)
+		}
+		for j, v := range indexes {
+			if frames[0].VecView(j).String() != full.VecView(v).String() {
+				Te.Errorf("Frame %d atom %d differs: %v %v", i, v, frames[0].VecView(j), full.VecView(v))
+			}
+		}
+	}
+	chans, err := sub.NextConc(frames)
+	if err != nil {
+		Te.Fatal(err)
+	}
+	for i, c := range chans {
+		if err := traj.Next(full); err != nil {
+			Te.Fatal(err)
+		}
+		if c == nil {
+			continue
+		}
+		coords := <-c
+		for j, v := range indexes {
+			if coords.VecView(j).String() != full.VecView(v).String() {
+				Te.Errorf("NextConc frame %d atom %d differs: %v %v", i, v, coords.VecView(j), full.VecView(v))
+			}
+		}
+	}
+	if _, err := New("../test/test.xtc", []int{-1}); err == nil {
+		Te.Error("Negative index accepted")
+	}
+}
+
 func TestFrameXTCConc(Te *testing.T) {
 	traj, err := New("../test/test.xtc")
 	if err != nil {